@@ -0,0 +1,28 @@
+// Package analyzer defines the interface shared by the analyses that find the
+// files an image needs and the pipeline combining them, so that analyses can
+// be ordered, skipped and combined freely and new ones added from outside.
+package analyzer
+
+import (
+	"context"
+	"errors"
+
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+var log = logger.Log
+
+// ErrNotApplicable is returned by analyzers that do not apply to an image,
+// e.g. by the Python analyzer for an image running a Go binary. Stages none
+// of whose analyzers apply are skipped.
+var ErrNotApplicable = errors.New("analyzer does not apply to the image")
+
+// Analyzer finds files an image needs to run its command.
+type Analyzer interface {
+	// Name identifies the analyzer in logs and configuration.
+	Name() string
+	// Analyze returns the files it found. On error the files found so far
+	// may be returned as well.
+	Analyze(ctx context.Context, image types.Image) (types.FileSet, error)
+}
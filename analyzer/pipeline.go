@@ -0,0 +1,119 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Stage is a step of a Pipeline. Its analyzers run in order and the files
+// they found are merged.
+type Stage struct {
+	Name      string
+	Analyzers []Analyzer
+	// Standalone stages find every file the image needs by themselves and
+	// validate their result, like binary search. Their files replace the ones
+	// found by the previous stages instead of extending them and are not
+	// validated again.
+	Standalone bool
+}
+
+// Validator checks that an image built from files runs, after stage.
+// It may adjust files in place, e.g. to apply keep and drop rules.
+type Validator func(ctx context.Context, stage string, files *types.FileSet) error
+
+// Pipeline runs stages one after another, each one extending the files found
+// by the previous ones.
+type Pipeline struct {
+	Stages   []Stage
+	Validate Validator
+	// AtEnd validates only the files found by all stages together instead of
+	// validating after every stage and stopping at the first valid one.
+	AtEnd bool
+}
+
+// Outcome is the result of running a pipeline.
+type Outcome struct {
+	// Stage is the last stage that found files, Files what was found up to
+	// it and Validated whether those passed validation.
+	Stage     string
+	Files     types.FileSet
+	Validated bool
+	// Errors holds the reason each failed stage was rejected.
+	Errors map[string]error
+}
+
+// Run runs the pipeline starting from the files found before it, so that a
+// stage without analyzers validates those. An error is returned when the
+// context is done or no stage produced valid files; the outcome then holds
+// the files of the last stage that found any nevertheless.
+func (p Pipeline) Run(ctx context.Context, image types.Image, initial types.FileSet) (Outcome, error) {
+	outcome := Outcome{Files: initial.Clone(), Errors: make(map[string]error)}
+	for _, stage := range p.Stages {
+		found, err := stage.run(ctx, image)
+		switch {
+		case errors.Is(err, ErrNotApplicable):
+			log.Info("Stage ", stage.Name, " does not apply to the image")
+		case err != nil:
+			log.Error("Stage ", stage.Name, " failed: ", err)
+			outcome.Errors[stage.Name] = err
+		default:
+			if stage.Standalone {
+				outcome.Files = types.NewFileSet()
+			}
+			outcome.Files.Merge(found)
+			outcome.Stage, outcome.Validated = stage.Name, stage.Standalone
+			if !p.AtEnd && !outcome.Validated {
+				p.validate(ctx, &outcome)
+			}
+		}
+		if outcome.Validated && !p.AtEnd {
+			return outcome, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return outcome, err
+		}
+	}
+	if p.AtEnd && !outcome.Validated && outcome.Stage != "" {
+		p.validate(ctx, &outcome)
+	}
+	if outcome.Validated {
+		return outcome, nil
+	}
+	return outcome, errors.New("no stage produced a valid minimal Dockerfile")
+}
+
+func (p Pipeline) validate(ctx context.Context, outcome *Outcome) {
+	log.Info("Validating files found up to stage ", outcome.Stage, "...")
+	err := p.Validate(ctx, outcome.Stage, &outcome.Files)
+	if err != nil {
+		outcome.Errors[outcome.Stage] = err
+	}
+	outcome.Validated = err == nil
+}
+
+// run runs the analyzers of the stage and merges what they found. The stage
+// fails with the first analyzer that fails, and with ErrNotApplicable when
+// none of its analyzers applies.
+func (s Stage) run(ctx context.Context, image types.Image) (types.FileSet, error) {
+	found := types.NewFileSet()
+	applied := len(s.Analyzers) == 0
+	for _, a := range s.Analyzers {
+		files, err := a.Analyze(ctx, image)
+		if errors.Is(err, ErrNotApplicable) {
+			continue
+		}
+		applied = true
+		if err != nil {
+			return found, err
+		}
+		log.Info("Analyzer ", a.Name(), " found ", files.Len(), " paths")
+		files.Attribute(a.Name())
+		found.Merge(files)
+	}
+	if !applied {
+		return found, ErrNotApplicable
+	}
+	return found, nil
+}
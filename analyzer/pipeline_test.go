@@ -0,0 +1,253 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// stub finds paths, or fails with err after finding them.
+type stub struct {
+	name  string
+	paths []string
+	err   error
+	calls *[]string
+}
+
+func (s stub) Name() string {
+	return s.name
+}
+
+func (s stub) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	*s.calls = append(*s.calls, "analyze "+s.name)
+	files := types.NewFileSet()
+	for _, path := range s.paths {
+		files.Add(types.Entry{Path: path, Kind: types.KindFile})
+	}
+	return files, s.err
+}
+
+func TestPipelineRun(t *testing.T) {
+	errFailed := errors.New("strace not found")
+	tests := []struct {
+		name   string
+		stages func(calls *[]string) []Stage
+		atEnd  bool
+		// invalid are the stages whose files fail validation.
+		invalid []string
+		// cancel cancels the context when validating the stage.
+		cancel     string
+		want       []string
+		wantStage  string
+		wantFiles  []string
+		wantValid  bool
+		wantErrors []string
+		wantErr    string
+	}{
+		{
+			name: "first valid stage",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "initial"},
+					{Name: "ldd", Analyzers: []Analyzer{stub{"ldd", []string{"/lib/libc.so.6"}, nil, calls}}},
+					{Name: "strace", Analyzers: []Analyzer{stub{"strace", []string{"/etc/hosts"}, nil, calls}}},
+				}
+			},
+			invalid:    []string{"initial"},
+			want:       []string{"validate initial /app", "analyze ldd", "validate ldd /app /lib/libc.so.6"},
+			wantStage:  "ldd",
+			wantFiles:  []string{"/app", "/lib/libc.so.6"},
+			wantValid:  true,
+			wantErrors: []string{"initial"},
+		},
+		{
+			name: "not applicable",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "python+node", Analyzers: []Analyzer{
+						stub{"python", nil, ErrNotApplicable, calls}, stub{"node", nil, ErrNotApplicable, calls},
+					}},
+					{Name: "java", Analyzers: []Analyzer{
+						stub{"ruby", nil, ErrNotApplicable, calls}, stub{"java", []string{"/app.jar"}, nil, calls},
+					}},
+				}
+			},
+			want:      []string{"analyze python", "analyze node", "analyze ruby", "analyze java", "validate java /app /app.jar"},
+			wantStage: "java",
+			wantFiles: []string{"/app", "/app.jar"},
+			wantValid: true,
+		},
+		{
+			name: "failing stage",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "strace", Analyzers: []Analyzer{
+						stub{"ldd", []string{"/lib/libc.so.6"}, nil, calls}, stub{"strace", []string{"/etc/hosts"}, errFailed, calls},
+						stub{"other", nil, nil, calls},
+					}},
+					{Name: "ldd", Analyzers: []Analyzer{stub{"ldd", []string{"/lib/libm.so.6"}, nil, calls}}},
+				}
+			},
+			want:       []string{"analyze ldd", "analyze strace", "analyze ldd", "validate ldd /app /lib/libm.so.6"},
+			wantStage:  "ldd",
+			wantFiles:  []string{"/app", "/lib/libm.so.6"},
+			wantValid:  true,
+			wantErrors: []string{"strace"},
+		},
+		{
+			name: "standalone",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "ldd", Analyzers: []Analyzer{stub{"ldd", []string{"/lib/libc.so.6"}, nil, calls}}},
+					{Name: "binary_search", Analyzers: []Analyzer{stub{"binary_search", []string{"/bin/sh"}, nil, calls}}, Standalone: true},
+					{Name: "strace", Analyzers: []Analyzer{stub{"strace", []string{"/etc/hosts"}, nil, calls}}},
+				}
+			},
+			invalid:    []string{"ldd"},
+			want:       []string{"analyze ldd", "validate ldd /app /lib/libc.so.6", "analyze binary_search"},
+			wantStage:  "binary_search",
+			wantFiles:  []string{"/bin/sh"},
+			wantValid:  true,
+			wantErrors: []string{"ldd"},
+		},
+		{
+			name: "at end",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "ldd", Analyzers: []Analyzer{stub{"ldd", []string{"/lib/libc.so.6"}, nil, calls}}},
+					{Name: "strace", Analyzers: []Analyzer{stub{"strace", []string{"/etc/hosts"}, nil, calls}}},
+					{Name: "ruby", Analyzers: []Analyzer{stub{"ruby", nil, ErrNotApplicable, calls}}},
+				}
+			},
+			atEnd:     true,
+			want:      []string{"analyze ldd", "analyze strace", "analyze ruby", "validate strace /app /etc/hosts /lib/libc.so.6"},
+			wantStage: "strace",
+			wantFiles: []string{"/app", "/etc/hosts", "/lib/libc.so.6"},
+			wantValid: true,
+		},
+		{
+			name: "at end after a standalone stage",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "binary_search", Analyzers: []Analyzer{stub{"binary_search", []string{"/bin/sh"}, nil, calls}}, Standalone: true},
+				}
+			},
+			atEnd:     true,
+			want:      []string{"analyze binary_search"},
+			wantStage: "binary_search",
+			wantFiles: []string{"/bin/sh"},
+			wantValid: true,
+		},
+		{
+			name: "no valid stage",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "ldd", Analyzers: []Analyzer{stub{"ldd", []string{"/lib/libc.so.6"}, nil, calls}}},
+					{Name: "strace", Analyzers: []Analyzer{stub{"strace", nil, errFailed, calls}}},
+				}
+			},
+			invalid:    []string{"ldd"},
+			want:       []string{"analyze ldd", "validate ldd /app /lib/libc.so.6", "analyze strace"},
+			wantStage:  "ldd",
+			wantFiles:  []string{"/app", "/lib/libc.so.6"},
+			wantErrors: []string{"ldd", "strace"},
+			wantErr:    "no stage produced a valid minimal Dockerfile",
+		},
+		{
+			name: "canceled",
+			stages: func(calls *[]string) []Stage {
+				return []Stage{
+					{Name: "ldd", Analyzers: []Analyzer{stub{"ldd", []string{"/lib/libc.so.6"}, nil, calls}}},
+					{Name: "strace", Analyzers: []Analyzer{stub{"strace", []string{"/etc/hosts"}, nil, calls}}},
+				}
+			},
+			invalid:    []string{"ldd"},
+			cancel:     "ldd",
+			want:       []string{"analyze ldd", "validate ldd /app /lib/libc.so.6"},
+			wantStage:  "ldd",
+			wantFiles:  []string{"/app", "/lib/libc.so.6"},
+			wantErrors: []string{"ldd"},
+			wantErr:    context.Canceled.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			calls := []string{}
+			pipeline := Pipeline{
+				Stages: tt.stages(&calls),
+				AtEnd:  tt.atEnd,
+				Validate: func(ctx context.Context, stage string, files *types.FileSet) error {
+					calls = append(calls, "validate "+stage+" "+strings.Join(files.Paths(), " "))
+					if stage == tt.cancel {
+						cancel()
+					}
+					if slices.Contains(tt.invalid, stage) {
+						return errors.New("container exited with code 1")
+					}
+					return nil
+				},
+			}
+			initial := types.NewFileSet()
+			initial.Add(types.Entry{Path: "/app", Kind: types.KindFile})
+			outcome, err := pipeline.Run(ctx, types.Image{Name: "app"}, initial)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("Run error = %v, want %q", err, tt.wantErr)
+			}
+			if !slices.Equal(calls, tt.want) {
+				t.Errorf("calls =\n%s\nwant\n%s", strings.Join(calls, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if outcome.Stage != tt.wantStage || outcome.Validated != tt.wantValid {
+				t.Errorf("outcome of stage %q validated %t, want %q validated %t",
+					outcome.Stage, outcome.Validated, tt.wantStage, tt.wantValid)
+			}
+			if got := outcome.Files.Paths(); !slices.Equal(got, tt.wantFiles) {
+				t.Errorf("files = %q, want %q", got, tt.wantFiles)
+			}
+			if got := slices.Sorted(maps.Keys(outcome.Errors)); !slices.Equal(got, tt.wantErrors) {
+				t.Errorf("errors of stages %q, want %q", got, tt.wantErrors)
+			}
+			if initial.Len() != 1 {
+				t.Errorf("the initial files were changed: %q", initial.Paths())
+			}
+		})
+	}
+}
+
+func TestPipelineAttribution(t *testing.T) {
+	calls := []string{}
+	initial := types.NewFileSet()
+	initial.Add(types.Entry{Path: "/bin/app", Kind: types.KindFile, Sources: []types.Source{{Analyzer: "initial", Reason: "command"}}})
+	pipeline := Pipeline{
+		Stages: []Stage{{Name: "ldd+strace", Analyzers: []Analyzer{
+			stub{"ldd", []string{"/bin/app", "/lib/libc.so.6"}, nil, &calls},
+			stub{"strace", []string{"/lib/libc.so.6", "/etc/hosts"}, nil, &calls},
+		}}},
+		Validate: func(ctx context.Context, stage string, files *types.FileSet) error { return nil },
+	}
+	outcome, err := pipeline.Run(context.Background(), types.Image{}, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"/bin/app":       {"initial", "ldd"},
+		"/lib/libc.so.6": {"ldd", "strace"},
+		"/etc/hosts":     {"strace"},
+	}
+	for path, analyzers := range want {
+		entry, _ := outcome.Files.Get(path)
+		got := []string{}
+		for _, source := range entry.Sources {
+			got = append(got, source.Analyzer)
+		}
+		if !slices.Equal(got, analyzers) {
+			t.Errorf("%s found by %q, want %q", path, got, analyzers)
+		}
+	}
+}
@@ -1,39 +1,62 @@
 package binarysearch
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
-	"math/big"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
-
 	"slices"
+	"strings"
 
-	"github.com/barkimedes/go-deepcopy"
+	"github.com/regelepuma/dockerminimizer/engine"
 	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/oci"
+	"github.com/regelepuma/dockerminimizer/types"
 	"github.com/regelepuma/dockerminimizer/utils"
 )
 
 var log = logger.Log
 
-func parseFilesystem(rootfsPath string) (map[string][]string,
-	map[string][]string, error) {
+var errBudgetExhausted = errors.New("reached maximum limit of binary search builds")
+
+// reducer implements the ddmin delta debugging algorithm over the sorted list
+// of paths found in the rootfs. Every test builds and validates one image, so
+// results are memoised and the number of builds is capped by maxLimit.
+type reducer struct {
+	ctx      context.Context
+	rt       engine.Runtime
+	image    types.Image
+	envPath  string
+	timeout  int
+	maxLimit int
+	builds   int
+	results  map[string]bool
+	// check reports whether the configuration of paths passes in build step,
+	// see validate.
+	check func(step int, paths []string) (bool, error)
+	// kept are part of every configuration without being searched.
+	kept []string
+	// load validates configurations by loading them as OCI images.
+	load bool
+}
+
+func parseFilesystem(rootfsPath string) ([]string, error) {
 	info, err := os.Stat(rootfsPath)
 	if err != nil {
 		log.Error("Error reading rootfs path:", err)
-		return nil, nil, err
+		return nil, err
 	}
 	if !info.IsDir() {
 		log.Error("Rootfs path is not a directory")
-		return nil, nil, errors.New("rootfs path is not a directory")
+		return nil, errors.New("rootfs path is not a directory")
 	}
 
-	usedFiles := make(map[string][]string)
-	unusedFiles := make(map[string][]string)
+	// WalkDir visits entries in lexical order, which keeps the search deterministic.
+	paths := []string{}
 	err = filepath.WalkDir(rootfsPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			log.Error("Error walking directory:", err)
@@ -41,103 +64,290 @@ func parseFilesystem(rootfsPath string) (map[string][]string,
 		}
 		relPath := strings.TrimPrefix(path, rootfsPath)
 		if relPath == "" {
-			relPath = "/"
+			return nil
 		}
-		unusedFiles[filepath.Dir(relPath)] = utils.AppendIfMissing(unusedFiles[filepath.Dir(relPath)], relPath)
+		paths = append(paths, relPath)
 		return nil
 	})
 	if err != nil {
 		log.Error("Error walking directory:", err)
-		return nil, nil, err
+		return nil, err
 	}
-	return usedFiles, unusedFiles, nil
+	return paths, nil
 }
 
-func splitFilesystem(usedFiles map[string][]string,
-	unusedFiles map[string][]string) (map[string][]string, map[string][]string) {
-	cpyUsedFiles, _ := deepcopy.Anything(usedFiles)
-	cpyUnusedFiles, _ := deepcopy.Anything(unusedFiles)
-	usedFiles, _ = cpyUsedFiles.(map[string][]string)
-	unusedFiles, _ = cpyUnusedFiles.(map[string][]string)
-	for dir, files := range unusedFiles {
-		originalFiles := slices.Clone(files)
-		for _, file := range originalFiles {
-			flag, _ := rand.Int(rand.Reader, big.NewInt(2))
-			ok := flag.Int64()
-			if ok == 0 {
-				usedFiles[dir] = utils.AppendIfMissing(usedFiles[dir], file)
-				unusedFiles[dir] = utils.RemoveElement(unusedFiles[dir], file)
-			}
-		}
-		if len(unusedFiles[dir]) == 0 {
-			delete(unusedFiles, dir)
+// fileSet returns the entries of paths in the rootfs, added for reason.
+func fileSet(paths []string, rootfsPath string, reason string) types.FileSet {
+	files := types.NewFileSet()
+	for _, path := range paths {
+		if entry, err := utils.StatEntry(rootfsPath, path); err == nil {
+			entry.Sources = []types.Source{{Reason: reason}}
+			files.Add(entry)
 		}
 	}
-	return usedFiles, unusedFiles
+	return files
+}
+
+func configurationKey(paths []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(paths, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// split partitions paths into n contiguous chunks whose sizes differ by at most one.
+func split(paths []string, n int) [][]string {
+	chunks := make([][]string, 0, n)
+	start := 0
+	for i := range n {
+		end := start + (len(paths)-start)/(n-i)
+		chunks = append(chunks, paths[start:end])
+		start = end
+	}
+	return chunks
 }
 
-func binarySearchStep(envPath string, context string, timeout int, step int, usedFiles map[string][]string,
-	unusedFiles map[string][]string) (map[string][]string, map[string][]string, error) {
-	for {
-		if len(unusedFiles) == 0 {
-			return nil, nil, errors.New("no unused files or symbolic links left to process")
+func complement(chunks [][]string, skip int) []string {
+	paths := []string{}
+	for i, chunk := range chunks {
+		if i != skip {
+			paths = append(paths, chunk...)
 		}
-		usedFiles, unusedFiles = splitFilesystem(usedFiles, unusedFiles)
+	}
+	return paths
+}
+
+func buildArchive(paths []string, envPath string) error {
+	tarFilename := fmt.Sprintf("%s/files.tar", envPath)
+	if err := utils.BuildTarArchive(fileSet(paths, envPath+"/rootfs", ""), tarFilename, envPath); err != nil {
+		log.Error("Error building tar archive:", err)
+		return err
+	}
+	return nil
+}
+
+func (r *reducer) test(paths []string) (bool, error) {
+	key := configurationKey(paths)
+	if result, ok := r.results[key]; ok {
+		return result, nil
+	}
+	if err := r.ctx.Err(); err != nil {
+		return false, err
+	}
+	if r.builds >= r.maxLimit {
+		return false, errBudgetExhausted
+	}
+	r.builds++
+	step := r.builds
+	log.Info("Binary search build ", step, " with ", len(paths), " files")
+
+	ok, err := r.check(step, paths)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		log.Info("Binary search build ", step, " succeeded.")
+	} else {
+		log.Info("Binary search build ", step, " failed.")
+	}
+	r.results[key] = ok
+	return ok, nil
+}
+
+// validate builds, or loads, the image of the kept paths and paths and
+// reports whether it passes validation, removing the image when it does not.
+func (r *reducer) validate(step int, paths []string) (bool, error) {
+	var err error
+	if r.load {
+		files := fileSet(slices.Concat(r.kept, paths), r.envPath+"/rootfs", "")
+		err = oci.Validate(r.ctx, r.rt, r.image, files, fmt.Sprint(step), r.timeout)
+	} else {
 		filename := fmt.Sprintf("Dockerfile.minimal.binary_search.%d", step)
-		tarFilename := fmt.Sprintf("%s/files.tar", envPath)
-		if err := utils.BuildTarArchive(usedFiles, tarFilename, envPath); err != nil {
-			log.Error("Error building tar archive:", err)
-			return nil, nil, err
+		if err := buildArchive(slices.Concat(r.kept, paths), r.envPath); err != nil {
+			return false, err
 		}
-		err := utils.AddTarToDockerfile(filename, "Dockerfile.minimal.template", envPath)
+		err = utils.AddTarToDockerfile(filename, "Dockerfile.minimal.template", r.envPath)
 		if err != nil {
 			log.Error("Error adding tar to Dockerfile:", err)
-			return nil, nil, errors.New("error adding tar to Dockerfile")
+			return false, errors.New("error adding tar to Dockerfile")
+		}
+		err = utils.ValidateDockerfile(r.ctx, r.rt, r.image, filename, r.timeout)
+	}
+	if err != nil {
+		r.rt.RemoveImages(r.ctx, "dockerminimize-"+filepath.Base(r.envPath)+":"+fmt.Sprint(step))
+	}
+	return err == nil, nil
+}
+
+// emit writes the Dockerfile.minimal.binary_search adding found, whose paths
+// passed validation, and validates it, as the candidates were built from a
+// single archive rather than the layers the Dockerfile plans. When it fails,
+// the Dockerfile adds the single archive like the candidates did instead.
+func (r *reducer) emit(paths []string, found types.FileSet) error {
+	const dockerfile = "Dockerfile.minimal.binary_search"
+	err := utils.CreateDockerfile(dockerfile, "Dockerfile.minimal.template", r.envPath, found)
+	if err != nil {
+		return err
+	}
+	err = utils.ValidateDockerfile(r.ctx, r.rt, r.image, dockerfile, r.timeout)
+	if err == nil {
+		return nil
+	}
+	log.Info("Binary search Dockerfile failed validation, adding the files from one archive instead")
+	if err := buildArchive(paths, r.envPath); err != nil {
+		return err
+	}
+	err = utils.AddTarToDockerfile(dockerfile, "Dockerfile.minimal.template", r.envPath)
+	if err != nil {
+		log.Error("Error adding tar to Dockerfile:", err)
+		return errors.New("error adding tar to Dockerfile")
+	}
+	if r.load {
+		// The candidates were loaded, not built from this Dockerfile.
+		return utils.ValidateDockerfile(r.ctx, r.rt, r.image, dockerfile, r.timeout)
+	}
+	return nil
+}
+
+// reduce runs ddmin on paths, which is assumed to pass. It returns the
+// smallest passing configuration found and whether it is 1-minimal, i.e.
+// removing any single path makes validation fail.
+func (r *reducer) reduce(paths []string) ([]string, bool, error) {
+	n := 2
+	for len(paths) >= 2 {
+		chunks := split(paths, n)
+		reduced := false
+		for _, chunk := range chunks {
+			ok, err := r.test(chunk)
+			if err != nil {
+				return paths, false, err
+			}
+			if ok {
+				paths, n, reduced = chunk, 2, true
+				break
+			}
+		}
+		// With two chunks every complement is the other chunk, which was just tested.
+		if !reduced && n > 2 {
+			for i := range chunks {
+				candidate := complement(chunks, i)
+				ok, err := r.test(candidate)
+				if err != nil {
+					return paths, false, err
+				}
+				if ok {
+					paths, n, reduced = candidate, max(n-1, 2), true
+					break
+				}
+			}
 		}
-		utils.CopyFile(tarFilename, context+"/files.tar")
-		err = utils.ValidateDockerfile(filename, envPath, context, timeout)
-		os.Remove(context + "/files.tar")
+		if reduced {
+			continue
+		}
+		if n >= len(paths) {
+			break
+		}
+		n = min(2*n, len(paths))
+	}
+	// Splitting stops at a single path, which may not be needed either.
+	if len(paths) == 1 {
+		ok, err := r.test([]string{})
 		if err != nil {
-			exec.Command("docker", "rmi", "-f", "dockerminimize-"+filepath.Base(envPath)+":"+fmt.Sprint(step)).Run()
+			return paths, false, err
 		}
-		if err == nil {
-			log.Info("Binary search step ", step, " succeeded.")
-			utils.CopyFile(envPath+"/files.tar", "files.tar")
-			return make(map[string][]string), usedFiles, nil
+		if ok {
+			paths = []string{}
 		}
 	}
+	return paths, true, nil
 }
 
-func BinarySearch(envPath string, maxLimit int, context string, timeout int) error {
+// partition splits the paths of the rootfs into the ones kept by the
+// patterns of image.Keep and the ones left to search, leaving out the ones
+// dropped by image.Drop. Drop wins over Keep.
+func partition(paths []string, image types.Image) ([]string, []string) {
+	kept, searched := []string{}, []string{}
+	for _, path := range paths {
+		switch {
+		case utils.MatchesAny(image.Drop, path):
+		case utils.MatchesAny(image.Keep, path):
+			kept = append(kept, path)
+		default:
+			searched = append(searched, path)
+		}
+	}
+	return kept, searched
+}
+
+// Analyzer reduces the whole rootfs to a minimal set of files that still
+// validates, with at most MaxLimit builds, the first of which validates the
+// whole rootfs, and writes the Dockerfile.minimal.binary_search adding it to
+// the environment.
+type Analyzer struct {
+	Runtime  engine.Runtime
+	MaxLimit int
+	Timeout  int
+	// Load validates candidates by loading them as OCI images instead of
+	// building a Dockerfile for each.
+	Load bool
+}
+
+func (Analyzer) Name() string {
+	return "binary_search"
+}
+
+func (a Analyzer) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	rt, maxLimit, timeout := a.Runtime, a.MaxLimit, a.Timeout
+	envPath := image.EnvPath
 	log.Info("Starting binary search...")
-	usedFiles, unusedFiles, err := parseFilesystem(envPath + "/rootfs")
+	paths, err := parseFilesystem(envPath + "/rootfs")
 	if err != nil {
 		log.Error("Error parsing filesystem:", err)
-		return errors.New("error parsing filesystem")
+		return types.FileSet{}, errors.New("error parsing filesystem")
 	}
+	kept, paths := partition(paths, image)
+	log.Info("Keeping ", len(kept), " files, searching ", len(paths))
 
-	step := 0
-	var lastErr error
-	for step := 1; step <= maxLimit; step++ {
-		log.Info("Binary search iteration:", step)
-		usedFiles, unusedFiles, lastErr = binarySearchStep(envPath, context, timeout, step,
-			usedFiles, unusedFiles)
-		if lastErr != nil {
-			break
-		}
+	r := &reducer{
+		ctx:      ctx,
+		rt:       rt,
+		image:    image,
+		envPath:  envPath,
+		timeout:  timeout,
+		maxLimit: maxLimit,
+		results:  make(map[string]bool),
+		kept:     kept,
+		load:     a.Load,
 	}
-
-	if lastErr != nil {
-		log.Error("Binary search failed at step", step, "with error:", lastErr)
-		return lastErr
+	r.check = r.validate
+	// ddmin only tests subsets, so the whole rootfs is tested first: when it
+	// passes and no subset does, it is the result.
+	ok, err := r.test(paths)
+	if err != nil {
+		log.Error("Binary search failed to validate the full filesystem:", err)
+		return types.FileSet{}, err
 	}
-
-	if step > maxLimit {
-		log.Info("Reached maximum limit of binary search iterations:", maxLimit)
-		return errors.New("reached maximum limit of binary search iterations")
+	if !ok {
+		log.Error("Binary search could not validate the full filesystem")
+		return types.FileSet{}, errors.New("binary search could not validate the full filesystem")
+	}
+	minimal, complete, err := r.reduce(paths)
+	if err != nil && !errors.Is(err, errBudgetExhausted) {
+		log.Error("Binary search failed after ", r.builds, " builds with error:", err)
+		return types.FileSet{}, err
+	}
+	if len(minimal) == len(paths) {
+		log.Info("Binary search could not validate a smaller filesystem within ", maxLimit,
+			" builds, keeping all of it")
+	}
+	if !complete {
+		log.Info("Reached maximum limit of binary search builds: ", maxLimit,
+			", keeping the smallest validated configuration")
 	}
 
-	log.Info("Binary search completed successfully.")
-	utils.CopyFile(envPath+"/files.tar", "files.tar")
-	return nil
+	found := fileSet(kept, envPath+"/rootfs", "matches a keep pattern")
+	found.Merge(fileSet(minimal, envPath+"/rootfs", "needed to pass validation"))
+	if err := r.emit(slices.Concat(kept, minimal), found); err != nil {
+		return types.FileSet{}, err
+	}
+	log.Info("Binary search completed successfully with ", found.Len(), " of ", len(kept)+len(paths), " files.")
+	return found, nil
 }
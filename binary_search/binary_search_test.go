@@ -0,0 +1,159 @@
+package binarysearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// needs returns a check passing the configurations holding every path of
+// needed, and records the configurations it was called with.
+func needs(needed []string, calls *[][]string) func(int, []string) (bool, error) {
+	return func(_ int, paths []string) (bool, error) {
+		*calls = append(*calls, paths)
+		for _, path := range needed {
+			if !slices.Contains(paths, path) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+func newTestReducer(maxLimit int) *reducer {
+	return &reducer{ctx: context.Background(), maxLimit: maxLimit, results: make(map[string]bool)}
+}
+
+func numbered(n int) []string {
+	paths := []string{}
+	for i := range n {
+		paths = append(paths, fmt.Sprintf("/file%02d", i))
+	}
+	return paths
+}
+
+func TestReduce(t *testing.T) {
+	tests := []struct {
+		name   string
+		paths  []string
+		needed []string
+	}{
+		{"single", numbered(16), []string{"/file07"}},
+		{"spread", numbered(16), []string{"/file00", "/file09", "/file15"}},
+		{"adjacent", numbered(10), []string{"/file04", "/file05"}},
+		{"everything", numbered(4), numbered(4)},
+		{"nothing", numbered(8), nil},
+		{"one unneeded path", numbered(1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls [][]string
+			r := newTestReducer(1000)
+			r.check = needs(tt.needed, &calls)
+			minimal, complete, err := r.reduce(tt.paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !complete {
+				t.Error("reduce did not complete")
+			}
+			if !slices.Equal(minimal, tt.needed) {
+				t.Errorf("reduce = %v, want %v", minimal, tt.needed)
+			}
+			// 1-minimal: removing any single path fails.
+			for i := range minimal {
+				without := slices.Delete(slices.Clone(minimal), i, i+1)
+				if ok, _ := needs(tt.needed, new([][]string))(0, without); ok {
+					t.Errorf("%v still passes without %s", minimal, minimal[i])
+				}
+			}
+			seen := make(map[string]bool)
+			for _, call := range calls {
+				key := configurationKey(call)
+				if seen[key] {
+					t.Errorf("configuration %v was checked twice", call)
+				}
+				seen[key] = true
+			}
+			if r.builds != len(calls) {
+				t.Errorf("builds = %d, want %d", r.builds, len(calls))
+			}
+		})
+	}
+}
+
+func TestReduceBudget(t *testing.T) {
+	var calls [][]string
+	r := newTestReducer(3)
+	r.check = needs([]string{"/file03", "/file05"}, &calls)
+	paths := numbered(16)
+	minimal, complete, err := r.reduce(paths)
+	if !errors.Is(err, errBudgetExhausted) {
+		t.Fatalf("reduce error = %v, want %v", err, errBudgetExhausted)
+	}
+	if complete {
+		t.Error("reduce reported a complete search")
+	}
+	if len(calls) != 3 || r.builds != 3 {
+		t.Errorf("checked %d configurations in %d builds, want 3", len(calls), r.builds)
+	}
+	if ok, _ := needs([]string{"/file03", "/file05"}, new([][]string))(0, minimal); !ok {
+		t.Errorf("reduce = %v, which does not pass", minimal)
+	}
+	if len(minimal) >= len(paths) {
+		t.Errorf("reduce = %v, want a reduced configuration", minimal)
+	}
+}
+
+func TestReduceCheckError(t *testing.T) {
+	r := newTestReducer(10)
+	failure := errors.New("no space left on device")
+	r.check = func(int, []string) (bool, error) {
+		return false, failure
+	}
+	paths := numbered(4)
+	minimal, _, err := r.reduce(paths)
+	if !errors.Is(err, failure) {
+		t.Fatalf("reduce error = %v, want %v", err, failure)
+	}
+	if !slices.Equal(minimal, paths) {
+		t.Errorf("reduce = %v, want %v", minimal, paths)
+	}
+	if len(r.results) != 0 {
+		t.Errorf("failed check was memoised: %v", r.results)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	paths := []string{"/bin/sh", "/etc/passwd", "/usr/share/doc/a", "/usr/share/doc/b", "/usr/share/zoneinfo/UTC"}
+	image := types.Image{
+		Keep: []string{"/etc/passwd", "/usr/share/doc/b"},
+		Drop: []string{"/usr/share/doc/**"},
+	}
+	kept, searched := partition(paths, image)
+	// Drop wins over Keep.
+	if want := []string{"/etc/passwd"}; !slices.Equal(kept, want) {
+		t.Errorf("kept = %v, want %v", kept, want)
+	}
+	if want := []string{"/bin/sh", "/usr/share/zoneinfo/UTC"}; !slices.Equal(searched, want) {
+		t.Errorf("searched = %v, want %v", searched, want)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	chunks := split(numbered(7), 3)
+	sizes := []int{}
+	for _, chunk := range chunks {
+		sizes = append(sizes, len(chunk))
+	}
+	if want := []int{2, 2, 3}; !slices.Equal(sizes, want) {
+		t.Errorf("chunk sizes = %v, want %v", sizes, want)
+	}
+	if got := slices.Concat(chunks...); !slices.Equal(got, numbered(7)) {
+		t.Errorf("chunks = %v, want a partition of the paths", chunks)
+	}
+}
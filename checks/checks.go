@@ -0,0 +1,239 @@
+// Package checks decides whether a container run of a candidate image
+// behaves as expected. Without checks an image passes when its container
+// exits with code 0 or is still running at the timeout; checks make that
+// decision stricter and configurable per project.
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+var log = logger.Log
+
+// Types lists the check types accepted by New.
+var Types = []string{"http", "tcp", "exec", "stdout", "stderr", "exit_code"}
+
+// retryInterval is the pause between two attempts of a probe.
+const retryInterval = 500 * time.Millisecond
+
+// Check is a single health check.
+type Check interface {
+	String() string
+}
+
+// Probe is a check run against the container while it is running. Probes
+// are retried until they pass or the container stops.
+type Probe interface {
+	Check
+	Probe(ctx context.Context, c engine.Container) error
+}
+
+// Verifier is a check inspecting the outcome of the run.
+type Verifier interface {
+	Check
+	Verify(result engine.RunResult) error
+}
+
+// New creates the check described by config.
+func New(config types.Check) (Check, error) {
+	var pattern *regexp.Regexp
+	if config.Pattern != "" {
+		var err error
+		pattern, err = regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s check: invalid pattern: %w", config.Type, err)
+		}
+	}
+	switch config.Type {
+	case "http":
+		if config.Port == "" {
+			return nil, errors.New("http check: port is required")
+		}
+		path := config.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return &HTTP{Port: config.Port, Path: path, Status: config.Status, Body: pattern}, nil
+	case "tcp":
+		if config.Port == "" {
+			return nil, errors.New("tcp check: port is required")
+		}
+		return &TCP{Port: config.Port}, nil
+	case "exec":
+		if len(config.Command) == 0 {
+			return nil, errors.New("exec check: command is required")
+		}
+		return &Exec{Command: config.Command, ExitCode: config.ExitCode, Output: pattern}, nil
+	case "stdout", "stderr":
+		if pattern == nil {
+			return nil, fmt.Errorf("%s check: pattern is required", config.Type)
+		}
+		return &Output{Stream: config.Type, Pattern: pattern}, nil
+	case "exit_code":
+		return &ExitCode{Code: config.ExitCode}, nil
+	}
+	return nil, fmt.Errorf("unknown check type %q, expected one of %v", config.Type, Types)
+}
+
+// Parse reads the command line form of a check:
+//
+//	http:8080/health=200  tcp:5432  exec:pg_isready -U postgres
+//	stdout:REGEX  stderr:REGEX  exit_code:0
+//
+// The path and status of http checks are optional.
+func Parse(spec string) (types.Check, error) {
+	kind, value, ok := strings.Cut(spec, ":")
+	if !ok || value == "" {
+		return types.Check{}, fmt.Errorf("invalid check %q, expected <type>:<value>", spec)
+	}
+	config := types.Check{Type: kind}
+	switch kind {
+	case "http":
+		target, status, hasStatus := strings.Cut(value, "=")
+		port, path, _ := strings.Cut(target, "/")
+		config.Port, config.Path = port, "/"+path
+		if hasStatus {
+			code, err := strconv.Atoi(status)
+			if err != nil {
+				return config, fmt.Errorf("invalid status in check %q: %w", spec, err)
+			}
+			config.Status = code
+		}
+	case "tcp":
+		config.Port = value
+	case "exec":
+		config.Command = strings.Fields(value)
+	case "stdout", "stderr":
+		config.Pattern = value
+	case "exit_code":
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid exit code in check %q: %w", spec, err)
+		}
+		config.ExitCode = code
+	default:
+		return config, fmt.Errorf("unknown check type %q, expected one of %v", kind, Types)
+	}
+	_, err := New(config)
+	return config, err
+}
+
+// Suite runs a set of checks against a container run.
+type Suite struct {
+	probes    []Probe
+	verifiers []Verifier
+	exitCode  bool
+}
+
+// NewSuite creates the checks described by configs.
+func NewSuite(configs []types.Check) (*Suite, error) {
+	s := &Suite{}
+	for _, config := range configs {
+		check, err := New(config)
+		if err != nil {
+			return nil, err
+		}
+		if probe, ok := check.(Probe); ok {
+			s.probes = append(s.probes, probe)
+		}
+		if verifier, ok := check.(Verifier); ok {
+			s.verifiers = append(s.verifiers, verifier)
+		}
+		if _, ok := check.(*ExitCode); ok {
+			s.exitCode = true
+		}
+	}
+	return s, nil
+}
+
+// Ports returns the container ports the probes need published.
+func (s *Suite) Ports() []string {
+	ports := []string{}
+	for _, probe := range s.probes {
+		switch p := probe.(type) {
+		case *HTTP:
+			ports = append(ports, p.Port)
+		case *TCP:
+			ports = append(ports, p.Port)
+		}
+	}
+	return ports
+}
+
+// While returns the hook for engine.RunOptions.While running the probes and
+// then, once they passed, next, which may be nil. It is nil when there is
+// nothing to run. The container is stopped when the hook returns, unless its
+// exit code is checked, then it is left to exit on its own.
+func (s *Suite) While(next func(ctx context.Context, c engine.Container) error) func(ctx context.Context, c engine.Container) error {
+	if len(s.probes) == 0 && next == nil {
+		return nil
+	}
+	return func(ctx context.Context, c engine.Container) error {
+		for _, probe := range s.probes {
+			if err := retry(ctx, probe, c); err != nil {
+				return err
+			}
+			log.Info("Check passed: ", probe)
+		}
+		if next != nil {
+			if err := next(ctx, c); err != nil {
+				return err
+			}
+		}
+		if s.exitCode {
+			<-ctx.Done()
+		}
+		return nil
+	}
+}
+
+func retry(ctx context.Context, probe Probe, c engine.Container) error {
+	for {
+		err := probe.Probe(ctx, c)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", probe, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Verify decides whether result passes the checks. Unless an exit_code check
+// is configured the container has to exit with code 0 or still be running
+// when it was stopped.
+func (s *Suite) Verify(result engine.RunResult) error {
+	running := result.TimedOut || result.Stopped
+	if !s.exitCode && !running && result.ExitCode != 0 {
+		return errors.Join(fmt.Errorf("container exited with code %d", result.ExitCode), s.VerifyChecks(result))
+	}
+	return s.VerifyChecks(result)
+}
+
+// VerifyChecks is Verify without the default exit code requirement, for
+// differential validation where the exit code is compared with the one of
+// the original image instead.
+func (s *Suite) VerifyChecks(result engine.RunResult) error {
+	var errs []error
+	if result.WhileErr != nil {
+		errs = append(errs, result.WhileErr)
+	}
+	for _, verifier := range s.verifiers {
+		if err := verifier.Verify(result); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", verifier, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,255 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    types.Check
+		wantErr string
+	}{
+		{"http:8080", types.Check{Type: "http", Port: "8080", Path: "/"}, ""},
+		{"http:8080/health=204", types.Check{Type: "http", Port: "8080", Path: "/health", Status: 204}, ""},
+		{"http:8080/api/v1/ping", types.Check{Type: "http", Port: "8080", Path: "/api/v1/ping"}, ""},
+		{"tcp:5432", types.Check{Type: "tcp", Port: "5432"}, ""},
+		{"exec:pg_isready -U postgres", types.Check{Type: "exec", Command: []string{"pg_isready", "-U", "postgres"}}, ""},
+		{"stdout:listening on :\\d+", types.Check{Type: "stdout", Pattern: "listening on :\\d+"}, ""},
+		{"stderr:ready", types.Check{Type: "stderr", Pattern: "ready"}, ""},
+		{"exit_code:3", types.Check{Type: "exit_code", ExitCode: 3}, ""},
+		{"http", types.Check{}, `invalid check "http"`},
+		{"tcp:", types.Check{}, `invalid check "tcp:"`},
+		{"http:8080/=ok", types.Check{}, `invalid status in check "http:8080/=ok"`},
+		{"http:/health", types.Check{}, "http check: port is required"},
+		{"exit_code:zero", types.Check{}, `invalid exit code in check "exit_code:zero"`},
+		{"stdout:(", types.Check{}, "stdout check: invalid pattern"},
+		{"exec:   ", types.Check{}, "exec check: command is required"},
+		{"udp:53", types.Check{}, `unknown check type "udp"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := Parse(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Parse(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.spec, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+// suite returns the suite of the checks in command line form.
+func suite(t *testing.T, specs ...string) *Suite {
+	t.Helper()
+	configs := []types.Check{}
+	for _, spec := range specs {
+		config, err := Parse(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config)
+	}
+	s, err := NewSuite(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSuitePorts(t *testing.T) {
+	s := suite(t, "http:8080/health", "exec:true", "tcp:5432", "stdout:ready")
+	if got, want := s.Ports(), []string{"8080", "5432"}; !slices.Equal(got, want) {
+		t.Errorf("Ports = %v, want %v", got, want)
+	}
+}
+
+func TestSuiteVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		specs  []string
+		result engine.RunResult
+		// wantErr are the parts of the error expected, none when it passes.
+		wantErr []string
+	}{
+		{
+			name:   "exited with code 0",
+			result: engine.RunResult{ExitCode: 0},
+		},
+		{
+			name:   "stopped while running",
+			result: engine.RunResult{ExitCode: 137, Stopped: true},
+		},
+		{
+			name:   "timed out",
+			result: engine.RunResult{ExitCode: 137, TimedOut: true},
+		},
+		{
+			name:    "exited with an error",
+			result:  engine.RunResult{ExitCode: 1},
+			wantErr: []string{"container exited with code 1"},
+		},
+		{
+			name:    "probe failed",
+			result:  engine.RunResult{Stopped: true, WhileErr: errors.New("tcp 5432: connection refused")},
+			wantErr: []string{"tcp 5432: connection refused"},
+		},
+		{
+			name:   "output",
+			specs:  []string{"stdout:^listening", "stderr:warn"},
+			result: engine.RunResult{Stdout: []byte("listening on 80\n"), Stderr: []byte("warning: debug\n")},
+		},
+		{
+			name:    "output mismatch",
+			specs:   []string{"stdout:^listening", "stderr:warn"},
+			result:  engine.RunResult{ExitCode: 2, Stdout: []byte("error\n")},
+			wantErr: []string{"container exited with code 2", `stdout ^listening: stdout does not match "^listening"`, `stderr does not match "warn"`},
+		},
+		{
+			// The exit code check replaces the default requirement.
+			name:   "expected exit code",
+			specs:  []string{"exit_code:3"},
+			result: engine.RunResult{ExitCode: 3},
+		},
+		{
+			name:    "unexpected exit code",
+			specs:   []string{"exit_code:3"},
+			result:  engine.RunResult{ExitCode: 0},
+			wantErr: []string{"exit code 3: exited with code 0"},
+		},
+		{
+			name:    "exit code while running",
+			specs:   []string{"exit_code:0"},
+			result:  engine.RunResult{TimedOut: true},
+			wantErr: []string{"exit code 0: container was still running"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := suite(t, tt.specs...).Verify(tt.result)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Verify: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Verify passed, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Verify error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSuiteVerifyChecks(t *testing.T) {
+	// The exit code is left to the differential comparison.
+	if err := suite(t).VerifyChecks(engine.RunResult{ExitCode: 1}); err != nil {
+		t.Errorf("VerifyChecks: %v", err)
+	}
+}
+
+func TestSuiteWhile(t *testing.T) {
+	if suite(t, "stdout:ready").While(nil) != nil {
+		t.Error("While returned a hook with no probes and no next hook")
+	}
+
+	tests := []struct {
+		name  string
+		specs []string
+		// failures is the number of times the exec probe fails first.
+		failures int
+		nextErr  error
+		timeout  time.Duration
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:  "probes then next",
+			specs: []string{"exec:pg_isready", "exec:psql -c select"},
+			want:  []string{"exec app pg_isready", "exec app psql -c select", "next"},
+		},
+		{
+			name:     "retried until passing",
+			specs:    []string{"exec:pg_isready"},
+			failures: 2,
+			want:     []string{"exec app pg_isready", "exec app pg_isready", "exec app pg_isready", "next"},
+		},
+		{
+			name:     "never passing",
+			specs:    []string{"exec:pg_isready", "exec:psql -c select"},
+			failures: 100,
+			timeout:  retryInterval + retryInterval/2,
+			want:     []string{"exec app pg_isready", "exec app pg_isready"},
+			wantErr:  "exec pg_isready: exited with code 2, expected 0",
+		},
+		{
+			name:    "next fails",
+			specs:   []string{"exec:pg_isready"},
+			nextErr: errors.New("workload failed"),
+			want:    []string{"exec app pg_isready", "next"},
+			wantErr: "workload failed",
+		},
+		{
+			// The container is left to exit on its own for its code to be
+			// checked.
+			name:    "waits for the exit code",
+			specs:   []string{"exit_code:0"},
+			timeout: 10 * time.Millisecond,
+			want:    []string{"next"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &engine.Fake{}
+			calls := 0
+			fake.ExecFunc = func(cmd []string) (engine.ExecResult, error) {
+				calls++
+				if calls <= tt.failures {
+					return engine.ExecResult{ExitCode: 2}, nil
+				}
+				return engine.ExecResult{}, nil
+			}
+			next := func(ctx context.Context, c engine.Container) error {
+				fake.Calls = append(fake.Calls, "next")
+				return tt.nextErr
+			}
+			ctx := context.Background()
+			if tt.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			result, err := fake.Run(ctx, engine.RunOptions{Name: "app", Image: "app", While: suite(t, tt.specs...).While(next)})
+			if err != nil && ctx.Err() == nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(fake.Calls[1:], tt.want) {
+				t.Errorf("calls = %q, want %q", fake.Calls[1:], tt.want)
+			}
+			if tt.wantErr == "" && result.WhileErr != nil || tt.wantErr != "" &&
+				(result.WhileErr == nil || result.WhileErr.Error() != tt.wantErr) {
+				t.Errorf("While error = %v, want %q", result.WhileErr, tt.wantErr)
+			}
+		})
+	}
+}
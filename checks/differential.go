@@ -0,0 +1,322 @@
+package checks
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// defaultNormalizations mask the parts of the output that differ between any
+// two runs of the same image.
+var defaultNormalizations = []types.Normalization{
+	{Pattern: `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`, Replacement: "<timestamp>"},
+	{Pattern: `\b\d{2}:\d{2}:\d{2}(\.\d+)?\b`, Replacement: "<time>"},
+	{Pattern: `\b0x[0-9a-fA-F]+\b`, Replacement: "<address>"},
+	{Pattern: `(?i)\b(pid)([ =:#]*)\d+`, Replacement: "${1}${2}<pid>"},
+	{Pattern: `\b([0-9a-f]{64}|[0-9a-f]{12})\b`, Replacement: "<id>"},
+}
+
+// Observation is the observable behaviour of one container run, normalised.
+type Observation struct {
+	ExitCode int
+	// Running is set when the container was still running at the end of the
+	// run, its exit code is then meaningless.
+	Running   bool
+	Stdout    string
+	Stderr    string
+	Responses []Response
+	// Volumes maps every compared volume to the digests of the files below
+	// it, keyed by their path relative to the volume.
+	Volumes map[string]map[string]string
+}
+
+// Response is the outcome of a request, Error is set when none was received.
+type Response struct {
+	Request string
+	Status  int
+	Body    string
+	Error   string
+}
+
+type normalization struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Differential compares the behaviour of candidate images with the one of
+// the original image.
+type Differential struct {
+	config types.Differential
+	rules  []normalization
+}
+
+// NewDifferential validates config and compiles its normalisation rules.
+func NewDifferential(config types.Differential) (*Differential, error) {
+	d := &Differential{config: config}
+	for _, rule := range slices.Concat(defaultNormalizations, config.Normalize) {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid normalization %q: %w", rule.Pattern, err)
+		}
+		d.rules = append(d.rules, normalization{pattern: pattern, replacement: rule.Replacement})
+	}
+	for _, request := range config.Requests {
+		if request.Port == "" {
+			return nil, fmt.Errorf("request %s: port is required", request.Path)
+		}
+	}
+	for _, volume := range config.Volumes {
+		if !filepath.IsAbs(volume) {
+			return nil, fmt.Errorf("volume %s: path must be absolute", volume)
+		}
+	}
+	return d, nil
+}
+
+// ParseRequest reads the command line form of a request, [METHOD ]PORT[/PATH],
+// e.g. "8080/health" or "POST 8080/api/reset".
+func ParseRequest(spec string) (types.Request, error) {
+	request := types.Request{Method: http.MethodGet}
+	if method, target, ok := strings.Cut(spec, " "); ok {
+		request.Method, spec = strings.ToUpper(method), strings.TrimSpace(target)
+	}
+	port, path, _ := strings.Cut(spec, "/")
+	if port == "" {
+		return request, fmt.Errorf("invalid request %q, expected [METHOD ]PORT[/PATH]", spec)
+	}
+	request.Port, request.Path = port, "/"+path
+	return request, nil
+}
+
+func (d *Differential) normalize(data []byte) string {
+	text := string(data)
+	for _, rule := range d.rules {
+		text = rule.pattern.ReplaceAllString(text, rule.replacement)
+	}
+	return text
+}
+
+// Ports returns the container ports the requests need published.
+func (d *Differential) Ports() []string {
+	ports := []string{}
+	for _, request := range d.config.Requests {
+		ports = append(ports, request.Port)
+	}
+	return ports
+}
+
+func requestString(request types.Request) string {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	return method + " " + request.Port + request.Path
+}
+
+// send performs request, retrying until the container answers or ctx ends.
+func (d *Differential) send(ctx context.Context, c engine.Container, request types.Request) Response {
+	response := Response{Request: requestString(request)}
+	method, _, _ := strings.Cut(response.Request, " ")
+	for {
+		err := func() error {
+			addr, err := c.HostAddr(ctx, request.Port)
+			if err != nil {
+				return err
+			}
+			attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(attemptCtx, method, "http://"+addr+request.Path, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return err
+			}
+			response.Status, response.Body = resp.StatusCode, d.normalize(body)
+			return nil
+		}()
+		if err == nil {
+			return response
+		}
+		select {
+		case <-ctx.Done():
+			response.Error = "no response"
+			return response
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Run runs a container with opts, sending the requests once the probes of
+// opts.While passed, and observes its behaviour. Volumes are mounted from
+// directories created below workDir.
+func (d *Differential) Run(ctx context.Context, rt engine.Runtime, opts engine.RunOptions,
+	workDir string) (Observation, engine.RunResult, error) {
+	observation := Observation{Volumes: make(map[string]map[string]string)}
+	if err := os.RemoveAll(workDir); err != nil {
+		return observation, engine.RunResult{}, err
+	}
+	hostDirs := make(map[string]string)
+	for i, volume := range d.config.Volumes {
+		dir := filepath.Join(workDir, fmt.Sprint(i))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return observation, engine.RunResult{}, err
+		}
+		// The container may run as any user.
+		os.Chmod(dir, 0777)
+		hostDirs[volume] = dir
+		opts.Binds = append(slices.Clone(opts.Binds), dir+":"+volume)
+	}
+	opts.Ports = slices.Concat(opts.Ports, d.Ports())
+	probes := opts.While
+	if probes != nil || len(d.config.Requests) > 0 {
+		opts.While = func(ctx context.Context, c engine.Container) error {
+			if probes != nil {
+				if err := probes(ctx, c); err != nil {
+					return err
+				}
+			}
+			for _, request := range d.config.Requests {
+				observation.Responses = append(observation.Responses, d.send(ctx, c, request))
+			}
+			return nil
+		}
+	}
+
+	result, err := rt.Run(ctx, opts)
+	if err != nil {
+		return observation, result, err
+	}
+	observation.ExitCode = result.ExitCode
+	observation.Running = result.TimedOut || result.Stopped
+	observation.Stdout = d.normalize(result.Stdout)
+	observation.Stderr = d.normalize(result.Stderr)
+	for volume, dir := range hostDirs {
+		observation.Volumes[volume] = digestTree(dir)
+	}
+	return observation, result, nil
+}
+
+// digestTree returns the sha256 of every regular file below dir and the
+// target of every symbolic link, keyed by path relative to dir.
+func digestTree(dir string) map[string]string {
+	digests := make(map[string]string)
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		rel, _ := filepath.Rel(dir, path)
+		if err != nil {
+			digests[rel] = "unreadable"
+			return nil
+		}
+		switch {
+		case entry.Type()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			digests[rel] = "-> " + target
+		case entry.Type().IsRegular():
+			digests[rel] = digestFile(path)
+		}
+		return nil
+	})
+	return digests
+}
+
+func digestFile(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return "unreadable"
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "unreadable"
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// firstDifference describes the first line in which want and got differ.
+func firstDifference(want string, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := range max(len(wantLines), len(gotLines)) {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d: expected %q, got %q", i+1, w, g)
+		}
+	}
+	return ""
+}
+
+// Compare reports every difference between the original behaviour want and
+// the behaviour got of a candidate image.
+func (d *Differential) Compare(want Observation, got Observation) error {
+	var errs []error
+	switch {
+	case want.Running != got.Running:
+		errs = append(errs, fmt.Errorf("container running at the end: expected %t, got %t", want.Running, got.Running))
+	case !want.Running && want.ExitCode != got.ExitCode:
+		errs = append(errs, fmt.Errorf("exit code: expected %d, got %d", want.ExitCode, got.ExitCode))
+	}
+	if want.Stdout != got.Stdout {
+		errs = append(errs, errors.New("stdout differs, "+firstDifference(want.Stdout, got.Stdout)))
+	}
+	if want.Stderr != got.Stderr {
+		errs = append(errs, errors.New("stderr differs, "+firstDifference(want.Stderr, got.Stderr)))
+	}
+	for i, expected := range want.Responses {
+		if i >= len(got.Responses) {
+			errs = append(errs, fmt.Errorf("%s: no response", expected.Request))
+			continue
+		}
+		actual := got.Responses[i]
+		switch {
+		case expected.Error != actual.Error:
+			errs = append(errs, fmt.Errorf("%s: expected %q, got %q", expected.Request, expected.Error, actual.Error))
+		case expected.Status != actual.Status:
+			errs = append(errs, fmt.Errorf("%s: status: expected %d, got %d", expected.Request, expected.Status, actual.Status))
+		case expected.Body != actual.Body:
+			errs = append(errs, fmt.Errorf("%s: body differs, %s", expected.Request, firstDifference(expected.Body, actual.Body)))
+		}
+	}
+	for _, volume := range slices.Sorted(maps.Keys(want.Volumes)) {
+		expected, actual := want.Volumes[volume], got.Volumes[volume]
+		for _, path := range slices.Sorted(maps.Keys(expected)) {
+			digest, ok := actual[path]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Errorf("%s: %s was not written", volume, path))
+			case digest != expected[path]:
+				errs = append(errs, fmt.Errorf("%s: %s differs", volume, path))
+			}
+		}
+		for _, path := range slices.Sorted(maps.Keys(actual)) {
+			if _, ok := expected[path]; !ok {
+				errs = append(errs, fmt.Errorf("%s: %s was not expected", volume, path))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,240 @@
+package checks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestNormalize(t *testing.T) {
+	d, err := NewDifferential(types.Differential{Normalize: []types.Normalization{
+		{Pattern: `took \d+ms`, Replacement: "took <duration>"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"2024-05-01T12:30:45.123Z started", "<timestamp> started"},
+		{"2024-05-01 12:30:45+02:00 started", "<timestamp> started"},
+		{"[12:30:45.5] ready", "[<time>] ready"},
+		{"panic at 0x7ffd4b2c", "panic at <address>"},
+		{"worker PID: 4242, pid=17", "worker PID: <pid>, pid=<pid>"},
+		{"container 3f4e5d6c7b8a up", "container <id> up"},
+		{"request took 35ms", "request took <duration>"},
+		{"listening on port 8080", "listening on port 8080"},
+	}
+	for _, tt := range tests {
+		if got := d.normalize([]byte(tt.output)); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestNewDifferential(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  types.Differential
+		wantErr string
+	}{
+		{"valid", types.Differential{Requests: []types.Request{{Port: "80", Path: "/"}}, Volumes: []string{"/data"}}, ""},
+		{"invalid normalization", types.Differential{Normalize: []types.Normalization{{Pattern: "("}}}, `invalid normalization "("`},
+		{"request without port", types.Differential{Requests: []types.Request{{Path: "/health"}}}, "request /health: port is required"},
+		{"relative volume", types.Differential{Volumes: []string{"data"}}, "volume data: path must be absolute"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDifferential(tt.config)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("NewDifferential error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    types.Request
+		wantErr bool
+	}{
+		{"8080", types.Request{Method: "GET", Port: "8080", Path: "/"}, false},
+		{"8080/health", types.Request{Method: "GET", Port: "8080", Path: "/health"}, false},
+		{"post 8080/api/reset", types.Request{Method: "POST", Port: "8080", Path: "/api/reset"}, false},
+		{"/health", types.Request{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRequest(tt.spec)
+		if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+			t.Errorf("ParseRequest(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	d, err := NewDifferential(types.Differential{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Observation{
+		ExitCode: 0,
+		Stdout:   "starting\nready\n",
+		Responses: []Response{
+			{Request: "GET 8080/", Status: 200, Body: "hello"},
+			{Request: "GET 8080/missing", Status: 404},
+		},
+		Volumes: map[string]map[string]string{"/data": {"db": "a1", "logs/app.log": "b2"}},
+	}
+	tests := []struct {
+		name string
+		// change alters a copy of want into the observation compared.
+		change  func(o *Observation)
+		wantErr []string
+	}{
+		{
+			name:   "equal",
+			change: func(o *Observation) {},
+		},
+		{
+			name:    "exit code",
+			change:  func(o *Observation) { o.ExitCode = 1 },
+			wantErr: []string{"exit code: expected 0, got 1"},
+		},
+		{
+			name:    "still running",
+			change:  func(o *Observation) { o.Running = true },
+			wantErr: []string{"container running at the end: expected false, got true"},
+		},
+		{
+			name:    "output",
+			change:  func(o *Observation) { o.Stdout, o.Stderr = "starting\nerror\n", "warning" },
+			wantErr: []string{`stdout differs, line 2: expected "ready", got "error"`, `stderr differs, line 1: expected "", got "warning"`},
+		},
+		{
+			name: "responses",
+			change: func(o *Observation) {
+				o.Responses = []Response{{Request: "GET 8080/", Status: 200, Body: "bye"}}
+			},
+			wantErr: []string{`GET 8080/: body differs, line 1: expected "hello", got "bye"`, "GET 8080/missing: no response"},
+		},
+		{
+			name: "status and error",
+			change: func(o *Observation) {
+				o.Responses = []Response{{Request: "GET 8080/", Status: 500}, {Request: "GET 8080/missing", Error: "no response"}}
+			},
+			wantErr: []string{"GET 8080/: status: expected 200, got 500", `GET 8080/missing: expected "", got "no response"`},
+		},
+		{
+			name: "volumes",
+			change: func(o *Observation) {
+				o.Volumes = map[string]map[string]string{"/data": {"db": "c3", "tmp/lock": "d4"}}
+			},
+			wantErr: []string{"/data: db differs", "/data: logs/app.log was not written", "/data: tmp/lock was not expected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := want
+			got.Responses = append([]Response{}, want.Responses...)
+			got.Volumes = map[string]map[string]string{"/data": {"db": "a1", "logs/app.log": "b2"}}
+			tt.change(&got)
+			err := d.Compare(want, got)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Compare: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Compare passed, want %q", tt.wantErr)
+			}
+			if lines := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(lines, tt.wantErr) {
+				t.Errorf("Compare errors = %q, want %q", lines, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDifferentialRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path + " at 2024-05-01T12:30:45Z"))
+	}))
+	defer server.Close()
+	d, err := NewDifferential(types.Differential{
+		Requests: []types.Request{{Port: "8080", Path: "/"}, {Port: "8080", Method: "POST", Path: "/reset"}},
+		Volumes:  []string{"/data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run observes a container writing contents to db in its volume.
+	run := func(contents string) Observation {
+		fake := &engine.Fake{
+			HostAddrFunc: func(port string) (string, error) {
+				return strings.TrimPrefix(server.URL, "http://"), nil
+			},
+			RunFunc: func(opts engine.RunOptions) (engine.RunResult, error) {
+				if !reflect.DeepEqual(opts.Ports, []string{"9090", "8080", "8080"}) {
+					t.Errorf("ports = %q", opts.Ports)
+				}
+				dir, volume, _ := strings.Cut(opts.Binds[len(opts.Binds)-1], ":")
+				if volume != "/data" {
+					t.Errorf("binds = %q", opts.Binds)
+				}
+				os.MkdirAll(filepath.Join(dir, "logs"), 0755)
+				os.WriteFile(filepath.Join(dir, "db"), []byte(contents), 0644)
+				os.Symlink("../db", filepath.Join(dir, "logs", "current"))
+				return engine.RunResult{Stdout: []byte("pid 42 ready\n")}, nil
+			},
+		}
+		probed := false
+		observation, _, err := d.Run(context.Background(), fake, engine.RunOptions{
+			Image: "app", Ports: []string{"9090"}, Binds: []string{"/etc/app:/config"},
+			While: func(ctx context.Context, c engine.Container) error {
+				probed = true
+				return nil
+			},
+		}, t.TempDir()+"/volumes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !probed {
+			t.Error("the probes did not run")
+		}
+		return observation
+	}
+
+	original := run("rows")
+	want := Observation{
+		Running: true,
+		Stdout:  "pid <pid> ready\n",
+		Responses: []Response{
+			{Request: "GET 8080/", Status: 200, Body: "GET / at <timestamp>"},
+			{Request: "POST 8080/reset", Status: 200, Body: "POST /reset at <timestamp>"},
+		},
+		Volumes: map[string]map[string]string{"/data": {
+			"db":           "bc51e9e65d79e1c90ba544ab2eae1044ccdf8c1af7a559ba375cba4276f7d99e",
+			"logs/current": "-> ../db",
+		}},
+	}
+	if !reflect.DeepEqual(original, want) {
+		t.Errorf("Run = %+v, want %+v", original, want)
+	}
+	if err := d.Compare(original, run("rows")); err != nil {
+		t.Errorf("Compare of the same behaviour: %v", err)
+	}
+	if err := d.Compare(original, run("other rows")); err == nil || err.Error() != "/data: db differs" {
+		t.Errorf("Compare error = %v, want the volume difference", err)
+	}
+}
@@ -0,0 +1,152 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+)
+
+// attemptTimeout bounds a single attempt of a network probe.
+const attemptTimeout = 2 * time.Second
+
+// HTTP requests Path on a published port and expects Status, or any status
+// below 400, and a body matching Body when set.
+type HTTP struct {
+	Port   string
+	Path   string
+	Status int
+	Body   *regexp.Regexp
+}
+
+func (h *HTTP) String() string {
+	return "http " + h.Port + h.Path
+}
+
+func (h *HTTP) Probe(ctx context.Context, c engine.Container) error {
+	addr, err := c.HostAddr(ctx, h.Port)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+h.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if h.Status != 0 && resp.StatusCode != h.Status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, h.Status)
+	}
+	if h.Status == 0 && resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if h.Body != nil && !h.Body.Match(body) {
+		return fmt.Errorf("body does not match %q", h.Body)
+	}
+	return nil
+}
+
+// TCP connects to a published port.
+type TCP struct {
+	Port string
+}
+
+func (t *TCP) String() string {
+	return "tcp " + t.Port
+}
+
+func (t *TCP) Probe(ctx context.Context, c engine.Container) error {
+	addr, err := c.HostAddr(ctx, t.Port)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{Timeout: attemptTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Exec runs Command inside the container and expects ExitCode and, when set,
+// output matching Output.
+type Exec struct {
+	Command  []string
+	ExitCode int
+	Output   *regexp.Regexp
+}
+
+func (e *Exec) String() string {
+	return "exec " + strings.Join(e.Command, " ")
+}
+
+func (e *Exec) Probe(ctx context.Context, c engine.Container) error {
+	result, err := c.Exec(ctx, e.Command)
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != e.ExitCode {
+		return fmt.Errorf("exited with code %d, expected %d", result.ExitCode, e.ExitCode)
+	}
+	if e.Output != nil && !e.Output.Match(result.Stdout) && !e.Output.Match(result.Stderr) {
+		return fmt.Errorf("output does not match %q", e.Output)
+	}
+	return nil
+}
+
+// Output expects the stdout or stderr Stream of the container to match
+// Pattern.
+type Output struct {
+	Stream  string
+	Pattern *regexp.Regexp
+}
+
+func (o *Output) String() string {
+	return o.Stream + " " + o.Pattern.String()
+}
+
+func (o *Output) Verify(result engine.RunResult) error {
+	output := result.Stdout
+	if o.Stream == "stderr" {
+		output = result.Stderr
+	}
+	if !o.Pattern.Match(output) {
+		return fmt.Errorf("%s does not match %q", o.Stream, o.Pattern)
+	}
+	return nil
+}
+
+// ExitCode expects the container to exit on its own with Code.
+type ExitCode struct {
+	Code int
+}
+
+func (e *ExitCode) String() string {
+	return fmt.Sprintf("exit code %d", e.Code)
+}
+
+func (e *ExitCode) Verify(result engine.RunResult) error {
+	if result.TimedOut || result.Stopped {
+		return errors.New("container was still running")
+	}
+	if result.ExitCode != e.Code {
+		return fmt.Errorf("exited with code %d", result.ExitCode)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// probe runs the probe described by config once against a container of
+// fake, whose port 8080 is published at addr.
+func probe(t *testing.T, fake *engine.Fake, addr string, config types.Check) error {
+	t.Helper()
+	check, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.HostAddrFunc = func(port string) (string, error) {
+		if port != "8080" {
+			return "", errors.New("port " + port + " is not published")
+		}
+		return addr, nil
+	}
+	var probeErr error
+	fake.Run(context.Background(), engine.RunOptions{Name: "app", While: func(ctx context.Context, c engine.Container) error {
+		probeErr = check.(Probe).Probe(ctx, c)
+		return nil
+	}})
+	return probeErr
+}
+
+// checkErr reports err unless it is the error wanted, none when empty.
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+		t.Errorf("Probe error = %v, want %q", err, want)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.Write([]byte(`{"status": "up"}`))
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/redirect":
+			http.Redirect(w, r, "/health", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name    string
+		config  types.Check
+		wantErr string
+	}{
+		{name: "any status below 400", config: types.Check{Type: "http", Port: "8080", Path: "/created"}},
+		{name: "redirect followed", config: types.Check{Type: "http", Port: "8080", Path: "redirect", Status: 200}},
+		{name: "status", config: types.Check{Type: "http", Port: "8080", Path: "/created", Status: 200}, wantErr: "status 201, expected 200"},
+		{name: "not found", config: types.Check{Type: "http", Port: "8080", Path: "/missing"}, wantErr: "status 404"},
+		{name: "body", config: types.Check{Type: "http", Port: "8080", Path: "/health", Pattern: `"status": "up"`}},
+		{name: "body mismatch", config: types.Check{Type: "http", Port: "8080", Path: "/health", Pattern: "down"}, wantErr: `body does not match "down"`},
+		{name: "unpublished port", config: types.Check{Type: "http", Port: "9090"}, wantErr: "port 9090 is not published"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErr(t, probe(t, &engine.Fake{}, addr, tt.config), tt.wantErr)
+		})
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	config := types.Check{Type: "tcp", Port: "8080"}
+	checkErr(t, probe(t, &engine.Fake{}, addr, config), "")
+	listener.Close()
+	checkErr(t, probe(t, &engine.Fake{}, addr, config), "connection refused")
+	checkErr(t, probe(t, &engine.Fake{}, addr, types.Check{Type: "tcp", Port: "5432"}), "port 5432 is not published")
+}
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  types.Check
+		result  engine.ExecResult
+		err     error
+		wantErr string
+	}{
+		{
+			name:   "exit code",
+			config: types.Check{Type: "exec", Command: []string{"pg_isready"}},
+		},
+		{
+			name:    "unexpected exit code",
+			config:  types.Check{Type: "exec", Command: []string{"pg_isready"}},
+			result:  engine.ExecResult{ExitCode: 2},
+			wantErr: "exited with code 2, expected 0",
+		},
+		{
+			name:   "expected exit code",
+			config: types.Check{Type: "exec", Command: []string{"test", "-e", "/tmp/lock"}, ExitCode: 1},
+			result: engine.ExecResult{ExitCode: 1},
+		},
+		{
+			name:   "output on stderr",
+			config: types.Check{Type: "exec", Command: []string{"app", "--version"}, Pattern: `^app \d+`},
+			result: engine.ExecResult{Stderr: []byte("app 2.1\n")},
+		},
+		{
+			name:    "output mismatch",
+			config:  types.Check{Type: "exec", Command: []string{"app", "--version"}, Pattern: `^app \d+`},
+			result:  engine.ExecResult{Stdout: []byte("usage: app\n")},
+			wantErr: `output does not match "^app \\d+"`,
+		},
+		{
+			name:    "exec fails",
+			config:  types.Check{Type: "exec", Command: []string{"pg_isready"}},
+			err:     errors.New("container is not running"),
+			wantErr: "container is not running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &engine.Fake{ExecFunc: func(cmd []string) (engine.ExecResult, error) {
+				return tt.result, tt.err
+			}}
+			checkErr(t, probe(t, fake, "", tt.config), tt.wantErr)
+			if want := "exec app " + strings.Join(tt.config.Command, " "); fake.Calls[1] != want {
+				t.Errorf("calls = %q, want %q", fake.Calls, want)
+			}
+		})
+	}
+}
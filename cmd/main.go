@@ -1,35 +1,208 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
+
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/regelepuma/dockerminimizer"
+	"github.com/regelepuma/dockerminimizer/checks"
+	"github.com/regelepuma/dockerminimizer/config"
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/oci"
+	"github.com/regelepuma/dockerminimizer/packs"
+	"github.com/regelepuma/dockerminimizer/strace"
 	"github.com/regelepuma/dockerminimizer/types"
 )
 
-func parseArgs(runFunc func(args types.Args)) *cobra.Command {
+func parseArgs(runFunc func(args types.Args) error) *cobra.Command {
 	var args types.Args
+	var configPath string
+	var checkSpecs, requestSpecs, normalizations, workloadCommands []string
+	var sidecarCommand, runArgs string
 	cmd := &cobra.Command{
 		Use:   "dockerminimizer",
 		Short: "A tool to minimize Dockerfiles by determining the dependencies of the containerized application",
-		Run: func(cmd *cobra.Command, _ []string) {
-			runFunc(args)
+		// main prints the error.
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			// The arguments parsed, errors from here on are not usage errors.
+			cmd.SilenceUsage = true
+			for _, spec := range checkSpecs {
+				check, err := checks.Parse(spec)
+				if err != nil {
+					return err
+				}
+				args.Checks = append(args.Checks, check)
+			}
+			for _, spec := range requestSpecs {
+				request, err := checks.ParseRequest(spec)
+				if err != nil {
+					return err
+				}
+				args.Differential.Requests = append(args.Differential.Requests, request)
+			}
+			for _, pattern := range normalizations {
+				args.Differential.Normalize = append(args.Differential.Normalize,
+					types.Normalization{Pattern: pattern, Replacement: "<normalized>"})
+			}
+			for _, command := range workloadCommands {
+				args.Workload.Exec = append(args.Workload.Exec, strings.Fields(command))
+			}
+			args.Workload.Sidecar.Cmd = strings.Fields(sidecarCommand)
+			args.RunArgs = strings.Fields(runArgs)
+			if configPath == "" {
+				if _, err := os.Stat(config.DefaultPath); err == nil {
+					configPath = config.DefaultPath
+				}
+			}
+			if configPath == "" {
+				return runFunc(args)
+			}
+			merged, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			cmd.Flags().Visit(func(flag *pflag.Flag) {
+				mergeFlag(&merged, args, flag.Name)
+			})
+			if merged.Dockerfile == "" && merged.Image == "" {
+				merged.Dockerfile = config.DefaultDockerfile(configPath)
+			}
+			return runFunc(merged)
 		},
 	}
 
-	cmd.Flags().StringVarP(&args.Dockerfile, "file", "f", "./Dockerfile", "Path to the Dockerfile")
+	cmd.Flags().StringVarP(&configPath, "config", "c", "",
+		"Path to the project file, defaults to "+config.DefaultPath+" if it exists, flags override its settings")
+
+	cmd.Flags().StringVarP(&args.Dockerfile, "file", "f", "",
+		"Path to the Dockerfile, ./Dockerfile unless an image is given; --file and --image are exclusive")
 	cmd.Flags().StringVarP(&args.Image, "image", "i", "", "Name of the Docker image")
-	cmd.Flags().IntVar(&args.MaxLimit, "max_limit", 10, "Number of binary search steps")
+	cmd.Flags().IntVar(&args.MaxLimit, "max_limit", 10, "Maximum number of image builds during binary search")
 	cmd.Flags().BoolVar(&args.Debug, "debug", false, "Enable debug mode")
 	cmd.Flags().IntVar(&args.Timeout, "timeout", 30, "How long the container should run before being declared healthy")
 	cmd.Flags().StringVar(&args.StracePath, "strace_path", "/usr/local/bin/strace", "Path to the statically linked strace binary")
+	cmd.Flags().StringSliceVar(&args.Syscalls, "syscalls", nil,
+		"System calls to trace during dynamic analysis, strace classes such as %file are accepted (default: "+strings.Join(strace.DefaultSyscalls, ",")+")")
 	cmd.Flags().BoolVar(&args.BinarySearch, "binary_search", true, "Continue with binary search if dynamic analysis fails")
+	cmd.Flags().StringArrayVar(&checkSpecs, "check", nil,
+		"Health check minimized images have to pass, repeatable: http:PORT[/PATH][=STATUS], tcp:PORT, exec:COMMAND, "+
+			"stdout:REGEX, stderr:REGEX or exit_code:CODE")
+	cmd.Flags().BoolVar(&args.Differential.Enabled, "differential", false,
+		"Validate minimized images by comparing their behaviour with the original image")
+	cmd.Flags().StringArrayVar(&requestSpecs, "request", nil,
+		"HTTP request sent to the original and the minimized containers during differential validation, repeatable: [METHOD ]PORT[/PATH]")
+	cmd.Flags().StringArrayVar(&normalizations, "normalize", nil,
+		"Regular expression masked in output before differential comparison, repeatable")
+	cmd.Flags().StringArrayVar(&args.Differential.Volumes, "output_volume", nil,
+		"Directory inside the container whose written files are compared during differential validation, repeatable")
+	cmd.Flags().StringArrayVar(&workloadCommands, "workload_exec", nil,
+		"Command executed inside the container while tracing and validating to exercise the application, repeatable")
+	cmd.Flags().StringVar(&args.Workload.Sidecar.Image, "workload_sidecar", "",
+		"Image run in the network namespace of the container while tracing and validating, it has to exit with code 0")
+	cmd.Flags().StringVar(&sidecarCommand, "workload_sidecar_cmd", "", "Command of the workload sidecar")
+	cmd.Flags().StringArrayVar(&args.Workload.Sidecar.Env, "workload_sidecar_env", nil,
+		"Environment variable of the workload sidecar, repeatable: NAME=VALUE")
+	cmd.Flags().StringSliceVar(&args.Stages, "stages", nil,
+		"Analysis stages to run in order, join stages with + to run them as one (default: "+strings.Join(config.Stages, ",")+")")
+	cmd.Flags().StringVar(&args.Validation, "validation", config.ValidateEach,
+		"When to validate: each to validate after every stage, end to validate once after all stages")
+	cmd.Flags().StringArrayVar(&args.Keep, "keep", nil,
+		"Glob pattern of paths copied into the minimized image whatever the analysis finds, repeatable, e.g. /etc/ssl/certs/**")
+	cmd.Flags().StringArrayVar(&args.Drop, "drop", nil,
+		"Glob pattern of paths left out of the minimized image whatever the analysis finds or --keep matches, repeatable, e.g. /usr/share/man/**")
+	cmd.Flags().StringArrayVar(&args.Packs, "pack", nil,
+		"Knowledge pack whose keep rules apply, repeatable: NAME[@VERSION] with NAME one of "+
+			strings.Join(packs.Names(), ", ")+", or "+packs.Auto+" for every pack detected in the image")
+	cmd.Flags().StringArrayVarP(&args.Env, "env", "e", nil,
+		"Environment variable of the container while tracing and validating, repeatable: NAME=VALUE")
+	cmd.Flags().StringVar(&runArgs, "run_args", "", "Arguments replacing the CMD of the image while tracing and validating")
+	cmd.Flags().StringVar(&args.Runtime, "runtime", "docker",
+		"Container runtime to use ("+strings.Join(engine.Runtimes, ", ")+"), Podman requires its API socket to be enabled")
+	cmd.Flags().StringVar(&args.Platform, "platform", "", "Target platform of the image, e.g. linux/arm64, defaults to the host platform")
+	cmd.Flags().StringVarP(&args.OutputDir, "output", "o", ".", "Directory to write Dockerfile.minimal and the archives it adds to")
+	cmd.Flags().StringVar(&args.OutputFormat, "output_format", config.OutputDockerfile,
+		"Output to write: dockerfile, oci for an OCI image layout as well or oci-archive for it as a tar archive; "+
+			"OCI images are validated by loading them instead of building")
+	cmd.Flags().StringVar(&args.Compression, "compression", "gzip",
+		"Compression of the layers of OCI images ("+strings.Join(oci.Compressions, ", ")+")")
 	return cmd
 }
 
+// mergeFlag overrides the setting of the project file controlled by the flag
+// name with its value in flags. A Dockerfile and an image given by the file
+// and the flags together are left for validation to reject.
+func mergeFlag(args *types.Args, flags types.Args, name string) {
+	switch name {
+	case "file":
+		args.Dockerfile = flags.Dockerfile
+	case "image":
+		args.Image = flags.Image
+	case "max_limit":
+		args.MaxLimit = flags.MaxLimit
+	case "debug":
+		args.Debug = flags.Debug
+	case "timeout":
+		args.Timeout = flags.Timeout
+	case "strace_path":
+		args.StracePath = flags.StracePath
+	case "syscalls":
+		args.Syscalls = flags.Syscalls
+	case "binary_search":
+		args.BinarySearch = flags.BinarySearch
+	case "check":
+		args.Checks = flags.Checks
+	case "differential":
+		args.Differential.Enabled = flags.Differential.Enabled
+	case "request":
+		args.Differential.Requests = flags.Differential.Requests
+	case "normalize":
+		args.Differential.Normalize = flags.Differential.Normalize
+	case "output_volume":
+		args.Differential.Volumes = flags.Differential.Volumes
+	case "workload_exec":
+		args.Workload.Exec = flags.Workload.Exec
+	case "workload_sidecar":
+		args.Workload.Sidecar.Image = flags.Workload.Sidecar.Image
+	case "workload_sidecar_cmd":
+		args.Workload.Sidecar.Cmd = flags.Workload.Sidecar.Cmd
+	case "workload_sidecar_env":
+		args.Workload.Sidecar.Env = flags.Workload.Sidecar.Env
+	case "stages":
+		args.Stages = flags.Stages
+	case "validation":
+		args.Validation = flags.Validation
+	case "keep":
+		args.Keep = flags.Keep
+	case "drop":
+		args.Drop = flags.Drop
+	case "pack":
+		args.Packs = flags.Packs
+	case "env":
+		args.Env = flags.Env
+	case "run_args":
+		args.RunArgs = flags.RunArgs
+	case "runtime":
+		args.Runtime = flags.Runtime
+	case "platform":
+		args.Platform = flags.Platform
+	case "output":
+		args.OutputDir = flags.OutputDir
+	case "output_format":
+		args.OutputFormat = flags.OutputFormat
+	case "compression":
+		args.Compression = flags.Compression
+	}
+}
+
 func main() {
 	err := parseArgs(dockerminimizer.Run).Execute()
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/config"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		project string
+		flags   []string
+		// want checks the merged arguments, which are valid unless wantErr
+		// is set.
+		want    func(t *testing.T, args types.Args)
+		wantErr string
+	}{
+		{
+			name:    "flags override the file",
+			project: "timeout: 10\nmax_limit: 4\n",
+			flags:   []string{"--timeout", "20"},
+			want: func(t *testing.T, args types.Args) {
+				if args.Timeout != 20 || args.MaxLimit != 4 {
+					t.Errorf("timeout = %d, max_limit = %d, want 20 and 4", args.Timeout, args.MaxLimit)
+				}
+				if args.Dockerfile != "Dockerfile" {
+					t.Errorf("dockerfile = %s, want the one next to the project file", args.Dockerfile)
+				}
+			},
+		},
+		{
+			name:    "image flag",
+			project: "timeout: 10\n",
+			flags:   []string{"--image", "nginx:1.27"},
+			want: func(t *testing.T, args types.Args) {
+				if args.Image != "nginx:1.27" || args.Dockerfile != "" {
+					t.Errorf("image = %q, dockerfile = %q, want the image only", args.Image, args.Dockerfile)
+				}
+			},
+		},
+		{
+			name:    "file flag",
+			project: "timeout: 10\n",
+			flags:   []string{"--file", "other/Dockerfile"},
+			want: func(t *testing.T, args types.Args) {
+				if args.Dockerfile != "other/Dockerfile" || args.Image != "" {
+					t.Errorf("image = %q, dockerfile = %q, want the Dockerfile only", args.Image, args.Dockerfile)
+				}
+			},
+		},
+		{
+			name:    "file flag and image in the file",
+			project: "image: nginx:1.27\n",
+			flags:   []string{"--file", "Dockerfile"},
+			wantErr: `image: "nginx:1.27" conflicts with dockerfile "Dockerfile"`,
+		},
+		{
+			name:    "image flag and Dockerfile in the file",
+			project: "dockerfile: Dockerfile.prod\n",
+			flags:   []string{"--image", "nginx:1.27"},
+			wantErr: `image: "nginx:1.27" conflicts with dockerfile`,
+		},
+		{
+			name:    "file and image flags",
+			flags:   []string{"--file", "Dockerfile", "--image", "nginx:1.27"},
+			wantErr: `image: "nginx:1.27" conflicts with dockerfile "Dockerfile"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if tt.project != "" {
+				if err := os.WriteFile(config.DefaultPath, []byte(tt.project), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got types.Args
+			cmd := parseArgs(func(args types.Args) error {
+				got = args
+				return nil
+			})
+			cmd.SetArgs(tt.flags)
+			if err := cmd.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			err := config.Validate(got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Validate error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want(t, got)
+		})
+	}
+}
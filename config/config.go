@@ -0,0 +1,443 @@
+// Package config reads dockerminimizer.yaml, the project file holding the
+// settings of one service, so that they can be checked in next to its
+// Dockerfile instead of being repeated on every command line.
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+
+	"github.com/regelepuma/dockerminimizer/checks"
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/oci"
+	"github.com/regelepuma/dockerminimizer/packs"
+	"github.com/regelepuma/dockerminimizer/types"
+	"github.com/regelepuma/dockerminimizer/workload"
+)
+
+// DefaultPath is the project file loaded when none is given explicitly.
+const DefaultPath = "dockerminimizer.yaml"
+
+// Languages lists the stages of the language runtime analyzers, which
+// find the modules interpreted programs load.
+var Languages = []string{"python", "node", "java", "ruby"}
+
+// Stages lists the analysis stages in the order they run by default. The
+// language analyzers run as one stage, before the ones following libraries
+// and system calls.
+var Stages = []string{"initial", strings.Join(Languages, "+"), "ldd", "strace", "binary_search"}
+
+// Validations are the values of the validation option.
+const (
+	ValidateEach  = "each"
+	ValidateAtEnd = "end"
+)
+
+// Output formats are the values of the output_format option.
+const (
+	OutputDockerfile = "dockerfile"
+	OutputOCI        = "oci"
+	OutputOCIArchive = "oci-archive"
+)
+
+// OutputFormats lists the output formats.
+var OutputFormats = []string{OutputDockerfile, OutputOCI, OutputOCIArchive}
+
+// File is the layout of the project file:
+//
+//	dockerfile: ./Dockerfile
+//	stages: [initial, ldd+strace]
+//	validation: each
+//	keep: [/etc/ssl/certs/**, /etc/nsswitch.conf]
+//	drop: [/usr/share/doc, /usr/share/man/**]
+//	packs: [glibc-nss, tzdata@1]
+//	checks:
+//	  - http:8080/health=200
+//	  - type: exec
+//	    command: pg_isready -U postgres
+//	workload:
+//	  exec: ["curl -sf localhost:8080/"]
+//	run:
+//	  env: {LOG_LEVEL: debug}
+//	  args: [serve, --port, "8080"]
+//	output: ./minimal
+//	output_format: oci-archive
+//	compression: zstd
+//
+// Keep and drop take doublestar patterns, a pattern naming a directory covers
+// its contents and drop wins over keep. Checks, requests and normalizations accept the command line
+// form as well.
+// Relative paths on the host are relative to the directory of the file.
+type File struct {
+	Dockerfile   string       `yaml:"dockerfile"`
+	Image        string       `yaml:"image"`
+	Platform     string       `yaml:"platform"`
+	Runtime      string       `yaml:"runtime"`
+	Timeout      int          `yaml:"timeout"`
+	MaxLimit     int          `yaml:"max_limit"`
+	Debug        bool         `yaml:"debug"`
+	StracePath   string       `yaml:"strace_path"`
+	Syscalls     []string     `yaml:"syscalls"`
+	Stages       []string     `yaml:"stages"`
+	Validation   string       `yaml:"validation"`
+	Keep         []string     `yaml:"keep"`
+	Drop         []string     `yaml:"drop"`
+	Packs        []string     `yaml:"packs"`
+	Checks       []check      `yaml:"checks"`
+	Workload     workloadFile `yaml:"workload"`
+	Differential differential `yaml:"differential"`
+	Run          run          `yaml:"run"`
+	Output       string       `yaml:"output"`
+	OutputFormat string       `yaml:"output_format"`
+	Compression  string       `yaml:"compression"`
+}
+
+type check types.Check
+
+func (c *check) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		config, err := checks.Parse(node.Value)
+		*c = check(config)
+		return at(node, err)
+	}
+	var fields struct {
+		Type     string  `yaml:"type"`
+		Port     string  `yaml:"port"`
+		Path     string  `yaml:"path"`
+		Status   int     `yaml:"status"`
+		Command  command `yaml:"command"`
+		Pattern  string  `yaml:"pattern"`
+		ExitCode int     `yaml:"exit_code"`
+	}
+	if err := decodeStrict(node, &fields); err != nil {
+		return err
+	}
+	*c = check{Type: fields.Type, Port: fields.Port, Path: fields.Path, Status: fields.Status,
+		Command: fields.Command, Pattern: fields.Pattern, ExitCode: fields.ExitCode}
+	return nil
+}
+
+// command is a command line, written either as a list of arguments or as a
+// string split at whitespace.
+type command []string
+
+func (c *command) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*c = strings.Fields(node.Value)
+		return nil
+	}
+	var args []string
+	err := node.Decode(&args)
+	*c = args
+	return err
+}
+
+// environment is a list of NAME=VALUE entries or a mapping of names to values.
+type environment []string
+
+func (e *environment) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		var variables []string
+		err := node.Decode(&variables)
+		*e = variables
+		return err
+	}
+	// The content of a mapping alternates keys and values, in file order.
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		*e = append(*e, node.Content[i].Value+"="+node.Content[i+1].Value)
+	}
+	return nil
+}
+
+type workloadFile struct {
+	Exec    []command `yaml:"exec"`
+	Sidecar struct {
+		Image string      `yaml:"image"`
+		Cmd   command     `yaml:"cmd"`
+		Env   environment `yaml:"env"`
+	} `yaml:"sidecar"`
+}
+
+type request types.Request
+
+func (r *request) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		config, err := checks.ParseRequest(node.Value)
+		*r = request(config)
+		return at(node, err)
+	}
+	var fields struct {
+		Port   string `yaml:"port"`
+		Method string `yaml:"method"`
+		Path   string `yaml:"path"`
+	}
+	if err := decodeStrict(node, &fields); err != nil {
+		return err
+	}
+	*r = request{Port: fields.Port, Method: fields.Method, Path: fields.Path}
+	return nil
+}
+
+type normalization types.Normalization
+
+func (n *normalization) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*n = normalization{Pattern: node.Value, Replacement: "<normalized>"}
+		return nil
+	}
+	var fields struct {
+		Pattern     string `yaml:"pattern"`
+		Replacement string `yaml:"replacement"`
+	}
+	if err := decodeStrict(node, &fields); err != nil {
+		return err
+	}
+	*n = normalization{Pattern: fields.Pattern, Replacement: fields.Replacement}
+	return nil
+}
+
+type differential struct {
+	Enabled   bool            `yaml:"enabled"`
+	Requests  []request       `yaml:"requests"`
+	Normalize []normalization `yaml:"normalize"`
+	Volumes   []string        `yaml:"volumes"`
+}
+
+type run struct {
+	Env  environment `yaml:"env"`
+	Args command     `yaml:"args"`
+}
+
+var (
+	linePrefix = regexp.MustCompile(`^line (\d+): `)
+	typeSuffix = regexp.MustCompile(` in type .*$`)
+)
+
+// at prefixes err with the line of node, as the decoder does for its own
+// errors but not for the ones of custom unmarshalers.
+func at(node *yaml.Node, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("line %d: %w", node.Line, err)
+}
+
+// cleanTypeError shifts the line numbers of err by offset and drops the Go
+// types from its messages, which mean nothing to the author of the file.
+func cleanTypeError(err error, offset int) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	for i, message := range typeErr.Errors {
+		message = typeSuffix.ReplaceAllString(message, "")
+		if match := linePrefix.FindStringSubmatch(message); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			message = fmt.Sprintf("line %d: %s", line+offset, message[len(match[0]):])
+		}
+		typeErr.Errors[i] = message
+	}
+	return typeErr
+}
+
+// decodeStrict decodes node into out, rejecting unknown fields, which
+// Node.Decode does not do on its own.
+func decodeStrict(node *yaml.Node, out any) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(out)
+	var typeErr *yaml.TypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		return at(node, err)
+	}
+	// The lines are counted from the start of node.
+	return cleanTypeError(err, node.Line-1)
+}
+
+// Load reads and validates the project file at path and returns the
+// arguments it describes. Options missing from the file keep the defaults
+// of the command line, except for the Dockerfile, which is left empty so
+// that an image can be given instead; see DefaultDockerfile.
+func Load(path string) (types.Args, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return types.Args{}, err
+	}
+	var file File
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return types.Args{}, fmt.Errorf("%s: %w", path, cleanTypeError(err, 0))
+	}
+	args := file.args(filepath.Dir(path))
+	if err := Validate(args); err != nil {
+		return args, fmt.Errorf("%s: %w", path, err)
+	}
+	return args, nil
+}
+
+// DefaultDockerfile returns the Dockerfile used when neither the project file
+// at path nor the command line names a Dockerfile or an image: the one next
+// to the project file.
+func DefaultDockerfile(path string) string {
+	return filepath.Join(filepath.Dir(path), "Dockerfile")
+}
+
+// args converts the file into arguments, resolving host paths against dir.
+func (f File) args(dir string) types.Args {
+	hostPath := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	args := types.Args{
+		Dockerfile:   hostPath(f.Dockerfile),
+		Image:        f.Image,
+		Timeout:      cmp.Or(f.Timeout, 30),
+		MaxLimit:     cmp.Or(f.MaxLimit, 10),
+		Debug:        f.Debug,
+		StracePath:   cmp.Or(hostPath(f.StracePath), "/usr/local/bin/strace"),
+		BinarySearch: true,
+		OutputDir:    cmp.Or(hostPath(f.Output), "."),
+		OutputFormat: f.OutputFormat,
+		Compression:  f.Compression,
+		Runtime:      cmp.Or(f.Runtime, "docker"),
+		Platform:     f.Platform,
+		Syscalls:     f.Syscalls,
+		Stages:       f.Stages,
+		Validation:   f.Validation,
+		Keep:         f.Keep,
+		Drop:         f.Drop,
+		Packs:        f.Packs,
+		Env:          f.Run.Env,
+		RunArgs:      f.Run.Args,
+		Differential: types.Differential{
+			Enabled: f.Differential.Enabled,
+			Volumes: f.Differential.Volumes,
+		},
+		Workload: types.Workload{
+			Sidecar: types.Sidecar{
+				Image: f.Workload.Sidecar.Image,
+				Cmd:   f.Workload.Sidecar.Cmd,
+				Env:   f.Workload.Sidecar.Env,
+			},
+		},
+	}
+	for _, c := range f.Checks {
+		args.Checks = append(args.Checks, types.Check(c))
+	}
+	for _, r := range f.Differential.Requests {
+		args.Differential.Requests = append(args.Differential.Requests, types.Request(r))
+	}
+	for _, n := range f.Differential.Normalize {
+		args.Differential.Normalize = append(args.Differential.Normalize, types.Normalization(n))
+	}
+	for _, c := range f.Workload.Exec {
+		args.Workload.Exec = append(args.Workload.Exec, c)
+	}
+	return args
+}
+
+// Validate reports every configuration error of args, naming the offending
+// option as it is spelled in the project file. Stages may name the analyzers
+// as well.
+func Validate(args types.Args, analyzers ...string) error {
+	var errs []error
+	if args.Dockerfile != "" && args.Image != "" {
+		errs = append(errs, fmt.Errorf("image: %q conflicts with dockerfile %q, set only one of them", args.Image, args.Dockerfile))
+	}
+	if args.Timeout < 0 {
+		errs = append(errs, errors.New("timeout: must be positive"))
+	}
+	if args.MaxLimit < 0 {
+		errs = append(errs, errors.New("max_limit: must be positive"))
+	}
+	if args.Runtime != "" && !slices.Contains(engine.Runtimes, args.Runtime) {
+		errs = append(errs, fmt.Errorf("runtime: unknown runtime %q, expected one of %v", args.Runtime, engine.Runtimes))
+	}
+	var known []string
+	for _, stage := range Stages {
+		known = append(known, strings.Split(stage, "+")...)
+	}
+	known = append(known, analyzers...)
+	for i, stage := range args.Stages {
+		parts := strings.Split(stage, "+")
+		for _, part := range parts {
+			if !slices.Contains(known, part) {
+				errs = append(errs, fmt.Errorf("stages[%d]: unknown stage %q, expected one of %v", i, part, known))
+			}
+		}
+		if len(parts) > 1 && slices.Contains(parts, "binary_search") {
+			errs = append(errs, fmt.Errorf("stages[%d]: binary_search cannot be combined with other stages", i))
+		}
+	}
+	if args.Validation != "" && args.Validation != ValidateEach && args.Validation != ValidateAtEnd {
+		errs = append(errs, fmt.Errorf("validation: unknown value %q, expected %s or %s", args.Validation, ValidateEach, ValidateAtEnd))
+	}
+	if args.OutputFormat != "" && !slices.Contains(OutputFormats, args.OutputFormat) {
+		errs = append(errs, fmt.Errorf("output_format: unknown format %q, expected one of %v", args.OutputFormat, OutputFormats))
+	}
+	if args.Compression != "" && !slices.Contains(oci.Compressions, args.Compression) {
+		errs = append(errs, fmt.Errorf("compression: unknown compression %q, expected one of %v", args.Compression, oci.Compressions))
+	}
+	for i, pattern := range args.Keep {
+		if err := validatePattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("keep[%d]: %w", i, err))
+		}
+	}
+	for i, pattern := range args.Drop {
+		if err := validatePattern(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("drop[%d]: %w", i, err))
+		}
+	}
+	for i, spec := range args.Packs {
+		if err := packs.Validate([]string{spec}); err != nil {
+			errs = append(errs, fmt.Errorf("packs[%d]: %w", i, err))
+		}
+	}
+	for i, check := range args.Checks {
+		if _, err := checks.New(check); err != nil {
+			errs = append(errs, fmt.Errorf("checks[%d]: %w", i, err))
+		}
+	}
+	if _, err := checks.NewDifferential(args.Differential); err != nil {
+		errs = append(errs, fmt.Errorf("differential: %w", err))
+	}
+	if err := workload.Validate(args.Workload); err != nil {
+		errs = append(errs, fmt.Errorf("workload: %w", err))
+	}
+	for i, variable := range args.Env {
+		if name, _, ok := strings.Cut(variable, "="); !ok || name == "" {
+			errs = append(errs, fmt.Errorf("run.env[%d]: %q: expected NAME=VALUE", i, variable))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validatePattern checks that pattern is an absolute doublestar pattern.
+func validatePattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("%s: pattern must be absolute", pattern)
+	}
+	if !doublestar.ValidatePattern(pattern) {
+		return fmt.Errorf("%s: invalid pattern", pattern)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// writeFile writes a project file with content to a new directory and
+// returns its path.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), DefaultPath)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeFile(t, `dockerfile: build/Dockerfile
+stages: [initial, ldd+strace]
+keep: [/etc/ssl/certs/**]
+checks:
+  - http:8080/health=200
+  - type: exec
+    command: pg_isready -U postgres
+workload:
+  exec: ["curl -sf localhost:8080/", [wget, -q, "localhost:8080/health"]]
+run:
+  env: {LOG_LEVEL: debug, A: "1"}
+  args: serve --port 8080
+output: ./minimal
+`)
+	dir := filepath.Dir(path)
+	args, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "build/Dockerfile"); args.Dockerfile != want {
+		t.Errorf("dockerfile = %s, want %s", args.Dockerfile, want)
+	}
+	if want := filepath.Join(dir, "minimal"); args.OutputDir != want {
+		t.Errorf("output = %s, want %s", args.OutputDir, want)
+	}
+	if args.Timeout != 30 || args.MaxLimit != 10 || args.Runtime != "docker" || !args.BinarySearch {
+		t.Errorf("defaults not applied: %+v", args)
+	}
+	if want := []string{"LOG_LEVEL=debug", "A=1"}; !slices.Equal(args.Env, want) {
+		t.Errorf("env = %v, want %v in file order", args.Env, want)
+	}
+	if want := []string{"serve", "--port", "8080"}; !slices.Equal(args.RunArgs, want) {
+		t.Errorf("args = %v, want %v", args.RunArgs, want)
+	}
+	if len(args.Checks) != 2 || args.Checks[0].Type != "http" || args.Checks[1].Type != "exec" ||
+		!slices.Equal(args.Checks[1].Command, []string{"pg_isready", "-U", "postgres"}) {
+		t.Errorf("checks = %+v", args.Checks)
+	}
+	if len(args.Workload.Exec) != 2 || !slices.Equal(args.Workload.Exec[1], []string{"wget", "-q", "localhost:8080/health"}) {
+		t.Errorf("workload = %+v", args.Workload.Exec)
+	}
+}
+
+func TestLoadDockerfile(t *testing.T) {
+	// The Dockerfile is left for the command line to default, an image may
+	// still be given there.
+	args, err := Load(writeFile(t, "timeout: 10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.Dockerfile != "" || args.Image != "" {
+		t.Errorf("dockerfile = %q, image = %q, want neither", args.Dockerfile, args.Image)
+	}
+	if got, want := DefaultDockerfile("/srv/app/"+DefaultPath), "/srv/app/Dockerfile"; got != want {
+		t.Errorf("DefaultDockerfile = %s, want %s", got, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// want are substrings of the error.
+		want []string
+	}{
+		{"unknown key", "timeout: 10\nstagse: [ldd]\n", []string{"line 2", "field stagse not found"}},
+		{"unknown check key", "checks:\n  - type: http\n    prot: 8080\n", []string{"line 3", "field prot not found"}},
+		{"unknown run key", "run:\n  environment: {A: b}\n", []string{"line 2", "field environment not found"}},
+		{"wrong type", "timeout: soon\n", []string{"line 1", "cannot unmarshal !!str `soon`"}},
+		{"invalid check", "timeout: 5\nchecks: [\"http:8080=ok\"]\n", []string{"line 2", `invalid status in check "http:8080=ok"`}},
+		{"unknown check type", "checks:\n  - type: grpc\n", []string{"checks[0]", `"grpc"`}},
+		{"negative timeout", "timeout: -1\n", []string{"timeout: must be positive"}},
+		{"negative max_limit", "max_limit: -3\n", []string{"max_limit: must be positive"}},
+		{"unknown runtime", "runtime: containerd\n", []string{`runtime: unknown runtime "containerd"`}},
+		{"unknown stage", "stages: [initial, lld]\n", []string{`stages[1]: unknown stage "lld"`}},
+		{"combined binary search", "stages: [ldd+binary_search]\n", []string{"stages[0]: binary_search cannot be combined"}},
+		{"unknown validation", "validation: sometimes\n", []string{`validation: unknown value "sometimes"`}},
+		{"unknown output format", "output_format: docker\n", []string{`output_format: unknown format "docker"`}},
+		{"unknown compression", "compression: lz4\n", []string{`compression: unknown compression "lz4"`}},
+		{"relative keep", "keep: [etc/passwd]\n", []string{"keep[0]: etc/passwd: pattern must be absolute"}},
+		{"invalid drop", "drop: [\"/usr/[share\"]\n", []string{"drop[0]: /usr/[share: invalid pattern"}},
+		{"invalid env", "run:\n  env: [LOG_LEVEL]\n", []string{`run.env[0]: "LOG_LEVEL": expected NAME=VALUE`}},
+		{"empty workload command", "workload:\n  exec: [\"\"]\n", []string{"workload: workload command 1 is empty"}},
+		{"sidecar without image", "workload:\n  sidecar:\n    cmd: run\n", []string{"workload: workload sidecar needs an image"}},
+		{"dockerfile and image", "dockerfile: Dockerfile\nimage: nginx\n", []string{`image: "nginx" conflicts with dockerfile`}},
+		{
+			name:    "every error at once",
+			content: "timeout: -1\nvalidation: never\n",
+			want:    []string{"timeout: must be positive", `validation: unknown value "never"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.content)
+			_, err := Load(path)
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			if !strings.HasPrefix(err.Error(), path+": ") {
+				t.Errorf("error %q does not name the file", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+			// Go types mean nothing to the author of the file.
+			if strings.Contains(err.Error(), "config.") || strings.Contains(err.Error(), "[]string") {
+				t.Errorf("error %q names Go types", err)
+			}
+		})
+	}
+}
+
+func TestValidateAnalyzers(t *testing.T) {
+	args := types.Args{Stages: []string{"initial", "custom+ldd"}}
+	if err := Validate(args); err == nil {
+		t.Error("Validate accepted an unknown stage")
+	}
+	if err := Validate(args, "custom"); err != nil {
+		t.Errorf("Validate rejected a registered analyzer: %v", err)
+	}
+}
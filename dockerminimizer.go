@@ -1,20 +1,39 @@
 package dockerminimizer
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
+	"github.com/regelepuma/dockerminimizer/analyzer"
 	binarysearch "github.com/regelepuma/dockerminimizer/binary_search"
+	"github.com/regelepuma/dockerminimizer/config"
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/languages"
 	"github.com/regelepuma/dockerminimizer/ldd"
 	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/oci"
 	"github.com/regelepuma/dockerminimizer/preprocess"
 	"github.com/regelepuma/dockerminimizer/strace"
 	"github.com/regelepuma/dockerminimizer/types"
 	"github.com/regelepuma/dockerminimizer/utils"
 )
 
-func Run(args types.Args) {
-	if args.Dockerfile == "" {
+// Options configures a minimization run.
+type Options struct {
+	types.Args
+	// Backend overrides the container runtime selected by name in
+	// Args.Runtime, e.g. with an engine.Fake in tests.
+	Backend engine.Runtime
+	// Analyzers are run by the stages naming them in Args.Stages, next to the
+	// built-in ones.
+	Analyzers []analyzer.Analyzer
+}
+
+func setDefaults(args *types.Args) {
+	if args.Dockerfile == "" && args.Image == "" {
 		args.Dockerfile = "./Dockerfile"
 	}
 	if args.MaxLimit == 0 {
@@ -29,51 +48,166 @@ func Run(args types.Args) {
 	if args.StracePath == "" {
 		args.StracePath = "/usr/local/bin/strace"
 	}
+	if len(args.Syscalls) == 0 {
+		args.Syscalls = strace.DefaultSyscalls
+	}
+	if args.OutputFormat == "" {
+		args.OutputFormat = config.OutputDockerfile
+	}
+	if args.Compression == "" {
+		args.Compression = string(oci.Gzip)
+	}
+}
+
+// loadsImages reports whether candidate images are loaded as OCI images
+// instead of built, which is the case when an OCI image is written.
+func (o Options) loadsImages() bool {
+	return o.OutputFormat == config.OutputOCI || o.OutputFormat == config.OutputOCIArchive
+}
 
+// Minimize builds the image described by opts and runs the enabled analysis
+// stages in order until one of them produces a Dockerfile that validates, or
+// all of them before validating with Validation set to end. Artifacts are
+// written to opts.OutputDir when it is set. An error is returned when setup
+// fails or no stage produced a minimal Dockerfile; the per-stage failures are
+// recorded in Result.StageErrors.
+func Minimize(ctx context.Context, opts Options) (*Result, error) {
+	setDefaults(&opts.Args)
 	logger.InitLogger()
 	log := logger.Log
 	log.Info("Starting dockerminimizer...")
 
-	imageName, envPath, metadata, err := preprocess.ProcessArgs(args)
-	if err == nil {
-		log.Error("Dockerfile is already minimal")
-		log.Info("Cleaning up...")
-		utils.Cleanup(envPath, imageName)
-		return
+	rt := opts.Backend
+	if rt == nil {
+		var err error
+		rt, err = engine.New(opts.Runtime)
+		if err != nil {
+			return nil, err
+		}
 	}
-	log.Info("Dockerfile is not minimal, starting analysis...")
-	context := filepath.Dir(args.Dockerfile)
-	files, symLinks, err := ldd.StaticAnalysis(imageName, envPath, metadata, context, args.Timeout)
-	if err == nil {
-		log.Info("Static analysis succeeded")
+	names := []string{}
+	for _, a := range opts.Analyzers {
+		names = append(names, a.Name())
+	}
+	if err := config.Validate(opts.Args, names...); err != nil {
+		return nil, err
+	}
+	result := newResult()
+	image, files, err := preprocess.ProcessArgs(ctx, rt, opts.Args)
+	defer func() {
 		log.Info("Cleaning up...")
-		utils.Cleanup(envPath, imageName)
-		return
+		utils.Cleanup(rt, image.EnvPath, image.Name)
+	}()
+	if err != nil {
+		log.Error("Preprocessing failed: ", err)
+		return nil, err
 	}
-	log.Error("Static analysis failed, continuing with dynamic analysis")
-	err = strace.DynamicAnalysis(imageName, envPath, metadata, files,
-		symLinks, args.StracePath, context, args.Timeout)
-	if err == nil {
-		_, new_err := os.Stat(envPath + "/files.tar")
-		if new_err == nil {
-			utils.CopyFile(envPath+"/files.tar", "files.tar")
+	result.SizeBefore = rootfsSize(image.EnvPath)
+	result.Packs = image.Packs
+
+	var negatives strace.Negatives
+	pipeline := opts.pipeline(rt, &negatives)
+	pipeline.Validate = func(ctx context.Context, stage string, files *types.FileSet) error {
+		utils.KeepAndDrop(image, files)
+		dockerfile := dockerfileName(stage)
+		if err := utils.CreateDockerfile(dockerfile, "Dockerfile.minimal.template", image.EnvPath, *files); err != nil {
+			return err
 		}
-		log.Info("Dynamic analysis succeeded")
-		log.Info("Cleaning up...")
-		utils.Cleanup(envPath, imageName)
-		return
+		if opts.loadsImages() {
+			tag := strings.TrimPrefix(dockerfile, "Dockerfile.minimal.")
+			return oci.Validate(ctx, rt, image, *files, tag, opts.Timeout)
+		}
+		return utils.ValidateDockerfile(ctx, rt, image, dockerfile, opts.Timeout)
 	}
-	if !args.BinarySearch {
-		utils.CopyFile(envPath+"/Dockerfile.minimal.strace", "Dockerfile.minimal")
-		log.Info("Cleaning up...")
-		utils.Cleanup(envPath, imageName)
-		return
+	outcome, err := pipeline.Run(ctx, image, files)
+	result.Absent, result.Lookups = negatives.Absent, negatives.Lookups
+	for stage, stageErr := range outcome.Errors {
+		result.StageErrors[Stage(stage)] = stageErr
 	}
-	err = binarysearch.BinarySearch(envPath, args.MaxLimit, context, args.Timeout)
-	if err != nil {
-		os.Remove("Dockerfile.minimal")
-		os.Remove("files.tar")
+	if err == nil {
+		log.Info("Stage ", outcome.Stage, " produced a valid minimal Dockerfile")
+		return result.finish(Stage(outcome.Stage), image, outcome.Files, opts.Args)
+	}
+	if ctx.Err() == nil && outcome.Stage == string(StageStrace) &&
+		!slices.ContainsFunc(pipeline.Stages, func(stage analyzer.Stage) bool { return stage.Standalone }) {
+		// Keep the unvalidated strace result as a starting point for manual tweaking.
+		result.Validated = false
+		return result.finish(StageStrace, image, outcome.Files, opts.Args)
+	}
+	return result, err
+}
+
+// pipeline builds the stages listed in Stages, in their order. Stages joined
+// with + run as one stage, merging what their analyzers find.
+func (o Options) pipeline(rt engine.Runtime, negatives *strace.Negatives) analyzer.Pipeline {
+	builtin := map[string]analyzer.Analyzer{
+		string(StageLdd): ldd.Analyzer{},
+		string(StageStrace): strace.Analyzer{Runtime: rt, StracePath: o.StracePath, Syscalls: o.Syscalls,
+			Timeout: o.Timeout, Negatives: negatives},
+		string(StageBinarySearch): binarysearch.Analyzer{Runtime: rt, MaxLimit: o.MaxLimit, Timeout: o.Timeout,
+			Load: o.loadsImages()},
+	}
+	for _, a := range slices.Concat(languages.All(), o.Analyzers) {
+		builtin[a.Name()] = a
+	}
+	stages := o.Stages
+	if len(stages) == 0 {
+		stages = config.Stages
+	}
+	pipeline := analyzer.Pipeline{AtEnd: o.Validation == config.ValidateAtEnd}
+	for _, name := range stages {
+		stage := analyzer.Stage{Name: name}
+		for _, part := range strings.Split(name, "+") {
+			switch {
+			case part == string(StageBinarySearch) && !o.BinarySearch:
+			case part == string(StageBinarySearch):
+				stage.Standalone = true
+				fallthrough
+			default:
+				if a, ok := builtin[part]; ok {
+					stage.Analyzers = append(stage.Analyzers, a)
+				}
+			}
+		}
+		if len(stage.Analyzers) == 0 && name != string(StageInitial) {
+			// Binary search is disabled.
+			continue
+		}
+		pipeline.Stages = append(pipeline.Stages, stage)
+	}
+	return pipeline
+}
+
+// dockerfileName returns the name of the Dockerfile written for stage in the
+// environment, which also gives the tag of the image built from it.
+func dockerfileName(stage string) string {
+	return "Dockerfile.minimal." + strings.ReplaceAll(stage, "+", "-")
+}
+
+// Run minimizes the image described by args and writes Dockerfile.minimal,
+// files.json, the archives it adds and the OCI image, if requested, to
+// args.OutputDir, defaulting to the current working directory.
+func Run(args types.Args) error {
+	if args.OutputDir == "" {
+		args.OutputDir = "."
 	}
-	log.Info("Cleaning up...")
-	utils.Cleanup(envPath, imageName)
+	_, err := Minimize(context.Background(), Options{Args: args})
+	return err
+}
+
+func rootfsSize(envPath string) int64 {
+	var size int64
+	filepath.WalkDir(envPath+"/rootfs", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
 }
@@ -0,0 +1,343 @@
+package dockerminimizer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/config"
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// rootfsTar returns a tar stream of a small image running /app/server.
+func rootfsTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	entries := []struct {
+		name    string
+		mode    int64
+		content string
+	}{
+		{"app/", 0755, ""},
+		{"app/server", 0755, "server"},
+		{"etc/", 0755, ""},
+		{"etc/hostname", 0644, "minimal"},
+		{"etc/passwd", 0644, "root:x:0:0::/root:/bin/sh\n"},
+		{"usr/", 0755, ""},
+		{"usr/share/", 0755, ""},
+		{"usr/share/doc/", 0755, ""},
+		{"usr/share/doc/README", 0644, "documentation"},
+	}
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: entry.mode, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if strings.HasSuffix(entry.name, "/") {
+			header.Typeflag = tar.TypeDir
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(entry.content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarPaths lists the paths of the entries of a tar stream.
+func tarPaths(r io.Reader) ([]string, error) {
+	paths := []string{}
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path.Clean("/"+header.Name))
+	}
+}
+
+// builtPaths lists the paths the minimal Dockerfile of a build adds, from the
+// archives it adds and the files it copies from the builder.
+func builtPaths(opts engine.BuildOptions) ([]string, error) {
+	dockerfile, err := os.ReadFile(opts.Dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		if archive, ok := strings.CutPrefix(line, "ADD "); ok {
+			archive, _, _ = strings.Cut(archive, " ")
+			fd, err := os.Open(opts.ExtraFiles[archive])
+			if err != nil {
+				return nil, err
+			}
+			added, err := tarPaths(fd)
+			fd.Close()
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, added...)
+		}
+		if sources, ok := strings.CutPrefix(line, "COPY --from=builder "); ok {
+			if strings.HasPrefix(sources, "--chown=") {
+				_, sources, _ = strings.Cut(sources, " ")
+			}
+			var copied []string
+			if err := json.Unmarshal([]byte(sources), &copied); err != nil {
+				return nil, err
+			}
+			paths = append(paths, copied[:len(copied)-1]...)
+		}
+	}
+	return paths, nil
+}
+
+// loadedPaths returns the tag and paths of the image of a docker-archive.
+func loadedPaths(archive io.Reader) (string, []string, error) {
+	blobs := make(map[string][]byte)
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return "", nil, err
+		}
+		blobs[header.Name] = data
+	}
+	var manifests []struct {
+		RepoTags []string
+		Layers   []string
+	}
+	if err := json.Unmarshal(blobs["manifest.json"], &manifests); err != nil {
+		return "", nil, err
+	}
+	paths := []string{}
+	for _, layer := range manifests[0].Layers {
+		added, err := tarPaths(bytes.NewReader(blobs[layer]))
+		if err != nil {
+			return "", nil, err
+		}
+		paths = append(paths, added...)
+	}
+	return manifests[0].RepoTags[0], paths, nil
+}
+
+// fakeRuntime returns a runtime whose minimized images run successfully when
+// they hold every path of needed.
+func fakeRuntime(t *testing.T, needed []string) *engine.Fake {
+	images := make(map[string][]string)
+	fake := &engine.Fake{
+		Config: types.DockerConfig{Cmd: []string{"/app/server"}},
+		Rootfs: rootfsTar(t),
+	}
+	fake.BuildFunc = func(opts engine.BuildOptions) error {
+		if !strings.Contains(opts.Tag, ":") {
+			// The original image.
+			return nil
+		}
+		paths, err := builtPaths(opts)
+		images[opts.Tag] = paths
+		return err
+	}
+	fake.LoadFunc = func(archive io.Reader) error {
+		tag, paths, err := loadedPaths(archive)
+		images[tag] = paths
+		return err
+	}
+	fake.RunFunc = func(opts engine.RunOptions) (engine.RunResult, error) {
+		for _, path := range needed {
+			if !slices.Contains(images[opts.Image], path) {
+				return engine.RunResult{ExitCode: 127, Stderr: []byte(path + ": not found")}, nil
+			}
+		}
+		return engine.RunResult{}, nil
+	}
+	return fake
+}
+
+func TestMinimize(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   types.Args
+		needed []string
+		// stage is the stage expected to produce the result, empty when
+		// none does.
+		stage   Stage
+		kept    []string
+		dropped []string
+		// calls are substrings of calls expected to be made to the runtime.
+		calls []string
+	}{
+		{
+			name:    "initial",
+			args:    types.Args{Stages: []string{"initial"}},
+			needed:  []string{"/app/server"},
+			stage:   StageInitial,
+			kept:    []string{"/app/server"},
+			dropped: []string{"/etc/passwd", "/usr/share/doc/README"},
+			calls:   []string{"build dockerminimize-"},
+		},
+		{
+			name:    "binary search",
+			args:    types.Args{Stages: []string{"initial", "binary_search"}, BinarySearch: true, MaxLimit: 100},
+			needed:  []string{"/app/server", "/etc/passwd"},
+			stage:   StageBinarySearch,
+			kept:    []string{"/app/server", "/etc/passwd"},
+			dropped: []string{"/etc/hostname", "/usr/share/doc/README"},
+			// The Dockerfile emitted is validated as well.
+			calls: []string{"Dockerfile.minimal.binary_search.1", ":binary_search "},
+		},
+		{
+			name: "binary search loading OCI images",
+			args: types.Args{Stages: []string{"initial", "binary_search"}, BinarySearch: true, MaxLimit: 100,
+				OutputFormat: config.OutputOCI},
+			needed:  []string{"/app/server", "/etc/passwd"},
+			stage:   StageBinarySearch,
+			kept:    []string{"/app/server", "/etc/passwd"},
+			dropped: []string{"/etc/hostname", "/usr/share/doc/README"},
+			calls:   []string{"load", ":binary_search "},
+		},
+		{
+			name:   "keep pattern",
+			args:   types.Args{Stages: []string{"initial"}, Keep: []string{"/etc/passwd"}},
+			needed: []string{"/app/server", "/etc/passwd"},
+			stage:  StageInitial,
+			kept:   []string{"/app/server", "/etc/passwd"},
+		},
+		{
+			name:   "nothing validates",
+			args:   types.Args{Stages: []string{"initial"}},
+			needed: []string{"/app/server", "/etc/passwd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			dir := t.TempDir()
+			tt.args.Dockerfile = filepath.Join(dir, "Dockerfile")
+			tt.args.OutputDir = filepath.Join(dir, "output")
+			if err := os.WriteFile(tt.args.Dockerfile, []byte("FROM scratch\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Mkdir(tt.args.OutputDir, 0755)
+			fake := fakeRuntime(t, tt.needed)
+
+			result, err := Minimize(context.Background(), Options{Args: tt.args, Backend: fake})
+			if tt.stage == "" {
+				if err == nil {
+					t.Fatalf("Minimize succeeded with stage %s", result.Stage)
+				}
+				if result.StageErrors[StageInitial] == nil {
+					t.Errorf("no error recorded for stage %s: %v", StageInitial, result.StageErrors)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Stage != tt.stage || !result.Validated {
+				t.Errorf("result of stage %s, validated %t, want stage %s, validated", result.Stage, result.Validated, tt.stage)
+			}
+			for _, path := range tt.kept {
+				if !result.FileSet.Has(path) {
+					t.Errorf("result lacks %s: %v", path, result.Files)
+				}
+			}
+			for _, path := range tt.dropped {
+				if result.FileSet.Has(path) {
+					t.Errorf("result keeps %s", path)
+				}
+			}
+			for _, want := range tt.calls {
+				if !slices.ContainsFunc(fake.Calls, func(call string) bool { return strings.Contains(call, want) }) {
+					t.Errorf("no call %q among %v", want, fake.Calls)
+				}
+			}
+			if _, err := os.Stat(result.DockerfilePath); err != nil {
+				t.Errorf("Dockerfile not written: %v", err)
+			}
+			if tt.args.OutputFormat == config.OutputOCI {
+				if _, err := os.Stat(filepath.Join(result.ImagePath, "index.json")); err != nil {
+					t.Errorf("OCI image layout not written: %v", err)
+				}
+			}
+			entries, _ := os.ReadDir(filepath.Join(os.Getenv("HOME"), ".dockerminimizer"))
+			if len(entries) != 0 {
+				t.Errorf("environment not cleaned up: %v", entries)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	describe := func(pipeline analyzer.Pipeline) []string {
+		var stages []string
+		for _, stage := range pipeline.Stages {
+			var names []string
+			for _, a := range stage.Analyzers {
+				names = append(names, a.Name())
+			}
+			stages = append(stages, stage.Name+": "+strings.Join(names, " "))
+		}
+		return stages
+	}
+	tests := []struct {
+		name string
+		args types.Args
+		want []string
+	}{
+		{
+			name: "default stages",
+			args: types.Args{BinarySearch: true},
+			want: []string{
+				"initial: ",
+				"python+node+java+ruby: python node java ruby",
+				"ldd: ldd",
+				"strace: strace",
+				"binary_search: binary_search",
+			},
+		},
+		{
+			name: "languages ordered and combined",
+			args: types.Args{Stages: []string{"ruby", "ldd+python", "strace"}},
+			want: []string{"ruby: ruby", "ldd+python: ldd python", "strace: strace"},
+		},
+		{
+			name: "binary search disabled",
+			args: types.Args{Stages: []string{"initial", "node", "binary_search"}},
+			want: []string{"initial: ", "node: node"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := config.Validate(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			got := describe(Options{Args: tt.args}.pipeline(&engine.Fake{}, nil))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("pipeline = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
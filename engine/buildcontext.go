@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+)
+
+// dockerfileName is the name the Dockerfile is stored under in the build context.
+const dockerfileName = ".dockerminimizer.Dockerfile"
+
+func readDockerignore(contextDir string) (*patternmatcher.PatternMatcher, error) {
+	fd, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return patternmatcher.New(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	patterns, err := ignorefile.ReadAll(fd)
+	if err != nil {
+		return nil, err
+	}
+	return patternmatcher.New(patterns)
+}
+
+func addToContext(tw *tar.Writer, name string, path string, info fs.FileInfo) error {
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = io.Copy(tw, fd)
+	return err
+}
+
+// writeBuildContext streams the build context described by opts as a tar
+// archive, honouring the .dockerignore file of the context directory.
+func writeBuildContext(w io.Writer, opts BuildOptions) error {
+	matcher, err := readDockerignore(opts.ContextDir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	err = filepath.WalkDir(opts.ContextDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opts.ContextDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		ignored, err := matcher.MatchesOrParentMatches(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		if ignored {
+			if d.IsDir() && !matcher.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return addToContext(tw, rel, path, info)
+	})
+	if err != nil {
+		return err
+	}
+	extraFiles := map[string]string{dockerfileName: opts.Dockerfile}
+	for name, path := range opts.ExtraFiles {
+		extraFiles[name] = path
+	}
+	for name, path := range extraFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := addToContext(tw, name, path, info); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
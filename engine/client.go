@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const apiVersion = "v1.41"
+
+// client speaks the Docker Engine API over a unix socket or plain TCP.
+type client struct {
+	http    *http.Client
+	baseURL string
+}
+
+type apiError struct {
+	Message string `json:"message"`
+}
+
+func newClient(host string) (*client, error) {
+	parsed, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid engine host %q: %w", host, err)
+	}
+	transport := &http.Transport{}
+	baseURL := "http://engine/" + apiVersion
+	switch parsed.Scheme {
+	case "unix":
+		socket := parsed.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	case "tcp", "http":
+		baseURL = "http://" + parsed.Host + "/" + apiVersion
+	default:
+		return nil, fmt.Errorf("unsupported engine host scheme %q", parsed.Scheme)
+	}
+	return &client{http: &http.Client{Transport: transport}, baseURL: baseURL}, nil
+}
+
+func (c *client) do(ctx context.Context, method string, path string, query url.Values,
+	body io.Reader, contentType string) (*http.Response, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var apiErr apiError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
+			return nil, fmt.Errorf("%s %s: %s", method, path, apiErr.Message)
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// doJSON sends in as JSON, if not nil, and decodes the response into out, if not nil.
+func (c *client) doJSON(ctx context.Context, method string, path string, query url.Values, in any, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = strings.NewReader(string(data))
+		contentType = "application/json"
+	}
+	resp, err := c.do(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type jsonMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// readJSONMessages consumes a stream of progress messages, such as the output
+// of a build, passing every line of output to logLine and returning the first
+// error reported by the engine.
+func readJSONMessages(r io.Reader, logLine func(string)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg jsonMessage
+		err := decoder.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(strings.TrimSpace(msg.Error))
+		}
+		if msg.ErrorDetail.Message != "" {
+			return errors.New(strings.TrimSpace(msg.ErrorDetail.Message))
+		}
+		for _, text := range []string{msg.Stream, msg.Status} {
+			for line := range strings.Lines(text) {
+				if line = strings.TrimRight(line, "\r\n"); line != "" {
+					logLine(line)
+				}
+			}
+		}
+	}
+}
+
+// demultiplex splits the multiplexed stdout/stderr stream returned for
+// containers without a TTY into its two components.
+func demultiplex(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		dest := stdout
+		if header[0] == 2 {
+			dest = stderr
+		}
+		if _, err := io.CopyN(dest, r, size); err != nil {
+			return err
+		}
+	}
+}
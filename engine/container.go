@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dockerContainer implements Container for containers run by Docker.
+type dockerContainer struct {
+	docker *Docker
+	id     string
+}
+
+func (c *dockerContainer) ID() string {
+	return c.id
+}
+
+type execCreateRequest struct {
+	Cmd          []string `json:"Cmd"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+}
+
+func (c *dockerContainer) Exec(ctx context.Context, cmd []string) (ExecResult, error) {
+	result := ExecResult{}
+	var created createResponse
+	err := c.docker.client.doJSON(ctx, "POST", "/containers/"+c.id+"/exec", nil, execCreateRequest{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, &created)
+	if err != nil {
+		return result, err
+	}
+	resp, err := c.docker.client.do(ctx, "POST", "/exec/"+created.ID+"/start", nil,
+		strings.NewReader(`{"Detach": false, "Tty": false}`), "application/json")
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	var stdout, stderr bytes.Buffer
+	if err := demultiplex(resp.Body, &stdout, &stderr); err != nil {
+		return result, err
+	}
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	err = c.docker.client.doJSON(ctx, "GET", "/exec/"+created.ID+"/json", nil, nil, &inspect)
+	result.ExitCode = inspect.ExitCode
+	return result, err
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+func (c *dockerContainer) HostAddr(ctx context.Context, port string) (string, error) {
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+	var inspect struct {
+		NetworkSettings struct {
+			Ports map[string][]portBinding `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := c.docker.client.doJSON(ctx, "GET", "/containers/"+c.id+"/json", nil, nil, &inspect); err != nil {
+		return "", err
+	}
+	for _, binding := range inspect.NetworkSettings.Ports[port] {
+		if binding.HostPort == "" {
+			continue
+		}
+		host := binding.HostIP
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		return net.JoinHostPort(host, binding.HostPort), nil
+	}
+	return "", fmt.Errorf("port %s is not published", port)
+}
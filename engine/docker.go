@@ -0,0 +1,417 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+var log = logger.Log
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// stopTimeout is the grace period, in seconds, given to containers on stop.
+const stopTimeout = "5"
+
+// Docker implements Runtime on top of the Docker Engine API.
+type Docker struct {
+	client *client
+}
+
+// NewDocker connects to the engine at DOCKER_HOST, or at the default unix
+// socket when it is not set.
+func NewDocker() (*Docker, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = defaultDockerHost
+	}
+	client, err := newClient(host)
+	if err != nil {
+		return nil, err
+	}
+	return &Docker{client: client}, nil
+}
+
+func (d *Docker) Build(ctx context.Context, opts BuildOptions) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeBuildContext(writer, opts))
+	}()
+	defer reader.Close()
+
+	query := url.Values{}
+	query.Set("dockerfile", dockerfileName)
+	query.Set("t", opts.Tag)
+	query.Set("rm", "1")
+	query.Set("forcerm", "1")
+	if opts.Platform != "" {
+		query.Set("platform", opts.Platform)
+	}
+	log.Info("Building image ", opts.Tag, " from ", opts.Dockerfile)
+	resp, err := d.client.do(ctx, "POST", "/build", query, reader, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readJSONMessages(resp.Body, func(line string) {
+		log.Info(line)
+	})
+}
+
+type createRequest struct {
+	Image        string              `json:"Image"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   hostConfig          `json:"HostConfig"`
+}
+
+type hostConfig struct {
+	Binds        []string                 `json:"Binds,omitempty"`
+	CapAdd       []string                 `json:"CapAdd,omitempty"`
+	SecurityOpt  []string                 `json:"SecurityOpt,omitempty"`
+	PortBindings map[string][]portBinding `json:"PortBindings,omitempty"`
+	NetworkMode  string                   `json:"NetworkMode,omitempty"`
+}
+
+// publish binds every port to an ephemeral port of the host loopback interface.
+func publish(ports []string) (map[string]struct{}, map[string][]portBinding) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	exposed := make(map[string]struct{})
+	bindings := make(map[string][]portBinding)
+	for _, port := range ports {
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		exposed[port] = struct{}{}
+		bindings[port] = []portBinding{{HostIP: "127.0.0.1"}}
+	}
+	return exposed, bindings
+}
+
+type createResponse struct {
+	ID string `json:"Id"`
+}
+
+type waitResponse struct {
+	StatusCode int `json:"StatusCode"`
+	Error      *struct {
+		Message string `json:"Message"`
+	} `json:"Error"`
+}
+
+func (d *Docker) create(ctx context.Context, name string, platform string, req createRequest) (string, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if platform != "" {
+		query.Set("platform", platform)
+	}
+	var resp createResponse
+	if err := d.client.doJSON(ctx, "POST", "/containers/create", query, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (d *Docker) remove(id string) {
+	query := url.Values{}
+	query.Set("force", "1")
+	query.Set("v", "1")
+	// The caller's context may already be cancelled, the container must go regardless.
+	err := d.client.doJSON(context.Background(), "DELETE", "/containers/"+id, query, nil, nil)
+	if err != nil {
+		log.Error("Failed to remove container ", id, ": ", err)
+	}
+}
+
+func (d *Docker) ExportRootfs(ctx context.Context, image string, platform string, w io.Writer) error {
+	// The container is never started, the command only has to satisfy create.
+	id, err := d.create(ctx, "", platform, createRequest{Image: image, Cmd: []string{"/"}})
+	if err != nil {
+		return err
+	}
+	defer d.remove(id)
+	resp, err := d.client.do(ctx, "GET", "/containers/"+id+"/export", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// splitReference splits an image reference into the repository and the tag
+// or digest the create endpoint expects, defaulting to the latest tag.
+func splitReference(reference string) (string, string) {
+	if repository, digest, ok := strings.Cut(reference, "@"); ok {
+		return repository, digest
+	}
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		return reference[:i], reference[i+1:]
+	}
+	return reference, "latest"
+}
+
+func (d *Docker) Pull(ctx context.Context, image string, platform string) error {
+	err := d.client.doJSON(ctx, "GET", "/images/"+image+"/json", nil, nil, nil)
+	if err == nil {
+		return nil
+	}
+	repository, tag := splitReference(image)
+	query := url.Values{}
+	query.Set("fromImage", repository)
+	query.Set("tag", tag)
+	if platform != "" {
+		query.Set("platform", platform)
+	}
+	log.Info("Pulling image ", image)
+	resp, err := d.client.do(ctx, "POST", "/images/create", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readJSONMessages(resp.Body, func(line string) {
+		log.Info(line)
+	})
+}
+
+func (d *Docker) Load(ctx context.Context, archive io.Reader) error {
+	query := url.Values{}
+	query.Set("quiet", "1")
+	resp, err := d.client.do(ctx, "POST", "/images/load", query, archive, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return readJSONMessages(resp.Body, func(line string) {
+		log.Info(line)
+	})
+}
+
+func (d *Docker) InspectConfig(ctx context.Context, image string) (types.DockerConfig, error) {
+	var resp struct {
+		Config types.DockerConfig `json:"Config"`
+	}
+	err := d.client.doJSON(ctx, "GET", "/images/"+image+"/json", nil, nil, &resp)
+	return resp.Config, err
+}
+
+func (d *Docker) wait(ctx context.Context, id string) (int, error) {
+	var resp waitResponse
+	if err := d.client.doJSON(ctx, "POST", "/containers/"+id+"/wait", nil, nil, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Error != nil && resp.Error.Message != "" {
+		return resp.StatusCode, errors.New(resp.Error.Message)
+	}
+	return resp.StatusCode, nil
+}
+
+// streamLogs follows the output of the container until it stops, logging
+// every line as it arrives.
+func (d *Docker) streamLogs(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+	query := url.Values{}
+	query.Set("follow", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	resp, err := d.client.do(ctx, "GET", "/containers/"+id+"/logs", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	logWriter := log.WriterLevel(logrus.InfoLevel)
+	defer logWriter.Close()
+	return demultiplex(resp.Body, io.MultiWriter(stdout, logWriter), io.MultiWriter(stderr, logWriter))
+}
+
+func (d *Docker) Run(ctx context.Context, opts RunOptions) (RunResult, error) {
+	result := RunResult{}
+	exposed, bindings := publish(opts.Ports)
+	id, err := d.create(ctx, opts.Name, opts.Platform, createRequest{
+		Image:        opts.Image,
+		Entrypoint:   opts.Entrypoint,
+		Cmd:          opts.Cmd,
+		Env:          opts.Env,
+		ExposedPorts: exposed,
+		HostConfig: hostConfig{
+			Binds:        opts.Binds,
+			CapAdd:       opts.CapAdd,
+			SecurityOpt:  opts.SecurityOpt,
+			PortBindings: bindings,
+			NetworkMode:  opts.NetworkMode,
+		},
+	})
+	if err != nil {
+		return result, err
+	}
+	result.ContainerID = id
+	defer d.remove(id)
+	if err := d.client.doJSON(ctx, "POST", "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return result, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := d.streamLogs(context.Background(), id, &stdout, &stderr); err != nil {
+			log.Error("Failed to stream container logs: ", err)
+		}
+	}()
+
+	waitCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	// whileCtx ends when the container exits; stopWait ends the wait once
+	// While returned, so that the container is stopped.
+	whileCtx, cancelWhile := context.WithCancel(waitCtx)
+	defer cancelWhile()
+	waitCtx, stopWait := context.WithCancel(waitCtx)
+	defer stopWait()
+	var whileDone chan struct{}
+	if opts.While != nil {
+		whileDone = make(chan struct{})
+		go func() {
+			defer close(whileDone)
+			result.WhileErr = opts.While(whileCtx, &dockerContainer{docker: d, id: id})
+			stopWait()
+		}()
+	}
+
+	result.ExitCode, err = d.wait(waitCtx, id)
+	if err != nil && waitCtx.Err() != nil {
+		result.TimedOut = errors.Is(waitCtx.Err(), context.DeadlineExceeded)
+		result.Stopped = !result.TimedOut && ctx.Err() == nil
+		if result.TimedOut {
+			log.Info("Container ", opts.Name, " still running after ", opts.Timeout, ", stopping it")
+		}
+		query := url.Values{}
+		query.Set("t", stopTimeout)
+		d.client.doJSON(context.Background(), "POST", "/containers/"+id+"/stop", query, nil, nil)
+		result.ExitCode, _ = d.wait(context.Background(), id)
+		err = nil
+	}
+	cancelWhile()
+	if whileDone != nil {
+		<-whileDone
+	}
+	wg.Wait()
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return result, err
+}
+
+// Paths strace and its log file are mounted at inside traced containers.
+const (
+	straceBinary = "/usr/bin/strace"
+	straceLog    = "/log.txt"
+)
+
+// traceCommand returns cmd wrapped in strace, logging to the mounted log file.
+func traceCommand(opts TraceOptions, cmd []string) []string {
+	return slices.Concat([]string{straceBinary}, opts.Args, []string{"-o", straceLog}, cmd)
+}
+
+// tracedContainer executes commands in a traced container under strace,
+// appending to the log of the traced command.
+type tracedContainer struct {
+	Container
+	opts TraceOptions
+}
+
+func (c tracedContainer) Exec(ctx context.Context, cmd []string) (ExecResult, error) {
+	return c.Container.Exec(ctx, slices.Concat([]string{straceBinary}, c.opts.Args, []string{"-A", "-o", straceLog}, cmd))
+}
+
+// traceRunOptions wraps the traced command, and the commands While executes,
+// in strace, mounting the binary and its log file and granting the container
+// the right to ptrace. bindSuffix is appended to both bind mounts.
+func traceRunOptions(opts TraceOptions, bindSuffix string) RunOptions {
+	run := opts.RunOptions
+	command := traceCommand(opts, opts.Cmd)
+	run.Entrypoint, run.Cmd = command[:1], command[1:]
+	run.Binds = slices.Concat(run.Binds, []string{
+		opts.StracePath + ":" + straceBinary + bindSuffix,
+		opts.LogPath + ":" + straceLog + bindSuffix,
+	})
+	run.CapAdd = append(slices.Clone(run.CapAdd), "SYS_PTRACE")
+	run.SecurityOpt = append(slices.Clone(run.SecurityOpt), "seccomp=unconfined")
+	if while := opts.While; while != nil {
+		run.While = func(ctx context.Context, c Container) error {
+			return while(ctx, tracedContainer{c, opts})
+		}
+	}
+	return run
+}
+
+func (d *Docker) Trace(ctx context.Context, opts TraceOptions) (RunResult, error) {
+	return d.Run(ctx, traceRunOptions(opts, ""))
+}
+
+func (d *Docker) Rootless(ctx context.Context) (bool, error) {
+	var info struct {
+		SecurityOptions []string `json:"SecurityOptions"`
+	}
+	if err := d.client.doJSON(ctx, "GET", "/info", nil, nil, &info); err != nil {
+		return false, err
+	}
+	return slices.Contains(info.SecurityOptions, "name=rootless"), nil
+}
+
+type imageSummary struct {
+	ID       string   `json:"Id"`
+	RepoTags []string `json:"RepoTags"`
+}
+
+func (d *Docker) RemoveImages(ctx context.Context, reference string) error {
+	filters, _ := json.Marshal(map[string][]string{"reference": {reference}})
+	query := url.Values{}
+	query.Set("filters", string(filters))
+	var images []imageSummary
+	if err := d.client.doJSON(ctx, "GET", "/images/json", query, nil, &images); err != nil {
+		return err
+	}
+	tags := []string{}
+	for _, image := range images {
+		tags = append(tags, image.RepoTags...)
+	}
+	return d.removeTags(ctx, tags)
+}
+
+func (d *Docker) removeTags(ctx context.Context, tags []string) error {
+	var errs []error
+	for _, tag := range tags {
+		log.Info("Removing image ", tag)
+		query := url.Values{}
+		query.Set("force", "1")
+		err := d.client.doJSON(ctx, "DELETE", "/images/"+tag, query, nil, nil)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
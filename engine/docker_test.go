@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestTraceRunOptions(t *testing.T) {
+	opts := TraceOptions{
+		RunOptions: RunOptions{
+			Image: "app",
+			Cmd:   []string{"/app/server", "--port", "80"},
+			Binds: []string{"/data:/data"},
+			While: func(ctx context.Context, c Container) error {
+				_, err := c.Exec(ctx, []string{"curl", "-sf", "localhost/"})
+				return err
+			},
+		},
+		StracePath: "/env/strace",
+		LogPath:    "/env/log.txt",
+		Args:       []string{"-f", "-e", "trace=open"},
+	}
+	run := traceRunOptions(opts, ":z")
+	if got, want := slices.Concat(run.Entrypoint, run.Cmd), []string{
+		"/usr/bin/strace", "-f", "-e", "trace=open", "-o", "/log.txt", "/app/server", "--port", "80",
+	}; !slices.Equal(got, want) {
+		t.Errorf("command = %q, want %q", got, want)
+	}
+	if want := []string{"/data:/data", "/env/strace:/usr/bin/strace:z", "/env/log.txt:/log.txt:z"}; !slices.Equal(run.Binds, want) {
+		t.Errorf("binds = %q, want %q", run.Binds, want)
+	}
+	if !slices.Contains(run.CapAdd, "SYS_PTRACE") || !slices.Contains(run.SecurityOpt, "seccomp=unconfined") {
+		t.Errorf("container cannot ptrace: %q %q", run.CapAdd, run.SecurityOpt)
+	}
+
+	// Commands executed in the container are traced into the same log.
+	fake := &Fake{}
+	if err := run.While(context.Background(), &fakeContainer{fake: fake, id: "app"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"exec app /usr/bin/strace -f -e trace=open -A -o /log.txt curl -sf localhost/"}
+	if !slices.Equal(fake.Calls, want) {
+		t.Errorf("calls = %q, want %q", fake.Calls, want)
+	}
+}
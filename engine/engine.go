@@ -0,0 +1,146 @@
+// Package engine abstracts the container runtime used to build, inspect, run
+// and remove images, so that no container operation has to go through a shell.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Runtimes lists the names accepted by New.
+var Runtimes = []string{"docker", "podman"}
+
+type Runtime interface {
+	// Build builds the Dockerfile with the given context and tags the result.
+	Build(ctx context.Context, opts BuildOptions) error
+	// ExportRootfs writes the flattened filesystem of image for platform, or
+	// the host platform when empty, as a tar stream to w.
+	ExportRootfs(ctx context.Context, image string, platform string, w io.Writer) error
+	// Pull pulls image for platform unless it is already present.
+	Pull(ctx context.Context, image string, platform string) error
+	// Load loads the images of a docker-archive or oci-archive tar stream,
+	// tagged as the archive names them.
+	Load(ctx context.Context, archive io.Reader) error
+	// InspectConfig returns the runtime configuration of image.
+	InspectConfig(ctx context.Context, image string) (types.DockerConfig, error)
+	// Run creates and starts a container, waits for it to exit or for the
+	// timeout to pass, collects its output and removes it.
+	Run(ctx context.Context, opts RunOptions) (RunResult, error)
+	// Trace runs the container like Run, with its command executed under the
+	// statically linked strace binary described by opts. Commands executed
+	// in the container by RunOptions.While are traced too, into the same log.
+	Trace(ctx context.Context, opts TraceOptions) (RunResult, error)
+	// Rootless reports whether containers run in a user namespace owned by
+	// the invoking user, in which case files it owns appear as root inside.
+	Rootless(ctx context.Context) (bool, error)
+	// RemoveImages force removes every image matching reference. A reference
+	// without a tag matches all tags of the repository.
+	RemoveImages(ctx context.Context, reference string) error
+}
+
+type BuildOptions struct {
+	// ContextDir is the directory sent as build context.
+	ContextDir string
+	// Dockerfile is the path of the Dockerfile on the host; it does not have
+	// to be inside ContextDir.
+	Dockerfile string
+	Tag        string
+	// Platform selects the target platform, e.g. linux/arm64, of the build.
+	Platform string
+	// ExtraFiles maps names inside the build context to host files that are
+	// added to it regardless of .dockerignore.
+	ExtraFiles map[string]string
+}
+
+type RunOptions struct {
+	Image    string
+	Name     string
+	Platform string
+	// Entrypoint and Cmd override the image configuration when not nil.
+	Entrypoint []string
+	Cmd        []string
+	// Env is added to the environment of the image.
+	Env         []string
+	Binds       []string
+	CapAdd      []string
+	SecurityOpt []string
+	// NetworkMode is passed to the runtime as is, e.g. container:<id> to
+	// join the network namespace of another container.
+	NetworkMode string
+	// Timeout stops the container once it has run for this long. Zero waits
+	// until the container exits on its own.
+	Timeout time.Duration
+	// Ports are container ports, e.g. 8080/tcp, to publish on ephemeral ports
+	// of the host loopback interface.
+	Ports []string
+	// While, when set, is called once the container has started, with a
+	// context that ends when the container exits or the timeout passes. The
+	// container is stopped as soon as While returns, its error is reported in
+	// RunResult.WhileErr.
+	While func(ctx context.Context, c Container) error
+}
+
+// Container is a running container handed to RunOptions.While.
+type Container interface {
+	ID() string
+	// Exec runs cmd inside the container and waits for it to exit.
+	Exec(ctx context.Context, cmd []string) (ExecResult, error)
+	// HostAddr returns the host:port on the host a port published through
+	// RunOptions.Ports is reachable at.
+	HostAddr(ctx context.Context, port string) (string, error)
+}
+
+type ExecResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+type TraceOptions struct {
+	RunOptions
+	// StracePath is the strace binary and LogPath the file receiving its
+	// output, both on the host.
+	StracePath string
+	LogPath    string
+	// Args are passed to strace before the traced command, which is taken
+	// from RunOptions.Cmd.
+	Args []string
+}
+
+type RunResult struct {
+	ContainerID string
+	ExitCode    int
+	// TimedOut reports that the container was still running at the timeout
+	// and had to be stopped.
+	TimedOut bool
+	// Stopped reports that the container was still running when While
+	// returned and had to be stopped.
+	Stopped bool
+	// WhileErr is the error returned by RunOptions.While.
+	WhileErr error
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// New returns the runtime registered under name, see Runtimes.
+func New(name string) (Runtime, error) {
+	switch name {
+	case "", "docker":
+		docker, err := NewDocker()
+		if err != nil {
+			return nil, err
+		}
+		return docker, nil
+	case "podman":
+		podman, err := NewPodman()
+		if err != nil {
+			return nil, err
+		}
+		return podman, nil
+	}
+	return nil, fmt.Errorf("unknown container runtime %q, expected one of %v", name, Runtimes)
+}
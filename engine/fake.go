@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Fake is an in-memory Runtime for tests. It records every call and answers
+// with the configured values; a nil hook succeeds with a zero result.
+type Fake struct {
+	mu    sync.Mutex
+	Calls []string
+
+	Config types.DockerConfig
+	// Rootfs is the tar stream returned by ExportRootfs.
+	Rootfs []byte
+
+	BuildFunc        func(opts BuildOptions) error
+	LoadFunc         func(archive io.Reader) error
+	RunFunc          func(opts RunOptions) (RunResult, error)
+	ExecFunc         func(cmd []string) (ExecResult, error)
+	HostAddrFunc     func(port string) (string, error)
+	TraceFunc        func(opts TraceOptions) (RunResult, error)
+	RootlessResult   bool
+	RemoveImagesFunc func(reference string) error
+}
+
+func (f *Fake) record(format string, args ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, fmt.Sprintf(format, args...))
+}
+
+func (f *Fake) Build(ctx context.Context, opts BuildOptions) error {
+	f.record("build %s %s", opts.Tag, opts.Dockerfile)
+	if f.BuildFunc != nil {
+		return f.BuildFunc(opts)
+	}
+	return ctx.Err()
+}
+
+func (f *Fake) ExportRootfs(ctx context.Context, image string, platform string, w io.Writer) error {
+	f.record("export %s %s", image, platform)
+	_, err := w.Write(f.Rootfs)
+	return err
+}
+
+func (f *Fake) Pull(ctx context.Context, image string, platform string) error {
+	f.record("pull %s %s", image, platform)
+	return ctx.Err()
+}
+
+func (f *Fake) Load(ctx context.Context, archive io.Reader) error {
+	f.record("load")
+	if f.LoadFunc != nil {
+		return f.LoadFunc(archive)
+	}
+	return ctx.Err()
+}
+
+func (f *Fake) InspectConfig(ctx context.Context, image string) (types.DockerConfig, error) {
+	f.record("inspect %s", image)
+	return f.Config, ctx.Err()
+}
+
+// Run answers with RunFunc and then calls opts.While, if set, as if the
+// container were still running.
+func (f *Fake) Run(ctx context.Context, opts RunOptions) (RunResult, error) {
+	f.record("run %s %s", opts.Image, strings.Join(slices.Concat(opts.Entrypoint, opts.Cmd), " "))
+	result := RunResult{}
+	var err error
+	if f.RunFunc != nil {
+		result, err = f.RunFunc(opts)
+	}
+	if err == nil && opts.While != nil {
+		result.WhileErr = opts.While(ctx, &fakeContainer{fake: f, id: opts.Name})
+		result.Stopped = true
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return result, err
+}
+
+type fakeContainer struct {
+	fake *Fake
+	id   string
+}
+
+func (c *fakeContainer) ID() string {
+	return c.id
+}
+
+func (c *fakeContainer) Exec(ctx context.Context, cmd []string) (ExecResult, error) {
+	c.fake.record("exec %s %s", c.id, strings.Join(cmd, " "))
+	if c.fake.ExecFunc != nil {
+		return c.fake.ExecFunc(cmd)
+	}
+	return ExecResult{}, ctx.Err()
+}
+
+func (c *fakeContainer) HostAddr(ctx context.Context, port string) (string, error) {
+	if c.fake.HostAddrFunc != nil {
+		return c.fake.HostAddrFunc(port)
+	}
+	return "", fmt.Errorf("port %s is not published", port)
+}
+
+func (f *Fake) Trace(ctx context.Context, opts TraceOptions) (RunResult, error) {
+	f.record("trace %s %s", opts.Image, strings.Join(opts.Cmd, " "))
+	if f.TraceFunc != nil {
+		return f.TraceFunc(opts)
+	}
+	return RunResult{}, ctx.Err()
+}
+
+func (f *Fake) Rootless(ctx context.Context) (bool, error) {
+	return f.RootlessResult, ctx.Err()
+}
+
+func (f *Fake) RemoveImages(ctx context.Context, reference string) error {
+	f.record("rmi %s", reference)
+	if f.RemoveImagesFunc != nil {
+		return f.RemoveImagesFunc(reference)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Podman implements Runtime on top of the Docker compatible API served by
+// the Podman socket, which has to be enabled with
+// "systemctl --user enable --now podman.socket" for rootless setups.
+type Podman struct {
+	Docker
+}
+
+// podmanHost returns the socket of the invoking user's Podman service, or
+// the system wide one when running as root.
+func podmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" && os.Getuid() != 0 {
+		return "unix://" + runtimeDir + "/podman/podman.sock"
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// NewPodman connects to the Podman service at CONTAINER_HOST, or at the
+// default socket of the invoking user when it is not set.
+func NewPodman() (*Podman, error) {
+	client, err := newClient(podmanHost())
+	if err != nil {
+		return nil, err
+	}
+	return &Podman{Docker: Docker{client: client}}, nil
+}
+
+func (p *Podman) Trace(ctx context.Context, opts TraceOptions) (RunResult, error) {
+	// Relabel the mounts, SELinux would otherwise deny the container access to them.
+	return p.Run(ctx, traceRunOptions(opts, ":z"))
+}
+
+// normalizeReference strips the registry Podman prefixes to local images.
+func normalizeReference(reference string) string {
+	return strings.TrimPrefix(reference, "localhost/")
+}
+
+// repository returns name without its tag, which follows the last colon
+// after the last slash: a colon before it separates the port of a registry.
+func repository(name string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i]
+	}
+	return name
+}
+
+func (p *Podman) RemoveImages(ctx context.Context, reference string) error {
+	// Podman stores local images as localhost/<name>, which the reference
+	// filter of the compatibility API does not match, so filter here instead.
+	var images []imageSummary
+	if err := p.client.doJSON(ctx, "GET", "/images/json", url.Values{}, nil, &images); err != nil {
+		return err
+	}
+	reference = normalizeReference(reference)
+	tags := []string{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			name := normalizeReference(tag)
+			if name == reference || repository(name) == reference {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return p.removeTags(ctx, tags)
+}
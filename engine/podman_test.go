@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRepository(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"app:latest", "app"},
+		{"app", "app"},
+		{"localhost/dockerminimize-app:3", "localhost/dockerminimize-app"},
+		{"registry:5000/app:tag", "registry:5000/app"},
+		{"registry:5000/team/app", "registry:5000/team/app"},
+	}
+	for _, tt := range tests {
+		if got := repository(tt.name); got != tt.want {
+			t.Errorf("repository(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPodmanRemoveImages(t *testing.T) {
+	images := []imageSummary{
+		{ID: "1", RepoTags: []string{"localhost/dockerminimize-app:1", "localhost/dockerminimize-app:2"}},
+		{ID: "2", RepoTags: []string{"localhost/dockerminimize-app-other:1"}},
+		{ID: "3", RepoTags: []string{"registry:5000/app:tag", "registry:5000/app:other"}},
+		{ID: "4", RepoTags: []string{"registry:5000/app-other:tag"}},
+	}
+	tests := []struct {
+		reference string
+		want      []string
+	}{
+		{"dockerminimize-app", []string{"localhost/dockerminimize-app:1", "localhost/dockerminimize-app:2"}},
+		{"dockerminimize-app:2", []string{"localhost/dockerminimize-app:2"}},
+		{"registry:5000/app", []string{"registry:5000/app:tag", "registry:5000/app:other"}},
+		{"registry:5000/app:tag", []string{"registry:5000/app:tag"}},
+		{"registry", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			var removed []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/images/json"):
+					json.NewEncoder(w).Encode(images)
+				case r.Method == "DELETE":
+					_, name, _ := strings.Cut(r.URL.Path, "/images/")
+					removed = append(removed, name)
+					w.Write([]byte("[]"))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+			client, err := newClient("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &Podman{Docker: Docker{client: client}}
+			if err := p.RemoveImages(context.Background(), tt.reference); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(removed, tt.want) {
+				t.Errorf("removed %q, want %q", removed, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package languages
+
+import (
+	"archive/zip"
+	"bufio"
+	"cmp"
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Java finds the Java runtime, with its lib/modules jimage, native libraries
+// and configuration, and the class path and module path of a JVM program,
+// following the Class-Path of jar manifests.
+type Java struct{}
+
+// javaPathOptions are the options whose value is a class or module path.
+var javaPathOptions = []string{"-cp", "-classpath", "--class-path", "-p", "--module-path", "--upgrade-module-path"}
+
+// javaOptions are the other options taking a separate value.
+var javaOptions = []string{"--add-modules", "--add-opens", "--add-exports", "--add-reads", "--limit-modules", "-d"}
+
+func (Java) Name() string {
+	return "java"
+}
+
+// java is the state of the analysis of one program.
+type java struct {
+	*program
+	jars map[string]bool
+}
+
+func (Java) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	p, err := newProgram(image)
+	if err != nil {
+		return types.FileSet{}, err
+	}
+	if !p.is("java") {
+		return types.FileSet{}, analyzer.ErrNotApplicable
+	}
+	j := &java{program: p, jars: make(map[string]bool)}
+	home := filepath.Dir(filepath.Dir(p.interpreter))
+	log.Info("Analyzing Java program ", strings.Join(p.args, " "), " with runtime ", home)
+	p.add(p.command)
+	p.addLibraries(p.interpreter)
+	// The runtime loads classes from the lib/modules jimage, or rt.jar before
+	// Java 9, and native libraries, configuration and data files from lib.
+	for _, dir := range []string{"/lib", "/conf", "/release", "/jre/lib"} {
+		p.add(home+dir, ".so")
+	}
+	// Sources and compiler data are of no use at run time.
+	p.remove(home+"/lib/src.zip", home+"/lib/ct.sym")
+
+	classPath, agents := []string{}, []string{}
+	explicit := false
+	args := p.args
+	for i := 0; i < len(args) && ctx.Err() == nil; i++ {
+		arg := args[i]
+		switch {
+		case slices.Contains(javaPathOptions, arg) && i+1 < len(args):
+			classPath = append(classPath, filepath.SplitList(args[i+1])...)
+			explicit = explicit || !strings.HasSuffix(arg, "module-path") && arg != "-p"
+			i++
+		case strings.HasPrefix(arg, "--class-path=") || strings.HasPrefix(arg, "--module-path="):
+			_, value, _ := strings.Cut(arg, "=")
+			classPath = append(classPath, filepath.SplitList(value)...)
+			explicit = explicit || strings.HasPrefix(arg, "--class-path=")
+		case arg == "-jar" && i+1 < len(args):
+			// The jar is the whole class path, -cp is ignored.
+			classPath, explicit = []string{args[i+1]}, true
+			i = len(args)
+		case strings.HasPrefix(arg, "-javaagent:"):
+			// Agents are loaded whatever the class path, -jar included.
+			agent, _, _ := strings.Cut(strings.TrimPrefix(arg, "-javaagent:"), "=")
+			agents = append(agents, agent)
+		case strings.HasPrefix(arg, "-agentpath:"):
+			agent, _, _ := strings.Cut(strings.TrimPrefix(arg, "-agentpath:"), "=")
+			p.add(p.path(agent))
+			p.addLibraries(p.path(agent))
+		case slices.Contains(javaOptions, arg):
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			// The main class, the remaining arguments belong to the program.
+			i = len(args)
+		}
+	}
+	if !explicit {
+		classPath = append(classPath, filepath.SplitList(cmp.Or(p.getenv("CLASSPATH"), "."))...)
+	}
+	for _, entry := range slices.Concat(agents, classPath) {
+		j.addEntry(p.path(entry))
+	}
+	return p.result()
+}
+
+// addEntry adds a class path entry: a jar, a directory of classes or a
+// directory followed by /* for every jar in it.
+func (j *java) addEntry(path string) {
+	p := j.program
+	if dir, ok := strings.CutSuffix(path, "/*"); ok {
+		for _, jar := range slices.Concat(p.glob(dir+"/*.jar"), p.glob(dir+"/*.JAR")) {
+			j.addJar(jar)
+		}
+		return
+	}
+	if p.isDir(path) {
+		p.add(path, ".so")
+		return
+	}
+	j.addJar(path)
+}
+
+// addJar adds the jar at path and the entries of the Class-Path of its
+// manifest, which are relative to its directory.
+func (j *java) addJar(path string) {
+	p := j.program
+	if j.jars[path] || !p.exists(path) {
+		return
+	}
+	j.jars[path] = true
+	p.add(path)
+	for _, entry := range j.manifestClassPath(path) {
+		if !filepath.IsAbs(entry) {
+			entry = filepath.Join(filepath.Dir(path), entry)
+		}
+		j.addEntry(entry)
+	}
+}
+
+// manifestClassPath reads the Class-Path attribute of the manifest of the
+// jar at path, joining its continuation lines.
+func (j *java) manifestClassPath(path string) []string {
+	archive, err := zip.OpenReader(j.program.rootfsPath + path)
+	if err != nil {
+		return nil
+	}
+	defer archive.Close()
+	manifest, err := archive.Open("META-INF/MANIFEST.MF")
+	if err != nil {
+		return nil
+	}
+	defer manifest.Close()
+	var value string
+	inClassPath := false
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case inClassPath && strings.HasPrefix(line, " "):
+			value += line[1:]
+		case strings.HasPrefix(line, "Class-Path:"):
+			value, inClassPath = strings.TrimPrefix(line, "Class-Path:"), true
+		default:
+			inClassPath = false
+		}
+	}
+	return strings.Fields(value)
+}
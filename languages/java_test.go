@@ -0,0 +1,97 @@
+package languages
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// jar returns a jar whose manifest holds the attributes, or none when empty.
+func jar(t *testing.T, manifest string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	if manifest != "" {
+		file, err := writer.Create("META-INF/MANIFEST.MF")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("Manifest-Version: 1.0\r\n" + manifest))
+	}
+	if _, err := writer.Create("app/Main.class"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestJava(t *testing.T) {
+	const home = "/opt/java/openjdk"
+	envPath := writeEnv(t, map[string]string{
+		home + "/bin/java":                    "\x7fELF",
+		home + "/bin/javac":                   "\x7fELF",
+		home + "/lib/modules":                 "jimage",
+		home + "/lib/libjava.so":              "\x7fELF",
+		home + "/lib/security/cacerts":        "",
+		home + "/lib/src.zip":                 "",
+		home + "/lib/ct.sym":                  "",
+		home + "/conf/security/java.security": "",
+		home + "/release":                     "JAVA_VERSION=\"21\"\n",
+		home + "/jmods/java.base.jmod":        "",
+		// The Class-Path is continued on a second line.
+		"/app/app.jar":                  jar(t, "Main-Class: app.Main\r\nClass-Path: lib/dep.jar\r\n  lib/other.jar\r\n"),
+		"/app/lib/dep.jar":              jar(t, "Class-Path: ../classes/\r\n"),
+		"/app/lib/other.jar":            jar(t, ""),
+		"/app/lib/unused.jar":           jar(t, ""),
+		"/app/classes/app/Config.class": "",
+		"/opt/agent/agent.jar":          jar(t, ""),
+		"/opt/agent/libprofiler.so":     "\x7fELF",
+	}, map[string]string{"/usr/bin/java": home + "/bin/java"})
+	runtime := []string{
+		"/usr/bin/java", home + "/bin/java", home + "/lib/modules", home + "/lib/libjava.so",
+		home + "/lib/security/cacerts", home + "/conf/security/java.security", home + "/release",
+	}
+	env := []string{"PATH=/usr/bin:/bin"}
+	tests := []struct {
+		name     string
+		metadata types.DockerConfig
+		want     []string
+		absent   []string
+	}{
+		{
+			name: "jar",
+			metadata: types.DockerConfig{Entrypoint: []string{"java", "-javaagent:/opt/agent/agent.jar=port=9000",
+				"-agentpath:/opt/agent/libprofiler.so", "-cp", "ignored", "-jar", "app.jar", "--port", "80"},
+				WorkingDir: "/app", Env: env},
+			want: append([]string{"/app/app.jar", "/app/lib/dep.jar", "/app/lib/other.jar",
+				"/app/classes/app/Config.class", "/opt/agent/agent.jar", "/opt/agent/libprofiler.so"}, runtime...),
+			absent: []string{
+				"/app/lib/unused.jar", home + "/lib/src.zip", home + "/lib/ct.sym",
+				home + "/jmods/java.base.jmod", home + "/bin/javac",
+			},
+		},
+		{
+			name: "class path",
+			metadata: types.DockerConfig{Cmd: []string{"java", "-cp", "lib/*:classes", "app.Main", "-jar", "app.jar"},
+				WorkingDir: "/app", Env: env},
+			want:   append([]string{"/app/lib/dep.jar", "/app/lib/other.jar", "/app/lib/unused.jar", "/app/classes/app/Config.class"}, runtime...),
+			absent: []string{"/app/app.jar"},
+		},
+		{
+			name: "CLASSPATH",
+			metadata: types.DockerConfig{Cmd: []string{"java", "app.Main"}, WorkingDir: "/",
+				Env: append([]string{"CLASSPATH=/app/lib/other.jar"}, env...)},
+			want:   []string{"/app/lib/other.jar"},
+			absent: []string{"/app/lib/dep.jar", "/app/app.jar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analyze(t, Java{}, envPath, tt.metadata, tt.want, tt.absent)
+		})
+	}
+}
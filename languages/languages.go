@@ -0,0 +1,260 @@
+// Package languages analyses applications run by a language runtime. For
+// them the executable of the image is only the interpreter, the files that
+// matter are the scripts, modules and packages it loads, which the analyzers
+// find by following the module resolution rules of each runtime inside the
+// rootfs, without running anything.
+package languages
+
+import (
+	"bufio"
+	"cmp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/ldd"
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/types"
+	"github.com/regelepuma/dockerminimizer/utils"
+)
+
+var log = logger.Log
+
+// All returns the analyzers of every supported language runtime.
+func All() []analyzer.Analyzer {
+	return []analyzer.Analyzer{Python{}, Node{}, Java{}, Ruby{}}
+}
+
+// shells are the interpreters whose -c script is looked into for the actual
+// command.
+var shells = []string{"sh", "bash", "dash", "ash"}
+
+// program is the command of an image as seen by a language analyzer, with
+// the files found so far.
+type program struct {
+	rootfsPath string
+	env        []string
+	workingDir string
+	// command is the path of the executable run, interpreter the path it
+	// resolves to inside the rootfs.
+	command     string
+	interpreter string
+	args        []string
+
+	found   types.FileSet
+	scanned map[string]bool
+}
+
+func newProgram(image types.Image) (*program, error) {
+	argv, err := utils.GetFullContainerCommand(image.EnvPath, image.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	p := &program{
+		rootfsPath: image.EnvPath + "/rootfs",
+		env:        image.Metadata.Env,
+		workingDir: cmp.Or(image.Metadata.WorkingDir, "/"),
+		found:      types.NewFileSet(),
+		scanned:    make(map[string]bool),
+	}
+	// Unwrap shell scripts, env and shebangs down to the interpreter.
+	for range 4 {
+		name := filepath.Base(argv[0])
+		switch {
+		case slices.Contains(shells, name) && len(argv) > 2 && argv[1] == "-c":
+			argv = strings.Fields(argv[2])
+			if len(argv) > 1 && argv[0] == "exec" {
+				argv = argv[1:]
+			}
+		case name == "env" && len(argv) > 1:
+			argv = envCommand(argv[1:])
+		default:
+			if interpreter := p.shebang(argv[0]); interpreter != nil {
+				argv = slices.Concat(interpreter, argv)
+			}
+		}
+		if len(argv) == 0 {
+			return nil, analyzer.ErrNotApplicable
+		}
+		argv[0] = p.lookPath(argv[0])
+	}
+	p.command, p.args = argv[0], argv[1:]
+	p.interpreter, err = utils.ResolveInRoot(p.rootfsPath, p.command)
+	if err != nil {
+		p.interpreter = p.command
+	}
+	return p, nil
+}
+
+// envCommand returns the command env runs with args, skipping the options
+// and the variables it sets.
+func envCommand(args []string) []string {
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			return args[i+1:]
+		case arg == "-u" || arg == "-C" || arg == "--unset" || arg == "--chdir":
+			i++
+		case strings.HasPrefix(arg, "-") || strings.Contains(arg, "="):
+		default:
+			return args[i:]
+		}
+	}
+	return nil
+}
+
+// lookPath resolves command the way a shell does: relative to the working
+// directory when it contains a slash, in the PATH otherwise. Commands not
+// found are returned as they are.
+func (p *program) lookPath(command string) string {
+	if strings.Contains(command, "/") {
+		return p.path(command)
+	}
+	if path, err := utils.LookPath(command, p.rootfsPath, p.env); err == nil {
+		return path
+	}
+	return command
+}
+
+// shebang returns the interpreter and its argument named by the shebang of
+// the script at path, or nil if it has none.
+func (p *program) shebang(path string) []string {
+	file, err := os.Open(p.rootfsPath + p.path(path))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(2); string(magic) != "#!" {
+		return nil
+	}
+	line, _ := reader.ReadString('\n')
+	return strings.Fields(line[2:])
+}
+
+// is reports whether the interpreter is one of names, ignoring version
+// suffixes such as the 3.12 of python3.12.
+func (p *program) is(names ...string) bool {
+	for _, path := range []string{p.command, p.interpreter} {
+		base := strings.TrimRight(filepath.Base(path), "0123456789.")
+		if slices.Contains(names, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// getenv returns the value of the environment variable name, the last
+// definition wins as in the container.
+func (p *program) getenv(name string) string {
+	value := ""
+	for _, variable := range p.env {
+		if v, ok := strings.CutPrefix(variable, name+"="); ok {
+			value = v
+		}
+	}
+	return value
+}
+
+// path makes path absolute, relative to the working directory.
+func (p *program) path(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(p.workingDir, path)
+}
+
+func (p *program) exists(path string) bool {
+	_, err := os.Lstat(p.rootfsPath + path)
+	return err == nil
+}
+
+func (p *program) isDir(path string) bool {
+	return utils.CheckIfDirectoryExists(path, p.rootfsPath)
+}
+
+// glob returns the paths matching the shell pattern inside the rootfs.
+func (p *program) glob(pattern string) []string {
+	matches, _ := filepath.Glob(p.rootfsPath + pattern)
+	for i, match := range matches {
+		matches[i] = strings.TrimPrefix(match, p.rootfsPath)
+	}
+	return matches
+}
+
+// add adds path, with everything below it when it is a directory, and the
+// shared libraries of the native extensions among them, recognised by ext.
+func (p *program) add(path string, ext ...string) {
+	if !p.exists(path) {
+		return
+	}
+	utils.AddTree(path, &p.found, p.rootfsPath, types.Source{Reason: "loaded by " + p.command})
+	if len(ext) == 0 {
+		return
+	}
+	filepath.WalkDir(p.rootfsPath+path, func(file string, entry os.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && slices.Contains(ext, filepath.Ext(file)) {
+			p.addLibraries(strings.TrimPrefix(file, p.rootfsPath))
+		}
+		return nil
+	})
+}
+
+// remove removes paths from the files found.
+func (p *program) remove(paths ...string) {
+	for _, path := range paths {
+		p.found.Remove(path)
+	}
+}
+
+// addLibraries adds the shared libraries the ELF object at path needs.
+func (p *program) addLibraries(path string) {
+	libs, err := ldd.Resolve(path, p.rootfsPath, p.env)
+	if err != nil {
+		log.Info("Failed to resolve shared libraries of ", path, ": ", err)
+	}
+	p.found.Merge(libs)
+}
+
+// scan returns the first group of every match of the patterns in the file at
+// path, or nil when the file was scanned before.
+func (p *program) scan(path string, patterns ...*regexp.Regexp) []string {
+	if p.scanned[path] {
+		return nil
+	}
+	p.scanned[path] = true
+	data, err := os.ReadFile(p.rootfsPath + path)
+	if err != nil {
+		return nil
+	}
+	return submatches(data, patterns...)
+}
+
+// scanTree scans every file below dir with one of the extensions ext.
+func (p *program) scanTree(dir string, ext []string, patterns ...*regexp.Regexp) []string {
+	var found []string
+	filepath.WalkDir(p.rootfsPath+dir, func(file string, entry os.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && slices.Contains(ext, filepath.Ext(file)) {
+			found = append(found, p.scan(strings.TrimPrefix(file, p.rootfsPath), patterns...)...)
+		}
+		return nil
+	})
+	return found
+}
+
+func submatches(data []byte, patterns ...*regexp.Regexp) []string {
+	var found []string
+	for _, pattern := range patterns {
+		for _, match := range pattern.FindAllSubmatch(data, -1) {
+			found = append(found, string(match[1]))
+		}
+	}
+	return found
+}
+
+func (p *program) result() (types.FileSet, error) {
+	return p.found, nil
+}
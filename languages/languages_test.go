@@ -0,0 +1,242 @@
+package languages
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// writeEnv creates an environment whose rootfs holds files, mapped to their
+// content, and symbolic links. Files whose content starts with #! or \x7fELF
+// are executable.
+func writeEnv(t *testing.T, files map[string]string, links map[string]string) string {
+	t.Helper()
+	envPath := t.TempDir()
+	rootfs := filepath.Join(envPath, "rootfs")
+	for path, content := range files {
+		mode := os.FileMode(0644)
+		if len(content) > 1 && (content[:2] == "#!" || content[0] == 0x7f) {
+			mode = 0755
+		}
+		if err := os.MkdirAll(filepath.Dir(rootfs+path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(rootfs+path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, target := range links {
+		if err := os.MkdirAll(filepath.Dir(rootfs+path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, rootfs+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return envPath
+}
+
+func TestNewProgram(t *testing.T) {
+	const elf = "\x7fELF"
+	envPath := writeEnv(t, map[string]string{
+		"/bin/sh":              elf,
+		"/usr/bin/env":         elf,
+		"/usr/bin/python3.12":  elf,
+		"/usr/local/bin/node":  elf,
+		"/app/run.py":          "#!/usr/bin/env python3\nimport app\n",
+		"/app/unbuffered.py":   "#!/usr/bin/env -S PYTHONUNBUFFERED=1 python3 -u\n",
+		"/app/isolated":        "#!/usr/bin/python3 -E\n",
+		"/app/start.sh":        "#!/bin/sh\nexec node server.js\n",
+		"/app/bin/entrypoint":  "#!/app/run.py\n",
+		"/app/server.js":       "require('http')\n",
+		"/app/no-interpreter":  "#!\n",
+		"/opt/venv/bin/python": elf,
+	}, map[string]string{
+		"/usr/bin/python3": "python3.12",
+	})
+	tests := []struct {
+		name        string
+		metadata    types.DockerConfig
+		command     string
+		interpreter string
+		args        []string
+		is          string
+	}{
+		{
+			name:        "executable in the PATH",
+			metadata:    types.DockerConfig{Cmd: []string{"python3", "-m", "http.server"}},
+			command:     "/usr/bin/python3",
+			interpreter: "/usr/bin/python3.12",
+			args:        []string{"-m", "http.server"},
+			is:          "python",
+		},
+		{
+			name:        "shebang through env",
+			metadata:    types.DockerConfig{Cmd: []string{"/app/run.py", "--port", "80"}},
+			command:     "/usr/bin/python3",
+			interpreter: "/usr/bin/python3.12",
+			args:        []string{"/app/run.py", "--port", "80"},
+			is:          "python",
+		},
+		{
+			name:        "shebang with an argument",
+			metadata:    types.DockerConfig{Entrypoint: []string{"/app/isolated"}},
+			command:     "/usr/bin/python3",
+			interpreter: "/usr/bin/python3.12",
+			args:        []string{"-E", "/app/isolated"},
+			is:          "python",
+		},
+		{
+			name:        "env options and variables",
+			metadata:    types.DockerConfig{Entrypoint: []string{"/app/unbuffered.py"}},
+			command:     "/usr/bin/python3",
+			interpreter: "/usr/bin/python3.12",
+			args:        []string{"-u", "/app/unbuffered.py"},
+			is:          "python",
+		},
+		{
+			name: "env in the command",
+			metadata: types.DockerConfig{Cmd: []string{"env", "-u", "HOME", "NODE_ENV=production", "node", "server.js"},
+				WorkingDir: "/app"},
+			command:     "/usr/local/bin/node",
+			interpreter: "/usr/local/bin/node",
+			args:        []string{"server.js"},
+			is:          "node",
+		},
+		{
+			name:        "sh -c with exec",
+			metadata:    types.DockerConfig{Entrypoint: []string{"/bin/sh", "-c", "exec node /app/server.js"}},
+			command:     "/usr/local/bin/node",
+			interpreter: "/usr/local/bin/node",
+			args:        []string{"/app/server.js"},
+			is:          "node",
+		},
+		{
+			name:        "sh -c running a relative script",
+			metadata:    types.DockerConfig{Cmd: []string{"sh", "-c", "./run.py --debug"}, WorkingDir: "/app"},
+			command:     "/usr/bin/python3",
+			interpreter: "/usr/bin/python3.12",
+			args:        []string{"/app/run.py", "--debug"},
+			is:          "python",
+		},
+		{
+			name:        "script whose interpreter is a script",
+			metadata:    types.DockerConfig{Entrypoint: []string{"/app/bin/entrypoint"}},
+			command:     "/usr/bin/python3",
+			interpreter: "/usr/bin/python3.12",
+			args:        []string{"/app/run.py", "/app/bin/entrypoint"},
+			is:          "python",
+		},
+		{
+			// Shell scripts are not looked into.
+			name:        "shell script",
+			metadata:    types.DockerConfig{Cmd: []string{"/app/start.sh"}},
+			command:     "/bin/sh",
+			interpreter: "/bin/sh",
+			args:        []string{"/app/start.sh"},
+			is:          "sh",
+		},
+		{
+			name:        "interpreter outside the PATH",
+			metadata:    types.DockerConfig{Entrypoint: []string{"/opt/venv/bin/python", "app.py"}},
+			command:     "/opt/venv/bin/python",
+			interpreter: "/opt/venv/bin/python",
+			args:        []string{"app.py"},
+			is:          "python",
+		},
+		{
+			name:        "empty shebang",
+			metadata:    types.DockerConfig{Entrypoint: []string{"/app/no-interpreter"}},
+			command:     "/app/no-interpreter",
+			interpreter: "/app/no-interpreter",
+			args:        []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newProgram(types.Image{EnvPath: envPath, Metadata: tt.metadata})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.command != tt.command || p.interpreter != tt.interpreter || !slices.Equal(p.args, tt.args) {
+				t.Errorf("newProgram = %s (%s) %q, want %s (%s) %q",
+					p.command, p.interpreter, p.args, tt.command, tt.interpreter, tt.args)
+			}
+			if tt.is != "" && !p.is(tt.is) {
+				t.Errorf("program is not %s", tt.is)
+			}
+		})
+	}
+}
+
+func TestNewProgramErrors(t *testing.T) {
+	envPath := writeEnv(t, map[string]string{"/bin/sh": "\x7fELF"}, nil)
+	if _, err := newProgram(types.Image{EnvPath: envPath}); err == nil {
+		t.Error("newProgram succeeded without a command")
+	}
+	metadata := types.DockerConfig{Cmd: []string{"/bin/sh", "-c", " "}}
+	if _, err := newProgram(types.Image{EnvPath: envPath, Metadata: metadata}); !errors.Is(err, analyzer.ErrNotApplicable) {
+		t.Errorf("newProgram error = %v, want %v", err, analyzer.ErrNotApplicable)
+	}
+}
+
+func TestEnvCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"python3", "app.py"}, []string{"python3", "app.py"}},
+		{[]string{"-i", "A=1", "B=2", "node"}, []string{"node"}},
+		{[]string{"--chdir", "/app", "-u", "HOME", "ruby", "-w"}, []string{"ruby", "-w"}},
+		{[]string{"-S", "python3", "-u"}, []string{"python3", "-u"}},
+		{[]string{"--", "-weird"}, []string{"-weird"}},
+		{[]string{"A=1"}, nil},
+	}
+	for _, tt := range tests {
+		if got := envCommand(tt.args); !slices.Equal(got, tt.want) {
+			t.Errorf("envCommand(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// analyze runs a on an image of the environment with metadata and checks
+// that the files found include want and exclude absent.
+func analyze(t *testing.T, a analyzer.Analyzer, envPath string, metadata types.DockerConfig, want, absent []string) types.FileSet {
+	t.Helper()
+	found, err := a.Analyze(context.Background(), types.Image{EnvPath: envPath, Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range want {
+		if !found.Has(path) {
+			t.Errorf("%s not found", path)
+		}
+	}
+	for _, path := range absent {
+		if found.Has(path) {
+			t.Errorf("%s found", path)
+		}
+	}
+	if t.Failed() {
+		t.Logf("found %s", strings.Join(found.Paths(), " "))
+	}
+	return found
+}
+
+func TestNotApplicable(t *testing.T) {
+	envPath := writeEnv(t, map[string]string{"/app/server": "\x7fELF"}, nil)
+	metadata := types.DockerConfig{Entrypoint: []string{"/app/server"}}
+	for _, a := range All() {
+		_, err := a.Analyze(context.Background(), types.Image{EnvPath: envPath, Metadata: metadata})
+		if !errors.Is(err, analyzer.ErrNotApplicable) {
+			t.Errorf("%s error = %v, want %v", a.Name(), err, analyzer.ErrNotApplicable)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package languages
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Node finds the modules a Node.js program loads, following the require and
+// import resolution of Node: relative specifiers are resolved as files or
+// directories, bare ones in the node_modules directories above the importing
+// file. Packages are kept whole, with their dependencies.
+type Node struct{}
+
+var (
+	nodeRequire = regexp.MustCompile(`\brequire(?:\.resolve)?\(\s*['"]([^'"\n]+)['"]\s*\)`)
+	nodeImport  = regexp.MustCompile(`(?m)^\s*(?:import|export)\b[^'"\n;]*?\bfrom\s*['"]([^'"\n]+)['"]`)
+	nodeBare    = regexp.MustCompile(`(?m)^\s*import\s*['"]([^'"\n]+)['"]`)
+	nodeDynamic = regexp.MustCompile(`\bimport\(\s*['"]([^'"\n]+)['"]\s*\)`)
+)
+
+// nodeExtensions are tried in order for specifiers without extension.
+var nodeExtensions = []string{".js", ".json", ".node", ".mjs", ".cjs"}
+
+// nodeOptions are the command line options taking a value, the ones loading
+// a module are handled separately.
+var nodeOptions = []string{"--title", "--inspect-port", "--max-http-header-size", "--stack-size", "--env-file"}
+
+// nodeBuiltins are the core modules, which are part of the binary.
+var nodeBuiltins = []string{
+	"assert", "async_hooks", "buffer", "child_process", "cluster", "console", "constants", "crypto",
+	"dgram", "diagnostics_channel", "dns", "domain", "events", "fs", "http", "http2", "https",
+	"inspector", "module", "net", "os", "path", "perf_hooks", "process", "punycode", "querystring",
+	"readline", "repl", "stream", "string_decoder", "sys", "timers", "tls", "trace_events", "tty",
+	"url", "util", "v8", "vm", "wasi", "worker_threads", "zlib",
+}
+
+func (Node) Name() string {
+	return "node"
+}
+
+type packageJSON struct {
+	Main                 string            `json:"main"`
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+	PeerDependencies     map[string]string `json:"peerDependencies"`
+}
+
+// node is the state of the analysis of one program.
+type node struct {
+	*program
+	packages map[string]bool
+	pending  []string
+}
+
+func (Node) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	p, err := newProgram(image)
+	if err != nil {
+		return types.FileSet{}, err
+	}
+	if !p.is("node", "nodejs") {
+		return types.FileSet{}, analyzer.ErrNotApplicable
+	}
+	n := &node{program: p, packages: make(map[string]bool)}
+	log.Info("Analyzing Node.js program ", strings.Join(p.args, " "))
+	p.add(p.command)
+	p.addLibraries(p.interpreter)
+
+	var preloaded []string
+	args := p.args
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (arg == "-r" || arg == "--require" || arg == "--import" || arg == "--loader") && i+1 < len(args):
+			preloaded = append(preloaded, args[i+1])
+			i++
+		case (arg == "-e" || arg == "--eval" || arg == "-p" || arg == "--print") && i+1 < len(args):
+			n.require(p.workingDir, submatches([]byte(args[i+1]), nodeRequire, nodeImport, nodeDynamic)...)
+			i = len(args)
+		case slices.Contains(nodeOptions, arg):
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			// The script is a path, never a package.
+			n.addFile(p.path(arg))
+			i = len(args)
+		}
+	}
+	n.require(p.workingDir, preloaded...)
+	for len(n.pending) > 0 && ctx.Err() == nil {
+		file := n.pending[0]
+		n.pending = n.pending[1:]
+		n.require(filepath.Dir(file), p.scan(file, nodeRequire, nodeImport, nodeBare, nodeDynamic)...)
+	}
+	return p.result()
+}
+
+// require resolves the specifiers imported from dir.
+func (n *node) require(dir string, specifiers ...string) {
+	for _, specifier := range specifiers {
+		name := strings.TrimPrefix(specifier, "node:")
+		top, _, _ := strings.Cut(name, "/")
+		switch {
+		case strings.HasPrefix(specifier, "node:") || slices.Contains(nodeBuiltins, top):
+		case strings.HasPrefix(specifier, ".") || filepath.IsAbs(specifier):
+			path := specifier
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			n.addFile(path)
+		default:
+			n.addPackage(dir, name)
+		}
+	}
+}
+
+// addFile adds the module at path, trying the extensions and directory
+// entry points Node tries, and queues it for scanning.
+func (n *node) addFile(path string) {
+	p := n.program
+	candidates := []string{path}
+	for _, ext := range nodeExtensions {
+		candidates = append(candidates, path+ext)
+	}
+	for _, candidate := range candidates {
+		if p.exists(candidate) && !p.isDir(candidate) {
+			n.addModule(candidate)
+			n.addManifest(filepath.Dir(candidate))
+			return
+		}
+	}
+	if !p.isDir(path) {
+		return
+	}
+	if pkg, ok := n.readPackage(path); ok && pkg.Main != "" {
+		p.add(path + "/package.json")
+		n.addFile(filepath.Join(path, pkg.Main))
+		return
+	}
+	for _, index := range []string{"/index.js", "/index.json", "/index.node", "/index.mjs", "/index.cjs"} {
+		if p.exists(path + index) {
+			n.addModule(path + index)
+			return
+		}
+	}
+}
+
+func (n *node) addModule(path string) {
+	p := n.program
+	p.add(path)
+	switch filepath.Ext(path) {
+	case ".node":
+		p.addLibraries(path)
+	case ".js", ".mjs", ".cjs":
+		if !p.scanned[path] {
+			n.pending = append(n.pending, path)
+		}
+	}
+}
+
+// addManifest adds the package.json closest above dir, which decides whether
+// .js files are CommonJS or ES modules.
+func (n *node) addManifest(dir string) {
+	for ; ; dir = filepath.Dir(dir) {
+		if n.program.exists(dir + "/package.json") {
+			n.program.add(dir + "/package.json")
+			return
+		}
+		if dir == "/" {
+			return
+		}
+	}
+}
+
+// addPackage adds the package name, possibly with a subpath, found from dir,
+// with its whole directory and its dependencies.
+func (n *node) addPackage(dir string, name string) {
+	parts := strings.Split(name, "/")
+	packageName := parts[0]
+	if strings.HasPrefix(name, "@") && len(parts) > 1 {
+		packageName = parts[0] + "/" + parts[1]
+	}
+	for _, root := range n.nodeModules(dir) {
+		path := root + "/" + packageName
+		if !n.program.exists(path) {
+			continue
+		}
+		if n.packages[path] {
+			return
+		}
+		n.packages[path] = true
+		n.program.add(path, ".node")
+		pkg, _ := n.readPackage(path)
+		if pkg.Main != "" {
+			n.addFile(filepath.Join(path, pkg.Main))
+		} else {
+			n.addFile(path)
+		}
+		if subpath := strings.TrimPrefix(name, packageName); subpath != "" {
+			n.addFile(path + subpath)
+		}
+		for _, dependencies := range []map[string]string{pkg.Dependencies, pkg.OptionalDependencies, pkg.PeerDependencies} {
+			for dependency := range dependencies {
+				n.addPackage(path, dependency)
+			}
+		}
+		return
+	}
+}
+
+// nodeModules returns the directories bare specifiers imported from dir are
+// looked up in, closest first.
+func (n *node) nodeModules(dir string) []string {
+	var dirs []string
+	for ; ; dir = filepath.Dir(dir) {
+		if filepath.Base(dir) != "node_modules" {
+			dirs = append(dirs, filepath.Join(dir, "node_modules"))
+		}
+		if dir == "/" {
+			break
+		}
+	}
+	for _, path := range filepath.SplitList(n.program.getenv("NODE_PATH")) {
+		if path != "" {
+			dirs = append(dirs, n.program.path(path))
+		}
+	}
+	return dirs
+}
+
+func (n *node) readPackage(dir string) (packageJSON, bool) {
+	var pkg packageJSON
+	data, err := os.ReadFile(n.program.rootfsPath + dir + "/package.json")
+	if err != nil {
+		return pkg, false
+	}
+	return pkg, json.Unmarshal(data, &pkg) == nil
+}
@@ -0,0 +1,81 @@
+package languages
+
+import (
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestNode(t *testing.T) {
+	const modules = "/app/node_modules"
+	envPath := writeEnv(t, map[string]string{
+		"/usr/local/bin/node": "\x7fELF",
+		"/app/package.json":   `{"name": "app", "type": "commonjs"}`,
+		"/app/server.js": "const express = require('express')\n" +
+			"const util = require('./lib/util')\n" +
+			"const fs = require('node:fs'), path = require('path')\n" +
+			"const addon = require('addon')\n" +
+			"const global = require('globalmod')\n" +
+			"import('./lazy.mjs')\n",
+		"/app/lib/util.js":         "module.exports = require('../shared')\n",
+		"/app/shared/index.js":     "module.exports = {}\n",
+		"/app/lazy.mjs":            "import { helper } from '@scope/pkg/sub'\nimport './polyfill'\n",
+		"/app/polyfill.js":         "",
+		"/app/preload.js":          "",
+		"/app/test/server.test.js": "require('../server')\n",
+
+		modules + "/express/package.json":           `{"main": "lib/express.js", "dependencies": {"debug": "^4"}}`,
+		modules + "/express/lib/express.js":         "require('./router')\n",
+		modules + "/express/lib/router/index.js":    "",
+		modules + "/express/README.md":              "",
+		modules + "/debug/package.json":             `{}`,
+		modules + "/debug/index.js":                 "",
+		modules + "/@scope/pkg/package.json":        `{"main": "index.js"}`,
+		modules + "/@scope/pkg/index.js":            "",
+		modules + "/@scope/pkg/sub.js":              "",
+		modules + "/addon/package.json":             `{"main": "build/Release/addon.node"}`,
+		modules + "/addon/build/Release/addon.node": "\x7fELF",
+		modules + "/lodash/index.js":                "",
+		"/usr/lib/node/globalmod/index.js":          "",
+	}, nil)
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "NODE_PATH=/usr/lib/node"}
+	tests := []struct {
+		name     string
+		metadata types.DockerConfig
+		want     []string
+		absent   []string
+	}{
+		{
+			name:     "script",
+			metadata: types.DockerConfig{Cmd: []string{"node", "server.js"}, WorkingDir: "/app", Env: env},
+			want: []string{
+				"/usr/local/bin/node", "/app/server.js", "/app/package.json",
+				// Relative modules, as files and directories.
+				"/app/lib/util.js", "/app/shared/index.js", "/app/lazy.mjs", "/app/polyfill.js",
+				// Packages whole, with their dependencies.
+				modules + "/express/package.json", modules + "/express/lib/express.js",
+				modules + "/express/lib/router/index.js", modules + "/express/README.md",
+				modules + "/debug/index.js",
+				// A scoped package imported with a subpath from an ES module.
+				modules + "/@scope/pkg/index.js", modules + "/@scope/pkg/sub.js",
+				// A native addon.
+				modules + "/addon/build/Release/addon.node",
+				// NODE_PATH.
+				"/usr/lib/node/globalmod/index.js",
+			},
+			absent: []string{modules + "/lodash/index.js", "/app/test/server.test.js", "/app/preload.js"},
+		},
+		{
+			name: "preloaded module and eval",
+			metadata: types.DockerConfig{Entrypoint: []string{"node", "-r", "./preload.js", "-e", "require('debug')"},
+				WorkingDir: "/app", Env: env},
+			want:   []string{"/app/preload.js", modules + "/debug/index.js"},
+			absent: []string{"/app/server.js", modules + "/express/lib/express.js"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analyze(t, Node{}, envPath, tt.metadata, tt.want, tt.absent)
+		})
+	}
+}
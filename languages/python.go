@@ -0,0 +1,210 @@
+package languages
+
+import (
+	"cmp"
+	"context"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Python finds the standard library, the site packages and the modules a
+// Python program imports, following sys.path as the interpreter builds it.
+// Imports are read from the source with regular expressions, which also sees
+// conditional and lazy ones, and packages are kept whole.
+type Python struct{}
+
+var (
+	pythonImport  = regexp.MustCompile(`(?m)^[ \t]*import[ \t]+([^\n#;]+)`)
+	pythonFrom    = regexp.MustCompile(`(?m)^[ \t]*from[ \t]+([\w.]+)[ \t]+import\b`)
+	pythonDynamic = regexp.MustCompile(`(?:import_module|__import__)\(\s*['"]([\w.]+)['"]`)
+	pythonVersion = regexp.MustCompile(`^python(\d+\.\d+)$`)
+)
+
+// pythonStartup are the modules the interpreter imports before the program.
+var pythonStartup = []string{
+	"site", "os", "encodings", "codecs", "io", "abc", "stat", "posixpath", "genericpath",
+	"_collections_abc", "_sitebuiltins", "sitecustomize", "usercustomize",
+}
+
+// pythonOptions are the command line options taking a value.
+var pythonOptions = []string{"-W", "-X", "-Q", "--check-hash-based-pycs"}
+
+func (Python) Name() string {
+	return "python"
+}
+
+// python is the state of the analysis of one program.
+type python struct {
+	*program
+	version string
+	// path is sys.path.
+	path     []string
+	resolved map[string]bool
+	pending  []string
+}
+
+func (Python) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	p, err := newProgram(image)
+	if err != nil {
+		return types.FileSet{}, err
+	}
+	if !p.is("python") {
+		return types.FileSet{}, analyzer.ErrNotApplicable
+	}
+	py := &python{program: p, resolved: make(map[string]bool)}
+	prefix := filepath.Dir(filepath.Dir(p.interpreter))
+	if match := pythonVersion.FindStringSubmatch(filepath.Base(p.interpreter)); match != nil {
+		py.version = match[1]
+	} else if landmarks := p.glob(prefix + "/lib/python3.*/os.py"); len(landmarks) > 0 {
+		py.version = strings.TrimPrefix(filepath.Base(filepath.Dir(landmarks[0])), "python")
+	}
+	log.Info("Analyzing Python ", py.version, " program ", strings.Join(p.args, " "))
+	p.add(p.command)
+	p.addLibraries(p.interpreter)
+
+	// sys.path[0] is the directory of the script, or the working directory.
+	entry, module, code := py.entry()
+	if entry != "" {
+		py.path = append(py.path, filepath.Dir(entry))
+	} else {
+		py.path = append(py.path, p.workingDir)
+	}
+	for _, dir := range filepath.SplitList(p.getenv("PYTHONPATH")) {
+		if dir != "" {
+			py.path = append(py.path, p.path(dir))
+		}
+	}
+	version := "python" + py.version
+	stdlib := prefix + "/lib/" + version
+	py.path = append(py.path,
+		prefix+"/lib/python"+strings.ReplaceAll(py.version, ".", "")+".zip",
+		stdlib, stdlib+"/lib-dynload")
+	sitePackages := []string{
+		stdlib + "/site-packages",
+		"/usr/local/lib/" + version + "/site-packages",
+		"/usr/local/lib/" + version + "/dist-packages",
+		"/usr/lib/python3/dist-packages",
+		"/usr/lib/" + version + "/dist-packages",
+		cmp.Or(p.getenv("HOME"), "/root") + "/.local/lib/" + version + "/site-packages",
+	}
+	// A virtual environment has its own site packages on top of the ones of
+	// the interpreter it was created from.
+	if venv := filepath.Dir(filepath.Dir(p.command)); p.exists(venv + "/pyvenv.cfg") {
+		p.add(venv + "/pyvenv.cfg")
+		sitePackages = append([]string{venv + "/lib/" + version + "/site-packages"}, sitePackages...)
+	}
+	for _, dir := range sitePackages {
+		if !p.isDir(dir) || slices.Contains(py.path, dir) {
+			continue
+		}
+		py.path = append(py.path, dir)
+		// Distribution metadata is read by importlib.metadata and .pth files
+		// extend sys.path or import modules at startup.
+		for _, pattern := range []string{"/*.dist-info", "/*.egg-info", "/*.egg-link", "/*.pth"} {
+			for _, match := range p.glob(dir + pattern) {
+				p.add(match)
+			}
+		}
+		for _, pth := range p.glob(dir + "/*.pth") {
+			py.importAll(p.scan(pth, pythonImport))
+		}
+	}
+	py.path = slices.DeleteFunc(py.path, func(dir string) bool { return !p.exists(dir) })
+
+	p.add(stdlib+"/lib-dynload", ".so")
+	for _, sysconfig := range p.glob(stdlib + "/_sysconfigdata*.py") {
+		p.add(sysconfig)
+	}
+	py.importAll(pythonStartup)
+	switch {
+	case entry != "":
+		p.add(entry)
+		py.importAll(p.scan(entry, pythonImport, pythonFrom, pythonDynamic))
+	case module != "":
+		py.importAll([]string{"runpy", module})
+	case code != "":
+		py.importAll(submatches([]byte(code), pythonImport, pythonFrom, pythonDynamic))
+	}
+	for len(py.pending) > 0 && ctx.Err() == nil {
+		name := py.pending[0]
+		py.pending = py.pending[1:]
+		py.resolve(name)
+	}
+	return p.result()
+}
+
+// entry returns the script, module or code the command line runs.
+func (py *python) entry() (script string, module string, code string) {
+	args := py.args
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-m" && i+1 < len(args):
+			return "", args[i+1], ""
+		case arg == "-c" && i+1 < len(args):
+			return "", "", args[i+1]
+		case strings.HasPrefix(arg, "-m") && len(arg) > 2:
+			return "", arg[2:], ""
+		case slices.Contains(pythonOptions, arg):
+			i++
+		case arg == "-":
+			return "", "", ""
+		case !strings.HasPrefix(arg, "-"):
+			return py.program.path(arg), "", ""
+		}
+	}
+	return "", "", ""
+}
+
+// importAll queues the top level packages of the imports in specs, which are
+// module names or the text following an import statement.
+func (py *python) importAll(specs []string) {
+	for _, spec := range specs {
+		for _, name := range strings.Split(spec, ",") {
+			fields := strings.Fields(strings.Trim(name, " \t()\\"))
+			if len(fields) == 0 {
+				continue
+			}
+			top, _, _ := strings.Cut(fields[0], ".")
+			if top != "" && !py.resolved[top] {
+				py.resolved[top] = true
+				py.pending = append(py.pending, top)
+			}
+		}
+	}
+}
+
+// resolve adds the first module or package named name on sys.path and
+// queues its imports. Built-in modules are not found and need nothing.
+func (py *python) resolve(name string) {
+	p := py.program
+	for _, dir := range py.path {
+		base := dir + "/" + name
+		switch {
+		case p.isDir(base):
+			p.add(base, ".so")
+			py.importAll(p.scanTree(base, []string{".py"}, pythonImport, pythonFrom, pythonDynamic))
+			return
+		case p.exists(base + ".py"):
+			p.add(base + ".py")
+			for _, cached := range p.glob(dir + "/__pycache__/" + name + ".*.pyc") {
+				p.add(cached)
+			}
+			py.importAll(p.scan(base+".py", pythonImport, pythonFrom, pythonDynamic))
+			return
+		}
+		extensions := slices.Concat(p.glob(base+".*.so"), p.glob(base+".so"))
+		if len(extensions) > 0 {
+			for _, extension := range extensions {
+				p.add(extension)
+				p.addLibraries(extension)
+			}
+			return
+		}
+	}
+}
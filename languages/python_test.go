@@ -0,0 +1,112 @@
+package languages
+
+import (
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestPython(t *testing.T) {
+	const (
+		elf    = "\x7fELF"
+		stdlib = "/usr/local/lib/python3.12"
+		site   = stdlib + "/site-packages"
+	)
+	envPath := writeEnv(t, map[string]string{
+		"/usr/local/bin/python3.12":                                   elf,
+		stdlib + "/os.py":                                             "import abc\n",
+		stdlib + "/site.py":                                           "",
+		stdlib + "/abc.py":                                            "",
+		stdlib + "/encodings/__init__.py":                             "from . import aliases\n",
+		stdlib + "/encodings/aliases.py":                              "",
+		stdlib + "/json/__init__.py":                                  "from .decoder import JSONDecoder\n",
+		stdlib + "/json/decoder.py":                                   "import re\n",
+		stdlib + "/re.py":                                             "",
+		stdlib + "/__pycache__/re.cpython-312.pyc":                    "",
+		stdlib + "/smtplib.py":                                        "",
+		stdlib + "/_sysconfigdata__linux_x86_64-linux-gnu.py":         "",
+		stdlib + "/lib-dynload/_json.cpython-312-x86_64-linux-gnu.so": elf,
+		site + "/requests/__init__.py":                                "import urllib3\nfrom . import api\n",
+		site + "/requests/api.py":                                     "",
+		site + "/requests-2.31.0.dist-info/METADATA":                  "",
+		site + "/urllib3/__init__.py":                                 "",
+		site + "/_cffi_backend.cpython-312-x86_64-linux-gnu.so":       elf,
+		site + "/hooks.pth":                                           "import pthhook\n",
+		site + "/pthhook.py":                                          "",
+		site + "/flask/__init__.py":                                   "",
+		"/app/main.py": "#!/usr/bin/env python3\n" +
+			"import json, requests  # the API\n" +
+			"from helpers import greet\n" +
+			"import _cffi_backend\n" +
+			"plugins = importlib.import_module('plugins.mail')\n",
+		"/app/plugins/__init__.py":                                 "",
+		"/app/plugins/mail.py":                                     "import smtplib\n",
+		"/app/tests/test_main.py":                                  "import pytest\n",
+		"/app/lib/helpers.py":                                      "",
+		"/opt/venv/pyvenv.cfg":                                     "home = /usr/local/bin\n",
+		"/opt/venv/lib/python3.12/site-packages/flask/__init__.py": "import werkzeug\n",
+		"/opt/venv/lib/python3.12/site-packages/werkzeug.py":       "",
+	}, map[string]string{
+		"/usr/local/bin/python3": "python3.12",
+		"/opt/venv/bin/python":   "/usr/local/bin/python3.12",
+	})
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "PYTHONPATH=/app/lib"}
+	tests := []struct {
+		name     string
+		metadata types.DockerConfig
+		want     []string
+		absent   []string
+	}{
+		{
+			name:     "script",
+			metadata: types.DockerConfig{Cmd: []string{"python3", "main.py"}, WorkingDir: "/app", Env: env},
+			want: []string{
+				"/usr/local/bin/python3", "/usr/local/bin/python3.12", "/app/main.py",
+				// The startup modules and the standard library imported.
+				stdlib + "/os.py", stdlib + "/site.py", stdlib + "/abc.py", stdlib + "/encodings/aliases.py",
+				stdlib + "/_sysconfigdata__linux_x86_64-linux-gnu.py",
+				stdlib + "/lib-dynload/_json.cpython-312-x86_64-linux-gnu.so",
+				stdlib + "/json/__init__.py", stdlib + "/json/decoder.py",
+				stdlib + "/re.py", stdlib + "/__pycache__/re.cpython-312.pyc",
+				// Site packages, their metadata and the imports of .pth files.
+				site + "/requests/__init__.py", site + "/requests/api.py", site + "/urllib3/__init__.py",
+				site + "/requests-2.31.0.dist-info/METADATA", site + "/hooks.pth", site + "/pthhook.py",
+				// A native extension module.
+				site + "/_cffi_backend.cpython-312-x86_64-linux-gnu.so",
+				// PYTHONPATH and a package imported dynamically next to the script.
+				"/app/lib/helpers.py", "/app/plugins/__init__.py", "/app/plugins/mail.py", stdlib + "/smtplib.py",
+			},
+			absent: []string{site + "/flask/__init__.py", "/app/tests/test_main.py", "/opt/venv/pyvenv.cfg"},
+		},
+		{
+			name:     "module",
+			metadata: types.DockerConfig{Cmd: []string{"python3", "-m", "flask"}, WorkingDir: "/", Env: env},
+			want:     []string{site + "/flask/__init__.py", stdlib + "/os.py"},
+			absent:   []string{"/app/main.py", site + "/requests/__init__.py"},
+		},
+		{
+			name: "code",
+			metadata: types.DockerConfig{Entrypoint: []string{"python3", "-c", "import urllib3; print(1)"},
+				WorkingDir: "/", Env: env},
+			want:   []string{site + "/urllib3/__init__.py"},
+			absent: []string{site + "/requests/__init__.py"},
+		},
+		{
+			// The site packages of the virtual environment come first.
+			name: "virtual environment",
+			metadata: types.DockerConfig{Entrypoint: []string{"/opt/venv/bin/python", "-m", "flask"},
+				WorkingDir: "/", Env: env},
+			want: []string{
+				"/opt/venv/bin/python", "/opt/venv/pyvenv.cfg", "/usr/local/bin/python3.12",
+				"/opt/venv/lib/python3.12/site-packages/flask/__init__.py",
+				"/opt/venv/lib/python3.12/site-packages/werkzeug.py",
+			},
+			absent: []string{site + "/flask/__init__.py"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analyze(t, Python{}, envPath, tt.metadata, tt.want, tt.absent)
+		})
+	}
+}
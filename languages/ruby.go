@@ -0,0 +1,193 @@
+package languages
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/analyzer"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// Ruby finds the Ruby installation with its standard library and default
+// gems, the gems of the bundle, as locked by Gemfile.lock when there is one,
+// and the files the program loads with require_relative.
+type Ruby struct{}
+
+var (
+	rubyRelative = regexp.MustCompile(`\brequire_relative\s*\(?\s*['"]([^'"\n]+)['"]`)
+	rubyLocal    = regexp.MustCompile(`\b(?:require|load)\s*\(?\s*['"](\.{1,2}/[^'"\n]+)['"]`)
+	// rubySpec matches the gems of the specs sections of Gemfile.lock, which
+	// are indented by four spaces, their dependencies by six.
+	rubySpec = regexp.MustCompile(`^    ([^ (]+) \(([^)]+)\)$`)
+)
+
+// rubyOptions are the command line options taking a separate value.
+var rubyOptions = []string{"-I", "-r", "-C", "-E", "-F", "-x"}
+
+func (Ruby) Name() string {
+	return "ruby"
+}
+
+// ruby is the state of the analysis of one program.
+type ruby struct {
+	*program
+	pending []string
+}
+
+func (Ruby) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	p, err := newProgram(image)
+	if err != nil {
+		return types.FileSet{}, err
+	}
+	if !p.is("ruby") {
+		return types.FileSet{}, analyzer.ErrNotApplicable
+	}
+	r := &ruby{program: p}
+	prefix := filepath.Dir(filepath.Dir(p.interpreter))
+	log.Info("Analyzing Ruby program ", strings.Join(p.args, " "))
+	p.add(p.command)
+	p.addLibraries(p.interpreter)
+	// The standard library, the extensions and the default gems.
+	p.add(prefix+"/lib/ruby", ".so")
+	for _, gemrc := range []string{"/etc/gemrc", prefix + "/etc/gemrc"} {
+		p.add(gemrc)
+	}
+
+	var script string
+	args := p.args
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-I" && i+1 < len(args):
+			p.add(p.path(args[i+1]), ".so")
+			i++
+		case strings.HasPrefix(arg, "-I") && len(arg) > 2:
+			p.add(p.path(arg[2:]), ".so")
+		case arg == "-e" && i+1 < len(args):
+			r.queue(p.workingDir, submatches([]byte(args[i+1]), rubyRelative, rubyLocal))
+			i = len(args)
+		case slices.Contains(rubyOptions, arg):
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			script = p.path(arg)
+			i = len(args)
+		}
+	}
+	for _, dir := range filepath.SplitList(p.getenv("RUBYLIB")) {
+		if dir != "" {
+			p.add(p.path(dir), ".so")
+		}
+	}
+	r.addBundle(script)
+	if script != "" {
+		r.pending = append(r.pending, script)
+	}
+	for len(r.pending) > 0 && ctx.Err() == nil {
+		file := r.pending[0]
+		r.pending = r.pending[1:]
+		p.add(file)
+		r.queue(filepath.Dir(file), p.scan(file, rubyRelative, rubyLocal))
+	}
+	return p.result()
+}
+
+// queue queues the files loaded relative to dir.
+func (r *ruby) queue(dir string, paths []string) {
+	for _, path := range paths {
+		path = filepath.Join(dir, path)
+		if !strings.HasSuffix(path, ".rb") && !r.program.exists(path) {
+			path += ".rb"
+		}
+		if r.program.exists(path) && !r.program.scanned[path] {
+			r.pending = append(r.pending, path)
+		}
+	}
+}
+
+// addBundle adds the gems installed for the program. With a Gemfile.lock only
+// the locked gems are added, otherwise every installed gem.
+func (r *ruby) addBundle(script string) {
+	p := r.program
+	gemfile := p.getenv("BUNDLE_GEMFILE")
+	if gemfile == "" {
+		for _, dir := range []string{p.workingDir, filepath.Dir(script)} {
+			if filepath.IsAbs(dir) && p.exists(dir+"/Gemfile") {
+				gemfile = dir + "/Gemfile"
+				break
+			}
+		}
+	} else {
+		gemfile = p.path(gemfile)
+	}
+	gemDirs := []string{}
+	for _, variable := range []string{"GEM_HOME", "BUNDLE_PATH"} {
+		if dir := p.getenv(variable); dir != "" {
+			gemDirs = append(gemDirs, p.path(dir))
+		}
+	}
+	for _, dir := range filepath.SplitList(p.getenv("GEM_PATH")) {
+		if dir != "" {
+			gemDirs = append(gemDirs, p.path(dir))
+		}
+	}
+	// BUNDLE_PATH holds the gems below ruby/VERSION.
+	for _, dir := range slices.Clone(gemDirs) {
+		gemDirs = append(gemDirs, p.glob(dir+"/ruby/*")...)
+	}
+	if config := p.getenv("BUNDLE_APP_CONFIG"); config != "" {
+		p.add(p.path(config) + "/config")
+	}
+
+	locked := r.lockedGems(gemfile + ".lock")
+	if gemfile != "" {
+		p.add(gemfile)
+		p.add(gemfile + ".lock")
+		p.add(filepath.Dir(gemfile) + "/.bundle/config")
+	}
+	for _, dir := range gemDirs {
+		if !p.isDir(dir) {
+			continue
+		}
+		p.add(dir+"/bin", ".so")
+		if locked == nil {
+			for _, sub := range []string{"/gems", "/specifications", "/extensions", "/bundler"} {
+				p.add(dir+sub, ".so")
+			}
+			continue
+		}
+		for _, gem := range locked {
+			// Platform gems carry a suffix such as -x86_64-linux, gems from git
+			// the revision instead of the version.
+			for _, pattern := range []string{"/gems/" + gem[0] + "-" + gem[1] + "*",
+				"/specifications/" + gem[0] + "-" + gem[1] + "*.gemspec",
+				"/extensions/*/*/" + gem[0] + "-" + gem[1] + "*", "/bundler/gems/" + gem[0] + "-*"} {
+				for _, match := range p.glob(dir + pattern) {
+					p.add(match, ".so")
+				}
+			}
+		}
+	}
+}
+
+// lockedGems returns the name and version of every gem locked in the
+// Gemfile.lock at path, or nil when there is none.
+func (r *ruby) lockedGems(path string) [][2]string {
+	file, err := os.Open(r.program.rootfsPath + path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	gems := [][2]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := rubySpec.FindStringSubmatch(scanner.Text()); match != nil {
+			gems = append(gems, [2]string{match[1], match[2]})
+		}
+	}
+	return gems
+}
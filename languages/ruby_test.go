@@ -0,0 +1,98 @@
+package languages
+
+import (
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestRuby(t *testing.T) {
+	const gems = "/usr/local/bundle"
+	envPath := writeEnv(t, map[string]string{
+		"/usr/local/bin/ruby":                           "\x7fELF",
+		"/usr/local/lib/ruby/3.3.0/json.rb":             "",
+		"/usr/local/lib/ruby/3.3.0/x86_64-linux/etc.so": "\x7fELF",
+		"/usr/local/etc/gemrc":                          "gem: --no-document\n",
+		"/usr/local/share/ri/3.3.0/system/String.ri":    "",
+
+		gems + "/gems/rack-3.0.8/lib/rack.rb":                                  "",
+		gems + "/specifications/rack-3.0.8.gemspec":                            "",
+		gems + "/gems/nokogiri-1.16.0-x86_64-linux/lib/nokogiri.rb":            "",
+		gems + "/gems/nokogiri-1.16.0-x86_64-linux/lib/nokogiri/nokogiri.so":   "\x7fELF",
+		gems + "/specifications/nokogiri-1.16.0-x86_64-linux.gemspec":          "",
+		gems + "/extensions/x86_64-linux/3.3.0/nio4r-2.7.0/gem.build_complete": "",
+		gems + "/gems/nio4r-2.7.0/lib/nio.rb":                                  "",
+		gems + "/bundler/gems/sinatra-1a2b3c4d/lib/sinatra.rb":                 "",
+		gems + "/gems/puma-6.4.0/lib/puma.rb":                                  "",
+		gems + "/specifications/puma-6.4.0.gemspec":                            "",
+		gems + "/bin/rackup": "#!/usr/local/bin/ruby\n",
+
+		"/app/Gemfile": "source 'https://rubygems.org'\ngem 'rack'\n",
+		"/app/Gemfile.lock": "GIT\n  remote: https://github.com/sinatra/sinatra\n  specs:\n" +
+			"    sinatra (4.0.0)\n      rack (>= 3)\n\n" +
+			"GEM\n  remote: https://rubygems.org/\n  specs:\n" +
+			"    nio4r (2.7.0)\n    nokogiri (1.16.0-x86_64-linux)\n      racc (~> 1.4)\n    rack (3.0.8)\n\n" +
+			"PLATFORMS\n  x86_64-linux\n",
+		"/app/.bundle/config": "BUNDLE_DEPLOYMENT: \"true\"\n",
+		"/app/app.rb": "require_relative 'lib/routes'\nrequire 'rack'\nload './config/boot.rb'\n" +
+			"require_relative \"missing\"\n",
+		"/app/lib/routes.rb":    "require_relative('handlers')\n",
+		"/app/lib/handlers.rb":  "",
+		"/app/lib/admin.rb":     "",
+		"/app/config/boot.rb":   "",
+		"/app/spec/app_spec.rb": "require_relative '../app'\n",
+		"/srv/tool.rb":          "require 'puma'\n",
+	}, nil)
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin", "GEM_HOME=" + gems}
+	runtime := []string{
+		"/usr/local/bin/ruby", "/usr/local/lib/ruby/3.3.0/json.rb", "/usr/local/lib/ruby/3.3.0/x86_64-linux/etc.so",
+		"/usr/local/etc/gemrc", gems + "/bin/rackup",
+	}
+	tests := []struct {
+		name     string
+		metadata types.DockerConfig
+		want     []string
+		absent   []string
+	}{
+		{
+			name:     "bundle",
+			metadata: types.DockerConfig{Cmd: []string{"ruby", "app.rb"}, WorkingDir: "/app", Env: env},
+			want: append([]string{
+				"/app/app.rb", "/app/lib/routes.rb", "/app/lib/handlers.rb", "/app/config/boot.rb",
+				"/app/Gemfile", "/app/Gemfile.lock", "/app/.bundle/config",
+				// The locked gems only, platform and git gems included.
+				gems + "/gems/rack-3.0.8/lib/rack.rb", gems + "/specifications/rack-3.0.8.gemspec",
+				gems + "/gems/nokogiri-1.16.0-x86_64-linux/lib/nokogiri.rb",
+				gems + "/gems/nokogiri-1.16.0-x86_64-linux/lib/nokogiri/nokogiri.so",
+				gems + "/specifications/nokogiri-1.16.0-x86_64-linux.gemspec",
+				gems + "/extensions/x86_64-linux/3.3.0/nio4r-2.7.0/gem.build_complete",
+				gems + "/bundler/gems/sinatra-1a2b3c4d/lib/sinatra.rb",
+			}, runtime...),
+			absent: []string{
+				gems + "/gems/puma-6.4.0/lib/puma.rb", gems + "/specifications/puma-6.4.0.gemspec",
+				"/app/lib/admin.rb", "/app/spec/app_spec.rb", "/usr/local/share/ri/3.3.0/system/String.ri",
+			},
+		},
+		{
+			name:     "every installed gem without a lockfile",
+			metadata: types.DockerConfig{Cmd: []string{"ruby", "-W0", "tool.rb"}, WorkingDir: "/srv", Env: env},
+			want: append([]string{
+				"/srv/tool.rb", gems + "/gems/puma-6.4.0/lib/puma.rb", gems + "/gems/rack-3.0.8/lib/rack.rb",
+				gems + "/bundler/gems/sinatra-1a2b3c4d/lib/sinatra.rb",
+			}, runtime...),
+			absent: []string{"/app/Gemfile.lock", "/app/app.rb"},
+		},
+		{
+			name: "load path and code",
+			metadata: types.DockerConfig{Entrypoint: []string{"ruby", "-I", "/app/lib", "-e", "require_relative 'config/boot'"},
+				WorkingDir: "/app", Env: env},
+			want:   []string{"/app/lib/admin.rb", "/app/lib/routes.rb", "/app/config/boot.rb"},
+			absent: []string{"/app/app.rb"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analyze(t, Ruby{}, envPath, tt.metadata, tt.want, tt.absent)
+		})
+	}
+}
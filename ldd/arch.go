@@ -0,0 +1,61 @@
+package ldd
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+)
+
+// arch describes the loader conventions of one target architecture, so that
+// images can be analysed regardless of the architecture of the host.
+type arch struct {
+	name    string
+	machine elf.Machine
+	class   elf.Class
+	data    elf.Data
+	// triplet is the Debian multiarch tuple libraries are installed under.
+	triplet string
+	// systemDirs are the directories glibc searches after the cache.
+	systemDirs []string
+}
+
+var archs = []arch{
+	{"x86_64", elf.EM_X86_64, elf.ELFCLASS64, elf.ELFDATA2LSB, "x86_64-linux-gnu", []string{"/lib64", "/usr/lib64"}},
+	{"i386", elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB, "i386-linux-gnu", []string{"/lib", "/usr/lib"}},
+	{"aarch64", elf.EM_AARCH64, elf.ELFCLASS64, elf.ELFDATA2LSB, "aarch64-linux-gnu", []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64"}},
+	{"armhf", elf.EM_ARM, elf.ELFCLASS32, elf.ELFDATA2LSB, "arm-linux-gnueabihf", []string{"/lib", "/usr/lib"}},
+	{"ppc64le", elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2LSB, "powerpc64le-linux-gnu", []string{"/lib64", "/usr/lib64"}},
+	{"ppc64", elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2MSB, "powerpc64-linux-gnu", []string{"/lib64", "/usr/lib64"}},
+	{"s390x", elf.EM_S390, elf.ELFCLASS64, elf.ELFDATA2MSB, "s390x-linux-gnu", []string{"/lib64", "/usr/lib64"}},
+	{"riscv64", elf.EM_RISCV, elf.ELFCLASS64, elf.ELFDATA2LSB, "riscv64-linux-gnu", []string{"/lib64/lp64d", "/usr/lib64/lp64d", "/lib64", "/usr/lib64"}},
+}
+
+// EF_ARM_ABI_FLOAT_HARD marks ARM objects using the hard-float calling
+// convention, which cannot be mixed with soft-float ones.
+const efArmAbiFloatHard = 0x400
+
+// lookupArch returns the architecture of objects of class, machine and byte
+// order data. The byte order tells apart the triplets of machines running
+// either way, like ppc64 and ppc64le.
+func lookupArch(class elf.Class, machine elf.Machine, data elf.Data) (arch, bool) {
+	for _, a := range archs {
+		if a.class == class && a.machine == machine && a.data == data {
+			return a, true
+		}
+	}
+	return arch{}, false
+}
+
+// headerFlags returns e_flags of the ELF header of file, which debug/elf
+// does not expose.
+func headerFlags(file *os.File, class elf.Class, order binary.ByteOrder) uint32 {
+	offset := int64(36)
+	if class == elf.ELFCLASS64 {
+		offset = 48
+	}
+	data := make([]byte, 4)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return 0
+	}
+	return order.Uint32(data)
+}
@@ -0,0 +1,320 @@
+package ldd
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/types"
+	"github.com/regelepuma/dockerminimizer/utils"
+)
+
+// object is a loaded ELF file together with the dynamic section entries
+// that influence how its dependencies are searched for.
+type object struct {
+	path    string
+	needed  []string
+	rpath   []string
+	runpath []string
+	interp  string
+}
+
+// resolver walks the dependency closure of an executable inside an extracted
+// rootfs the way the dynamic loader of the image would, without running it.
+type resolver struct {
+	rootfsPath      string
+	class           elf.Class
+	machine         elf.Machine
+	data            elf.Data
+	hardFloat       bool
+	libraryPath     []string
+	cache           map[string][]string
+	defaultDirs     []string
+	loaded          map[string]bool
+	files           types.FileSet
+	executableRpath []string
+}
+
+func (r *resolver) open(path string) (*elf.File, error) {
+	resolved, err := utils.ResolveInRoot(r.rootfsPath, path)
+	if err != nil {
+		return nil, err
+	}
+	return elf.Open(r.rootfsPath + resolved)
+}
+
+func (r *resolver) isHardFloat(path string, file *elf.File) bool {
+	resolved, err := utils.ResolveInRoot(r.rootfsPath, path)
+	if err != nil {
+		return false
+	}
+	fd, err := os.Open(r.rootfsPath + resolved)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	return headerFlags(fd, file.Class, file.ByteOrder)&efArmAbiFloatHard != 0
+}
+
+// compatible reports whether path is an ELF object the loader would accept
+// for the executable being resolved.
+func (r *resolver) compatible(path string) bool {
+	file, err := r.open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if file.Class != r.class || file.Machine != r.machine || file.Data != r.data {
+		return false
+	}
+	return r.machine != elf.EM_ARM || r.isHardFloat(path, file) == r.hardFloat
+}
+
+func splitPaths(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ':' || r == ';'
+	})
+}
+
+func dynStrings(file *elf.File, tag elf.DynTag) []string {
+	values, err := file.DynString(tag)
+	if err != nil {
+		return nil
+	}
+	result := []string{}
+	for _, value := range values {
+		result = append(result, splitPaths(value)...)
+	}
+	return result
+}
+
+func interpreter(file *elf.File) string {
+	for _, prog := range file.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return ""
+		}
+		return strings.TrimRight(string(data), "\x00")
+	}
+	return ""
+}
+
+func (r *resolver) load(path string) (*object, error) {
+	file, err := r.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	obj := &object{path: path, interp: interpreter(file)}
+	obj.needed, _ = file.DynString(elf.DT_NEEDED)
+	obj.rpath = dynStrings(file, elf.DT_RPATH)
+	obj.runpath = dynStrings(file, elf.DT_RUNPATH)
+	return obj, nil
+}
+
+// expand substitutes the dynamic string tokens the loader supports in
+// search paths of obj.
+func (r *resolver) expand(dirs []string, obj *object) []string {
+	lib := "lib"
+	if r.class == elf.ELFCLASS64 && utils.CheckIfDirectoryExists("/lib64", r.rootfsPath) {
+		lib = "lib64"
+	}
+	origin := filepath.Dir(obj.path)
+	if resolved, err := utils.ResolveInRoot(r.rootfsPath, obj.path); err == nil {
+		origin = filepath.Dir(resolved)
+	}
+	replacer := strings.NewReplacer(
+		"${ORIGIN}", origin, "$ORIGIN", origin,
+		"${LIB}", lib, "$LIB", lib,
+		// The platform is only known at run time, directories using it are skipped.
+		"${PLATFORM}", "\x00", "$PLATFORM", "\x00",
+	)
+	expanded := []string{}
+	for _, dir := range dirs {
+		dir = replacer.Replace(dir)
+		if strings.Contains(dir, "\x00") || !filepath.IsAbs(dir) {
+			continue
+		}
+		expanded = append(expanded, filepath.Clean(dir))
+	}
+	return expanded
+}
+
+func (r *resolver) searchDirs(dirs []string, soname string) string {
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, soname)
+		if r.compatible(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// find locates soname for loader following the search order of ld.so(8):
+// DT_RPATH unless DT_RUNPATH is set, LD_LIBRARY_PATH, DT_RUNPATH, the
+// ld.so.cache and finally the default directories.
+func (r *resolver) find(soname string, loader *object) string {
+	if strings.Contains(soname, "/") {
+		if r.compatible(soname) {
+			return filepath.Clean(soname)
+		}
+		return ""
+	}
+	if len(loader.runpath) == 0 {
+		if found := r.searchDirs(r.expand(loader.rpath, loader), soname); found != "" {
+			return found
+		}
+		if found := r.searchDirs(r.executableRpath, soname); found != "" {
+			return found
+		}
+	}
+	if found := r.searchDirs(r.libraryPath, soname); found != "" {
+		return found
+	}
+	if found := r.searchDirs(r.expand(loader.runpath, loader), soname); found != "" {
+		return found
+	}
+	for _, candidate := range r.cache[soname] {
+		if r.compatible(candidate) {
+			return candidate
+		}
+	}
+	return r.searchDirs(r.defaultDirs, soname)
+}
+
+// hwcapsVariants returns the compatible copies of the library at path in the
+// glibc-hwcaps subdirectories of its directory, or its copy in that directory
+// when path is itself one of them. The loader picks among them by the CPU it
+// runs on, which is not known in advance, so all of them are kept.
+func (r *resolver) hwcapsVariants(path string) []string {
+	dir, soname := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if filepath.Base(filepath.Dir(dir)) == "glibc-hwcaps" {
+		dir = filepath.Dir(filepath.Dir(dir))
+	}
+	candidates, _ := filepath.Glob(r.rootfsPath + filepath.Join(dir, "glibc-hwcaps", "*", soname))
+	for i, candidate := range candidates {
+		candidates[i] = strings.TrimPrefix(candidate, r.rootfsPath)
+	}
+	candidates = append(candidates, filepath.Join(dir, soname))
+	variants := []string{}
+	for _, candidate := range candidates {
+		if candidate != path && r.compatible(candidate) {
+			variants = append(variants, candidate)
+		}
+	}
+	return variants
+}
+
+func (r *resolver) add(path string, reason string) {
+	utils.AddFile(path, &r.files, r.rootfsPath, types.Source{Reason: reason})
+}
+
+func (r *resolver) walk(obj *object) error {
+	var errs []error
+	for _, soname := range obj.needed {
+		if r.loaded[soname] {
+			continue
+		}
+		r.loaded[soname] = true
+		path := r.find(soname, obj)
+		if path == "" {
+			errs = append(errs, fmt.Errorf("%s: not found", soname))
+			continue
+		}
+		log.Info("Resolved ", soname, " => ", path)
+		for _, path := range append([]string{path}, r.hwcapsVariants(path)...) {
+			r.add(path, "needed by "+obj.path)
+			dep, err := r.load(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				continue
+			}
+			errs = append(errs, r.walk(dep))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func libraryPath(env []string) []string {
+	var dirs []string
+	// Later definitions override earlier ones, as in the container.
+	for _, variable := range env {
+		if value, ok := strings.CutPrefix(variable, "LD_LIBRARY_PATH="); ok {
+			dirs = splitPaths(value)
+		}
+	}
+	return dirs
+}
+
+func defaultDirs(rootfsPath string, class elf.Class, machine elf.Machine, data elf.Data) []string {
+	dirs := readLdSoConf(rootfsPath, "/etc/ld.so.conf", map[string]bool{})
+	// musl reads its search path from a per architecture file instead.
+	matches, _ := filepath.Glob(rootfsPath + "/etc/ld-musl-*.path")
+	for _, match := range matches {
+		dirs = append(dirs, readLdSoConf(rootfsPath, strings.TrimPrefix(match, rootfsPath), map[string]bool{})...)
+	}
+	if a, ok := lookupArch(class, machine, data); ok {
+		log.Info("Resolving libraries for architecture ", a.name)
+		dirs = append(dirs, "/lib/"+a.triplet, "/usr/lib/"+a.triplet)
+		dirs = append(dirs, a.systemDirs...)
+	} else {
+		log.Info("Unknown architecture ", machine, ", using generic library directories")
+	}
+	return append(dirs, "/lib", "/usr/local/lib", "/usr/lib")
+}
+
+// Resolve computes the shared libraries, including the program interpreter,
+// that executable needs to run inside the rootfs by reading the ELF dynamic
+// sections of the executable and of its dependencies. env is the environment
+// of the container, used for LD_LIBRARY_PATH. Libraries come with their
+// glibc-hwcaps variants, as the CPU decides which one is loaded. Nothing from
+// the image is executed and the architecture is taken from the executable, so
+// images of any architecture can be analysed on any host.
+func Resolve(executable string, rootfsPath string, env []string) (types.FileSet, error) {
+	r := &resolver{
+		rootfsPath: rootfsPath,
+		loaded:     make(map[string]bool),
+		files:      types.NewFileSet(),
+	}
+	file, err := r.open(executable)
+	if err != nil {
+		return r.files, fmt.Errorf("%s: %w", executable, err)
+	}
+	r.class = file.Class
+	r.machine = file.Machine
+	r.data = file.Data
+	r.hardFloat = r.isHardFloat(executable, file)
+	order := file.ByteOrder
+	file.Close()
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	exe, err := r.load(executable)
+	if err != nil {
+		return r.files, fmt.Errorf("%s: %w", executable, err)
+	}
+	if exe.interp == "" && len(exe.needed) == 0 {
+		log.Info(executable, " is statically linked")
+		return r.files, nil
+	}
+	if len(exe.runpath) == 0 {
+		r.executableRpath = r.expand(exe.rpath, exe)
+	}
+	r.libraryPath = libraryPath(env)
+	r.cache = readLdSoCache(rootfsPath, order)
+	r.defaultDirs = defaultDirs(rootfsPath, r.class, r.machine, r.data)
+	if exe.interp != "" {
+		r.add(exe.interp, "program interpreter of "+executable)
+		r.loaded[filepath.Base(exe.interp)] = true
+	}
+	return r.files, r.walk(exe)
+}
@@ -0,0 +1,369 @@
+package ldd
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fixture describes a minimal dynamically linked ELF object.
+type fixture struct {
+	class   elf.Class
+	machine elf.Machine
+	// data is the byte order, little-endian unless set.
+	data    elf.Data
+	interp  string
+	needed  []string
+	rpath   string
+	runpath string
+}
+
+// build returns the ELF object described by f: a header, a PT_INTERP
+// program header when interp is set and the .dynstr, .dynamic and
+// .shstrtab sections, which is all debug/elf and the resolver read.
+func (f fixture) build() []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	data := elf.ELFDATA2LSB
+	if f.data == elf.ELFDATA2MSB {
+		order, data = binary.BigEndian, elf.ELFDATA2MSB
+	}
+	class := f.class
+	if class == 0 {
+		class = elf.ELFCLASS64
+	}
+	is64 := class == elf.ELFCLASS64
+	ehsize, phentsize, shentsize, wordsize := 52, 32, 40, 4
+	if is64 {
+		ehsize, phentsize, shentsize, wordsize = 64, 56, 64, 8
+	}
+	machine := f.machine
+	if machine == 0 {
+		machine = elf.EM_X86_64
+	}
+
+	dynstr := []byte{0}
+	addString := func(s string) uint64 {
+		offset := uint64(len(dynstr))
+		dynstr = append(append(dynstr, s...), 0)
+		return offset
+	}
+	var dynamic bytes.Buffer
+	addDyn := func(tag elf.DynTag, value uint64) {
+		if is64 {
+			binary.Write(&dynamic, order, int64(tag))
+			binary.Write(&dynamic, order, value)
+		} else {
+			binary.Write(&dynamic, order, int32(tag))
+			binary.Write(&dynamic, order, uint32(value))
+		}
+	}
+	for _, needed := range f.needed {
+		addDyn(elf.DT_NEEDED, addString(needed))
+	}
+	if f.rpath != "" {
+		addDyn(elf.DT_RPATH, addString(f.rpath))
+	}
+	if f.runpath != "" {
+		addDyn(elf.DT_RUNPATH, addString(f.runpath))
+	}
+	addDyn(elf.DT_NULL, 0)
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+
+	phnum := 0
+	if f.interp != "" {
+		phnum = 1
+	}
+	interpOffset := ehsize + phnum*phentsize
+	interp := append([]byte(f.interp), 0)
+	dynstrOffset := interpOffset + len(interp)
+	dynamicOffset := dynstrOffset + len(dynstr)
+	shstrtabOffset := dynamicOffset + dynamic.Len()
+	shoff := (shstrtabOffset + len(shstrtab) + 7) &^ 7
+
+	var out bytes.Buffer
+	word := func(v uint64) {
+		if is64 {
+			binary.Write(&out, order, v)
+		} else {
+			binary.Write(&out, order, uint32(v))
+		}
+	}
+	out.Write([]byte{0x7f, 'E', 'L', 'F', byte(class), byte(data), byte(elf.EV_CURRENT)})
+	out.Write(make([]byte, 9))
+	binary.Write(&out, order, uint16(elf.ET_DYN))
+	binary.Write(&out, order, uint16(machine))
+	binary.Write(&out, order, uint32(elf.EV_CURRENT))
+	word(0) // entry
+	if phnum > 0 {
+		word(uint64(ehsize))
+	} else {
+		word(0)
+	}
+	word(uint64(shoff))
+	binary.Write(&out, order, uint32(0)) // flags
+	binary.Write(&out, order, uint16(ehsize))
+	binary.Write(&out, order, uint16(phentsize))
+	binary.Write(&out, order, uint16(phnum))
+	binary.Write(&out, order, uint16(shentsize))
+	binary.Write(&out, order, uint16(4))
+	binary.Write(&out, order, uint16(3))
+
+	if phnum > 0 {
+		binary.Write(&out, order, uint32(elf.PT_INTERP))
+		if is64 {
+			binary.Write(&out, order, uint32(elf.PF_R))
+		}
+		word(uint64(interpOffset))
+		word(0)
+		word(0)
+		word(uint64(len(interp)))
+		word(uint64(len(interp)))
+		if !is64 {
+			binary.Write(&out, order, uint32(elf.PF_R))
+		}
+		word(1)
+	}
+	out.Write(interp)
+	out.Write(dynstr)
+	out.Write(dynamic.Bytes())
+	out.Write(shstrtab)
+	out.Write(make([]byte, shoff-out.Len()))
+
+	section := func(name uint32, typ elf.SectionType, offset int, size int, link uint32, entsize int) {
+		binary.Write(&out, order, name)
+		binary.Write(&out, order, uint32(typ))
+		word(0) // flags
+		word(0) // addr
+		word(uint64(offset))
+		word(uint64(size))
+		binary.Write(&out, order, link)
+		binary.Write(&out, order, uint32(0)) // info
+		word(1)                              // addralign
+		word(uint64(entsize))
+	}
+	section(0, elf.SHT_NULL, 0, 0, 0, 0)
+	section(1, elf.SHT_STRTAB, dynstrOffset, len(dynstr), 0, 0)
+	section(9, elf.SHT_DYNAMIC, dynamicOffset, dynamic.Len(), 1, 2*wordsize)
+	section(18, elf.SHT_STRTAB, shstrtabOffset, len(shstrtab), 0, 0)
+	return out.Bytes()
+}
+
+// writeFixtures writes objects into a new rootfs and creates the directories
+// in dirs.
+func writeFixtures(t *testing.T, objects map[string]fixture, dirs ...string) string {
+	t.Helper()
+	rootfs := t.TempDir()
+	for path, object := range objects {
+		if err := os.MkdirAll(filepath.Dir(rootfs+path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(rootfs+path, object.build(), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(rootfs+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestFixture(t *testing.T) {
+	want := fixture{interp: "/lib/ld.so", needed: []string{"libc.so.6", "libm.so.6"}, runpath: "$ORIGIN/../lib"}
+	rootfs := writeFixtures(t, map[string]fixture{"/bin/app": want})
+	file, err := elf.Open(rootfs + "/bin/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	needed, err := file.DynString(elf.DT_NEEDED)
+	if err != nil || !slices.Equal(needed, want.needed) {
+		t.Errorf("DT_NEEDED = %v, %v, want %v", needed, err, want.needed)
+	}
+	if got := interpreter(file); got != want.interp {
+		t.Errorf("interpreter = %q, want %q", got, want.interp)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name  string
+		class elf.Class
+		dirs  []string
+		// lib64 creates /lib64 in the rootfs.
+		lib64 bool
+		want  []string
+	}{
+		{"origin", elf.ELFCLASS64, []string{"$ORIGIN/../lib", "${ORIGIN}/plugins"}, false, []string{"/opt/app/lib", "/opt/app/bin/plugins"}},
+		{"lib without lib64", elf.ELFCLASS64, []string{"/usr/$LIB/app"}, false, []string{"/usr/lib/app"}},
+		{"lib with lib64", elf.ELFCLASS64, []string{"/usr/${LIB}/app"}, true, []string{"/usr/lib64/app"}},
+		{"lib of 32-bit objects", elf.ELFCLASS32, []string{"/usr/$LIB"}, true, []string{"/usr/lib"}},
+		{"platform skipped", elf.ELFCLASS64, []string{"/usr/lib/$PLATFORM", "/usr/${PLATFORM}/lib", "/usr/lib"}, false, []string{"/usr/lib"}},
+		{"relative skipped", elf.ELFCLASS64, []string{"lib", "", "/lib/"}, false, []string{"/lib"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirs := []string{"/opt/app/bin"}
+			if tt.lib64 {
+				dirs = append(dirs, "/lib64")
+			}
+			r := &resolver{rootfsPath: writeFixtures(t, nil, dirs...), class: tt.class}
+			got := r.expand(tt.dirs, &object{path: "/opt/app/bin/app"})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expand(%v) = %v, want %v", tt.dirs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandOriginOfLink(t *testing.T) {
+	rootfs := writeFixtures(t, map[string]fixture{"/opt/app/bin/app": {}})
+	os.MkdirAll(rootfs+"/usr/bin", 0755)
+	if err := os.Symlink("/opt/app/bin/app", rootfs+"/usr/bin/app"); err != nil {
+		t.Fatal(err)
+	}
+	r := &resolver{rootfsPath: rootfs, class: elf.ELFCLASS64}
+	// $ORIGIN is the directory of the object, not of the link to it.
+	got := r.expand([]string{"$ORIGIN/../lib"}, &object{path: "/usr/bin/app"})
+	if want := []string{"/opt/app/lib"}; !slices.Equal(got, want) {
+		t.Errorf("expand = %v, want %v", got, want)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	const multiarch = "/usr/lib/x86_64-linux-gnu"
+	rootfs := writeFixtures(t, map[string]fixture{
+		"/opt/app/bin/app": {
+			interp:  "/lib64/ld-linux-x86-64.so.2",
+			needed:  []string{"libapp.so.1", "libcached.so.3", "libc.so.6"},
+			runpath: "$ORIGIN/../lib",
+		},
+		"/opt/app/lib/libapp.so.1":    {needed: []string{"libz.so.1", "libc.so.6"}},
+		"/lib64/ld-linux-x86-64.so.2": {},
+		multiarch + "/libc.so.6":      {},
+		// The wrong class for the executable, the loader skips it.
+		"/lib/x86_64-linux-gnu/libz.so.1":                 {class: elf.ELFCLASS32, machine: elf.EM_386},
+		multiarch + "/libz.so.1":                          {},
+		multiarch + "/glibc-hwcaps/x86-64-v3/libz.so.1":   {},
+		multiarch + "/glibc-hwcaps/x86-64-v2/libz.so.1":   {},
+		"/opt/cached/libcached.so.3":                      {},
+		"/usr/lib/x86_64-linux-gnu/unrelated/libfoo.so.1": {},
+	})
+	cache := newCache(binary.LittleEndian, [][2]string{{"libcached.so.3", "/opt/cached/libcached.so.3"}})
+	os.MkdirAll(rootfs+"/etc", 0755)
+	if err := os.WriteFile(rootfs+"/etc/ld.so.cache", cache, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Resolve("/opt/app/bin/app", rootfs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"/lib64/ld-linux-x86-64.so.2",
+		"/opt/app/lib/libapp.so.1",
+		"/opt/cached/libcached.so.3",
+		multiarch + "/glibc-hwcaps/x86-64-v2/libz.so.1",
+		multiarch + "/glibc-hwcaps/x86-64-v3/libz.so.1",
+		multiarch + "/libc.so.6",
+		multiarch + "/libz.so.1",
+	}
+	got := []string{}
+	for _, path := range files.Paths() {
+		if info, err := os.Stat(rootfs + path); err == nil && !info.IsDir() {
+			got = append(got, path)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Resolve = %v, want %v", got, want)
+	}
+}
+
+func TestResolveLibraryPath(t *testing.T) {
+	rootfs := writeFixtures(t, map[string]fixture{
+		"/bin/app":             {needed: []string{"libx.so"}, rpath: "/rpath"},
+		"/rpath/libx.so":       {},
+		"/env/libx.so":         {},
+		"/bin/runpath":         {needed: []string{"libx.so"}, runpath: "/rpath"},
+		"/bin/missing":         {needed: []string{"libmissing.so"}},
+		"/bin/static":          {},
+		"/usr/lib/libother.so": {},
+	})
+	env := []string{"LD_LIBRARY_PATH=/ignored", "LD_LIBRARY_PATH=/env"}
+	tests := []struct {
+		executable string
+		want       string
+		wantErr    bool
+	}{
+		// DT_RPATH comes before LD_LIBRARY_PATH, which comes before DT_RUNPATH.
+		{"/bin/app", "/rpath/libx.so", false},
+		{"/bin/runpath", "/env/libx.so", false},
+		{"/bin/missing", "", true},
+		{"/bin/static", "", false},
+	}
+	for _, tt := range tests {
+		files, err := Resolve(tt.executable, rootfs, env)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Resolve(%s) error = %v, want error %t", tt.executable, err, tt.wantErr)
+		}
+		if tt.want != "" && !files.Has(tt.want) {
+			t.Errorf("Resolve(%s) = %v, want %s", tt.executable, files.Paths(), tt.want)
+		}
+		if tt.want == "" && slices.ContainsFunc(files.Paths(), func(path string) bool { return filepath.Ext(path) == ".so" }) {
+			t.Errorf("Resolve(%s) = %v, want no library", tt.executable, files.Paths())
+		}
+	}
+}
+
+func TestResolveForeignArch(t *testing.T) {
+	tests := []struct {
+		name    string
+		machine elf.Machine
+		data    elf.Data
+		interp  string
+		triplet string
+	}{
+		{"aarch64", elf.EM_AARCH64, elf.ELFDATA2LSB, "/lib/ld-linux-aarch64.so.1", "aarch64-linux-gnu"},
+		{"ppc64le", elf.EM_PPC64, elf.ELFDATA2LSB, "/lib64/ld64.so.2", "powerpc64le-linux-gnu"},
+		{"ppc64", elf.EM_PPC64, elf.ELFDATA2MSB, "/lib64/ld64.so.1", "powerpc64-linux-gnu"},
+		{"s390x", elf.EM_S390, elf.ELFDATA2MSB, "/lib/ld64.so.1", "s390x-linux-gnu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := fixture{machine: tt.machine, data: tt.data}
+			// The same machine in the other byte order, which the loader skips.
+			other := fixture{machine: tt.machine, data: elf.ELFDATA2MSB}
+			if tt.data == elf.ELFDATA2MSB {
+				other.data = elf.ELFDATA2LSB
+			}
+			rootfs := writeFixtures(t, map[string]fixture{
+				"/bin/app":                              {machine: tt.machine, data: tt.data, interp: tt.interp, needed: []string{"libz.so.1", "libc.so.6"}},
+				tt.interp:                               target,
+				"/opt/lib/libz.so.1":                    other,
+				"/lib/" + tt.triplet + "/libz.so.1":     target,
+				"/usr/lib/" + tt.triplet + "/libc.so.6": target,
+				"/usr/lib/x86_64-linux-gnu/libc.so.6":   {},
+			})
+			files, err := Resolve("/bin/app", rootfs, []string{"LD_LIBRARY_PATH=/opt/lib"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{tt.interp, "/lib/" + tt.triplet + "/libz.so.1", "/usr/lib/" + tt.triplet + "/libc.so.6"}
+			got := []string{}
+			for _, path := range files.Paths() {
+				if info, err := os.Stat(rootfs + path); err == nil && !info.IsDir() {
+					got = append(got, path)
+				}
+			}
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Resolve = %v, want %v", got, want)
+			}
+		})
+	}
+}
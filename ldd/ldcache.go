@@ -0,0 +1,138 @@
+package ldd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	cacheMagicOld = "ld.so-1.7.0"
+	cacheMagicNew = "glibc-ld.so.cache1.1"
+	// Sizes of the headers and entries of both cache formats, see
+	// sysdeps/generic/dl-cache.h in glibc.
+	oldHeaderSize = 16
+	oldEntrySize  = 12
+	newHeaderSize = 48
+	newEntrySize  = 24
+)
+
+// readLdSoConf returns the library directories listed in the ld.so.conf at
+// path inside the rootfs, following include directives.
+func readLdSoConf(rootfsPath string, path string, seen map[string]bool) []string {
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+	fd, err := os.Open(rootfsPath + path)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+	dirs := []string{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ',' || r == ':'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "include":
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(path), pattern)
+				}
+				matches, _ := filepath.Glob(rootfsPath + pattern)
+				for _, match := range matches {
+					dirs = append(dirs, readLdSoConf(rootfsPath, strings.TrimPrefix(match, rootfsPath), seen)...)
+				}
+			}
+		case "hwcap":
+			continue
+		default:
+			for _, dir := range fields {
+				if filepath.IsAbs(dir) {
+					dirs = append(dirs, filepath.Clean(dir))
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+func cString(data []byte, offset uint32) (string, error) {
+	if int(offset) >= len(data) {
+		return "", errors.New("string offset out of range")
+	}
+	end := bytes.IndexByte(data[offset:], 0)
+	if end == -1 {
+		return "", errors.New("unterminated string")
+	}
+	return string(data[offset : int(offset)+end]), nil
+}
+
+// readLdSoCache parses /etc/ld.so.cache inside the rootfs into a map from
+// soname to the paths providing it, in cache order. The cache is written in
+// the byte order of the target, which is passed in.
+func readLdSoCache(rootfsPath string, order binary.ByteOrder) map[string][]string {
+	libs := make(map[string][]string)
+	data, err := os.ReadFile(rootfsPath + "/etc/ld.so.cache")
+	if err != nil {
+		return libs
+	}
+	add := func(key uint32, value uint32, base int) {
+		soname, err := cString(data, uint32(base)+key)
+		if err != nil {
+			return
+		}
+		path, err := cString(data, uint32(base)+value)
+		if err != nil {
+			return
+		}
+		libs[soname] = append(libs[soname], path)
+	}
+
+	offset := 0
+	if bytes.HasPrefix(data, []byte(cacheMagicOld)) {
+		if len(data) < oldHeaderSize {
+			return libs
+		}
+		count := int(order.Uint32(data[12:16]))
+		offset = oldHeaderSize + count*oldEntrySize
+		if offset > len(data) {
+			return libs
+		}
+		// Old caches may carry a new format cache after their entries, aligned
+		// to 8 bytes; prefer it as it is what current glibc reads.
+		aligned := (offset + 7) &^ 7
+		if !bytes.HasPrefix(data[min(aligned, len(data)):], []byte(cacheMagicNew)) {
+			for i := range count {
+				entry := data[oldHeaderSize+i*oldEntrySize:]
+				add(order.Uint32(entry[4:8]), order.Uint32(entry[8:12]), offset)
+			}
+			return libs
+		}
+		offset = aligned
+	}
+	if !bytes.HasPrefix(data[offset:], []byte(cacheMagicNew)) || len(data) < offset+newHeaderSize {
+		return libs
+	}
+	count := int(order.Uint32(data[offset+20 : offset+24]))
+	if offset+newHeaderSize+count*newEntrySize > len(data) {
+		return libs
+	}
+	for i := range count {
+		entry := data[offset+newHeaderSize+i*newEntrySize:]
+		// String offsets of the new format are relative to the start of the
+		// new cache, which is the start of the file unless it follows an old one.
+		add(order.Uint32(entry[4:8]), order.Uint32(entry[8:12]), offset)
+	}
+	return libs
+}
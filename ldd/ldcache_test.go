@@ -0,0 +1,144 @@
+package ldd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+)
+
+// newCache returns a new format ld.so.cache mapping sonames to paths, with
+// string offsets relative to its start.
+func newCache(order binary.ByteOrder, entries [][2]string) []byte {
+	var table bytes.Buffer
+	offsets := [][2]uint32{}
+	base := newHeaderSize + len(entries)*newEntrySize
+	for _, entry := range entries {
+		key := uint32(base + table.Len())
+		table.WriteString(entry[0] + "\x00")
+		value := uint32(base + table.Len())
+		table.WriteString(entry[1] + "\x00")
+		offsets = append(offsets, [2]uint32{key, value})
+	}
+	var out bytes.Buffer
+	out.WriteString(cacheMagicNew)
+	binary.Write(&out, order, uint32(len(entries)))
+	binary.Write(&out, order, uint32(table.Len()))
+	out.Write(make([]byte, newHeaderSize-out.Len()))
+	for _, offset := range offsets {
+		binary.Write(&out, order, int32(0x0303)) // flags: ELF x86-64 library
+		binary.Write(&out, order, offset[0])
+		binary.Write(&out, order, offset[1])
+		binary.Write(&out, order, uint32(0))
+		binary.Write(&out, order, uint64(0))
+	}
+	out.Write(table.Bytes())
+	return out.Bytes()
+}
+
+// oldCache returns an old format ld.so.cache mapping sonames to paths,
+// followed by next, aligned to 8 bytes, when it is set.
+func oldCache(order binary.ByteOrder, entries [][2]string, next []byte) []byte {
+	var table bytes.Buffer
+	var out bytes.Buffer
+	out.WriteString(cacheMagicOld)
+	out.WriteByte(0)
+	binary.Write(&out, order, uint32(len(entries)))
+	for _, entry := range entries {
+		binary.Write(&out, order, int32(1))
+		binary.Write(&out, order, uint32(table.Len()))
+		table.WriteString(entry[0] + "\x00")
+		binary.Write(&out, order, uint32(table.Len()))
+		table.WriteString(entry[1] + "\x00")
+	}
+	if next == nil {
+		out.Write(table.Bytes())
+		return out.Bytes()
+	}
+	// glibc writes the new cache in place of the old string table, whose
+	// strings are then found in the new one.
+	out.Write(make([]byte, (out.Len()+7)&^7-out.Len()))
+	out.Write(next)
+	return out.Bytes()
+}
+
+func TestReadLdSoCache(t *testing.T) {
+	entries := [][2]string{
+		{"libc.so.6", "/lib/x86_64-linux-gnu/libc.so.6"},
+		{"libz.so.1", "/usr/lib/x86_64-linux-gnu/glibc-hwcaps/x86-64-v3/libz.so.1"},
+		{"libz.so.1", "/usr/lib/x86_64-linux-gnu/libz.so.1"},
+	}
+	want := map[string][]string{
+		"libc.so.6": {"/lib/x86_64-linux-gnu/libc.so.6"},
+		"libz.so.1": {"/usr/lib/x86_64-linux-gnu/glibc-hwcaps/x86-64-v3/libz.so.1", "/usr/lib/x86_64-linux-gnu/libz.so.1"},
+	}
+	tests := []struct {
+		name  string
+		order binary.ByteOrder
+		data  []byte
+		want  map[string][]string
+	}{
+		{"new", binary.LittleEndian, newCache(binary.LittleEndian, entries), want},
+		{"new big endian", binary.BigEndian, newCache(binary.BigEndian, entries), want},
+		{"old", binary.LittleEndian, oldCache(binary.LittleEndian, entries, nil), want},
+		{
+			name:  "old followed by new",
+			order: binary.LittleEndian,
+			data: oldCache(binary.LittleEndian, [][2]string{{"libold.so", "/old/libold.so"}},
+				newCache(binary.LittleEndian, entries)),
+			want: want,
+		},
+		{"truncated", binary.LittleEndian, newCache(binary.LittleEndian, entries)[:60], map[string][]string{}},
+		{"empty", binary.LittleEndian, nil, map[string][]string{}},
+		{"garbage", binary.LittleEndian, []byte("not a cache at all, just some text"), map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			os.Mkdir(rootfs+"/etc", 0755)
+			if err := os.WriteFile(rootfs+"/etc/ld.so.cache", tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got := readLdSoCache(rootfs, tt.order)
+			if !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("readLdSoCache = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLdSoCacheOutOfRange(t *testing.T) {
+	data := newCache(binary.LittleEndian, [][2]string{{"libc.so.6", "/lib/libc.so.6"}})
+	// Point the path of the only entry past the end of the file.
+	binary.LittleEndian.PutUint32(data[newHeaderSize+8:], uint32(len(data)+100))
+	rootfs := t.TempDir()
+	os.Mkdir(rootfs+"/etc", 0755)
+	os.WriteFile(rootfs+"/etc/ld.so.cache", data, 0644)
+	if got := readLdSoCache(rootfs, binary.LittleEndian); len(got) != 0 {
+		t.Errorf("readLdSoCache = %v, want no entries", got)
+	}
+}
+
+func TestReadLdSoConf(t *testing.T) {
+	rootfs := t.TempDir()
+	os.MkdirAll(rootfs+"/etc/ld.so.conf.d", 0755)
+	files := map[string]string{
+		"/etc/ld.so.conf":                    "# comment\ninclude /etc/ld.so.conf.d/*.conf\n/usr/local/lib\nhwcap 0 nosegneg\n",
+		"/etc/ld.so.conf.d/a.conf":           "/opt/a/lib:/opt/a/lib64, relative\n",
+		"/etc/ld.so.conf.d/b.conf":           "include ../ld.so.conf\n/opt/b/lib/ # trailing\n",
+		"/etc/ld.so.conf.d/ignored.disabled": "/opt/ignored\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(rootfs+path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := readLdSoConf(rootfs, "/etc/ld.so.conf", map[string]bool{})
+	// b.conf includes ld.so.conf again, which is read once.
+	want := []string{"/opt/a/lib", "/opt/a/lib64", "/opt/b/lib", "/usr/local/lib"}
+	if !slices.Equal(got, want) {
+		t.Errorf("readLdSoConf = %v, want %v", got, want)
+	}
+}
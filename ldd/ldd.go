@@ -1,11 +1,7 @@
 package ldd
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
-	"os/exec"
-	"strings"
+	"context"
 
 	"github.com/regelepuma/dockerminimizer/logger"
 	"github.com/regelepuma/dockerminimizer/types"
@@ -14,42 +10,22 @@ import (
 
 var log = logger.Log
 
-func ParseOutput(output []byte, rootfsPath string) (map[string][]string, map[string]string) {
-	files := make(map[string][]string)
-	symLinks := make(map[string]string)
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "=>") {
-			parts := strings.Split(line, "=>")
-			lib := strings.Split(strings.TrimSpace(parts[1]), " ")[0]
+// Analyzer finds the shared libraries the command of an image needs.
+type Analyzer struct{}
 
-			if strings.Contains(lib, "not found") {
-				continue
-			}
-			utils.AddFilesToDockerfile(lib, files, symLinks, rootfsPath)
+func (Analyzer) Name() string {
+	return "ldd"
+}
 
-		} else if strings.Contains(line, "not found") {
-			continue
-		} else {
-			lib := strings.Split(strings.TrimSpace(line), " ")[0]
-			utils.AddFilesToDockerfile(lib, files, symLinks, rootfsPath)
-		}
+func (Analyzer) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	command, err := utils.GetContainerCommand(image.EnvPath, image.Metadata)
+	if err != nil {
+		return types.NewFileSet(), err
 	}
-	return files, symLinks
-}
-func StaticAnalysis(imageName string, envPath string, metadata types.DockerConfig, context string, timeout int) (map[string][]string, map[string]string, error) {
-	command := utils.GetContainerCommand(imageName, envPath, metadata)
-	hasSudo := utils.HasSudo()
-	lddCommand := hasSudo + " chroot " + envPath + "/rootfs ldd " + command
-	log.Info("Running command:", lddCommand)
-	lddOutput, err := exec.Command("sh", "-c", lddCommand).CombinedOutput()
+	log.Info("Resolving shared libraries of:", command)
+	libs, err := Resolve(command, image.EnvPath+"/rootfs", image.Metadata.Env)
 	if err != nil {
-		log.Error("Failed to run ldd command\n" + err.Error())
-		return nil, nil, errors.New("failed to run ldd command")
+		log.Error("Failed to resolve shared libraries\n" + err.Error())
 	}
-	libs, symlinkLibs := ParseOutput(lddOutput, envPath+"/rootfs")
-	utils.CreateDockerfile("Dockerfile.minimal.ldd", "Dockerfile.minimal.initial", envPath, libs, symlinkLibs)
-	log.Info("Validating Dockerfile...")
-	return libs, symlinkLibs, utils.ValidateDockerfile("Dockerfile.minimal.ldd", envPath, context, timeout)
+	return libs, err
 }
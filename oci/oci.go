@@ -0,0 +1,402 @@
+// Package oci writes minimized images as OCI image layouts, directly from the
+// files found in the rootfs of the original image, so that they can be loaded
+// or pushed without building a Dockerfile.
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/types"
+	"github.com/regelepuma/dockerminimizer/utils"
+)
+
+var log = logger.Log
+
+// Compression is the compression of the layers of an image.
+type Compression string
+
+const (
+	Uncompressed Compression = "none"
+	Gzip         Compression = "gzip"
+	Zstd         Compression = "zstd"
+)
+
+// Compressions lists the compressions accepted for written images.
+var Compressions = []string{string(Gzip), string(Zstd)}
+
+const (
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+func (c Compression) mediaType() string {
+	if c == Gzip || c == Zstd {
+		return mediaTypeLayer + "+" + string(c)
+	}
+	return mediaTypeLayer
+}
+
+func (c Compression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		// A single encoder goroutine keeps the output deterministic.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case Uncompressed:
+		return nopCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Image is a minimized image.
+type Image struct {
+	// EnvPath is the environment holding the rootfs Files are read from.
+	EnvPath string
+	Files   types.FileSet
+	Config  types.DockerConfig
+	// Platform is the platform of the image, e.g. linux/arm64, or empty for
+	// the platform of the host.
+	Platform string
+	// Reference names the image, e.g. app:minimal, when it is loaded.
+	Reference   string
+	Compression Compression
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *platform         `json:"platform,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+type config struct {
+	Created time.Time `json:"created"`
+	platform
+	Config struct {
+		User         string              `json:"User,omitempty"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+		Env          []string            `json:"Env,omitempty"`
+		Entrypoint   []string            `json:"Entrypoint,omitempty"`
+		Cmd          []string            `json:"Cmd,omitempty"`
+		WorkingDir   string              `json:"WorkingDir,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []history `json:"history,omitempty"`
+}
+
+type history struct {
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"created_by"`
+}
+
+// dockerManifest is the manifest.json of docker-archive tarballs, which
+// docker load reads when it does not support OCI layouts.
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// parsePlatform splits platform into its parts, defaulting to the host.
+func parsePlatform(spec string) platform {
+	p := platform{OS: "linux", Architecture: runtime.GOARCH}
+	parts := strings.Split(spec, "/")
+	if spec != "" && len(parts) >= 2 {
+		p.OS, p.Architecture = parts[0], parts[1]
+	}
+	if len(parts) >= 3 {
+		p.Variant = parts[2]
+	}
+	return p
+}
+
+// layout writes the blobs of an image layout to its directory.
+type layout struct {
+	dir string
+}
+
+// blob writes the contents written by write as a blob and returns its
+// descriptor.
+func (l layout) blob(mediaType string, write func(io.Writer) error) (descriptor, error) {
+	blobs := filepath.Join(l.dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return descriptor{}, err
+	}
+	file, err := os.CreateTemp(blobs, ".blob-")
+	if err != nil {
+		return descriptor{}, err
+	}
+	defer os.Remove(file.Name())
+	digest := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(file, digest)}
+	err = write(counter)
+	err = errors.Join(err, file.Chmod(0644), file.Close())
+	if err != nil {
+		return descriptor{}, err
+	}
+	hexDigest := hex.EncodeToString(digest.Sum(nil))
+	if err := os.Rename(file.Name(), filepath.Join(blobs, hexDigest)); err != nil {
+		return descriptor{}, err
+	}
+	return descriptor{MediaType: mediaType, Digest: "sha256:" + hexDigest, Size: counter.n}, nil
+}
+
+func (l layout) json(mediaType string, v any) (descriptor, error) {
+	return l.blob(mediaType, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// layer writes files as a compressed layer and returns its descriptor and
+// the digest of the uncompressed tar stream, its diff ID.
+func (l layout) layer(files types.FileSet, envPath string, compression Compression) (descriptor, string, error) {
+	var diffID hash.Hash
+	layer, err := l.blob(compression.mediaType(), func(w io.Writer) error {
+		compressor, err := compression.writer(w)
+		if err != nil {
+			return err
+		}
+		diffID = sha256.New()
+		err = utils.WriteTarArchive(io.MultiWriter(compressor, diffID), files, envPath)
+		return errors.Join(err, compressor.Close())
+	})
+	if err != nil {
+		return descriptor{}, "", err
+	}
+	return layer, "sha256:" + hex.EncodeToString(diffID.Sum(nil)), nil
+}
+
+// WriteLayout writes image as an OCI image layout to dir and returns the
+// digest of its manifest. Every tier of files, see utils.PlanLayers,
+// becomes one layer. The layout holds a manifest.json as well, so that
+// docker load accepts it once archived.
+func WriteLayout(dir string, image Image) (string, error) {
+	l := layout{dir}
+	var cfg config
+	cfg.Created = utils.SourceDateEpoch()
+	cfg.platform = parsePlatform(image.Platform)
+	cfg.Config.User = image.Config.User
+	cfg.Config.Env = image.Config.Env
+	cfg.Config.Entrypoint = image.Config.Entrypoint
+	cfg.Config.Cmd = image.Config.Cmd
+	cfg.Config.WorkingDir = image.Config.WorkingDir
+	for port := range image.Config.ExposedPorts {
+		if cfg.Config.ExposedPorts == nil {
+			cfg.Config.ExposedPorts = make(map[string]struct{})
+		}
+		cfg.Config.ExposedPorts[port] = struct{}{}
+	}
+	cfg.RootFS.Type = "layers"
+	cfg.RootFS.DiffIDs = []string{}
+
+	m := manifest{SchemaVersion: 2, MediaType: mediaTypeManifest, Layers: []descriptor{}}
+	docker := dockerManifest{}
+	if image.Reference != "" {
+		docker.RepoTags = []string{image.Reference}
+	}
+	for _, layer := range utils.PlanLayers(image.Files, image.EnvPath+"/rootfs", 0) {
+		log.Info("Writing layer of tier ", layer.Tier, " with ", layer.Files.Len(), " paths")
+		desc, diffID, err := l.layer(layer.Files, image.EnvPath, image.Compression)
+		if err != nil {
+			return "", err
+		}
+		m.Layers = append(m.Layers, desc)
+		cfg.RootFS.DiffIDs = append(cfg.RootFS.DiffIDs, diffID)
+		cfg.History = append(cfg.History, history{
+			Created:   cfg.Created,
+			CreatedBy: "dockerminimizer: " + layer.Tier.String() + " files",
+		})
+		docker.Layers = append(docker.Layers, blobPath(desc))
+	}
+	var err error
+	m.Config, err = l.json(mediaTypeConfig, cfg)
+	if err != nil {
+		return "", err
+	}
+	docker.Config = blobPath(m.Config)
+	desc, err := l.json(mediaTypeManifest, m)
+	if err != nil {
+		return "", err
+	}
+	desc.Platform = &cfg.platform
+	if image.Reference != "" {
+		_, tag, _ := strings.Cut(image.Reference[strings.LastIndex(image.Reference, "/")+1:], ":")
+		desc.Annotations = map[string]string{
+			"io.containerd.image.name":          image.Reference,
+			"org.opencontainers.image.ref.name": tag,
+		}
+	}
+	files := map[string]any{
+		"index.json":    index{SchemaVersion: 2, MediaType: mediaTypeIndex, Manifests: []descriptor{desc}},
+		"oci-layout":    map[string]string{"imageLayoutVersion": "1.0.0"},
+		"manifest.json": []dockerManifest{docker},
+	}
+	for name, v := range files {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return "", err
+		}
+	}
+	return desc.Digest, nil
+}
+
+func blobPath(desc descriptor) string {
+	return "blobs/sha256/" + strings.TrimPrefix(desc.Digest, "sha256:")
+}
+
+// WriteArchive writes image as an oci-archive, a tar archive of its layout,
+// to path and returns the digest of its manifest.
+func WriteArchive(path string, image Image) (string, error) {
+	dir, err := os.MkdirTemp(image.EnvPath, "oci-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	digest, err := WriteLayout(dir, image)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	modTime := utils.SourceDateEpoch()
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(dir, path)
+		header.Name = filepath.ToSlash(name)
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		header.Mode = 0644
+		if d.IsDir() {
+			header.Name += "/"
+			header.Mode = 0755
+		}
+		utils.NormalizeHeader(header, modTime)
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		_, err = io.Copy(writer, fd)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return digest, writer.Close()
+}
+
+// Validate loads files as the candidate image tag of image and validates it
+// like utils.ValidateDockerfile does the images it builds.
+func Validate(ctx context.Context, rt engine.Runtime, image types.Image, files types.FileSet, tag string, timeout int) error {
+	imageName := "dockerminimize-" + filepath.Base(image.EnvPath) + ":" + tag
+	archive := image.EnvPath + "/image-" + tag + ".tar"
+	_, err := WriteArchive(archive, Image{
+		EnvPath:     image.EnvPath,
+		Files:       files,
+		Config:      image.Config,
+		Platform:    image.Platform,
+		Reference:   imageName,
+		Compression: Uncompressed,
+	})
+	defer os.Remove(archive)
+	if err != nil {
+		log.Error("Failed to write image archive: ", err)
+		return errors.New("failed to write image archive")
+	}
+	fd, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := rt.Load(ctx, fd); err != nil {
+		log.Error("Failed to load image: ", err)
+		return errors.New("failed to load image")
+	}
+	return utils.ValidateImage(ctx, rt, image, imageName, timeout)
+}
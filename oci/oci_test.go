@@ -0,0 +1,231 @@
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+	"github.com/regelepuma/dockerminimizer/utils"
+)
+
+// writeEnv creates an environment whose rootfs holds files, mapped to their
+// content, and returns it with the set of those files.
+func writeEnv(t *testing.T, files map[string]string) (string, types.FileSet) {
+	t.Helper()
+	envPath := t.TempDir()
+	set := types.NewFileSet()
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(envPath+"/rootfs"+path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(envPath+"/rootfs"+path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := utils.StatEntry(envPath+"/rootfs", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.Add(entry)
+	}
+	return envPath, set
+}
+
+// readArchive returns the contents of the files of a tar archive by name.
+func readArchive(t *testing.T, r io.Reader) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = data
+	}
+}
+
+// readConfig follows the index of a layout, read by open, to the manifest
+// and configuration of its image.
+func readConfig(t *testing.T, open func(name string) []byte) (manifest, config) {
+	t.Helper()
+	var idx index
+	if err := json.Unmarshal(open("index.json"), &idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("index lists %d manifests, want 1", len(idx.Manifests))
+	}
+	var m manifest
+	if err := json.Unmarshal(open(blobPath(idx.Manifests[0])), &m); err != nil {
+		t.Fatal(err)
+	}
+	var cfg config
+	if err := json.Unmarshal(open(blobPath(m.Config)), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return m, cfg
+}
+
+func TestValidateConfig(t *testing.T) {
+	envPath, files := writeEnv(t, map[string]string{"/app/server": "server", "/etc/passwd": "root:x:0:0::/:\n"})
+	original := types.DockerConfig{
+		Env:        []string{"PATH=/usr/bin"},
+		Entrypoint: []string{"/app/server"},
+		Cmd:        []string{"--port", "80"},
+		WorkingDir: "/app",
+	}
+	// The analysis runs the image with the environment and arguments of the
+	// command line, which the minimized image must not keep.
+	image := types.Image{
+		Name:     "app",
+		EnvPath:  envPath,
+		Config:   original,
+		Metadata: original,
+		Env:      []string{"DEBUG=1"},
+		RunArgs:  []string{"--port", "8080"},
+	}
+	image.Metadata.Env = slices.Concat(original.Env, image.Env)
+	image.Metadata.Cmd = image.RunArgs
+
+	var cfg config
+	var ran engine.RunOptions
+	fake := &engine.Fake{
+		LoadFunc: func(archive io.Reader) error {
+			files := readArchive(t, archive)
+			_, cfg = readConfig(t, func(name string) []byte { return files[name] })
+			return nil
+		},
+		RunFunc: func(opts engine.RunOptions) (engine.RunResult, error) {
+			ran = opts
+			return engine.RunResult{}, nil
+		},
+	}
+	if err := Validate(context.Background(), fake, image, files, "strace", 5); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.Config.Env, original.Env) || !slices.Equal(cfg.Config.Cmd, original.Cmd) ||
+		!slices.Equal(cfg.Config.Entrypoint, original.Entrypoint) || cfg.Config.WorkingDir != original.WorkingDir {
+		t.Errorf("config = %+v, want %+v", cfg.Config, original)
+	}
+	if !slices.Equal(ran.Env, image.Env) || !slices.Equal(ran.Cmd, image.RunArgs) {
+		t.Errorf("ran with env %q and args %q, want %q and %q", ran.Env, ran.Cmd, image.Env, image.RunArgs)
+	}
+	if _, err := os.Stat(envPath + "/image-strace.tar"); !os.IsNotExist(err) {
+		t.Errorf("archive left behind: %v", err)
+	}
+	if !strings.HasPrefix(ran.Image, "dockerminimize-") {
+		t.Errorf("ran %s, want the loaded candidate", ran.Image)
+	}
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	envPath, files := writeEnv(t, map[string]string{
+		"/usr/lib/libc.so.6": "libc",
+		"/usr/local/bin/app": "app",
+		"/app/config.json":   "{}",
+	})
+	image := Image{
+		EnvPath:   envPath,
+		Files:     files,
+		Config:    types.DockerConfig{Cmd: []string{"/usr/local/bin/app"}},
+		Platform:  "linux/arm64",
+		Reference: "app:minimal",
+	}
+	// The digest of every compression and SOURCE_DATE_EPOCH.
+	seen := make(map[string]string)
+	for _, compression := range []Compression{Gzip, Zstd} {
+		for _, epoch := range []string{"", "1700000000"} {
+			t.Run(string(compression)+"/"+epoch, func(t *testing.T) {
+				t.Setenv("SOURCE_DATE_EPOCH", epoch)
+				image := image
+				image.Compression = compression
+				var digests, archives []string
+				for i := range 2 {
+					dir := t.TempDir()
+					digest, err := WriteLayout(dir, image)
+					if err != nil {
+						t.Fatal(err)
+					}
+					archive := filepath.Join(t.TempDir(), "image.tar")
+					archiveDigest, err := WriteArchive(archive, image)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if archiveDigest != digest {
+						t.Errorf("archive digest %s, layout digest %s", archiveDigest, digest)
+					}
+					data, err := os.ReadFile(archive)
+					if err != nil {
+						t.Fatal(err)
+					}
+					digests, archives = append(digests, digest), append(archives, string(data))
+
+					m, cfg := readConfig(t, func(name string) []byte {
+						data, err := os.ReadFile(filepath.Join(dir, name))
+						if err != nil {
+							t.Fatal(err)
+						}
+						return data
+					})
+					if want := utils.SourceDateEpoch(); !cfg.Created.Equal(want) {
+						t.Errorf("created %s, want %s", cfg.Created, want)
+					}
+					// Every layer has its history entry, dated like the image.
+					if len(cfg.History) != len(m.Layers) || len(cfg.RootFS.DiffIDs) != len(m.Layers) {
+						t.Errorf("%d layers, %d history entries and %d diff IDs",
+							len(m.Layers), len(cfg.History), len(cfg.RootFS.DiffIDs))
+					}
+					for _, h := range cfg.History {
+						if !h.Created.Equal(cfg.Created) {
+							t.Errorf("history entry %q created %s, want %s", h.CreatedBy, h.Created, cfg.Created)
+						}
+					}
+					if cfg.Architecture != "arm64" || !slices.Equal(cfg.Config.Cmd, image.Config.Cmd) {
+						t.Errorf("config = %+v", cfg)
+					}
+
+					// The times of the files and their directories do not leak
+					// into the layers.
+					later := utils.SourceDateEpoch().AddDate(i+1, 0, 0)
+					err = filepath.WalkDir(envPath+"/rootfs", func(path string, d fs.DirEntry, err error) error {
+						if err != nil {
+							return err
+						}
+						return os.Chtimes(path, later, later)
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if digests[0] != digests[1] {
+					t.Errorf("digests differ: %s and %s", digests[0], digests[1])
+				}
+				if archives[0] != archives[1] {
+					t.Error("archives differ")
+				}
+				for name, digest := range seen {
+					if digest == digests[0] {
+						t.Errorf("same digest as %s", name)
+					}
+				}
+				seen[t.Name()] = digests[0]
+			})
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package packs holds built-in knowledge about files that common runtimes
+// load lazily, on code paths the analysis rarely sees, such as the NSS
+// modules of glibc or the time zone database. A pack is detected from the
+// rootfs and, once enabled for a project, contributes keep rules.
+package packs
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+
+	"github.com/regelepuma/dockerminimizer/logger"
+)
+
+var log = logger.Log
+
+// Auto enables every pack detected in the rootfs.
+const Auto = "auto"
+
+// Pack is a versioned set of keep rules. The rules of a version never
+// change, so that projects pinning it with name@version keep their result.
+type Pack struct {
+	Name        string
+	Version     int
+	Description string
+	// Detect are doublestar patterns, the pack applies to a rootfs in which
+	// any of them matches.
+	Detect []string
+	// Keep are the doublestar patterns added to the keep rules.
+	Keep []string
+}
+
+func (p Pack) String() string {
+	return p.Name + "@" + strconv.Itoa(p.Version)
+}
+
+// builtin lists every version of every pack, in the order they are applied.
+var builtin = []Pack{
+	{
+		Name:        "glibc-nss",
+		Version:     1,
+		Description: "NSS modules and configuration glibc loads for user, group and host lookups",
+		Detect:      []string{"/lib*/**/libc.so.6", "/usr/lib*/**/libc.so.6"},
+		Keep: []string{
+			"/etc/nsswitch.conf", "/etc/host.conf", "/etc/hosts", "/etc/gai.conf",
+			"/lib*/**/libnss_*", "/usr/lib*/**/libnss_*",
+			"/lib*/**/libresolv.so*", "/usr/lib*/**/libresolv.so*",
+		},
+	},
+	{
+		Name:        "gconv",
+		Version:     1,
+		Description: "character set conversion modules glibc loads for iconv",
+		Detect:      []string{"/usr/lib*/**/gconv/gconv-modules*"},
+		Keep:        []string{"/usr/lib*/**/gconv/**"},
+	},
+	{
+		Name:        "ca-certificates",
+		Version:     1,
+		Description: "CA certificate bundles used to verify TLS peers",
+		Detect:      []string{"/etc/ssl/certs/*", "/etc/ssl/cert.pem", "/etc/pki/tls/certs/*"},
+		Keep: []string{
+			"/etc/ssl/certs/**", "/etc/ssl/cert.pem", "/etc/pki/tls/**", "/etc/pki/ca-trust/extracted/**",
+			"/usr/share/ca-certificates/**", "/usr/local/share/ca-certificates/**",
+		},
+	},
+	{
+		Name:        "tzdata",
+		Version:     1,
+		Description: "time zone database and the local time zone",
+		Detect:      []string{"/usr/share/zoneinfo/*"},
+		Keep:        []string{"/usr/share/zoneinfo/**", "/etc/localtime", "/etc/timezone"},
+	},
+	{
+		Name:        "passwd",
+		Version:     1,
+		Description: "user and group databases, needed to resolve the USER of the image",
+		Detect:      []string{"/etc/passwd"},
+		Keep:        []string{"/etc/passwd", "/etc/group"},
+	},
+	{
+		Name:        "locales",
+		Version:     1,
+		Description: "compiled locales and the locale configuration",
+		Detect:      []string{"/usr/lib/locale/*", "/usr/share/i18n/*"},
+		Keep: []string{
+			"/usr/lib/locale/**", "/usr/share/locale/locale.alias",
+			"/etc/default/locale", "/etc/locale.conf",
+		},
+	},
+}
+
+// All returns the latest version of every pack.
+func All() []Pack {
+	packs := []Pack{}
+	for _, pack := range builtin {
+		i := slices.IndexFunc(packs, func(p Pack) bool { return p.Name == pack.Name })
+		switch {
+		case i == -1:
+			packs = append(packs, pack)
+		case pack.Version > packs[i].Version:
+			packs[i] = pack
+		}
+	}
+	return packs
+}
+
+// Names returns the names of the packs.
+func Names() []string {
+	names := []string{}
+	for _, pack := range All() {
+		names = append(names, pack.Name)
+	}
+	return names
+}
+
+// Lookup returns the pack named by spec, name@version or name for its latest
+// version.
+func Lookup(spec string) (Pack, error) {
+	name, version, pinned := strings.Cut(spec, "@")
+	for _, pack := range All() {
+		if pack.Name != name {
+			continue
+		}
+		if !pinned {
+			return pack, nil
+		}
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return Pack{}, fmt.Errorf("invalid pack version %q", spec)
+		}
+		for _, p := range builtin {
+			if p.Name == name && p.Version == n {
+				return p, nil
+			}
+		}
+		return Pack{}, fmt.Errorf("pack %s has no version %d, the latest is %d", name, n, pack.Version)
+	}
+	return Pack{}, fmt.Errorf("unknown pack %q, expected %s or one of %v", spec, Auto, Names())
+}
+
+// Validate reports the first invalid spec.
+func Validate(specs []string) error {
+	for _, spec := range specs {
+		if spec == Auto {
+			continue
+		}
+		if _, err := Lookup(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Detected reports whether p applies to the rootfs at rootfsPath.
+func (p Pack) Detected(rootfsPath string) bool {
+	rootfs := os.DirFS(rootfsPath)
+	for _, pattern := range p.Detect {
+		matches, err := doublestar.Glob(rootfs, strings.TrimPrefix(pattern, "/"), doublestar.WithNoFollow())
+		if err == nil && len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect returns the latest version of the packs applying to the rootfs at
+// rootfsPath.
+func Detect(rootfsPath string) []Pack {
+	return slices.DeleteFunc(All(), func(p Pack) bool {
+		return !p.Detected(rootfsPath)
+	})
+}
+
+// Enable returns the packs named by specs, where Auto stands for every
+// detected pack. Detected packs that are not enabled are offered in the log.
+func Enable(specs []string, rootfsPath string) ([]Pack, error) {
+	enabled := []Pack{}
+	add := func(pack Pack) {
+		if !slices.ContainsFunc(enabled, func(p Pack) bool { return p.Name == pack.Name }) {
+			enabled = append(enabled, pack)
+		}
+	}
+	detected := Detect(rootfsPath)
+	for _, spec := range specs {
+		if spec == Auto {
+			for _, pack := range detected {
+				add(pack)
+			}
+			continue
+		}
+		pack, err := Lookup(spec)
+		if err != nil {
+			return nil, err
+		}
+		if !pack.Detected(rootfsPath) {
+			log.Info("Pack ", pack, " enabled but not detected in the image")
+		}
+		add(pack)
+	}
+	for _, pack := range detected {
+		if !slices.ContainsFunc(enabled, func(p Pack) bool { return p.Name == pack.Name }) {
+			log.Info("Detected pack ", pack.Name, " (", pack.Description, "), enable it with --pack ", pack.Name)
+		}
+	}
+	return enabled, nil
+}
+
+// Keep returns the keep rules of packs.
+func Keep(packs []Pack) []string {
+	keep := []string{}
+	for _, pack := range packs {
+		keep = append(keep, pack.Keep...)
+	}
+	return keep
+}
@@ -0,0 +1,154 @@
+package packs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withVersion adds a second version of glibc-nss to the builtin packs for
+// the duration of the test.
+func withVersion(t *testing.T) Pack {
+	t.Helper()
+	saved := builtin
+	t.Cleanup(func() { builtin = saved })
+	v2 := builtin[0]
+	v2.Version = 2
+	v2.Keep = append(slices.Clone(v2.Keep), "/etc/resolv.conf")
+	builtin = append(slices.Clone(builtin), v2)
+	return v2
+}
+
+func TestLookup(t *testing.T) {
+	v2 := withVersion(t)
+	tests := []struct {
+		spec    string
+		want    string
+		keep    int
+		wantErr string
+	}{
+		{spec: "glibc-nss", want: "glibc-nss@2", keep: len(v2.Keep)},
+		{spec: "glibc-nss@2", want: "glibc-nss@2", keep: len(v2.Keep)},
+		// Pinned projects keep the rules of the version they pinned.
+		{spec: "glibc-nss@1", want: "glibc-nss@1", keep: len(v2.Keep) - 1},
+		{spec: "tzdata@1", want: "tzdata@1", keep: 3},
+		{spec: "glibc-nss@3", wantErr: "pack glibc-nss has no version 3, the latest is 2"},
+		{spec: "glibc-nss@latest", wantErr: `invalid pack version "glibc-nss@latest"`},
+		{spec: "openssl", wantErr: `unknown pack "openssl", expected auto or one of`},
+		{spec: "auto", wantErr: `unknown pack "auto"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			pack, err := Lookup(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("Lookup(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pack.String() != tt.want || len(pack.Keep) != tt.keep {
+				t.Errorf("Lookup(%q) = %s with %d rules, want %s with %d", tt.spec, pack, len(pack.Keep), tt.want, tt.keep)
+			}
+		})
+	}
+}
+
+func TestAll(t *testing.T) {
+	withVersion(t)
+	all := All()
+	if got := Names(); !slices.Equal(got, []string{"glibc-nss", "gconv", "ca-certificates", "tzdata", "passwd", "locales"}) {
+		t.Errorf("Names = %q", got)
+	}
+	if all[0].Version != 2 {
+		t.Errorf("All returned %s, want the latest version", all[0])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate([]string{"auto", "tzdata@1", "passwd"}); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if err := Validate([]string{"tzdata", "tzdata@0", "openssl"}); err == nil || err.Error() != "pack tzdata has no version 0, the latest is 1" {
+		t.Errorf("Validate error = %v, want the first invalid spec", err)
+	}
+}
+
+// writeRootfs creates the files below a temporary rootfs and returns it.
+func writeRootfs(t *testing.T, files ...string) string {
+	t.Helper()
+	rootfs := t.TempDir()
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(rootfs+file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(rootfs+file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestEnable(t *testing.T) {
+	rootfs := writeRootfs(t,
+		"/usr/lib/x86_64-linux-gnu/libc.so.6",
+		"/usr/share/zoneinfo/UTC",
+		"/etc/passwd",
+	)
+	if err := os.Symlink("/usr/share/zoneinfo/UTC", rootfs+"/etc/localtime"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []string
+		wantErr string
+	}{
+		{name: "none", want: []string{}},
+		{name: "auto", specs: []string{"auto"}, want: []string{"glibc-nss@1", "tzdata@1", "passwd@1"}},
+		// Packs enabled by name apply whether detected or not.
+		{name: "by name", specs: []string{"locales", "tzdata@1"}, want: []string{"locales@1", "tzdata@1"}},
+		{name: "auto and by name", specs: []string{"tzdata@1", "auto", "gconv"}, want: []string{"tzdata@1", "glibc-nss@1", "passwd@1", "gconv@1"}},
+		{name: "unknown", specs: []string{"auto", "openssl"}, wantErr: `unknown pack "openssl"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packs, err := Enable(tt.specs, rootfs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("Enable error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, pack := range packs {
+				got = append(got, pack.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Enable(%q) = %q, want %q", tt.specs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeep(t *testing.T) {
+	tzdata, err := Lookup("tzdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwd, err := Lookup("passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/usr/share/zoneinfo/**", "/etc/localtime", "/etc/timezone", "/etc/passwd", "/etc/group"}
+	if got := Keep([]Pack{tzdata, passwd}); !slices.Equal(got, want) {
+		t.Errorf("Keep = %q, want %q", got, want)
+	}
+}
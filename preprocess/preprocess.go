@@ -2,75 +2,75 @@ package preprocess
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/regelepuma/dockerminimizer/engine"
 	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/packs"
 	"github.com/regelepuma/dockerminimizer/types"
 	"github.com/regelepuma/dockerminimizer/utils"
 )
 
 var log = logger.Log
 
-func createEnvironment() string {
+func createEnvironment() (string, error) {
 	dir := md5.Sum(fmt.Appendf(nil, "%d", time.Now().UnixNano()))
 	dirStr := hex.EncodeToString(dir[:])
 	homeDir, _ := os.UserHomeDir()
 	err := os.MkdirAll(homeDir+"/.dockerminimizer/"+dirStr, 0777)
 	if err != nil {
-		panic("Failed to create directory: " + err.Error())
+		return "", errors.New("failed to create directory: " + err.Error())
 	}
 	log.Info("Created directory:", homeDir+"/.dockerminimizer/"+dirStr)
-	return (homeDir + "/.dockerminimizer/" + dirStr)
+	return (homeDir + "/.dockerminimizer/" + dirStr), nil
 }
 
-func buildAndExtractFilesystem(dockerfile string, envPath string) string {
-	buildContext := filepath.Dir(dockerfile)
-	cmd := exec.Command("docker", "build", "-f", dockerfile, "-t", "dockerminimize-"+filepath.Base(envPath), buildContext)
-	log.Info(cmd.String())
-	output, err := cmd.CombinedOutput()
-	log.Info(string(output))
+func buildAndExtractFilesystem(ctx context.Context, rt engine.Runtime, dockerfile string, envPath string, platform string) (string, error) {
+	imageName := "dockerminimize-" + filepath.Base(envPath)
+	err := rt.Build(ctx, engine.BuildOptions{
+		ContextDir: filepath.Dir(dockerfile),
+		Dockerfile: dockerfile,
+		Tag:        imageName,
+		Platform:   platform,
+	})
 	if err != nil {
-		os.RemoveAll(envPath)
-		panic("Failed to build Docker image: " + err.Error())
-	}
-	hasSudo := utils.HasSudo()
-	cmd = utils.ExecCommandWithOptionalSudo(
-		hasSudo,
-		"docker",
-		"build",
-		"-f", dockerfile,
-		"-o", "type=tar,dest="+envPath+"/rootfs.tar",
-		buildContext)
-	log.Info(cmd.String())
-	output, err = cmd.CombinedOutput()
-	log.Info(string(output))
+		return "", errors.New("failed to build Docker image: " + err.Error())
+	}
+	rootfsTar, err := os.Create(envPath + "/rootfs.tar")
+	if err != nil {
+		return imageName, errors.New("failed to create rootfs archive: " + err.Error())
+	}
+	err = rt.ExportRootfs(ctx, imageName, platform, rootfsTar)
+	rootfsTar.Close()
 	if err != nil {
-		os.RemoveAll(envPath)
-		panic("Failed to extract filesystem from Docker image: " + err.Error())
+		return imageName, errors.New("failed to extract filesystem from Docker image: " + err.Error())
 	}
 	os.MkdirAll(envPath+"/rootfs", 0777)
 	log.Info("Extracting filesystem to:", envPath+"/rootfs")
-	utils.ExecCommandWithOptionalSudo(hasSudo, "tar", "-xf", envPath+"/rootfs.tar", "-C", envPath+"/rootfs").Run()
-	utils.ExecCommandWithOptionalSudo(hasSudo, "rm", "-f", envPath+"/rootfs.tar").Run()
-	if os.Getuid() != 0 {
-		exec.Command("sudo", "chown", "-R", os.Getenv("USER")+":"+os.Getenv("USER"), envPath).Run()
-		exec.Command("sudo", "chmod", "-R", "755", envPath).Run()
+	err = utils.ExtractTar(envPath+"/rootfs.tar", envPath+"/rootfs")
+	os.Remove(envPath + "/rootfs.tar")
+	if err != nil {
+		return imageName, errors.New("failed to extract filesystem: " + err.Error())
 	}
-	return "dockerminimize-" + filepath.Base(envPath)
+	return imageName, nil
 }
 
-func extractMetadata(imageName string, dockerfile string, envPath string) types.DockerConfig {
-	fd, _ := os.Open(dockerfile)
+func extractMetadata(ctx context.Context, rt engine.Runtime, imageName string, dockerfile string, envPath string) (types.DockerConfig, error) {
+	fd, err := os.Open(dockerfile)
+	if err != nil {
+		return types.DockerConfig{}, errors.New("failed to open Dockerfile: " + err.Error())
+	}
 	defer fd.Close()
 	scanner := bufio.NewScanner(fd)
 	var lines []string
@@ -84,22 +84,14 @@ func extractMetadata(imageName string, dockerfile string, envPath string) types.
 			break
 		}
 	}
-	cmd := exec.Command("docker", "inspect", "--format", "{{json .Config}}", imageName)
-	log.Info(cmd.String())
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	config, err := rt.InspectConfig(ctx, imageName)
 	if err != nil {
-		os.RemoveAll(envPath)
-		panic("Failed to inspect Docker image: " + err.Error())
+		return types.DockerConfig{}, errors.New("failed to inspect Docker image: " + err.Error())
 	}
-	var config types.DockerConfig
-	err = json.Unmarshal(out.Bytes(), &config)
+	file, err := os.Create(envPath + "/Dockerfile.minimal.template")
 	if err != nil {
-		os.RemoveAll(envPath)
-		panic("Failed to unmarshal Docker config: " + err.Error())
+		return types.DockerConfig{}, errors.New("failed to create Dockerfile template: " + err.Error())
 	}
-	file, _ := os.Create(envPath + "/Dockerfile.minimal.template")
 	defer file.Close()
 	writer := bufio.NewWriter(file)
 	for _, line := range lines {
@@ -118,8 +110,8 @@ func extractMetadata(imageName string, dockerfile string, envPath string) types.
 	if config.User != "" {
 		writer.WriteString("USER " + config.User + "\n")
 	}
-	for exposedPorts := range config.ExposedPorts {
-		writer.WriteString("EXPOSE " + exposedPorts + "\n")
+	for _, port := range slices.Sorted(maps.Keys(config.ExposedPorts)) {
+		writer.WriteString("EXPOSE " + port + "\n")
 	}
 	entrypoints := []string{}
 	for _, entrypoint := range config.Entrypoint {
@@ -135,76 +127,119 @@ func extractMetadata(imageName string, dockerfile string, envPath string) types.
 	if len(command) > 0 {
 		writer.WriteString("CMD [" + strings.Join(command, ", ") + "]\n")
 	}
-	writer.Flush()
-	return config
+	return config, writer.Flush()
 }
 
-func parseFile(file string, envPath string, metadata types.DockerConfig,
-	files map[string][]string, symLinks map[string]string) {
+func parseFile(file string, envPath string, metadata types.DockerConfig, files *types.FileSet) {
+	source := types.Source{Analyzer: "initial", Reason: "command of the image"}
 	workDir := filepath.Clean(envPath + "/rootfs/" + metadata.WorkingDir)
 	if utils.CheckIfFileExists(file, workDir) {
 		filePath := metadata.WorkingDir + "/" + file
-		utils.AddFilesToDockerfile(filePath, files, symLinks, envPath+"/rootfs")
+		utils.AddFile(filePath, files, envPath+"/rootfs", source)
 	} else {
-		hasSudo := utils.HasSudo()
-		output, err := utils.ExecCommandWithOptionalSudo(hasSudo, "chroot", envPath+"/rootfs", "which", file).CombinedOutput()
+		cmd, err := utils.LookPath(file, envPath+"/rootfs", metadata.Env)
 		if err != nil {
 			return
 		}
-		cmd := strings.TrimSpace(string(output))
-		if cmd == "" {
-			return
-		}
-		utils.AddFilesToDockerfile(cmd, files, symLinks, envPath+"/rootfs")
+		utils.AddFile(cmd, files, envPath+"/rootfs", source)
 	}
 }
 
-func parseCommand(metadata types.DockerConfig, envPath string) (map[string][]string, map[string]string) {
-	files := make(map[string][]string)
-	symLinks := make(map[string]string)
+func parseCommand(metadata types.DockerConfig, envPath string) types.FileSet {
+	files := types.NewFileSet()
 	for _, entrypoint := range metadata.Entrypoint {
-		parseFile(entrypoint, envPath, metadata, files, symLinks)
+		parseFile(entrypoint, envPath, metadata, &files)
 	}
 	for _, cmd := range metadata.Cmd {
-		parseFile(cmd, envPath, metadata, files, symLinks)
+		parseFile(cmd, envPath, metadata, &files)
 	}
-	return files, symLinks
+	return files
 }
 
-func processDockerfile(dockerfile string, envPath string, timeout int) (string, string, types.DockerConfig, error) {
-	content, _ := os.ReadFile(dockerfile)
-	_, err := parser.Parse(strings.NewReader(string(content)))
+func processDockerfile(ctx context.Context, rt engine.Runtime, image types.Image,
+	dockerfile string) (types.Image, types.FileSet, error) {
+	envPath := image.EnvPath
+	content, err := os.ReadFile(dockerfile)
 	if err != nil {
-		os.RemoveAll(envPath)
-		panic("Failed to parse Dockerfile: " + err.Error())
-	}
-	imageName := buildAndExtractFilesystem(dockerfile, envPath)
-	metadata := extractMetadata(imageName, dockerfile, envPath)
-	files, symLinks := parseCommand(metadata, envPath)
-	utils.CreateDockerfile("Dockerfile.minimal.initial", "Dockerfile.minimal.template", envPath, files, symLinks)
-	err = utils.ValidateDockerfile("Dockerfile.minimal.initial", envPath, filepath.Dir(dockerfile), timeout)
-	return imageName, envPath, metadata, err
+		return image, types.FileSet{}, errors.New("failed to read Dockerfile: " + err.Error())
+	}
+	_, err = parser.Parse(strings.NewReader(string(content)))
+	if err != nil {
+		return image, types.FileSet{}, errors.New("failed to parse Dockerfile: " + err.Error())
+	}
+	image.Name, err = buildAndExtractFilesystem(ctx, rt, dockerfile, envPath, image.Platform)
+	if err != nil {
+		return image, types.FileSet{}, err
+	}
+	image.Metadata, err = extractMetadata(ctx, rt, image.Name, dockerfile, envPath)
+	if err != nil {
+		return image, types.FileSet{}, err
+	}
+	// Minimized images keep the configuration of the image, the analysis
+	// looks at the container as it is run.
+	image.Config = image.Metadata
+	image.Metadata.Env = slices.Concat(image.Metadata.Env, image.Env)
+	if len(image.RunArgs) > 0 {
+		image.Metadata.Cmd = image.RunArgs
+	}
+	enabled, err := packs.Enable(image.Packs, envPath+"/rootfs")
+	if err != nil {
+		return image, types.FileSet{}, err
+	}
+	image.Packs = nil
+	for _, pack := range enabled {
+		log.Info("Enabling pack ", pack)
+		image.Packs = append(image.Packs, pack.String())
+	}
+	image.Keep = slices.Concat(image.Keep, packs.Keep(enabled))
+	files := parseCommand(image.Metadata, envPath)
+	utils.KeepAndDrop(image, &files)
+	err = utils.CreateDockerfile("Dockerfile.minimal.initial", "Dockerfile.minimal.template", envPath, files)
+	return image, files, err
 }
 
-func processImage(imageName string, envPath string, timeout int) (string, string, types.DockerConfig, error) {
-	dockerfile, _ := os.Create("Dockerfile")
-	defer dockerfile.Close()
-	defer os.Remove("Dockerfile")
-	writer := bufio.NewWriter(dockerfile)
-	writer.WriteString("FROM " + imageName + "\n")
-	writer.Flush()
-	return processDockerfile("Dockerfile", envPath, timeout)
+func processImage(ctx context.Context, rt engine.Runtime, image types.Image, imageName string) (types.Image, types.FileSet, error) {
+	// The generated Dockerfile gets its own build context, so that the whole
+	// environment is not sent to the engine on every build.
+	image.Context = image.EnvPath + "/context"
+	if err := os.MkdirAll(image.Context, 0777); err != nil {
+		return image, types.FileSet{}, errors.New("failed to create build context: " + err.Error())
+	}
+	err := os.WriteFile(image.Context+"/Dockerfile", []byte("FROM "+imageName+"\n"), 0666)
+	if err != nil {
+		return image, types.FileSet{}, errors.New("failed to create Dockerfile: " + err.Error())
+	}
+	return processDockerfile(ctx, rt, image, image.Context+"/Dockerfile")
 }
 
-func ProcessArgs(args types.Args) (string, string, types.DockerConfig, error) {
-	envPath := createEnvironment()
+// ProcessArgs creates the working environment, builds the image, extracts its
+// filesystem and metadata, runs the language analyzers and writes the initial
+// minimal Dockerfile. The returned image is filled in as far as preprocessing
+// got, even on error, so that the caller can clean up after it.
+func ProcessArgs(ctx context.Context, rt engine.Runtime, args types.Args) (types.Image, types.FileSet, error) {
+	envPath, err := createEnvironment()
+	if err != nil {
+		return types.Image{}, types.FileSet{}, err
+	}
+	image := types.Image{
+		EnvPath:      envPath,
+		Platform:     args.Platform,
+		Checks:       args.Checks,
+		Differential: args.Differential,
+		Workload:     args.Workload,
+		Keep:         args.Keep,
+		Drop:         args.Drop,
+		Packs:        args.Packs,
+		Env:          args.Env,
+		RunArgs:      args.RunArgs,
+	}
 	if args.Image == "" {
 		_, err := os.Stat(args.Dockerfile)
 		if os.IsNotExist(err) {
-			os.RemoveAll(envPath)
-			panic("Dockerfile does not exist")
+			return image, types.FileSet{}, errors.New("dockerfile does not exist")
 		}
-		return processDockerfile(args.Dockerfile, envPath, args.Timeout)
+		image.Context = filepath.Dir(args.Dockerfile)
+		return processDockerfile(ctx, rt, image, args.Dockerfile)
 	}
-	return processImage(args.Image, envPath, args.Timeout)
+	return processImage(ctx, rt, image, args.Image)
 }
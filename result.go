@@ -0,0 +1,181 @@
+package dockerminimizer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/config"
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/oci"
+	"github.com/regelepuma/dockerminimizer/strace"
+	"github.com/regelepuma/dockerminimizer/types"
+	"github.com/regelepuma/dockerminimizer/utils"
+)
+
+// Stage identifies the analysis stage that produced a minimal Dockerfile.
+type Stage string
+
+const (
+	StageInitial      Stage = "initial"
+	StageLdd          Stage = "ldd"
+	StageStrace       Stage = "strace"
+	StageBinarySearch Stage = "binary_search"
+)
+
+// FileSetReport is the file in the output directory the kept paths are
+// written to as JSON, with their metadata and provenance.
+const FileSetReport = "files.json"
+
+// Result describes the outcome of a minimization run.
+type Result struct {
+	// Stage is the stage whose Dockerfile was kept.
+	Stage Stage
+	// Validated is false when the kept Dockerfile did not pass validation,
+	// which only happens when binary search is disabled.
+	Validated bool
+	// Dockerfile holds the contents of the minimal Dockerfile.
+	Dockerfile string
+	// Files lists the kept paths inside the image, sorted.
+	Files []string
+	// SymLinks maps kept symbolic links to their targets.
+	SymLinks map[string]string
+	// FileSet holds the kept paths with their metadata and the analyzers
+	// that found them.
+	FileSet types.FileSet
+	// SizeBefore and SizeAfter are the sizes in bytes of the regular files in
+	// the original filesystem and in the kept set.
+	SizeBefore int64
+	SizeAfter  int64
+	// Absent lists the paths the traced programs looked up without finding
+	// them, which the minimized image, a subset of the original, lacks as
+	// well. Lookups holds the lookups of every traced program in order. Both
+	// are empty unless dynamic analysis ran.
+	Absent  []string
+	Lookups map[string][]strace.Lookup
+	// Packs lists the enabled knowledge packs as name@version.
+	Packs []string
+	// StageErrors holds the reason each failed stage was rejected.
+	StageErrors map[Stage]error
+	// DockerfilePath, ArchivePaths, FileSetPath, LookupReportPath and
+	// ImagePath point at the artifacts written to the output directory, if
+	// any. ArchivePaths lists the archives the Dockerfile adds,
+	// LookupReportPath is empty when dynamic analysis did not run and
+	// ImagePath, the OCI image layout or archive, unless OutputFormat asks
+	// for one.
+	DockerfilePath   string
+	ArchivePaths     []string
+	FileSetPath      string
+	LookupReportPath string
+	ImagePath        string
+	// ImageDigest is the digest of the manifest of the image at ImagePath.
+	ImageDigest string
+}
+
+func newResult() *Result {
+	return &Result{
+		Validated:   true,
+		SymLinks:    make(map[string]string),
+		StageErrors: make(map[Stage]error),
+	}
+}
+
+func (r *Result) finish(stage Stage, image types.Image, files types.FileSet, args types.Args) (*Result, error) {
+	outputDir := args.OutputDir
+	r.Stage = stage
+	rootfsPath := image.EnvPath + "/rootfs"
+	r.FileSet = files
+	for entry := range files.All() {
+		if entry.Kind == types.KindSymLink {
+			r.SymLinks[entry.Path] = entry.Target
+			continue
+		}
+		r.Files = append(r.Files, entry.Path)
+		info, err := os.Lstat(rootfsPath + entry.Path)
+		if err == nil && info.Mode().IsRegular() {
+			r.SizeAfter += info.Size()
+		}
+	}
+
+	dockerfile := image.EnvPath + "/" + dockerfileName(string(stage))
+	content, err := os.ReadFile(dockerfile)
+	if err != nil {
+		return r, err
+	}
+	r.Dockerfile = string(content)
+	if outputDir == "" {
+		return r, nil
+	}
+
+	r.DockerfilePath = filepath.Join(outputDir, "Dockerfile.minimal")
+	if err := utils.CopyFile(dockerfile, r.DockerfilePath); err != nil {
+		return r, err
+	}
+	for _, line := range strings.Split(r.Dockerfile, "\n") {
+		archive, ok := strings.CutPrefix(line, "ADD ")
+		if !ok {
+			continue
+		}
+		archive, _, _ = strings.Cut(archive, " ")
+		if !slices.Contains(utils.Archives(), archive) {
+			continue
+		}
+		path := filepath.Join(outputDir, archive)
+		if err := utils.CopyFile(image.EnvPath+"/"+archive, path); err != nil {
+			return r, err
+		}
+		r.ArchivePaths = append(r.ArchivePaths, path)
+	}
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return r, err
+	}
+	r.FileSetPath = filepath.Join(outputDir, FileSetReport)
+	if err := os.WriteFile(r.FileSetPath, append(data, '\n'), 0644); err != nil {
+		return r, err
+	}
+	report := image.EnvPath + "/" + strace.LookupReport
+	if utils.CheckIfFileExists(report, "") {
+		r.LookupReportPath = filepath.Join(outputDir, strace.LookupReport)
+		if err := utils.CopyFile(report, r.LookupReportPath); err != nil {
+			return r, err
+		}
+	}
+	return r, r.writeImage(image, files, args)
+}
+
+// writeImage writes files as an OCI image layout, or an oci-archive, to the
+// output directory when args.OutputFormat asks for it.
+func (r *Result) writeImage(image types.Image, files types.FileSet, args types.Args) error {
+	log := logger.Log
+	write := oci.WriteLayout
+	switch args.OutputFormat {
+	case config.OutputOCI:
+		r.ImagePath = filepath.Join(args.OutputDir, "image")
+		if err := os.MkdirAll(r.ImagePath, 0755); err != nil {
+			return err
+		}
+	case config.OutputOCIArchive:
+		r.ImagePath = filepath.Join(args.OutputDir, "image.tar")
+		write = oci.WriteArchive
+	default:
+		return nil
+	}
+	digest, err := write(r.ImagePath, oci.Image{
+		EnvPath:     image.EnvPath,
+		Files:       files,
+		Config:      image.Config,
+		Platform:    image.Platform,
+		Reference:   image.Name + ":minimal",
+		Compression: oci.Compression(args.Compression),
+	})
+	if err != nil {
+		log.Error("Error writing OCI image:", err)
+		return err
+	}
+	log.Info("Wrote OCI image ", digest, " to ", r.ImagePath)
+	r.ImageDigest = digest
+	return nil
+}
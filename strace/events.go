@@ -0,0 +1,266 @@
+package strace
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Call holds what every traced system call has in common.
+type Call struct {
+	PID  int
+	Name string
+	// Result is the return value, or -1 when the call failed with Errno.
+	Result int64
+	Errno  string
+	// Unfinished is set for calls that never returned, typically because the
+	// container was stopped while they were blocked.
+	Unfinished bool
+}
+
+// Syscall returns the fields shared by all events.
+func (c Call) Syscall() Call {
+	return c
+}
+
+// Failed reports whether the call returned an error.
+func (c Call) Failed() bool {
+	return c.Errno != ""
+}
+
+// Absent reports whether the call failed because a path it looked up does
+// not exist.
+func (c Call) Absent() bool {
+	return c.Errno == "ENOENT" || c.Errno == "ENOTDIR"
+}
+
+// Event is a system call decoded from strace output. Paths are absolute and
+// resolved against the working directory of the process.
+type Event interface {
+	Syscall() Call
+	Paths() []string
+}
+
+// Open is a call opening or creating a file: open, openat, openat2 or creat.
+type Open struct {
+	Call
+	Path  string
+	Flags string
+}
+
+func (e Open) Paths() []string { return nonEmpty(e.Path) }
+
+// Exec is a call executing a program: execve or execveat.
+type Exec struct {
+	Call
+	Path string
+	Argv []string
+}
+
+func (e Exec) Paths() []string { return nonEmpty(e.Path) }
+
+// Stat is a call looking up a path without opening it, such as stat, access
+// or readlink.
+type Stat struct {
+	Call
+	Path string
+}
+
+func (e Stat) Paths() []string { return nonEmpty(e.Path) }
+
+// Chdir is a call changing the working directory: chdir or fchdir.
+type Chdir struct {
+	Call
+	Path string
+}
+
+func (e Chdir) Paths() []string { return nonEmpty(e.Path) }
+
+// Rename is a call moving a file: rename, renameat or renameat2.
+type Rename struct {
+	Call
+	From string
+	To   string
+}
+
+func (e Rename) Paths() []string { return nonEmpty(e.From, e.To) }
+
+// Link is a call creating a hard or symbolic link at Path to Target.
+type Link struct {
+	Call
+	Target   string
+	Path     string
+	Symbolic bool
+}
+
+func (e Link) Paths() []string { return nonEmpty(e.Target, e.Path) }
+
+// Connect is a connection to a unix socket.
+type Connect struct {
+	Call
+	Path string
+}
+
+func (e Connect) Paths() []string { return nonEmpty(e.Path) }
+
+// Clone is a call creating a process, its Result is the PID of the child.
+type Clone struct {
+	Call
+}
+
+func (e Clone) Paths() []string { return nil }
+
+// PathCall is any other call taking paths, such as mkdir, unlink or chmod.
+type PathCall struct {
+	Call
+	Args []string
+}
+
+func (e PathCall) Paths() []string { return nonEmpty(e.Args...) }
+
+func nonEmpty(paths ...string) []string {
+	result := []string{}
+	for _, path := range paths {
+		if path != "" {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+var statSyscalls = []string{
+	"stat", "lstat", "stat64", "lstat64", "newfstatat", "fstatat64", "statx", "statfs",
+	"access", "faccessat", "faccessat2", "readlink", "readlinkat",
+	"getxattr", "lgetxattr", "listxattr", "llistxattr",
+}
+
+// parseResult splits the result of a call, such as 3</etc/passwd> or
+// -1 ENOENT (No such file or directory), into its value and errno.
+func parseResult(result string) (int64, string) {
+	fields := strings.Fields(result)
+	if len(fields) == 0 {
+		return 0, ""
+	}
+	number, _, _ := strings.Cut(fields[0], "<")
+	value, err := strconv.ParseInt(number, 0, 64)
+	if err != nil {
+		return 0, ""
+	}
+	if value < 0 && len(fields) > 1 && strings.HasPrefix(fields[1], "E") {
+		return value, fields[1]
+	}
+	return value, ""
+}
+
+// parseArgv decodes an argument vector such as ["sh", "-c", "exit 0"].
+func parseArgv(arg string) []string {
+	inner, ok := strings.CutPrefix(arg, "[")
+	if !ok {
+		return nil
+	}
+	inner = strings.TrimSuffix(inner, "]")
+	elements, _ := splitArguments(inner)
+	argv := []string{}
+	for _, element := range elements {
+		if value, ok := unquote(element); ok {
+			argv = append(argv, value)
+		}
+	}
+	return argv
+}
+
+func argument(c call, i int) string {
+	if i < len(c.args) {
+		return c.args[i]
+	}
+	return ""
+}
+
+func openFlags(c call) string {
+	switch c.syscall {
+	case "open":
+		return argument(c, 1)
+	case "creat":
+		return "O_CREAT|O_WRONLY|O_TRUNC"
+	case "openat2":
+		// The flags are a member of struct open_how.
+		how := strings.Trim(argument(c, 2), "{}")
+		for member := range strings.SplitSeq(how, ", ") {
+			if flags, ok := strings.CutPrefix(member, "flags="); ok {
+				return flags
+			}
+		}
+		return ""
+	}
+	return argument(c, 2)
+}
+
+func newEvent(c call, paths []string, finished bool) Event {
+	// strace prints a result of ? for calls interrupted by the death of
+	// their process.
+	base := Call{PID: c.pid, Name: c.syscall, Unfinished: !finished || c.result == "?"}
+	base.Result, base.Errno = parseResult(c.result)
+	path := func(i int) string {
+		if i < len(paths) {
+			return paths[i]
+		}
+		return ""
+	}
+	switch {
+	case slices.Contains(fdSyscalls, c.syscall):
+		return Open{Call: base, Path: path(0), Flags: openFlags(c)}
+	case c.syscall == "execve":
+		return Exec{Call: base, Path: path(0), Argv: parseArgv(argument(c, 1))}
+	case c.syscall == "execveat":
+		return Exec{Call: base, Path: path(0), Argv: parseArgv(argument(c, 2))}
+	case slices.Contains(statSyscalls, c.syscall):
+		return Stat{Call: base, Path: path(0)}
+	case c.syscall == "chdir" || c.syscall == "fchdir":
+		return Chdir{Call: base, Path: path(0)}
+	case strings.HasPrefix(c.syscall, "rename"):
+		return Rename{Call: base, From: path(0), To: path(1)}
+	case c.syscall == "link" || c.syscall == "linkat":
+		return Link{Call: base, Target: path(0), Path: path(1)}
+	case c.syscall == "symlink" || c.syscall == "symlinkat":
+		return Link{Call: base, Target: path(0), Path: path(1), Symbolic: true}
+	case c.syscall == "connect":
+		return Connect{Call: base, Path: path(0)}
+	case slices.Contains(processSyscalls, c.syscall):
+		return Clone{Call: base}
+	}
+	return PathCall{Call: base, Args: paths}
+}
+
+// Parse decodes the output of strace -f -y into events, in the order the calls
+// returned. Relative paths are resolved starting from workingDir, the working
+// directory of the traced command. Lines that are not system calls, such as
+// signals and exit notices, are skipped.
+func Parse(r io.Reader, workingDir string) ([]Event, error) {
+	parser := newLineParser()
+	procs := newProcesses(workingDir)
+	events := []Event{}
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if c, ok := parser.parse(line); ok {
+			events = append(events, newEvent(c, procs.paths(c), true))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return events, err
+		}
+	}
+	// Calls still pending never returned, their arguments are all there is.
+	for _, pid := range slices.Sorted(maps.Keys(parser.pending)) {
+		if c, ok := parser.parse(strconv.Itoa(pid) + " " + parser.pending[pid] + ")"); ok {
+			events = append(events, newEvent(c, procs.paths(c), false))
+		}
+	}
+	return events, nil
+}
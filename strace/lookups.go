@@ -0,0 +1,111 @@
+package strace
+
+import (
+	"bufio"
+	"maps"
+	"os"
+	"slices"
+)
+
+// Lookup is one attempt of a program to find a path.
+type Lookup struct {
+	Path  string
+	Found bool
+}
+
+// Negatives describes the paths the traced programs looked for, including
+// the ones they did not find. Programs commonly probe a list of locations
+// before finding a file; the probed locations are negative dependencies that
+// have to stay absent for the program to behave the same, which they do: the
+// minimized image only holds files of the original one.
+type Negatives struct {
+	// Absent lists, sorted, the paths that were looked up and never found.
+	Absent []string
+	// Lookups lists the lookups of every program in the order they happened,
+	// keyed by the path of the program.
+	Lookups map[string][]Lookup
+}
+
+func (n *Negatives) merge(other Negatives) {
+	if n.Lookups == nil {
+		n.Lookups = make(map[string][]Lookup)
+	}
+	for program, lookups := range other.Lookups {
+		n.Lookups[program] = append(n.Lookups[program], lookups...)
+	}
+	found := make(map[string]bool)
+	for _, lookups := range n.Lookups {
+		for _, lookup := range lookups {
+			found[lookup.Path] = found[lookup.Path] || lookup.Found
+		}
+	}
+	n.Absent = []string{}
+	for path, ok := range found {
+		if !ok {
+			n.Absent = append(n.Absent, path)
+		}
+	}
+	slices.Sort(n.Absent)
+}
+
+// collectLookups collects the lookups of events per program. Processes run
+// program until they execute another one, children inherit the program of
+// their parent.
+func collectLookups(events []Event, program string) Negatives {
+	programs := make(map[int]string)
+	programOf := func(pid int) string {
+		if p, ok := programs[pid]; ok {
+			return p
+		}
+		return program
+	}
+	lookups := make(map[string][]Lookup)
+	for _, event := range events {
+		call := event.Syscall()
+		switch event.(type) {
+		case Clone:
+			if !call.Failed() && call.Result > 0 {
+				programs[int(call.Result)] = programOf(call.PID)
+			}
+			continue
+		case Open, Stat, Connect, Exec:
+		default:
+			continue
+		}
+		current := programOf(call.PID)
+		for _, path := range event.Paths() {
+			lookups[current] = append(lookups[current], Lookup{Path: path, Found: !call.Absent()})
+		}
+		// The lookup of an executed program is attributed to the process
+		// executing it, later ones to the program.
+		if exec, ok := event.(Exec); ok && !call.Failed() && exec.Path != "" {
+			programs[call.PID] = exec.Path
+		}
+	}
+	n := Negatives{}
+	n.merge(Negatives{Lookups: lookups})
+	return n
+}
+
+// writeLookupReport writes the lookups of every program to path, one
+// program per section with + marking found and - absent paths.
+func writeLookupReport(path string, n Negatives) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	for _, program := range slices.Sorted(maps.Keys(n.Lookups)) {
+		writer.WriteString("# " + program + "\n")
+		for _, lookup := range n.Lookups[program] {
+			mark := "- "
+			if lookup.Found {
+				mark = "+ "
+			}
+			writer.WriteString(mark + lookup.Path + "\n")
+		}
+		writer.WriteString("\n")
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,72 @@
+package strace
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCollectLookups(t *testing.T) {
+	log := strings.Join([]string{
+		`1 openat(AT_FDCWD</app>, "/etc/app/app.yml", O_RDONLY) = -1 ENOENT (No such file or directory)`,
+		`1 openat(AT_FDCWD</app>, "/app/app.yml", O_RDONLY) = 3</app/app.yml>`,
+		`1 clone(child_stack=NULL, flags=SIGCHLD) = 2`,
+		`2 execve("/usr/bin/python3", ["python3", "-c", "pass"], 0x7ffd /* 1 var */) = 0`,
+		`2 stat("/usr/lib/python3.12/site-packages/six.py", 0x7ffd) = -1 ENOENT (No such file or directory)`,
+		`2 stat("/etc/app/app.yml", 0x7ffd) = -1 ENOENT (No such file or directory)`,
+		// Created after a failed probe, the path is found in the end.
+		`1 stat("/app/cache", 0x7ffd) = -1 ENOENT (No such file or directory)`,
+		`1 mkdir("/app/cache", 0755) = 0`,
+		`1 stat("/app/cache", {st_mode=S_IFDIR|0755, ...}) = 0`,
+	}, "\n")
+	events, err := Parse(strings.NewReader(log), "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := collectLookups(events, "/app/server")
+	want := map[string][]Lookup{
+		"/app/server": {
+			{"/etc/app/app.yml", false},
+			{"/app/app.yml", true},
+			// The child looks up the program it executes.
+			{"/usr/bin/python3", true},
+			{"/app/cache", false},
+			{"/app/cache", true},
+		},
+		"/usr/bin/python3": {
+			{"/usr/lib/python3.12/site-packages/six.py", false},
+			{"/etc/app/app.yml", false},
+		},
+	}
+	if !reflect.DeepEqual(n.Lookups, want) {
+		t.Errorf("lookups = %v, want %v", n.Lookups, want)
+	}
+	if want := []string{"/etc/app/app.yml", "/usr/lib/python3.12/site-packages/six.py"}; !slices.Equal(n.Absent, want) {
+		t.Errorf("absent = %v, want %v", n.Absent, want)
+	}
+
+	// Merging the lookups of another trace finds what it found.
+	n.merge(Negatives{Lookups: map[string][]Lookup{"/bin/sh": {{"/etc/app/app.yml", true}}}})
+	if want := []string{"/usr/lib/python3.12/site-packages/six.py"}; !slices.Equal(n.Absent, want) {
+		t.Errorf("absent after merge = %v, want %v", n.Absent, want)
+	}
+}
+
+func TestWriteLookupReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LookupReport)
+	n := Negatives{Lookups: map[string][]Lookup{
+		"/usr/bin/python3": {{"/usr/lib/python3.12/six.py", false}},
+		"/app/server":      {{"/etc/app.yml", false}, {"/app/app.yml", true}},
+	}}
+	if err := writeLookupReport(path, n); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(path)
+	want := "# /app/server\n- /etc/app.yml\n+ /app/app.yml\n\n# /usr/bin/python3\n- /usr/lib/python3.12/six.py\n\n"
+	if string(got) != want {
+		t.Errorf("report =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package strace
+
+import (
+	"strconv"
+	"strings"
+)
+
+// call is a system call read from strace -f output, such as
+//
+//	42 openat(AT_FDCWD</app>, "config.yml", O_RDONLY) = 3</app/config.yml>
+//
+// result is the text after the equals sign, including the errno of failed calls.
+type call struct {
+	pid     int
+	syscall string
+	args    []string
+	result  string
+}
+
+const (
+	unfinished = "<unfinished ...>"
+	resumed    = " resumed>"
+)
+
+// lineParser turns lines of strace -f output into calls. System calls
+// interrupted by another process are printed in two parts, the first part is
+// kept per process until the line resuming it is read.
+type lineParser struct {
+	pending map[int]string
+}
+
+func newLineParser() *lineParser {
+	return &lineParser{pending: make(map[int]string)}
+}
+
+func (p *lineParser) parse(line string) (call, bool) {
+	c := call{}
+	line = strings.TrimSpace(line)
+	if pid, rest, ok := strings.Cut(line, " "); ok {
+		if n, err := strconv.Atoi(pid); err == nil {
+			c.pid = n
+			line = strings.TrimSpace(rest)
+		}
+	}
+	if before, ok := strings.CutSuffix(line, unfinished); ok {
+		p.pending[c.pid] = before
+		return c, false
+	}
+	if strings.HasPrefix(line, "<... ") {
+		_, rest, ok := strings.Cut(line, resumed)
+		before, found := p.pending[c.pid]
+		if !ok || !found {
+			return c, false
+		}
+		delete(p.pending, c.pid)
+		line = before + rest
+	}
+	open := strings.IndexByte(line, '(')
+	if open <= 0 {
+		return c, false
+	}
+	c.syscall = line[:open]
+	for _, r := range c.syscall {
+		if r != '_' && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return c, false
+		}
+	}
+	var rest string
+	c.args, rest = splitArguments(line[open+1:])
+	if result, ok := strings.CutPrefix(strings.TrimSpace(rest), "="); ok {
+		c.result = strings.TrimSpace(result)
+	}
+	return c, true
+}
+
+// splitArguments splits the argument list of a system call at top level
+// commas, returning the arguments and the text after the closing parenthesis.
+func splitArguments(s string) ([]string, string) {
+	args := []string{}
+	depth := 0
+	start := 0
+	inString := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return appendArgument(args, s[start:i]), s[i+1:]
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				args = appendArgument(args, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return appendArgument(args, s[start:]), ""
+}
+
+func appendArgument(args []string, arg string) []string {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return args
+	}
+	return append(args, arg)
+}
+
+// unquote decodes a string argument as printed by strace, which uses C
+// escapes with octal sequences of variable length. Strings longer than the
+// -s limit of strace are printed truncated, followed by ..., and are not
+// decoded: a prefix of a path is another path.
+func unquote(arg string) (string, bool) {
+	if len(arg) < 2 || arg[0] != '"' || arg[len(arg)-1] != '"' {
+		return "", false
+	}
+	return unescape(arg[1 : len(arg)-1]), true
+}
+
+// unescape decodes the C escapes of a string printed by strace.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'v':
+			b.WriteByte('\v')
+		case 'f':
+			b.WriteByte('\f')
+		case 'x':
+			end := i + 1
+			for end < len(s) && end < i+3 && isHex(s[end]) {
+				end++
+			}
+			value, _ := strconv.ParseUint(s[i+1:end], 16, 8)
+			b.WriteByte(byte(value))
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i
+			for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '7' {
+				end++
+			}
+			value, _ := strconv.ParseUint(s[i:end], 8, 8)
+			b.WriteByte(byte(value))
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// decodeFd splits a file descriptor decoded by strace -y, such as
+// 3</usr/lib>, into its number and path. The path is empty when strace did
+// not decode it or the descriptor is not a file, e.g. a socket or a pipe.
+// Paths are escaped like strings, with < and > escaped as well.
+func decodeFd(arg string) (int, string) {
+	number, path, found := strings.Cut(arg, "<")
+	fd, err := strconv.Atoi(number)
+	if err != nil {
+		fd = -1
+	}
+	path = strings.TrimSuffix(path, ">")
+	if !found || !strings.HasPrefix(path, "/") {
+		return fd, ""
+	}
+	return fd, unescape(path)
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
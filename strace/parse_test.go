@@ -0,0 +1,155 @@
+package strace
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+		ok   bool
+	}{
+		{`"/etc/passwd"`, "/etc/passwd", true},
+		{`""`, "", true},
+		{`"caf\303\251"`, "café", true},
+		{`"\0741\76"`, "<1>", true},
+		{`"\x2ftmp"`, "/tmp", true},
+		{`"a\tb\nc\\d\"e"`, "a\tb\nc\\d\"e", true},
+		{`"\1"`, "\x01", true},
+		{`"ends with dots..."`, "ends with dots...", true},
+		{`"/var/log/app/requests"...`, "", false},
+		{`""...`, "", false},
+		{`NULL`, "", false},
+		{`0x7ffc1c2ab7a0`, "", false},
+		{`"`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := unquote(tt.arg)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("unquote(%s) = %q, %t, want %q, %t", tt.arg, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDecodeFd(t *testing.T) {
+	tests := []struct {
+		arg  string
+		fd   int
+		path string
+	}{
+		{"3</usr/lib>", 3, "/usr/lib"},
+		{`4</srv/caf\303\251 \0741\76.txt>`, 4, "/srv/café <1>.txt"},
+		{"5<socket:[48213]>", 5, ""},
+		{"6<pipe:[1234]>", 6, ""},
+		{"7", 7, ""},
+		{"AT_FDCWD</app>", -1, "/app"},
+	}
+	for _, tt := range tests {
+		fd, path := decodeFd(tt.arg)
+		if fd != tt.fd || path != tt.path {
+			t.Errorf("decodeFd(%s) = %d, %q, want %d, %q", tt.arg, fd, path, tt.fd, tt.path)
+		}
+	}
+}
+
+func TestLineParser(t *testing.T) {
+	p := newLineParser()
+	lines := []string{
+		`42    openat(AT_FDCWD</app>, "a", O_RDONLY <unfinished ...>`,
+		`43    read(3</app/b>, <unfinished ...>`,
+		`43    <... read resumed>"data", 4096) = 4`,
+		`42    <... openat resumed>) = 3</app/a>`,
+		`44    <... close resumed>) = 0`,
+		`42    --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=43} ---`,
+		`43    +++ exited with 0 +++`,
+	}
+	want := []call{
+		{pid: 43, syscall: "read", args: []string{"3</app/b>", `"data"`, "4096"}, result: "4"},
+		{pid: 42, syscall: "openat", args: []string{"AT_FDCWD</app>", `"a"`, "O_RDONLY"}, result: "3</app/a>"},
+	}
+	got := []call{}
+	for _, line := range lines {
+		if c, ok := p.parse(line); ok {
+			got = append(got, c)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("calls left pending: %v", p.pending)
+	}
+}
+
+func TestParse(t *testing.T) {
+	fd, err := os.Open("testdata/app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	events, err := Parse(fd, "/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(pid int, name string, result int64, errno string) Call {
+		return Call{PID: pid, Name: name, Result: result, Errno: errno}
+	}
+	want := []Event{
+		Exec{Call: call(1, "execve", 0, ""), Path: "/usr/local/bin/app", Argv: []string{"app", "--config", "conf/app.yml"}},
+		Open{Call: call(1, "openat", 3, ""), Path: "/etc/ld.so.cache", Flags: "O_RDONLY|O_CLOEXEC"},
+		Open{Call: call(1, "openat", 3, ""), Path: "/lib/x86_64-linux-gnu/libc.so.6", Flags: "O_RDONLY|O_CLOEXEC"},
+		Chdir{Call: call(1, "chdir", 0, ""), Path: "/srv/app"},
+		Open{Call: call(1, "openat", 3, ""), Path: "/srv/app/conf", Flags: "O_RDONLY|O_DIRECTORY"},
+		Stat{Call: call(1, "newfstatat", -1, "ENOENT"), Path: "/srv/app/conf/local.yml"},
+		Clone{Call: call(1, "clone", 7, "")},
+		// Resumed in the order the calls returned, not the order they started.
+		Open{Call: call(1, "openat", 4, ""), Path: "/srv/app/data/café <1>.txt", Flags: "O_RDONLY"},
+		Open{Call: call(7, "openat", 4, ""), Path: "/srv/app/conf/app.yml", Flags: "O_RDONLY"},
+		Exec{Call: call(7, "execve", 0, ""), Path: "/bin/sh", Argv: []string{"sh", "-c", `printf "%s\t" . > out`}},
+		// The child inherited the working directory of its parent.
+		Stat{Call: call(7, "stat", 0, ""), Path: "/srv/run"},
+		Connect{Call: call(7, "connect", -1, "ENOENT"), Path: "/run/nscd/socket"},
+		// The truncated argument is not decoded, the descriptor names the file.
+		Open{Call: call(1, "openat", 5, ""), Path: "/var/log/app/requests-2024-06-01T00:00:00.log",
+			Flags: "O_WRONLY|O_CREAT|O_APPEND"},
+		Stat{Call: call(1, "newfstatat", 0, "")},
+		Clone{Call: call(1, "clone", 8, "")},
+		PathCall{Call: Call{PID: 1, Name: "mkdir", Unfinished: true}, Args: []string{"/srv/app/cache"}},
+		Stat{Call: Call{PID: 8, Name: "access", Unfinished: true}, Path: "/srv/app/ready"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("parsed %d events, want %d:\n%s", len(events), len(want), describe(events))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(events[i], want[i]) {
+			t.Errorf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestParseTruncatedPath(t *testing.T) {
+	// A failed call with a truncated path names no file at all.
+	log := `1 stat("/usr/share/locale/en_US.UTF-8/LC_MESSAGES/a"..., 0x7ffd4c1e2b30) = -1 ENOENT (No such file or directory)` + "\n"
+	events, err := Parse(strings.NewReader(log), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || len(events[0].Paths()) != 0 {
+		t.Errorf("parsed %s, want one event without paths", describe(events))
+	}
+}
+
+func describe(events []Event) string {
+	var b strings.Builder
+	for _, event := range events {
+		b.WriteString(reflect.TypeOf(event).Name())
+		b.WriteString(" ")
+		b.WriteString(strings.Join(event.Paths(), " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package strace
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// processes follows the working directory and the open file descriptors of
+// every traced process, so that the relative paths system calls receive can
+// be resolved to where they point inside the container.
+type processes struct {
+	workingDir string
+	cwd        map[int]string
+	fds        map[int]map[int]string
+}
+
+// fdSyscalls return a new file descriptor for their path.
+var fdSyscalls = []string{"open", "openat", "openat2", "creat"}
+
+func newProcesses(workingDir string) *processes {
+	if !filepath.IsAbs(workingDir) {
+		workingDir = "/"
+	}
+	return &processes{
+		workingDir: filepath.Clean(workingDir),
+		cwd:        make(map[int]string),
+		fds:        make(map[int]map[int]string),
+	}
+}
+
+func (p *processes) cwdOf(pid int) string {
+	if cwd, ok := p.cwd[pid]; ok {
+		return cwd
+	}
+	return p.workingDir
+}
+
+// dir returns the directory a dirfd argument refers to, or the working
+// directory of the process for AT_FDCWD.
+func (p *processes) dir(pid int, arg string) string {
+	if strings.HasPrefix(arg, "AT_FDCWD") {
+		return p.cwdOf(pid)
+	}
+	fd, path := decodeFd(arg)
+	if path != "" {
+		return path
+	}
+	if path, ok := p.fds[pid][fd]; ok {
+		return path
+	}
+	return p.cwdOf(pid)
+}
+
+func (p *processes) resolve(dir string, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
+}
+
+// succeeded reports whether a call returned without an error.
+func succeeded(result string) bool {
+	return result != "" && !strings.HasPrefix(result, "-1 ") && !strings.HasPrefix(result, "?")
+}
+
+// paths returns the absolute paths c refers to, one per path argument and
+// empty where an argument could not be decoded, and records the effects of c
+// on the working directory and file descriptors of the process.
+func (p *processes) paths(c call) []string {
+	switch c.syscall {
+	case "clone", "clone3", "fork", "vfork":
+		// The child inherits the working directory and descriptors of its parent.
+		if child, err := strconv.Atoi(strings.Fields(c.result + " x")[0]); err == nil && child > 0 {
+			p.cwd[child] = p.cwdOf(c.pid)
+			p.fds[child] = maps.Clone(p.fds[c.pid])
+		}
+		return nil
+	case "fchdir":
+		if len(c.args) == 0 {
+			return nil
+		}
+		dir := p.dir(c.pid, c.args[0])
+		if succeeded(c.result) {
+			p.cwd[c.pid] = dir
+		}
+		return []string{dir}
+	}
+
+	positions, ok := pathArguments[c.syscall]
+	if !ok {
+		for _, arg := range c.args {
+			if path, ok := unquote(arg); ok && path != "" {
+				return []string{p.resolve(p.cwdOf(c.pid), path)}
+			}
+		}
+		return nil
+	}
+	paths := make([]string, len(positions))
+	// Later arguments are resolved first, symbolic link targets depend on them.
+	for i := len(positions) - 1; i >= 0; i-- {
+		position := positions[i]
+		if position.path >= len(c.args) {
+			continue
+		}
+		arg := c.args[position.path]
+		if c.syscall == "connect" {
+			arg = socketPath(arg)
+		}
+		path, ok := unquote(arg)
+		if !ok || path == "" {
+			continue
+		}
+		switch {
+		case position.dirfd == atLink:
+			if i+1 < len(paths) && paths[i+1] != "" {
+				paths[i] = p.resolve(filepath.Dir(paths[i+1]), path)
+			}
+		case position.dirfd == atCwd || position.dirfd >= len(c.args):
+			paths[i] = p.resolve(p.cwdOf(c.pid), path)
+		default:
+			paths[i] = p.resolve(p.dir(c.pid, c.args[position.dirfd]), path)
+		}
+	}
+
+	if succeeded(c.result) {
+		if c.syscall == "chdir" && paths[0] != "" {
+			p.cwd[c.pid] = paths[0]
+		}
+		if fd, path := decodeFd(c.result); fd >= 0 && slices.Contains(fdSyscalls, c.syscall) {
+			// Arguments truncated by strace are not decoded, the descriptor
+			// still names the file.
+			if path == "" {
+				path = paths[0]
+			} else if paths[0] == "" {
+				paths[0] = path
+			}
+			if p.fds[c.pid] == nil {
+				p.fds[c.pid] = make(map[int]string)
+			}
+			p.fds[c.pid][fd] = path
+		}
+	}
+	return paths
+}
@@ -1,84 +1,119 @@
 package strace
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strings"
-	"syscall"
 	"time"
 
+	"github.com/regelepuma/dockerminimizer/checks"
+	"github.com/regelepuma/dockerminimizer/engine"
 	"github.com/regelepuma/dockerminimizer/ldd"
 	"github.com/regelepuma/dockerminimizer/logger"
 	"github.com/regelepuma/dockerminimizer/types"
 	"github.com/regelepuma/dockerminimizer/utils"
+	"github.com/regelepuma/dockerminimizer/workload"
 )
 
 var log = logger.Log
 
-const MAX_LIMIT = 127
-
-func getStraceOutput(imageName string, stracePath string, logPath string, syscalls []string, containerName string, command string, envPath string, metadata types.DockerConfig, timeout int) string {
-	hasSudo := utils.HasSudo()
-	command = fmt.Sprintf(
-		"docker run --cap-add=SYS_PTRACE --security-opt seccomp=unconfined --rm --name %s --entrypoint \"\" -v %s:/usr/bin/strace -v %s:/log.txt %s /usr/bin/strace -s 9999 -o /log.txt -fe %s %s",
-		containerName,
-		stracePath,
-		logPath,
-		imageName,
-		strings.Join(syscalls, ","),
-		command,
-	)
-	cmd := exec.Command("sh", "-c", command)
-	log.Info("Running command:", command)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
-		if cmd.Process != nil {
-			log.Info(fmt.Sprintf("%d seconds have passed. Killing strace.", timeout))
-			exec.Command("docker", "stop", "-t", "5", containerName).Run()
-			utils.ExecCommandWithOptionalSudo(hasSudo, "kill", "-15", fmt.Sprintf("-%d", cmd.Process.Pid)).Run()
-		}
-	})
-	defer timer.Stop()
-	err := cmd.Start()
+// LookupReport is the file in the environment the lookups of the traced
+// programs are written to.
+const LookupReport = "lookups.txt"
 
+// getStraceOutput traces command in a container of the image and returns the
+// log. With withWorkload the workload of the image runs against the container
+// once its checks passed, its commands traced along with the container.
+func getStraceOutput(ctx context.Context, rt engine.Runtime, image types.Image, syscalls []string,
+	containerName string, command []string, withWorkload bool, timeout int) string {
+	logPath := image.EnvPath + "/log.txt"
+	log.Info("Running strace on:", command)
+	// A run that fails to start strace must not leave the log of the
+	// previous one behind.
+	if err := os.Truncate(logPath, 0); err != nil {
+		log.Error("Failed to truncate strace log: ", err)
+	}
+	opts := engine.TraceOptions{
+		RunOptions: engine.RunOptions{
+			Image:    image.Name,
+			Name:     containerName,
+			Cmd:      command,
+			Env:      image.Env,
+			Platform: image.Platform,
+			Timeout:  time.Duration(timeout) * time.Second,
+		},
+		StracePath: image.EnvPath + "/strace",
+		LogPath:    logPath,
+		Args:       []string{"-s", "9999", "-f", "-y", "-e", traceExpression(syscalls)},
+	}
+	if withWorkload && !workload.Empty(image.Workload) {
+		suite, err := checks.NewSuite(image.Checks)
+		if err != nil {
+			log.Error("Failed to create checks: ", err)
+			return ""
+		}
+		opts.Ports = suite.Ports()
+		opts.While = suite.While(workload.Hook(rt, image))
+	}
+	result, err := rt.Trace(ctx, opts)
 	if err != nil {
 		log.Error("Failed to run strace command\n" + err.Error())
 		return ""
 	}
-	cmd.Wait()
+	if result.WhileErr != nil {
+		log.Error("Workload failed while tracing, coverage may be incomplete: ", result.WhileErr)
+	}
 	data, _ := os.ReadFile(logPath)
 	return string(data)
 }
 
-func parseOutput(output string, syscalls []string, files map[string][]string, symLinks map[string]string, envPath string) {
-	for _, syscall := range syscalls {
-		regex := regexp.MustCompile(syscall + `\([^"]*?"([^"]+)"`)
-		if regex.MatchString(output) {
-			matches := regex.FindAllStringSubmatch(output, -1)
-			for _, match := range matches {
-				if len(match) > 1 {
-					captures := match[1:]
-					for _, capture := range captures {
-						utils.AddFilesToDockerfile(capture, files, symLinks, envPath+"/rootfs")
-					}
-				}
-			}
+// parseOutput adds the files referenced in the strace log output of program
+// to files and its lookups to negatives. Relative paths are
+// resolved against the working directory and directory descriptors of the
+// calling process, starting from workingDir. Paths that were looked up but do
+// not exist are not added.
+func parseOutput(output string, program string, workingDir string, files *types.FileSet,
+	envPath string, negatives *Negatives) {
+	events, err := Parse(strings.NewReader(output), workingDir)
+	if err != nil {
+		log.Error("Failed to parse strace output: ", err)
+	}
+	for _, event := range events {
+		if event.Syscall().Absent() {
+			continue
+		}
+		for _, path := range event.Paths() {
+			utils.AddFile(path, files, envPath+"/rootfs", types.Source{Reason: event.Syscall().Name + " by " + program})
 		}
 	}
+	negatives.merge(collectLookups(events, program))
 }
 
-func prepareEnvironment(envPath string, stracePath string) error {
+func prepareEnvironment(ctx context.Context, rt engine.Runtime, envPath string, stracePath string) error {
 	err := utils.CopyFile(stracePath, envPath+"/strace")
 	if err != nil {
 		log.Error("Failed to copy strace to container rootfs")
 		return errors.New("failed to copy strace to container rootfs")
 	}
-	utils.ExecCommandWithOptionalSudo(utils.HasSudo(), "chown", "root:root", envPath+"/strace").Run()
-	utils.ExecCommandWithOptionalSudo(utils.HasSudo(), "chmod", "4755", envPath+"/strace").Run()
+	// strace is made setuid root so that it can trace images with a non-root
+	// USER. Rootless runtimes map the invoking user to root, so owning the
+	// copy is enough; otherwise it has to be handed over to root.
+	rootless, err := rt.Rootless(ctx)
+	if err != nil {
+		log.Error("Failed to query container runtime: ", err)
+	}
+	if rootless || os.Getuid() == 0 {
+		err = os.Chmod(envPath+"/strace", 04755)
+	} else {
+		utils.ExecCommandWithOptionalSudo(utils.HasSudo(), "chown", "root:root", envPath+"/strace").Run()
+		err = utils.ExecCommandWithOptionalSudo(utils.HasSudo(), "chmod", "4755", envPath+"/strace").Run()
+	}
+	if err != nil {
+		log.Error("Failed to make strace setuid root: ", err)
+	}
 	_, err = os.Create(envPath + "/log.txt")
 	if err != nil {
 		log.Error("Failed to create log file: ", envPath+"/log.txt")
@@ -113,96 +148,105 @@ func getSheBang(command string, rootfsPath string) string {
 	return string(firstLine)
 }
 
-func parseShebang(imageName string, containerName string, syscalls []string,
-	files map[string][]string, symLinks map[string]string, envPath string, metadata types.DockerConfig, timeout int) (map[string][]string, map[string]string) {
-	command := utils.GetContainerCommand(imageName, envPath, metadata)
-	hasSudo := utils.HasSudo()
+func parseShebang(ctx context.Context, rt engine.Runtime, image types.Image, containerName string, syscalls []string,
+	files *types.FileSet, negatives *Negatives, timeout int) error {
+	envPath, metadata := image.EnvPath, image.Metadata
+	command, err := utils.GetContainerCommand(envPath, metadata)
+	if err != nil {
+		return err
+	}
 	shebang := getSheBang(command, envPath+"/rootfs")
 	regex := regexp.MustCompile(`^#!\s*([^\s]+)`)
 	if !regex.MatchString(shebang) {
 		log.Error("Failed to find shebang in file:", command)
-		return files, symLinks
+		return nil
 	}
 	match := regex.FindStringSubmatch(shebang)
 	if len(match) < 2 {
 		log.Error("Failed to find interpreter in shebang:", command)
-		return files, symLinks
+		return nil
 	}
 	interpreter := match[1]
-	lddCommand := hasSudo + " chroot " + envPath + "/rootfs ldd " + interpreter
-	log.Info("Running command:", lddCommand)
-	lddOutput, err := exec.Command("sh", "-c", lddCommand).CombinedOutput()
+	libs, err := ldd.Resolve(interpreter, envPath+"/rootfs", metadata.Env)
+	if err != nil {
+		log.Error("Failed to resolve shared libraries of interpreter\n" + err.Error())
+	}
+	files.Merge(libs)
+
+	output := getStraceOutput(ctx, rt, image, syscalls, containerName, []string{interpreter}, false, timeout)
+	parseOutput(output, interpreter, image.Metadata.WorkingDir, files, envPath, negatives)
+	return nil
+}
+
+func parseCommand(ctx context.Context, rt engine.Runtime, image types.Image, containerName string, syscalls []string,
+	files *types.FileSet, negatives *Negatives, timeout int) error {
+	envPath := image.EnvPath
+	command, err := utils.GetFullContainerCommand(envPath, image.Metadata)
 	if err != nil {
-		log.Error("Failed to run ldd command\n" + err.Error())
+		return err
 	}
-	files, symLinks = ldd.ParseOutput(lddOutput, envPath+"/rootfs")
+	output := getStraceOutput(ctx, rt, image, syscalls, containerName, command, true, timeout)
+	parseOutput(output, command[0], image.Metadata.WorkingDir, files, envPath, negatives)
+	return nil
+}
 
-	output := getStraceOutput(imageName, envPath+"/strace", envPath+"/log.txt", syscalls,
-		containerName, interpreter, envPath, metadata, timeout)
-	parseOutput(output, syscalls, files, symLinks, envPath)
-	return files, symLinks
+// Analyzer traces the command of an image, and its interpreter when it is a
+// script, and finds the files they access.
+type Analyzer struct {
+	Runtime    engine.Runtime
+	StracePath string
+	Syscalls   []string
+	Timeout    int
+	// Negatives, when set, receives the lookups of the traced programs.
+	Negatives *Negatives
 }
 
-func parseCommand(imageName string, containerName string, syscalls []string,
-	files map[string][]string, symLinks map[string]string, envPath string, metadata types.DockerConfig, timeout int) (map[string][]string, map[string]string) {
-	output := getStraceOutput(imageName, envPath+"/strace", envPath+"/log.txt", syscalls,
-		containerName, utils.GetFullContainerCommand(imageName, envPath, metadata), envPath, metadata, timeout)
-	parseOutput(output, syscalls, files, symLinks, envPath)
-	return files, symLinks
+func (Analyzer) Name() string {
+	return "strace"
 }
 
-func DynamicAnalysis(imageName string, envPath string, metadata types.DockerConfig,
-	files map[string][]string, symLinks map[string]string, stracePath string, context string, timeout int) error {
+func (a Analyzer) Analyze(ctx context.Context, image types.Image) (types.FileSet, error) {
+	rt, stracePath, syscalls, timeout := a.Runtime, a.StracePath, a.Syscalls, a.Timeout
+	found := types.NewFileSet()
+	envPath := image.EnvPath
 	if !utils.CheckIfFileExists(stracePath, "") {
 		log.Error("Strace not found at path:", stracePath)
 		log.Error("Skipping dynamic analysis...")
-		return errors.New("strace not found")
+		return found, errors.New("strace not found")
 
 	}
 	_, err := exec.Command("ldd", stracePath).Output()
 	if err == nil {
 		log.Error("Strace is not statically linked")
 		log.Error("Skipping dynamic analysis...")
-		return errors.New("strace is not statically linked")
+		return found, errors.New("strace is not statically linked")
 	}
-	err = prepareEnvironment(envPath, stracePath)
+	err = prepareEnvironment(ctx, rt, envPath, stracePath)
 	if err != nil {
 		log.Error("Failed to prepare environment for strace")
 		log.Error("Skipping dynamic analysis...")
-		return errors.New("failed to prepare environment for strace")
-	}
-	syscalls := []string{
-		"open",
-		"openat",
-		"execve",
-		"execveat",
+		return found, errors.New("failed to prepare environment for strace")
 	}
-	if files == nil {
-		files = make(map[string][]string)
+	if len(syscalls) == 0 {
+		syscalls = DefaultSyscalls
 	}
-	if symLinks == nil {
-		symLinks = make(map[string]string)
+	negatives := Negatives{}
+	if a.Negatives != nil {
+		defer func() { *a.Negatives = negatives }()
 	}
-	containerName := imageName + "-strace"
+	containerName := image.Name + "-strace"
 	log.Info("Creating container:", containerName)
-	files, symLinks = parseShebang(imageName, containerName, syscalls, files, symLinks, envPath, metadata, timeout)
-	files, symLinks = parseCommand(imageName, containerName, syscalls, files, symLinks, envPath, metadata, timeout)
-	if len(files)+len(symLinks) > MAX_LIMIT {
-		for symlink := range symLinks {
-			files[filepath.Dir(symlink)] = utils.AppendIfMissing(files[filepath.Dir(symlink)], symlink)
-		}
-		tarFilename := fmt.Sprintf("%s/files.tar", envPath)
-		if err := utils.BuildTarArchive(files, tarFilename, envPath); err != nil {
-			log.Error("Error building tar archive:", err)
-			return err
-		}
-		utils.AddTarToDockerfile("Dockerfile.minimal.strace", "Dockerfile.minimal.ldd", envPath)
-		utils.CopyFile(tarFilename, context+"/files.tar")
-	} else {
-		utils.CreateDockerfile("Dockerfile.minimal.strace", "Dockerfile.minimal.template", envPath, files, symLinks)
+	err = parseShebang(ctx, rt, image, containerName, syscalls, &found, &negatives, timeout)
+	if err != nil {
+		return found, err
 	}
-	log.Info("Validating Dockerfile...")
-	err = utils.ValidateDockerfile("Dockerfile.minimal.strace", envPath, context, timeout)
-	os.Remove(context + "/files.tar")
-	return err
+	err = parseCommand(ctx, rt, image, containerName, syscalls, &found, &negatives, timeout)
+	if err != nil {
+		return found, err
+	}
+	log.Info("Paths looked up but absent: ", len(negatives.Absent))
+	if err := writeLookupReport(envPath+"/"+LookupReport, negatives); err != nil {
+		log.Error("Failed to write lookup report: ", err)
+	}
+	return found, nil
 }
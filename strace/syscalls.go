@@ -0,0 +1,120 @@
+package strace
+
+import (
+	"slices"
+	"strings"
+)
+
+// pathArgument locates a path argument of a system call together with the
+// directory file descriptor argument it is relative to.
+type pathArgument struct {
+	path  int
+	dirfd int
+}
+
+const (
+	// atCwd marks paths relative to the working directory of the process.
+	atCwd = -1
+	// atLink marks symbolic link targets, which are relative to the directory
+	// of the link, the following path argument.
+	atLink = -2
+)
+
+// pathArguments maps traced system calls to their path arguments. System
+// calls missing here fall back to their first string, relative to the
+// working directory.
+var pathArguments = map[string][]pathArgument{
+	"open":       {{0, atCwd}},
+	"openat":     {{1, 0}},
+	"openat2":    {{1, 0}},
+	"creat":      {{0, atCwd}},
+	"execve":     {{0, atCwd}},
+	"execveat":   {{1, 0}},
+	"uselib":     {{0, atCwd}},
+	"stat":       {{0, atCwd}},
+	"lstat":      {{0, atCwd}},
+	"stat64":     {{0, atCwd}},
+	"lstat64":    {{0, atCwd}},
+	"newfstatat": {{1, 0}},
+	"fstatat64":  {{1, 0}},
+	"statx":      {{1, 0}},
+	"statfs":     {{0, atCwd}},
+	"access":     {{0, atCwd}},
+	"faccessat":  {{1, 0}},
+	"faccessat2": {{1, 0}},
+	"readlink":   {{0, atCwd}},
+	"readlinkat": {{1, 0}},
+	"mkdir":      {{0, atCwd}},
+	"mkdirat":    {{1, 0}},
+	"chdir":      {{0, atCwd}},
+	"chroot":     {{0, atCwd}},
+	"rename":     {{0, atCwd}, {1, atCwd}},
+	"renameat":   {{1, 0}, {3, 2}},
+	"renameat2":  {{1, 0}, {3, 2}},
+	"link":       {{0, atCwd}, {1, atCwd}},
+	"linkat":     {{1, 0}, {3, 2}},
+	"symlink":    {{0, atLink}, {1, atCwd}},
+	"symlinkat":  {{0, atLink}, {2, 1}},
+	"unlink":     {{0, atCwd}},
+	"unlinkat":   {{1, 0}},
+	"rmdir":      {{0, atCwd}},
+	"mknod":      {{0, atCwd}},
+	"mknodat":    {{1, 0}},
+	"truncate":   {{0, atCwd}},
+	"chmod":      {{0, atCwd}},
+	"fchmodat":   {{1, 0}},
+	"chown":      {{0, atCwd}},
+	"lchown":     {{0, atCwd}},
+	"fchownat":   {{1, 0}},
+	"utimensat":  {{1, 0}},
+	"getxattr":   {{0, atCwd}},
+	"lgetxattr":  {{0, atCwd}},
+	"listxattr":  {{0, atCwd}},
+	"llistxattr": {{0, atCwd}},
+	// connect takes a socket address, only unix socket paths are of interest.
+	"connect": {{1, atCwd}},
+}
+
+// processSyscalls are always traced, in addition to the configured ones, to
+// follow the working directory of every process.
+var processSyscalls = []string{"chdir", "fchdir", "clone", "clone3", "fork", "vfork"}
+
+// DefaultSyscalls are traced when no system calls are configured.
+var DefaultSyscalls = []string{
+	"open", "openat", "openat2", "creat",
+	"execve", "execveat", "uselib",
+	"stat", "lstat", "stat64", "lstat64", "newfstatat", "fstatat64", "statx",
+	"access", "faccessat", "faccessat2",
+	"readlink", "readlinkat",
+	"mkdir", "mkdirat", "chdir",
+	"rename", "renameat", "renameat2",
+	"link", "linkat", "symlink", "symlinkat",
+	"connect",
+}
+
+// traceExpression builds the argument of strace -e trace=. Every name is
+// prefixed with ? so that system calls missing on the architecture of the
+// image, such as open or stat on aarch64, are ignored instead of fatal.
+func traceExpression(syscalls []string) string {
+	qualified := []string{}
+	for _, syscall := range slices.Concat(syscalls, processSyscalls) {
+		if !strings.HasPrefix(syscall, "?") && !strings.HasPrefix(syscall, "%") {
+			syscall = "?" + syscall
+		}
+		if !slices.Contains(qualified, syscall) {
+			qualified = append(qualified, syscall)
+		}
+	}
+	return "trace=" + strings.Join(qualified, ",")
+}
+
+// socketPath returns the quoted sun_path of a unix socket address such as
+// {sa_family=AF_UNIX, sun_path="/run/nscd/socket"}. Abstract sockets, shown
+// as sun_path=@"...", have no path in the filesystem.
+func socketPath(address string) string {
+	_, path, ok := strings.Cut(address, "sun_path=")
+	if !ok || !strings.HasPrefix(path, "\"") {
+		return ""
+	}
+	return strings.TrimSuffix(path, "}")
+}
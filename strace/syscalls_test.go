@@ -0,0 +1,50 @@
+package strace
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTraceExpression(t *testing.T) {
+	const process = "?chdir,?fchdir,?clone,?clone3,?fork,?vfork"
+	tests := []struct {
+		name     string
+		syscalls []string
+		want     string
+	}{
+		{"none", nil, "trace=" + process},
+		{"unknown to the architecture", []string{"open", "stat", "openat"}, "trace=?open,?stat,?openat," + process},
+		// Classes and names already optional are passed as is.
+		{"classes", []string{"%file", "?statx", "%process"}, "trace=%file,?statx,%process," + process},
+		{"duplicates", []string{"openat", "?openat", "chdir", "clone"}, "trace=?openat,?chdir,?clone,?fchdir,?clone3,?fork,?vfork"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := traceExpression(tt.syscalls); got != tt.want {
+				t.Errorf("traceExpression(%q) = %q, want %q", tt.syscalls, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultSyscalls(t *testing.T) {
+	expression, ok := strings.CutPrefix(traceExpression(DefaultSyscalls), "trace=")
+	if !ok {
+		t.Fatalf("traceExpression = %q, want a trace= expression", expression)
+	}
+	traced := strings.Split(expression, ",")
+	// chdir is both a default and a process system call.
+	if want := len(DefaultSyscalls) + len(processSyscalls) - 1; len(traced) != want {
+		t.Errorf("traced %d system calls, want %d: %q", len(traced), want, traced)
+	}
+	for _, syscall := range traced {
+		if !strings.HasPrefix(syscall, "?") {
+			t.Errorf("%s is fatal on architectures without it", syscall)
+		}
+	}
+	for _, syscall := range DefaultSyscalls {
+		if _, ok := pathArguments[syscall]; !ok {
+			t.Errorf("%s is traced without its path arguments", syscall)
+		}
+	}
+}
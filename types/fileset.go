@@ -0,0 +1,195 @@
+package types
+
+import (
+	"encoding/json"
+	"io/fs"
+	"iter"
+	"maps"
+	"slices"
+)
+
+// Kind is the type of file of an Entry.
+type Kind string
+
+const (
+	KindFile        Kind = "file"
+	KindDir         Kind = "dir"
+	KindSymLink     Kind = "symlink"
+	KindHardLink    Kind = "hardlink"
+	KindCharDevice  Kind = "char"
+	KindBlockDevice Kind = "block"
+	KindFIFO        Kind = "fifo"
+)
+
+// Entry is a path of the rootfs of an image with what is needed to recreate
+// it in the minimized image.
+type Entry struct {
+	Path string `json:"path"`
+	Kind Kind   `json:"kind"`
+	// Target is the path a symbolic link points to, or the path of the file
+	// a hard link shares its inode with.
+	Target string `json:"target,omitempty"`
+	// Mode holds the permission bits with setuid, setgid and sticky.
+	Mode fs.FileMode `json:"mode"`
+	UID  int         `json:"uid"`
+	GID  int         `json:"gid"`
+	// Major and Minor are the device numbers of device nodes.
+	Major uint32 `json:"major,omitempty"`
+	Minor uint32 `json:"minor,omitempty"`
+	// Sources tells why the path is in the set.
+	Sources []Source `json:"sources,omitempty"`
+}
+
+// Source is the provenance of an entry: the analyzer that found it and why.
+type Source struct {
+	Analyzer string `json:"analyzer,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// FileSet is a set of paths of the rootfs of an image. Paths are unique,
+// adding one again only records the new source. Iteration is in path order.
+// The zero value is an empty set ready to use; like a map, copies of a
+// FileSet share their entries, see Clone.
+type FileSet struct {
+	entries map[string]*Entry
+}
+
+func NewFileSet() FileSet {
+	return FileSet{entries: make(map[string]*Entry)}
+}
+
+// Add adds entry, or the sources of entry when its path is in the set.
+func (s *FileSet) Add(entry Entry) {
+	if s.entries == nil {
+		s.entries = make(map[string]*Entry)
+	}
+	if existing, ok := s.entries[entry.Path]; ok {
+		for _, source := range entry.Sources {
+			if !slices.Contains(existing.Sources, source) {
+				existing.Sources = append(existing.Sources, source)
+			}
+		}
+		return
+	}
+	entry.Sources = slices.Clone(entry.Sources)
+	s.entries[entry.Path] = &entry
+}
+
+// Get returns the entry of path.
+func (s *FileSet) Get(path string) (Entry, bool) {
+	entry, ok := s.entries[path]
+	if !ok {
+		return Entry{}, false
+	}
+	return *entry, true
+}
+
+func (s *FileSet) Has(path string) bool {
+	_, ok := s.entries[path]
+	return ok
+}
+
+func (s *FileSet) Remove(path string) {
+	delete(s.entries, path)
+}
+
+// RemoveFunc removes the entries for which del returns true.
+func (s *FileSet) RemoveFunc(del func(Entry) bool) {
+	maps.DeleteFunc(s.entries, func(_ string, entry *Entry) bool {
+		return del(*entry)
+	})
+}
+
+func (s *FileSet) Len() int {
+	return len(s.entries)
+}
+
+// All iterates over the entries in path order.
+func (s *FileSet) All() iter.Seq[Entry] {
+	return func(yield func(Entry) bool) {
+		for _, path := range s.Paths() {
+			if !yield(*s.entries[path]) {
+				return
+			}
+		}
+	}
+}
+
+// Entries returns the entries in path order.
+func (s *FileSet) Entries() []Entry {
+	return slices.Collect(s.All())
+}
+
+// Paths returns the paths in the set, sorted.
+func (s *FileSet) Paths() []string {
+	return slices.Sorted(maps.Keys(s.entries))
+}
+
+// Merge adds the entries of other to s.
+func (s *FileSet) Merge(other FileSet) {
+	for _, entry := range other.entries {
+		s.Add(*entry)
+	}
+}
+
+// Union returns a new set with the entries of s and other.
+func (s *FileSet) Union(other FileSet) FileSet {
+	union := s.Clone()
+	union.Merge(other)
+	return union
+}
+
+// Difference returns a new set with the entries of s whose path is not in
+// other.
+func (s *FileSet) Difference(other FileSet) FileSet {
+	difference := NewFileSet()
+	for path, entry := range s.entries {
+		if !other.Has(path) {
+			difference.Add(*entry)
+		}
+	}
+	return difference
+}
+
+// Clone returns a copy of s that can be changed independently of it.
+func (s *FileSet) Clone() FileSet {
+	clone := NewFileSet()
+	clone.Merge(*s)
+	return clone
+}
+
+// Attribute records analyzer as the analyzer of the sources that name none,
+// and adds a source naming it to the entries without any.
+func (s *FileSet) Attribute(analyzer string) {
+	for _, entry := range s.entries {
+		if len(entry.Sources) == 0 {
+			entry.Sources = []Source{{}}
+		}
+		for i := range entry.Sources {
+			if entry.Sources[i].Analyzer == "" {
+				entry.Sources[i].Analyzer = analyzer
+			}
+		}
+	}
+}
+
+// MarshalJSON encodes the set as the list of its entries in path order.
+func (s FileSet) MarshalJSON() ([]byte, error) {
+	entries := s.Entries()
+	if entries == nil {
+		entries = []Entry{}
+	}
+	return json.Marshal(entries)
+}
+
+func (s *FileSet) UnmarshalJSON(data []byte) error {
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	*s = NewFileSet()
+	for _, entry := range entries {
+		s.Add(entry)
+	}
+	return nil
+}
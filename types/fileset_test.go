@@ -0,0 +1,187 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func entry(path string, sources ...Source) Entry {
+	return Entry{Path: path, Kind: KindFile, Mode: 0644, Sources: sources}
+}
+
+func newSet(entries ...Entry) FileSet {
+	set := NewFileSet()
+	for _, e := range entries {
+		set.Add(e)
+	}
+	return set
+}
+
+func TestFileSetAdd(t *testing.T) {
+	var set FileSet // the zero value is ready to use
+	ldd := Source{Analyzer: "ldd", Reason: "needed by /bin/sh"}
+	strace := Source{Analyzer: "strace", Reason: "openat by /bin/sh"}
+	set.Add(entry("/lib/libc.so.6", ldd))
+	set.Add(Entry{Path: "/lib/libc.so.6", Kind: KindSymLink, Sources: []Source{strace, ldd}})
+	got, ok := set.Get("/lib/libc.so.6")
+	if !ok {
+		t.Fatal("entry missing")
+	}
+	// The first entry is kept, only its sources grow.
+	if got.Kind != KindFile || !slices.Equal(got.Sources, []Source{ldd, strace}) {
+		t.Errorf("entry = %+v, want a file found by ldd and strace", got)
+	}
+	if set.Len() != 1 {
+		t.Errorf("Len = %d, want 1", set.Len())
+	}
+	if _, ok := set.Get("/lib/libm.so.6"); ok {
+		t.Error("Get found a path never added")
+	}
+}
+
+func TestFileSetUnion(t *testing.T) {
+	a := newSet(entry("/bin/sh", Source{Analyzer: "initial"}), entry("/etc/passwd"))
+	b := newSet(entry("/bin/sh", Source{Analyzer: "strace"}), entry("/lib/libc.so.6"))
+	union := a.Union(b)
+	if want := []string{"/bin/sh", "/etc/passwd", "/lib/libc.so.6"}; !slices.Equal(union.Paths(), want) {
+		t.Errorf("Union = %v, want %v", union.Paths(), want)
+	}
+	sh, _ := union.Get("/bin/sh")
+	if want := []Source{{Analyzer: "initial"}, {Analyzer: "strace"}}; !slices.Equal(sh.Sources, want) {
+		t.Errorf("sources = %v, want %v", sh.Sources, want)
+	}
+	// The operands are left alone.
+	if a.Len() != 2 || b.Len() != 2 {
+		t.Errorf("operands changed: %v, %v", a.Paths(), b.Paths())
+	}
+	if sh, _ := a.Get("/bin/sh"); len(sh.Sources) != 1 {
+		t.Errorf("sources of the operand changed: %v", sh.Sources)
+	}
+	var empty FileSet
+	if got := empty.Union(a); !slices.Equal(got.Paths(), a.Paths()) {
+		t.Errorf("Union of the empty set = %v, want %v", got.Paths(), a.Paths())
+	}
+}
+
+func TestFileSetDifference(t *testing.T) {
+	a := newSet(entry("/bin/sh"), entry("/etc/passwd"), entry("/usr/share/doc/README"))
+	b := newSet(entry("/etc/passwd"), entry("/lib/libc.so.6"))
+	ab, ba := a.Difference(b), b.Difference(a)
+	if want := []string{"/bin/sh", "/usr/share/doc/README"}; !slices.Equal(ab.Paths(), want) {
+		t.Errorf("Difference = %v, want %v", ab.Paths(), want)
+	}
+	if want := []string{"/lib/libc.so.6"}; !slices.Equal(ba.Paths(), want) {
+		t.Errorf("Difference = %v, want %v", ba.Paths(), want)
+	}
+	if got := a.Difference(a); got.Len() != 0 {
+		t.Errorf("Difference with itself = %v, want nothing", got.Paths())
+	}
+	if a.Len() != 3 {
+		t.Errorf("operand changed: %v", a.Paths())
+	}
+}
+
+func TestFileSetClone(t *testing.T) {
+	original := newSet(entry("/bin/sh", Source{Reason: "entrypoint"}), entry("/etc/passwd"))
+	clone := original.Clone()
+	clone.Add(entry("/bin/sh", Source{Analyzer: "strace"}))
+	clone.Add(entry("/lib/libc.so.6"))
+	clone.Remove("/etc/passwd")
+	clone.Attribute("initial")
+
+	if want := []string{"/bin/sh", "/etc/passwd"}; !slices.Equal(original.Paths(), want) {
+		t.Errorf("original = %v, want %v", original.Paths(), want)
+	}
+	sh, _ := original.Get("/bin/sh")
+	if want := []Source{{Reason: "entrypoint"}}; !slices.Equal(sh.Sources, want) {
+		t.Errorf("sources of the original = %v, want %v", sh.Sources, want)
+	}
+	// A plain copy shares the entries.
+	shared := original
+	shared.Remove("/etc/passwd")
+	if original.Has("/etc/passwd") {
+		t.Error("copy does not share the entries of the original")
+	}
+}
+
+func TestFileSetAttribute(t *testing.T) {
+	set := newSet(
+		entry("/bin/sh"),
+		entry("/etc/passwd", Source{Reason: "opened"}),
+		entry("/lib/libc.so.6", Source{Analyzer: "ldd", Reason: "needed"}, Source{Reason: "opened"}),
+	)
+	set.Attribute("strace")
+	want := map[string][]Source{
+		"/bin/sh":        {{Analyzer: "strace"}},
+		"/etc/passwd":    {{Analyzer: "strace", Reason: "opened"}},
+		"/lib/libc.so.6": {{Analyzer: "ldd", Reason: "needed"}, {Analyzer: "strace", Reason: "opened"}},
+	}
+	for entry := range set.All() {
+		if !slices.Equal(entry.Sources, want[entry.Path]) {
+			t.Errorf("sources of %s = %v, want %v", entry.Path, entry.Sources, want[entry.Path])
+		}
+	}
+}
+
+func TestFileSetRemoveFunc(t *testing.T) {
+	set := newSet(entry("/bin/sh"), Entry{Path: "/usr/bin", Kind: KindDir}, entry("/usr/bin/env"))
+	set.RemoveFunc(func(e Entry) bool { return e.Kind == KindDir })
+	if want := []string{"/bin/sh", "/usr/bin/env"}; !slices.Equal(set.Paths(), want) {
+		t.Errorf("Paths = %v, want %v", set.Paths(), want)
+	}
+}
+
+func TestFileSetJSON(t *testing.T) {
+	// Added out of order, encoded in path order.
+	set := newSet(
+		entry("/usr/lib/libz.so.1", Source{Analyzer: "ldd"}),
+		Entry{Path: "/bin", Kind: KindDir, Mode: 0755},
+		Entry{Path: "/bin/sh", Kind: KindSymLink, Target: "dash", Mode: 0777},
+		Entry{Path: "/dev/null", Kind: KindCharDevice, Mode: 0666, Major: 1, Minor: 3},
+	)
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"path":"/bin","kind":"dir","mode":493,"uid":0,"gid":0},` +
+		`{"path":"/bin/sh","kind":"symlink","target":"dash","mode":511,"uid":0,"gid":0},` +
+		`{"path":"/dev/null","kind":"char","mode":438,"uid":0,"gid":0,"major":1,"minor":3},` +
+		`{"path":"/usr/lib/libz.so.1","kind":"file","mode":420,"uid":0,"gid":0,"sources":[{"analyzer":"ldd"}]}]`
+	if string(data) != want {
+		t.Errorf("Marshal =\n%s\nwant\n%s", data, want)
+	}
+	var decoded FileSet
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Entries(), set.Entries()) {
+		t.Errorf("round trip = %+v, want %+v", decoded.Entries(), set.Entries())
+	}
+
+	var empty FileSet
+	if data, _ := json.Marshal(empty); string(data) != "[]" {
+		t.Errorf("Marshal of the empty set = %s, want []", data)
+	}
+	// Inside a struct the set is encoded by value as well.
+	data, _ = json.Marshal(struct{ Files FileSet }{newSet(entry("/b"), entry("/a"))})
+	if want := `{"Files":[{"path":"/a","kind":"file","mode":420,"uid":0,"gid":0},` +
+		`{"path":"/b","kind":"file","mode":420,"uid":0,"gid":0}]}`; string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+}
+
+func TestFileSetAllStops(t *testing.T) {
+	set := newSet(entry("/c"), entry("/a"), entry("/b"))
+	var seen []string
+	for entry := range set.All() {
+		seen = append(seen, entry.Path)
+		if entry.Path == "/b" {
+			break
+		}
+	}
+	if want := []string{"/a", "/b"}; !slices.Equal(seen, want) {
+		t.Errorf("All yielded %v, want %v", seen, want)
+	}
+}
@@ -8,6 +8,77 @@ type Args struct {
 	Debug        bool
 	StracePath   string
 	BinarySearch bool
+	OutputDir    string
+	Runtime      string
+	Platform     string
+	Syscalls     []string
+	Checks       []Check
+	Differential Differential
+	Workload     Workload
+	// Stages lists the analysis stages to run, in order; stages joined with
+	// + run as one. Empty runs all of them.
+	Stages []string
+	// Validation is each to validate after every stage and stop at the first
+	// valid one, or end to run every stage and validate once at the end.
+	Validation string
+	// Keep lists doublestar patterns of paths copied into every minimized
+	// image, Drop patterns of paths left out of it even when the analysis
+	// found them. Drop wins over Keep, so that it can leave out parts of kept
+	// directories.
+	Keep []string
+	Drop []string
+	// Packs names the knowledge packs whose keep rules apply, as name,
+	// name@version or auto for every pack detected in the image.
+	Packs []string
+	// OutputFormat is dockerfile to write Dockerfile.minimal and the archives
+	// it adds, oci to write an OCI image layout as well and oci-archive to
+	// write it as a tar archive. Compression, gzip or zstd, applies to the
+	// layers of OCI images.
+	OutputFormat string
+	Compression  string
+	// Env is added to the environment of every container run of the image
+	// and RunArgs, when set, replace its CMD, like the arguments of docker run.
+	Env     []string
+	RunArgs []string
+}
+
+// Workload exercises the application while it is traced, so that code paths
+// only taken when it is used are seen, and again while it is validated.
+type Workload struct {
+	// Exec are commands executed one after another inside the container
+	// under test.
+	Exec [][]string
+	// Sidecar is run next to the container once the commands succeeded.
+	Sidecar Sidecar
+}
+
+// Sidecar is a container sharing the network namespace of the container
+// under test, so that it reaches the application on localhost. It has to
+// exit with code 0 for the workload to pass.
+type Sidecar struct {
+	Image string
+	Cmd   []string
+	Env   []string
+}
+
+// Check configures a health check a minimized image has to pass, see
+// package checks for the available types.
+type Check struct {
+	Type string
+	// Port is the container port probed by http and tcp checks.
+	Port string
+	// Path is the request path of http checks.
+	Path string
+	// Status is the status code http checks expect, zero accepts any status
+	// below 400.
+	Status int
+	// Command is run inside the container by exec checks.
+	Command []string
+	// Pattern is a regular expression the output, or the response body of
+	// http checks, has to match.
+	Pattern string
+	// ExitCode is the exit code exec and exit_code checks expect.
+	ExitCode int
 }
 
 type DockerConfig struct {
@@ -18,3 +89,63 @@ type DockerConfig struct {
 	WorkingDir   string                    `json:"WorkingDir"`
 	Entrypoint   []string                  `json:"Entrypoint"`
 }
+
+// Differential configures the comparison of the behaviour of minimized
+// images with the one of the original image.
+type Differential struct {
+	Enabled bool
+	// Requests are sent to both containers and their responses compared.
+	Requests []Request
+	// Normalize rewrites output before comparing it, on top of the built-in
+	// rules for timestamps, addresses, PIDs and container IDs.
+	Normalize []Normalization
+	// Volumes are directories inside the container whose contents, as left
+	// by the run, are compared.
+	Volumes []string
+}
+
+// Request is an HTTP request sent to a container port.
+type Request struct {
+	Port   string
+	Method string
+	Path   string
+}
+
+// Normalization replaces the matches of Pattern with Replacement.
+type Normalization struct {
+	Pattern     string
+	Replacement string
+}
+
+// Image describes the image being minimized and the working environment
+// created for it by preprocessing.
+type Image struct {
+	Name    string
+	EnvPath string
+	Context string
+	// Metadata is the configuration containers of the image are analyzed
+	// with: Config with Env and RunArgs applied.
+	Metadata DockerConfig
+	// Config is the configuration of the image as built, which minimized
+	// images keep.
+	Config DockerConfig
+	// Platform is the target platform, e.g. linux/arm64, or empty for the
+	// platform of the host.
+	Platform string
+	// Checks are run against every candidate image to decide whether it
+	// still works.
+	Checks []Check
+	// Differential, when enabled, compares every candidate image with Name.
+	Differential Differential
+	// Workload is run against the container while tracing and validating.
+	Workload Workload
+	// Keep and Drop adjust the files found by every analysis stage.
+	Keep []string
+	Drop []string
+	// Packs names the enabled knowledge packs, as name@version once
+	// preprocessing resolved them and added their rules to Keep.
+	Packs []string
+	// Env and RunArgs configure every container run of the image.
+	Env     []string
+	RunArgs []string
+}
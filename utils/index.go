@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Index maps the paths of an exported rootfs to their tar headers, which
+// hold what extracting it without root loses: owners, modes, device nodes,
+// extended attributes such as file capabilities, and hard links.
+type Index map[string]*tar.Header
+
+// indexPath returns the path of the index of the rootfs at rootfsPath,
+// written next to it by ExtractTar.
+func indexPath(rootfsPath string) string {
+	return filepath.Clean(rootfsPath) + ".index"
+}
+
+type cachedIndex struct {
+	modTime time.Time
+	index   Index
+}
+
+var (
+	indexesMu sync.Mutex
+	indexes   = make(map[string]cachedIndex)
+)
+
+// LoadIndex returns the index of the rootfs at rootfsPath. The index is read
+// once and kept until the file changes.
+func LoadIndex(rootfsPath string) (Index, error) {
+	path := indexPath(rootfsPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	if cached, ok := indexes[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.index, nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	index := make(Index)
+	reader := tar.NewReader(fd)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		index[filepath.Clean("/"+header.Name)] = header
+	}
+	indexes[path] = cachedIndex{info.ModTime(), index}
+	return index, nil
+}
+
+// Header returns a copy of the header of path, or nil if path is not in the
+// index.
+func (i Index) Header(path string) *tar.Header {
+	header, ok := i[filepath.Clean("/"+path)]
+	if !ok {
+		return nil
+	}
+	clone := *header
+	clone.PAXRecords = maps.Clone(header.PAXRecords)
+	return &clone
+}
+
+// indexWriter writes the headers of an archive without their contents.
+type indexWriter struct {
+	file   *os.File
+	writer *tar.Writer
+}
+
+func newIndexWriter(path string) (*indexWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &indexWriter{file, tar.NewWriter(file)}, nil
+}
+
+func (w *indexWriter) add(header *tar.Header) error {
+	clone := *header
+	clone.Size = 0
+	// The writer picks the format, GNU archives cannot hold PAX records.
+	clone.Format = tar.FormatUnknown
+	return w.writer.WriteHeader(&clone)
+}
+
+func (w *indexWriter) Close() error {
+	return errors.Join(w.writer.Close(), w.file.Close())
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// capability is the security.capability xattr granting cap_net_raw.
+const capability = "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+// roundTripHeaders are the entries of the archive exported from an image,
+// which extracting without root cannot reproduce on disk.
+var roundTripHeaders = []*tar.Header{
+	{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+	{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+	{Name: "home/app/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"},
+	{Name: "home/app/data", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"},
+	{Name: "usr/bin/ping", Typeflag: tar.TypeReg, Mode: 04755, PAXRecords: map[string]string{
+		"SCHILY.xattr.security.capability": capability,
+		"SCHILY.xattr.user.origin":         "iputils",
+	}},
+	{Name: "usr/bin/ping6", Typeflag: tar.TypeLink, Linkname: "usr/bin/ping"},
+	{Name: "usr/bin/ping4", Typeflag: tar.TypeLink, Linkname: "usr/bin/ping"},
+	{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin", Mode: 0777},
+	{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0660, Gid: 6, Gname: "disk", Devmajor: 8, Devminor: 0},
+	{Name: "run/initctl", Typeflag: tar.TypeFifo, Mode: 0600},
+	{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+}
+
+// writeExport writes the archive of roundTripHeaders, every file holding its
+// base name, to path.
+func writeExport(t *testing.T, path string) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, header := range roundTripHeaders {
+		header := *header
+		header.PAXRecords = maps.Clone(header.PAXRecords)
+		content := ""
+		if header.Typeflag == tar.TypeReg {
+			content = filepath.Base(header.Name)
+			header.Size = int64(len(content))
+		}
+		if err := writer.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// xattrs returns the extended attributes among PAX records.
+func xattrs(records map[string]string) map[string]string {
+	found := make(map[string]string)
+	for key, value := range records {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			found[key] = value
+		}
+	}
+	return found
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	envPath := t.TempDir()
+	writeExport(t, envPath+"/export.tar")
+	if err := ExtractTar(envPath+"/export.tar", envPath+"/rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(envPath + "/escape"); !os.IsNotExist(err) {
+		t.Errorf("entry outside of the rootfs extracted: %v", err)
+	}
+	if data, _ := os.ReadFile(envPath + "/rootfs/usr/bin/ping6"); string(data) != "ping" {
+		t.Errorf("hard link holds %q, want the contents of its file", data)
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		tests := []types.Entry{
+			{Path: "/home/app/data", Kind: types.KindFile, Mode: 0640, UID: 1000, GID: 1000},
+			{Path: "/usr/bin/ping", Kind: types.KindFile, Mode: 0755 | os.ModeSetuid},
+			{Path: "/usr/bin/ping6", Kind: types.KindHardLink, Target: "/usr/bin/ping", Mode: 0755 | os.ModeSetuid},
+			{Path: "/bin", Kind: types.KindSymLink, Target: "/usr/bin", Mode: 0777},
+			{Path: "/dev/null", Kind: types.KindCharDevice, Mode: 0666, Major: 1, Minor: 3},
+			{Path: "/dev/sda", Kind: types.KindBlockDevice, Mode: 0660, GID: 6, Major: 8},
+			{Path: "/run/initctl", Kind: types.KindFIFO, Mode: 0600},
+		}
+		for _, want := range tests {
+			got, err := StatEntry(envPath+"/rootfs", want.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Kind != want.Kind || got.Mode != want.Mode || got.UID != want.UID || got.GID != want.GID ||
+				got.Major != want.Major || got.Minor != want.Minor || got.Target != want.Target {
+				t.Errorf("StatEntry = %+v, want %+v", got, want)
+			}
+		}
+	})
+
+	tests := []struct {
+		name  string
+		paths []string
+		// want are the headers expected for the paths, their times aside.
+		want []*tar.Header
+	}{
+		{
+			name: "every entry",
+			paths: []string{"/etc", "/etc/passwd", "/home/app", "/home/app/data", "/usr/bin/ping", "/usr/bin/ping6",
+				"/usr/bin/ping4", "/bin", "/dev/null", "/dev/sda", "/run/initctl"},
+			want: []*tar.Header{
+				{Name: "/bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin", Mode: 0777},
+				{Name: "/dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+				{Name: "/dev/sda", Typeflag: tar.TypeBlock, Mode: 0660, Gid: 6, Gname: "disk", Devmajor: 8},
+				{Name: "/etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+				{Name: "/home/app/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"},
+				{Name: "/home/app/data", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1000, Uname: "app", Gname: "app", Size: 4},
+				{Name: "/run/initctl", Typeflag: tar.TypeFifo, Mode: 0600},
+				{Name: "/usr/bin/ping", Typeflag: tar.TypeReg, Mode: 04755, Size: 4, PAXRecords: roundTripHeaders[4].PAXRecords},
+				// The other paths of the hard link refer to the first one archived.
+				{Name: "/usr/bin/ping4", Typeflag: tar.TypeLink, Linkname: "/usr/bin/ping"},
+				{Name: "/usr/bin/ping6", Typeflag: tar.TypeLink, Linkname: "/usr/bin/ping"},
+			},
+		},
+		{
+			// The file the links share is left out, the first link archived
+			// takes its contents, mode and attributes.
+			name:  "hard links without their file",
+			paths: []string{"/usr/bin/ping4", "/usr/bin/ping6"},
+			want: []*tar.Header{
+				{Name: "/usr/bin/ping4", Typeflag: tar.TypeReg, Mode: 04755, Size: 4, PAXRecords: roundTripHeaders[4].PAXRecords},
+				{Name: "/usr/bin/ping6", Typeflag: tar.TypeLink, Linkname: "/usr/bin/ping4"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := types.NewFileSet()
+			for _, path := range tt.paths {
+				entry, err := StatEntry(envPath+"/rootfs", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				files.Add(entry)
+			}
+			var buf bytes.Buffer
+			if err := WriteTarArchive(&buf, files, envPath); err != nil {
+				t.Fatal(err)
+			}
+			reader := tar.NewReader(&buf)
+			for i := 0; ; i++ {
+				got, err := reader.Next()
+				if err == io.EOF {
+					if i != len(tt.want) {
+						t.Errorf("archived %d entries, want %d", i, len(tt.want))
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i >= len(tt.want) {
+					t.Errorf("unexpected entry %s", got.Name)
+					continue
+				}
+				want := tt.want[i]
+				if got.Name != want.Name || got.Typeflag != want.Typeflag || got.Linkname != want.Linkname ||
+					got.Uid != want.Uid || got.Gid != want.Gid || got.Uname != want.Uname || got.Gname != want.Gname ||
+					got.Devmajor != want.Devmajor || got.Devminor != want.Devminor || got.Size != want.Size ||
+					(got.Typeflag != tar.TypeLink && got.Mode != want.Mode) {
+					t.Errorf("header %d = %+v, want %+v", i, got, want)
+				}
+				if !maps.Equal(xattrs(got.PAXRecords), xattrs(want.PAXRecords)) {
+					t.Errorf("xattrs of %s = %q, want %q", got.Name, xattrs(got.PAXRecords), xattrs(want.PAXRecords))
+				}
+				if !got.ModTime.Equal(SourceDateEpoch()) {
+					t.Errorf("%s modified at %s", got.Name, got.ModTime)
+				}
+			}
+		})
+	}
+}
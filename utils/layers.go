@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+// MaxLayers bounds the instructions adding files to a minimized image, below
+// the 127 layers overlay filesystems can stack.
+const MaxLayers = 127
+
+// Tier groups paths by how often they change, so that the layers of the
+// files that rarely change come first and stay cached when the others do.
+type Tier int
+
+const (
+	// TierSystem holds the files of the distribution: libraries, binaries
+	// and configuration.
+	TierSystem Tier = iota
+	// TierRuntime holds software installed outside of the package manager,
+	// under /usr/local and /opt.
+	TierRuntime
+	// TierApp holds everything else, the application and its data.
+	TierApp
+)
+
+func (t Tier) String() string {
+	switch t {
+	case TierSystem:
+		return "system"
+	case TierRuntime:
+		return "runtime"
+	default:
+		return "app"
+	}
+}
+
+// Archive is the tar archive holding the entries of the tier that COPY
+// cannot recreate, or all of them when the files are not copied.
+func (t Tier) Archive() string {
+	return t.String() + ".tar"
+}
+
+var tiers = []Tier{TierSystem, TierRuntime, TierApp}
+
+var systemDirs = []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/usr", "/etc", "/var", "/dev", "/run"}
+
+func tierOf(path string) Tier {
+	under := func(dir string) bool {
+		return path == dir || strings.HasPrefix(path, dir+"/")
+	}
+	switch {
+	case under("/usr/local") || under("/opt"):
+		return TierRuntime
+	case slices.ContainsFunc(systemDirs, under):
+		return TierSystem
+	default:
+		return TierApp
+	}
+}
+
+// Layer is one instruction adding files to the minimized image: either the
+// ADD of an archive or a COPY from the builder of files sharing a directory
+// and owner.
+type Layer struct {
+	Tier Tier
+	// Archive is the archive added, empty for COPY layers.
+	Archive string
+	Files   types.FileSet
+	// Dir, UID and GID are the destination and owner of COPY layers.
+	Dir      string
+	UID, GID int
+}
+
+// PlanLayers splits files into at most maxLayers layers, ordered by tier.
+// Regular files are copied with one COPY per directory and owner, after an
+// archive per tier with the directories holding them, so that their owners
+// and modes are kept, and the symbolic links, which COPY would follow. Hard
+// links, with the files they link to, and paths COPY would read as patterns
+// or variables go to the archive as well. When that takes more than
+// maxLayers layers, or the files include device nodes or FIFOs, every tier
+// is added from its archive instead; with maxLayers 0 it always is.
+func PlanLayers(files types.FileSet, rootfsPath string, maxLayers int) []Layer {
+	archived := make(map[Tier]*types.FileSet)
+	copied := make(map[Tier][]Layer)
+	all := make(map[Tier]*types.FileSet)
+	add := func(sets map[Tier]*types.FileSet, entry types.Entry) {
+		tier := tierOf(entry.Path)
+		if sets[tier] == nil {
+			set := types.NewFileSet()
+			sets[tier] = &set
+		}
+		sets[tier].Add(entry)
+	}
+	linked := make(map[string]bool)
+	for entry := range files.All() {
+		if entry.Kind == types.KindHardLink {
+			linked[entry.Target] = true
+		}
+	}
+	copyable := true
+	parents := make(map[string]bool)
+	for entry := range files.All() {
+		add(all, entry)
+		switch {
+		case entry.Kind == types.KindFile && !linked[entry.Path] && !strings.ContainsAny(entry.Path, `*?[\$`):
+			tier := tierOf(entry.Path)
+			dir := filepath.Dir(entry.Path)
+			i := slices.IndexFunc(copied[tier], func(l Layer) bool {
+				return l.Dir == dir && l.UID == entry.UID && l.GID == entry.GID
+			})
+			if i < 0 {
+				copied[tier] = append(copied[tier], Layer{Tier: tier, Files: types.NewFileSet(), Dir: dir, UID: entry.UID, GID: entry.GID})
+				i = len(copied[tier]) - 1
+			}
+			copied[tier][i].Files.Add(entry)
+		case entry.Kind == types.KindCharDevice || entry.Kind == types.KindBlockDevice || entry.Kind == types.KindFIFO:
+			copyable = false
+			add(archived, entry)
+		default:
+			add(archived, entry)
+		}
+		for dir := filepath.Dir(entry.Path); dir != "/"; dir = filepath.Dir(dir) {
+			if files.Has(dir) || parents[dir] {
+				continue
+			}
+			parents[dir] = true
+			parent, err := StatEntry(rootfsPath, dir)
+			if err != nil {
+				log.Info("Failed to add directory ", dir, ": ", err)
+				continue
+			}
+			add(archived, parent)
+			add(all, parent)
+		}
+	}
+
+	count := 0
+	for _, tier := range tiers {
+		if archived[tier] != nil {
+			count++
+		}
+		count += len(copied[tier])
+	}
+	var layers []Layer
+	if copyable && count <= maxLayers {
+		for _, tier := range tiers {
+			if archived[tier] != nil {
+				layers = append(layers, Layer{Tier: tier, Archive: tier.Archive(), Files: *archived[tier]})
+			}
+			slices.SortFunc(copied[tier], func(a, b Layer) int {
+				return cmp.Or(strings.Compare(a.Dir, b.Dir), cmp.Compare(a.UID, b.UID), cmp.Compare(a.GID, b.GID))
+			})
+			layers = append(layers, copied[tier]...)
+		}
+		return layers
+	}
+	for _, tier := range tiers {
+		if all[tier] != nil {
+			layers = append(layers, Layer{Tier: tier, Archive: tier.Archive(), Files: *all[tier]})
+		}
+	}
+	return layers
+}
+
+// CreateDockerfile writes a Dockerfile adding files to the template with the
+// layers PlanLayers plans for them, and the archives of those layers.
+func CreateDockerfile(dockerfile string, template string, envPath string, files types.FileSet) error {
+	file, writer, err := createFromTemplate(dockerfile, template, envPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer.WriteString("\n")
+	for _, layer := range PlanLayers(files, envPath+"/rootfs", MaxLayers) {
+		if layer.Archive != "" {
+			log.Info("Adding ", layer.Files.Len(), " paths of tier ", layer.Tier, " from ", layer.Archive)
+			if err := BuildTarArchive(layer.Files, envPath+"/"+layer.Archive, envPath); err != nil {
+				return err
+			}
+			writer.WriteString("ADD " + layer.Archive + " /\n")
+			continue
+		}
+		// The JSON form takes any path, quotes and whitespace included.
+		sources, err := json.Marshal(append(layer.Files.Paths(), strings.TrimSuffix(layer.Dir, "/")+"/"))
+		if err != nil {
+			return err
+		}
+		log.Println("Copying files from " + layer.Dir)
+		// COPY keeps modes but not owners, files are owned by root unless
+		// told otherwise.
+		chown := ""
+		if layer.UID != 0 || layer.GID != 0 {
+			chown = fmt.Sprintf("--chown=%d:%d ", layer.UID, layer.GID)
+		}
+		writer.WriteString("COPY --from=builder " + chown + string(sources) + "\n")
+	}
+	writer.WriteString("\n")
+	return writer.Flush()
+}
+
+// Archives lists the archives a Dockerfile written by CreateDockerfile or
+// AddTarToDockerfile may add.
+func Archives() []string {
+	names := []string{"files.tar"}
+	for _, tier := range tiers {
+		names = append(names, tier.Archive())
+	}
+	return names
+}
@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestTierOf(t *testing.T) {
+	tests := []struct {
+		path string
+		want Tier
+	}{
+		{"/usr/lib/x86_64-linux-gnu/libc.so.6", TierSystem},
+		{"/etc/passwd", TierSystem},
+		{"/lib64", TierSystem},
+		{"/usr/local/bin/node", TierRuntime},
+		{"/usr/local", TierRuntime},
+		{"/opt/venv/bin/python", TierRuntime},
+		{"/app/server.js", TierApp},
+		{"/usrdata/file", TierApp},
+		{"/optional", TierApp},
+	}
+	for _, tt := range tests {
+		if got := tierOf(tt.path); got != tt.want {
+			t.Errorf("tierOf(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+// describeLayers lists layers as their tier, archive or COPY destination and
+// owner, and paths.
+func describeLayers(layers []Layer) []string {
+	var described []string
+	for _, layer := range layers {
+		how := layer.Archive
+		if how == "" {
+			how = fmt.Sprintf("COPY %s %d:%d", layer.Dir, layer.UID, layer.GID)
+		}
+		described = append(described, layer.Tier.String()+" "+how+" "+strings.Join(layer.Files.Paths(), " "))
+	}
+	return described
+}
+
+func TestPlanLayers(t *testing.T) {
+	rootfs := writeRootfs(t, t.TempDir(), map[string]os.FileMode{
+		"/usr/lib/libc.so.6":  0755,
+		"/usr/local/bin/node": 0755,
+		"/app/server.js":      0644,
+		"/app/index.js":       0644,
+		"/app/config.json":    0600,
+		"/app/data/.keep":     0644,
+		"/dev/.keep":          0644,
+	}, map[string]string{"/lib": "usr/lib"})
+	stat := func(path string) types.Entry {
+		entry, err := StatEntry(rootfs, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+	owned := func(path string, uid int) types.Entry {
+		entry := stat(path)
+		entry.UID, entry.GID = uid, uid
+		return entry
+	}
+	files := types.NewFileSet()
+	for _, entry := range []types.Entry{
+		stat("/usr/lib/libc.so.6"),
+		stat("/lib"),
+		stat("/usr/local/bin/node"),
+		owned("/app/server.js", 1000),
+		owned("/app/index.js", 1000),
+		owned("/app/config.json", 0),
+		owned("/app/data", 1000),
+	} {
+		files.Add(entry)
+	}
+	copied := []string{
+		"system system.tar /lib /usr /usr/lib",
+		"system COPY /usr/lib 0:0 /usr/lib/libc.so.6",
+		"runtime runtime.tar /usr/local /usr/local/bin",
+		"runtime COPY /usr/local/bin 0:0 /usr/local/bin/node",
+		"app app.tar /app /app/data",
+		"app COPY /app 0:0 /app/config.json",
+		"app COPY /app 1000:1000 /app/index.js /app/server.js",
+	}
+	archived := []string{
+		"system system.tar /lib /usr /usr/lib /usr/lib/libc.so.6",
+		"runtime runtime.tar /usr/local /usr/local/bin /usr/local/bin/node",
+		"app app.tar /app /app/config.json /app/data /app/index.js /app/server.js",
+	}
+
+	tests := []struct {
+		name      string
+		maxLayers int
+		extra     []types.Entry
+		want      []string
+	}{
+		{name: "copied by directory and owner", maxLayers: MaxLayers, want: copied},
+		{name: "exactly at the limit", maxLayers: len(copied), want: copied},
+		{name: "over the limit", maxLayers: len(copied) - 1, want: archived},
+		{name: "archives only", maxLayers: 0, want: archived},
+		{
+			// COPY would copy the paths of a hard link apart and read [ as a
+			// pattern.
+			name:      "hard link and pattern",
+			maxLayers: MaxLayers,
+			extra: []types.Entry{
+				{Path: "/app/index.mjs", Kind: types.KindHardLink, Target: "/app/index.js", Mode: 0644},
+				{Path: "/app/data/[id].json", Kind: types.KindFile, Mode: 0644},
+			},
+			want: slices.Concat(copied[:4], []string{
+				"app app.tar /app /app/data /app/data/[id].json /app/index.js /app/index.mjs",
+				"app COPY /app 0:0 /app/config.json",
+				"app COPY /app 1000:1000 /app/server.js",
+			}),
+		},
+		{
+			// COPY cannot create device nodes, every tier is archived.
+			name:      "device node",
+			maxLayers: MaxLayers,
+			extra:     []types.Entry{{Path: "/dev/null", Kind: types.KindCharDevice, Mode: 0666, Major: 1, Minor: 3}},
+			want: []string{
+				"system system.tar /dev /dev/null /lib /usr /usr/lib /usr/lib/libc.so.6",
+				archived[1],
+				archived[2],
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := files.Clone()
+			for _, entry := range tt.extra {
+				files.Add(entry)
+			}
+			layers := PlanLayers(files, rootfs, tt.maxLayers)
+			if got := describeLayers(layers); !slices.Equal(got, tt.want) {
+				t.Errorf("PlanLayers =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if len(layers) > max(tt.maxLayers, len(tiers)) {
+				t.Errorf("PlanLayers planned %d layers, more than %d", len(layers), tt.maxLayers)
+			}
+			// Every file is added once, along with its parents.
+			added := types.NewFileSet()
+			for _, layer := range layers {
+				for entry := range layer.Files.All() {
+					if added.Has(entry.Path) {
+						t.Errorf("%s added twice", entry.Path)
+					}
+					added.Add(entry)
+				}
+			}
+			for entry := range files.All() {
+				if !added.Has(entry.Path) {
+					t.Errorf("%s not added", entry.Path)
+				}
+				if dir := filepath.Dir(entry.Path); dir != "/" && !added.Has(dir) {
+					t.Errorf("parent of %s not added", entry.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanLayersMissingParent(t *testing.T) {
+	// Parents missing from the rootfs are left out, the files are still
+	// planned.
+	files := types.NewFileSet()
+	files.Add(types.Entry{Path: "/srv/www/index.html", Kind: types.KindFile, Mode: 0644})
+	layers := PlanLayers(files, t.TempDir(), MaxLayers)
+	want := []string{"app COPY /srv/www 0:0 /srv/www/index.html"}
+	if got := describeLayers(layers); !slices.Equal(got, want) {
+		t.Errorf("PlanLayers = %q, want %q", got, want)
+	}
+}
+
+// archivedHeaders returns the headers of the archive at path by name.
+func archivedHeaders(t *testing.T, path string) map[string]*tar.Header {
+	t.Helper()
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	headers := make(map[string]*tar.Header)
+	reader := tar.NewReader(fd)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[header.Name] = header
+	}
+}
+
+func TestCreateDockerfile(t *testing.T) {
+	const template = "FROM app AS builder\nFROM scratch\nCMD [\"/app/server\"]\n"
+	// The rootfs extracted from an image, with the index of its export, and
+	// files added since that are on disk only.
+	envPath := t.TempDir()
+	writeExport(t, envPath+"/export.tar")
+	if err := ExtractTar(envPath+"/export.tar", envPath+"/rootfs"); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := writeRootfs(t, envPath+"/rootfs", map[string]os.FileMode{
+		"/app/server":                    0755,
+		"/app/my \"quoted\" file.txt":    0644,
+		"/app/static/index.html":         0644,
+		"/usr/lib/x86_64-linux-gnu/libc": 0755,
+	}, nil)
+	if err := os.Chmod(rootfs+"/app", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(envPath+"/Dockerfile.minimal.template", []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := types.NewFileSet()
+	for _, path := range []string{"/app/server", "/app/my \"quoted\" file.txt", "/app/static/index.html", "/usr/lib/x86_64-linux-gnu/libc"} {
+		entry, err := StatEntry(rootfs, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(path, "/app/static") {
+			entry.UID, entry.GID = 1000, 1001
+		}
+		files.Add(entry)
+	}
+
+	tests := []struct {
+		name  string
+		extra []string
+		want  string
+		// dirs are the modes of directories expected in the archives.
+		dirs map[string]int64
+	}{
+		{
+			name: "copied",
+			want: template + "\n" +
+				"ADD system.tar /\n" +
+				`COPY --from=builder ["/usr/lib/x86_64-linux-gnu/libc","/usr/lib/x86_64-linux-gnu/"]` + "\n" +
+				"ADD app.tar /\n" +
+				`COPY --from=builder ["/app/my \"quoted\" file.txt","/app/server","/app/"]` + "\n" +
+				`COPY --from=builder --chown=1000:1001 ["/app/static/index.html","/app/static/"]` + "\n\n",
+			dirs: map[string]int64{"/app/": 0750, "/app/static/": 0755, "/usr/": 0755},
+		},
+		{
+			name:  "device node",
+			extra: []string{"/dev/null", "/home/app/data"},
+			want:  template + "\n" + "ADD system.tar /\n" + "ADD app.tar /\n\n",
+			dirs:  map[string]int64{"/app/": 0750, "/app/static/": 0755, "/home/app/": 0750},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, archive := range Archives() {
+				os.Remove(envPath + "/" + archive)
+			}
+			files := files.Clone()
+			for _, path := range tt.extra {
+				entry, err := StatEntry(rootfs, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				files.Add(entry)
+			}
+			if err := CreateDockerfile("Dockerfile.minimal.test", "Dockerfile.minimal.template", envPath, files); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(envPath + "/Dockerfile.minimal.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("Dockerfile =\n%s\nwant\n%s", data, tt.want)
+			}
+			headers := archivedHeaders(t, envPath+"/system.tar")
+			maps.Copy(headers, archivedHeaders(t, envPath+"/app.tar"))
+			for dir, mode := range tt.dirs {
+				header, ok := headers[dir]
+				if !ok || header.Typeflag != tar.TypeDir || header.Mode != mode {
+					t.Errorf("header of %s = %+v, want a directory with mode %o", dir, header, mode)
+				}
+			}
+			if len(tt.extra) > 0 {
+				if header := headers["/dev/null"]; header == nil || header.Typeflag != tar.TypeChar ||
+					header.Devmajor != 1 || header.Devminor != 3 {
+					t.Errorf("header of /dev/null = %+v, want the device node", header)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"archive/tar"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SourceDateEpoch is the modification time given to every entry of the
+// archives written, so that the same files give byte-identical archives. It
+// is read from SOURCE_DATE_EPOCH, in seconds since the Unix epoch, and
+// defaults to the epoch itself.
+func SourceDateEpoch() time.Time {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Unix(0, 0).UTC()
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Info("Ignoring invalid SOURCE_DATE_EPOCH ", value, ": ", err)
+		return time.Unix(0, 0).UTC()
+	}
+	return time.Unix(seconds, 0).UTC()
+}
+
+// headerKeys are the PAX records standing for fields of the header, which
+// the writer derives from the header itself.
+var headerKeys = []string{"path", "linkpath", "size", "uid", "gid", "uname", "gname", "mtime", "atime", "ctime"}
+
+// NormalizeHeader sets the times of header to modTime and leaves only the
+// PAX records the header fields do not stand for, such as extended
+// attributes, so that the header does not depend on when or from which
+// archive the file was read.
+func NormalizeHeader(header *tar.Header, modTime time.Time) {
+	header.ModTime = modTime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Format = tar.FormatUnknown
+	for _, key := range headerKeys {
+		delete(header.PAXRecords, key)
+	}
+	if len(header.PAXRecords) == 0 {
+		header.PAXRecords = nil
+	}
+}
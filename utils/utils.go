@@ -3,11 +3,12 @@ package utils
 import (
 	"archive/tar"
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"iter"
-	"maps"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,17 +17,75 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/barkimedes/go-deepcopy"
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/regelepuma/dockerminimizer/checks"
+	"github.com/regelepuma/dockerminimizer/engine"
 	"github.com/regelepuma/dockerminimizer/logger"
 	"github.com/regelepuma/dockerminimizer/types"
-	"github.com/samber/lo"
+	"github.com/regelepuma/dockerminimizer/workload"
+	"golang.org/x/sys/unix"
 )
 
 var log = logger.Log
 
-func RealPath(path string) string {
-	realPath, _ := filepath.Abs(path)
-	return filepath.Clean(realPath)
+// maxSymlinkHops matches the limit the Linux kernel applies to path lookups.
+const maxSymlinkHops = 40
+
+// ResolveInRoot resolves every symbolic link in path as if rootfsPath were
+// the root directory, so that absolute links never escape to the host. The
+// returned path is relative to the rootfs.
+func ResolveInRoot(rootfsPath string, path string) (string, error) {
+	resolved, _, err := ResolveChain(rootfsPath, path)
+	return resolved, err
+}
+
+// ResolveChain resolves path like ResolveInRoot and also returns the path of
+// every symbolic link followed on the way, at any directory level, in the
+// order they were followed. Following the same link with the same remaining
+// path twice is a loop and fails, as do more links than the kernel follows.
+func ResolveChain(rootfsPath string, path string) (string, []string, error) {
+	resolved := "/"
+	pending := strings.Split(path, "/")
+	var links []string
+	seen := make(map[string]bool)
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(rootfsPath + next)
+		if err != nil {
+			return "", links, err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		state := next + "\x00" + strings.Join(pending, "/")
+		if seen[state] {
+			return "", links, fmt.Errorf("%s: symbolic link loop at %s", path, next)
+		}
+		seen[state] = true
+		links = append(links, next)
+		if len(links) > maxSymlinkHops {
+			return "", links, fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		link, err := os.Readlink(rootfsPath + next)
+		if err != nil {
+			return "", links, err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+	return resolved, links, nil
 }
 
 func CheckIfDirectoryExists(dir string, envPath string) bool {
@@ -59,21 +118,6 @@ func ReadSymbolicLink(file string, envPath string) string {
 	return strings.TrimPrefix(resolved, envPath)
 }
 
-func RemoveElement[T comparable](slice []T, item T) []T {
-	index := slices.Index(slice, item)
-	if index == -1 {
-		return slice
-	}
-	return slices.Delete(slice, index, index+1)
-}
-
-func AppendIfMissing[T comparable](slice []T, item T) []T {
-	if slices.Contains(slice, item) {
-		return slice
-	}
-	return append(slice, item)
-}
-
 func HasSudo() string {
 	if os.Getuid() == 0 {
 		return ""
@@ -109,25 +153,58 @@ func CopyFile(src string, dest string) error {
 	return err
 }
 
-func GetFullContainerCommand(imageName string, envPath string, metadata types.DockerConfig) string {
-	command := GetContainerCommand(imageName, envPath, metadata) + " "
+// defaultPath is the PATH of containers whose image does not set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// LookPath searches for an executable named command in the PATH set by env,
+// or the default PATH, inside the rootfs, like which would inside a chroot.
+// Symbolic links are resolved inside the rootfs, never on the host.
+func LookPath(command string, rootfsPath string, env []string) (string, error) {
+	path := defaultPath
+	for _, variable := range env {
+		if value, ok := strings.CutPrefix(variable, "PATH="); ok {
+			path = value
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" || !filepath.IsAbs(dir) {
+			continue
+		}
+		candidate := filepath.Join(dir, command)
+		resolved, err := ResolveInRoot(rootfsPath, candidate)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(rootfsPath + resolved)
+		if err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH", command)
+}
+
+// GetFullContainerCommand returns the argv the container runs, with the
+// executable resolved inside the rootfs.
+func GetFullContainerCommand(envPath string, metadata types.DockerConfig) ([]string, error) {
+	command, err := GetContainerCommand(envPath, metadata)
+	if err != nil {
+		return nil, err
+	}
+	argv := []string{command}
 	if len(metadata.Entrypoint) > 1 {
-		command += strings.Join(metadata.Entrypoint[1:], " ")
+		argv = append(argv, metadata.Entrypoint[1:]...)
 	}
-	command += " "
 	if len(metadata.Cmd) > 0 {
-		var cmd []string
 		if len(metadata.Entrypoint) > 0 {
-			cmd = metadata.Cmd
+			argv = append(argv, metadata.Cmd...)
 		} else {
-			cmd = metadata.Cmd[1:]
+			argv = append(argv, metadata.Cmd[1:]...)
 		}
-		command += strings.Join(cmd, " ")
 	}
-	return strings.TrimSpace(command)
+	return argv, nil
 }
 
-func GetContainerCommand(imageName string, envPath string, metadata types.DockerConfig) string {
+func GetContainerCommand(envPath string, metadata types.DockerConfig) (string, error) {
 	command := ""
 	if len(metadata.Entrypoint) > 0 {
 		command = metadata.Entrypoint[0]
@@ -136,114 +213,89 @@ func GetContainerCommand(imageName string, envPath string, metadata types.Docker
 	}
 	if command == "" {
 		log.Error("Failed to find command in Docker image\n")
-		Cleanup(envPath, imageName)
-		os.Exit(1)
+		return "", errors.New("failed to find command in Docker image")
 	}
 	if filepath.IsAbs(command) {
-		return command
+		return command, nil
 	}
 	command = filepath.Base(command)
-	hasSudo := HasSudo()
 
-	output, err := ExecCommandWithOptionalSudo(hasSudo, "chroot", envPath+"/rootfs", "which", command).CombinedOutput()
-	cmd := strings.TrimSpace(string(output))
+	cmd, err := LookPath(command, envPath+"/rootfs", metadata.Env)
 	if err != nil {
 		cmd = metadata.WorkingDir + "/" + command
 		if !CheckIfFileExists(filepath.Clean(cmd), envPath+"/rootfs") {
 			log.Error("Failed to find command in filesystem")
-
-			Cleanup(envPath, imageName)
-			os.Exit(1)
+			return "", errors.New("failed to find command in filesystem")
 		}
 	}
 	log.Info("Command found: " + cmd)
-	return cmd
+	return cmd, nil
 }
 
-func iterToSlice[T any](s iter.Seq[T]) []T {
-	out := []T{}
-	for v := range s {
-		out = append(out, v)
-	}
-	return out
+// archive writes files of a rootfs to a tar archive with the headers the
+// index holds for them, so that owners, modes, extended attributes, device
+// nodes and hard links are kept. Files missing from the index are written
+// from their metadata on disk and owned by root. Every entry is modified at
+// modTime.
+type archive struct {
+	writer     *tar.Writer
+	rootfsPath string
+	index      Index
+	modTime    time.Time
+	// linked maps the first path of each set of hard links to the path its
+	// contents were written to.
+	linked map[string]string
 }
 
-func lowestCommonAncestor(s1, s2 string) string {
-	seg1 := lo.Filter(strings.Split(s1, "/"), func(seg string, _ int) bool {
-		return seg != ""
-	})
-	seg2 := lo.Filter(strings.Split(s2, "/"), func(seg string, _ int) bool {
-		return seg != ""
-	})
-
-	minLen := min(len(seg1), len(seg2))
-	i := 0
-	for i < minLen && seg1[i] == seg2[i] {
-		i++
-	}
-	if i == 0 {
-		return "/"
-	}
-	return filepath.Clean("/" + strings.Join(seg1[:i], "/"))
-}
-
-func ShrinkDictionary(dict map[string][]string, envPath string) map[string][]string {
-	const MAX_LIMIT = 127
-	cpyDict, _ := deepcopy.Anything(dict)
-	dict, _ = cpyDict.(map[string][]string)
-	for len(dict) > MAX_LIMIT {
-		keys := iterToSlice(maps.Keys(dict))
-		keys = lo.Filter(keys, func(key string, _ int) bool {
-			return len(key) > 0
-		})
-		slices.SortFunc(keys, func(a, b string) int {
-			return strings.Compare(a, b)
-		})
-		for i := 0; i < len(keys)-1; i += 2 {
-			delete(dict, keys[i])
-			delete(dict, keys[i+1])
-			ancestor := lowestCommonAncestor(keys[i], keys[i+1])
-			files, ok := dict[ancestor]
-			newFiles := []string{}
-			if filepath.Clean(keys[i]) != filepath.Clean(ancestor) {
-				name := keys[i]
-				if CheckIfDirectoryExists(name, envPath+"/rootfs") {
-					name = name + "/"
-				}
-				newFiles = append(newFiles, name)
-			}
-			if filepath.Clean(keys[i+1]) != filepath.Clean(ancestor) {
-				name := keys[i+1]
-				if CheckIfDirectoryExists(name, envPath+"/rootfs") {
-					name = name + "/"
-				}
-				newFiles = append(newFiles, name)
-			}
-			if !ok {
-				if len(newFiles) > 0 {
-					dict[ancestor] = newFiles
-				}
-			} else {
-				files = lo.Reduce(newFiles, func(files []string, file string, _ int) []string {
-					return AppendIfMissing(files, file)
-				}, files)
-				copyFiles := []string{}
-				for i := range files {
-					for j := i + 1; j < len(files); j++ {
-						combined := lowestCommonAncestor(files[i], files[j])
-						copyFiles = AppendIfMissing(copyFiles, combined)
-					}
-				}
-				if len(copyFiles) > 1 {
-					dict[ancestor] = copyFiles
-				}
-			}
+func (a *archive) add(file string) error {
+	filePath := a.rootfsPath + file
+	header := a.index.Header(file)
+	if header == nil {
+		return a.addFromDisk(file)
+	}
+	header.Name = filepath.ToSlash(file)
+	NormalizeHeader(header, a.modTime)
+	header.Size = 0
+	switch header.Typeflag {
+	case tar.TypeDir:
+		header.Name += "/"
+	case tar.TypeReg, tar.TypeLink:
+		// Hard links refer to the first path of their set in the rootfs,
+		// which need not be archived, so the first one archived takes the
+		// contents and the others link to it.
+		first := file
+		if header.Typeflag == tar.TypeLink {
+			first = filepath.Clean("/" + header.Linkname)
+		}
+		if written, ok := a.linked[first]; ok {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = filepath.ToSlash(written)
+			return a.writer.WriteHeader(header)
 		}
+		a.linked[first] = file
+		if inode := a.index.Header(first); first != file && inode != nil {
+			inode.Name = header.Name
+			NormalizeHeader(inode, a.modTime)
+			header = inode
+		}
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeReg
+		header.Linkname = ""
+		header.Size = info.Size()
+	}
+	if err := a.writer.WriteHeader(header); err != nil {
+		return err
 	}
-	return dict
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	return a.copyContents(filePath)
 }
 
-func addFileToTar(tarWriter *tar.Writer, file string, rootfsPath string) error {
+func (a *archive) addFromDisk(file string) error {
 	var overrideModes = map[string]int64{
 		"/tmp":     01777,
 		"tmp":      01777,
@@ -252,7 +304,7 @@ func addFileToTar(tarWriter *tar.Writer, file string, rootfsPath string) error {
 		"/root":    0700,
 		"root":     0700,
 	}
-	filePath := rootfsPath + file
+	filePath := a.rootfsPath + file
 
 	info, err := os.Lstat(filePath)
 	if err != nil {
@@ -273,158 +325,493 @@ func addFileToTar(tarWriter *tar.Writer, file string, rootfsPath string) error {
 	}
 
 	header.Name = filepath.ToSlash(file)
+	NormalizeHeader(header, a.modTime)
 	header.Uid = 0
 	header.Gid = 0
 	header.Uname = "root"
 	header.Gname = "root"
 	if overrideMode, ok := overrideModes[header.Name]; ok {
 		header.Mode = overrideMode
-	} else {
-		header.Mode = int64(info.Mode())
 	}
 	if info.IsDir() && !strings.HasSuffix(header.Name, "/") {
 		header.Name += "/"
 	}
 
-	if err := tarWriter.WriteHeader(header); err != nil {
+	if err := a.writer.WriteHeader(header); err != nil {
 		return err
 	}
 
-	if info.Mode()&os.ModeSymlink != 0 || info.IsDir() {
+	if !info.Mode().IsRegular() {
 		return nil
 	}
+	return a.copyContents(filePath)
+}
 
+func (a *archive) copyContents(filePath string) error {
 	fd, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer fd.Close()
 
-	_, err = io.Copy(tarWriter, fd)
+	_, err = io.Copy(a.writer, fd)
 	return err
 }
 
-func BuildTarArchive(files map[string][]string, tarFilename string, envPath string) error {
+func BuildTarArchive(files types.FileSet, tarFilename string, envPath string) error {
 	tarFile, err := os.Create(tarFilename)
 	if err != nil {
 		log.Error("Failed to create tar file: " + err.Error())
 		return err
 	}
 	defer tarFile.Close()
-	tarWriter := tar.NewWriter(tarFile)
-	defer tarWriter.Close()
-	for _, fileList := range files {
-		for _, file := range fileList {
-			err := addFileToTar(tarWriter, file, envPath+"/rootfs")
-			if err != nil {
-				log.Infof("Failed to add %s: %v\n", file, err)
-			}
+	return WriteTarArchive(tarFile, files, envPath)
+}
+
+// WriteTarArchive writes files, read from the rootfs of the environment, to w
+// as a tar stream in path order, with the times SourceDateEpoch gives, so
+// that the same files give the same stream. Files that cannot be read are
+// logged and left out.
+func WriteTarArchive(w io.Writer, files types.FileSet, envPath string) error {
+	tarWriter := tar.NewWriter(w)
+	index, err := LoadIndex(envPath + "/rootfs")
+	if err != nil {
+		log.Info("No index of the rootfs, files will be owned by root: ", err)
+	}
+	archive := &archive{tarWriter, envPath + "/rootfs", index, SourceDateEpoch(), make(map[string]string)}
+	for _, file := range files.Paths() {
+		err := archive.add(file)
+		if err != nil {
+			log.Infof("Failed to add %s: %v\n", file, err)
 		}
 	}
-	return nil
+	return tarWriter.Close()
 }
 
-func AddTarToDockerfile(dockerfile string, template string, envPath string) error {
-	file, _ := os.Create(envPath + "/" + dockerfile)
-	defer file.Close()
-	srcFile, _ := os.Open(envPath + "/" + template)
+func createFromTemplate(dockerfile string, template string, envPath string) (*os.File, *bufio.Writer, error) {
+	file, err := os.Create(envPath + "/" + dockerfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	srcFile, err := os.Open(envPath + "/" + template)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
 	defer srcFile.Close()
 	writer := bufio.NewWriter(file)
-	_, err := io.Copy(writer, srcFile)
+	_, err = io.Copy(writer, srcFile)
 	if err != nil {
-		log.Fatalf("Failed to copy template content: %v", err)
+		log.Errorf("Failed to copy template content: %v", err)
+		file.Close()
+		return nil, nil, err
 	}
-	writer.Flush()
+	return file, writer, nil
+}
+
+func AddTarToDockerfile(dockerfile string, template string, envPath string) error {
+	file, writer, err := createFromTemplate(dockerfile, template, envPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 	writer.WriteString("\n")
 	writer.WriteString("ADD files.tar /\n")
 	writer.WriteString("\n")
-	writer.Flush()
-	return nil
+	return writer.Flush()
 }
 
-func AddFilesToDockerfile(file string, files map[string][]string, symLinks map[string]string, rootfsPath string) {
-	file = RealPath(file)
-	if CheckIfFileExists(file, rootfsPath) {
-		if CheckIfSymbolicLink(file, rootfsPath) {
-			symLinks[file] = ReadSymbolicLink(file, rootfsPath)
-		} else {
-			files[filepath.Dir(file)] = AppendIfMissing(files[filepath.Dir(file)], file)
+// StatEntry returns the entry of the file at path inside the rootfs, with its
+// type, mode, owner and device numbers. These come from the index of the
+// rootfs when it has path, as extracting the rootfs loses them.
+func StatEntry(rootfsPath string, path string) (types.Entry, error) {
+	if index, err := LoadIndex(rootfsPath); err == nil {
+		if header := index.Header(path); header != nil {
+			return headerEntry(rootfsPath, path, header, index), nil
 		}
 	}
+	info, err := os.Lstat(rootfsPath + path)
+	if err != nil {
+		return types.Entry{}, err
+	}
+	mode := info.Mode()
+	entry := types.Entry{Path: path, Kind: types.KindFile, Mode: mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)}
+	switch {
+	case mode.IsDir():
+		entry.Kind = types.KindDir
+	case mode&fs.ModeSymlink != 0:
+		entry.Kind = types.KindSymLink
+		entry.Target = ReadSymbolicLink(path, rootfsPath)
+	case mode&fs.ModeCharDevice != 0:
+		entry.Kind = types.KindCharDevice
+	case mode&fs.ModeDevice != 0:
+		entry.Kind = types.KindBlockDevice
+	case mode&fs.ModeNamedPipe != 0:
+		entry.Kind = types.KindFIFO
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.UID, entry.GID = int(stat.Uid), int(stat.Gid)
+		if entry.Kind == types.KindCharDevice || entry.Kind == types.KindBlockDevice {
+			entry.Major, entry.Minor = unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))
+		}
+	}
+	return entry, nil
 }
 
-func CreateDockerfile(dockerfile string, template string, envPath string, files map[string][]string, symLinks map[string]string) {
-	file, _ := os.Create(envPath + "/" + dockerfile)
-	defer file.Close()
-	srcFile, _ := os.Open(envPath + "/" + template)
-	defer srcFile.Close()
-	writer := bufio.NewWriter(file)
-	_, err := io.Copy(writer, srcFile)
+// headerEntry returns the entry of path from its header in the index of the
+// rootfs. Hard links take their mode and owner from the file they link to.
+func headerEntry(rootfsPath string, path string, header *tar.Header, index Index) types.Entry {
+	target := ""
+	if header.Typeflag == tar.TypeLink {
+		target = filepath.Clean("/" + header.Linkname)
+		if inode := index.Header(target); inode != nil {
+			header = inode
+			header.Typeflag = tar.TypeLink
+		}
+	}
+	entry := types.Entry{
+		Path: path,
+		Kind: types.KindFile,
+		Mode: header.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky),
+		UID:  header.Uid,
+		GID:  header.Gid,
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		entry.Kind = types.KindDir
+	case tar.TypeSymlink:
+		entry.Kind = types.KindSymLink
+		entry.Target = ReadSymbolicLink(path, rootfsPath)
+	case tar.TypeLink:
+		entry.Kind = types.KindHardLink
+		entry.Target = target
+	case tar.TypeChar:
+		entry.Kind = types.KindCharDevice
+	case tar.TypeBlock:
+		entry.Kind = types.KindBlockDevice
+	case tar.TypeFifo:
+		entry.Kind = types.KindFIFO
+	}
+	if entry.Kind == types.KindCharDevice || entry.Kind == types.KindBlockDevice {
+		entry.Major, entry.Minor = uint32(header.Devmajor), uint32(header.Devminor)
+	}
+	return entry
+}
+
+// AddFile adds file to files, for source, resolving it inside the rootfs:
+// every symbolic link followed on the way, at any directory level, is added
+// with the file it finally resolves to, unless that is a directory. Nothing
+// is added when file does not exist.
+func AddFile(file string, files *types.FileSet, rootfsPath string, source types.Source) {
+	resolved, links, err := ResolveChain(rootfsPath, filepath.Join("/", file))
 	if err != nil {
-		log.Fatalf("Failed to copy template content: %v", err)
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Info("Failed to resolve ", file, ": ", err)
+		}
+		return
 	}
-	writer.Flush()
-	writer.WriteString("\n")
-	for dir, file := range files {
-		quoted := make([]string, len(file))
-		for i, s := range file {
-			quoted[i] = fmt.Sprintf("\"%s\"", s)
+	if !CheckIfDirectoryExists(resolved, rootfsPath) {
+		links = append(links, resolved)
+	}
+	for _, path := range links {
+		entry, err := StatEntry(rootfsPath, path)
+		if err != nil {
+			continue
 		}
-		quoted = append(quoted, filepath.Clean(fmt.Sprintf("\"%s/\"", dir)))
-		quoted = slices.Compact(quoted)
-		log.Println("Copying files from " + dir)
-		writer.WriteString("COPY --from=builder [" + strings.Join(quoted, ", ") + "]\n")
+		entry.Sources = []types.Source{source}
+		files.Add(entry)
 	}
-	for link, target := range symLinks {
-		log.Println("Copying symbolic link " + link + " to " + target)
-		writer.WriteString("COPY --from=builder [\"" + target + "\",  \"" + link + "\"]\n")
+}
+
+// MatchesAny reports whether path, or a directory above it, matches one of
+// the doublestar patterns, so that naming a directory covers its contents.
+func MatchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if doublestar.MatchUnvalidated(pattern, path) ||
+			doublestar.MatchUnvalidated(strings.TrimSuffix(pattern, "/")+"/**", path) {
+			return true
+		}
 	}
-	writer.WriteString("\n")
-	writer.Flush()
+	return false
+}
+
+// KeepAndDrop adds the paths matching image.Keep that exist in the rootfs to
+// files, with everything below the kept directories and the targets of kept
+// links, and then removes the paths matching image.Drop, kept ones included.
+func KeepAndDrop(image types.Image, files *types.FileSet) {
+	rootfsPath := image.EnvPath + "/rootfs"
+	rootfs := os.DirFS(rootfsPath)
+	for _, keep := range image.Keep {
+		matches, err := doublestar.Glob(rootfs, strings.TrimPrefix(keep, "/"), doublestar.WithNoFollow())
+		if err != nil {
+			log.Error("Invalid keep pattern ", keep, ": ", err)
+			continue
+		}
+		for _, match := range matches {
+			AddTree("/"+match, files, rootfsPath, types.Source{Analyzer: "keep", Reason: "matches " + keep})
+		}
+	}
+	files.RemoveFunc(func(entry types.Entry) bool {
+		return MatchesAny(image.Drop, entry.Path)
+	})
 }
 
-func ValidateDockerfile(dockerfile string, envPath string, context string, timeout int) error {
+// AddTree adds path to files, for source, with everything below it when it
+// is a directory. Symbolic links are resolved inside the rootfs and added
+// with their targets; below path, links to directories are added without
+// the contents of the directories.
+func AddTree(path string, files *types.FileSet, rootfsPath string, source types.Source) {
+	AddFile(path, files, rootfsPath, source)
+	root, err := ResolveInRoot(rootfsPath, path)
+	if err != nil || !CheckIfDirectoryExists(root, rootfsPath) {
+		return
+	}
+	filepath.WalkDir(rootfsPath+root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		AddFile(strings.TrimPrefix(path, rootfsPath), files, rootfsPath, source)
+		return nil
+	})
+}
+
+func ValidateDockerfile(ctx context.Context, rt engine.Runtime, image types.Image, dockerfile string, timeout int) error {
+	envPath := image.EnvPath
 	parts := strings.Split(dockerfile, ".")
 	tagName := parts[len(parts)-1]
 	imageName := "dockerminimize-" + filepath.Base(envPath) + ":" + tagName
-	buildPath := envPath + "/" + dockerfile
-	output, err := exec.Command("docker", "build", "-f", buildPath, "-t", imageName, context).CombinedOutput()
-	log.Info(string(output))
+	extraFiles := map[string]string{}
+	for _, archive := range Archives() {
+		if CheckIfFileExists(archive, envPath) {
+			extraFiles[archive] = envPath + "/" + archive
+		}
+	}
+	err := rt.Build(ctx, engine.BuildOptions{
+		ContextDir: image.Context,
+		Dockerfile: envPath + "/" + dockerfile,
+		Tag:        imageName,
+		Platform:   image.Platform,
+		ExtraFiles: extraFiles,
+	})
 	if err != nil {
-		log.Error("Failed to build Docker image\n")
+		log.Error("Failed to build Docker image: ", err)
 		return errors.New("failed to build Docker image")
 	}
+	return ValidateImage(ctx, rt, image, imageName, timeout)
+}
 
-	ok := true
+// ValidateImage runs imageName, a candidate minimized image, and checks that
+// it behaves as configured for image.
+func ValidateImage(ctx context.Context, rt engine.Runtime, image types.Image, imageName string, timeout int) error {
+	_, tagName, _ := strings.Cut(imageName, ":")
+	suite, err := checks.NewSuite(image.Checks)
+	if err != nil {
+		return err
+	}
 	containerName := strings.ReplaceAll(imageName, ":", "-") + "-test-" + tagName
-	cmd := exec.Command("docker", "run", "--rm", "--name", containerName, imageName)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
-		if cmd.Process != nil {
-			log.Info(fmt.Sprintf("%d seconds have passed. Stopping docker.", timeout))
-			exec.Command("docker", "stop", "-t", "5", containerName).Run()
-			ExecCommandWithOptionalSudo(HasSudo(), "kill", "-15", fmt.Sprintf("-%d", cmd.Process.Pid)).Run()
-			ok = false
+	opts := engine.RunOptions{
+		Image:    imageName,
+		Name:     containerName,
+		Platform: image.Platform,
+		Timeout:  time.Duration(timeout) * time.Second,
+		Env:      image.Env,
+		Cmd:      image.RunArgs,
+		Ports:    suite.Ports(),
+		While:    suite.While(workload.Hook(rt, image)),
+	}
+	if image.Differential.Enabled {
+		return validateDifferential(ctx, rt, image, suite, opts)
+	}
+	result, err := rt.Run(ctx, opts)
+	if err != nil {
+		log.Error("Failed to run Docker image: ", err)
+		return errors.New("failed to run Docker image")
+	}
+	if err := suite.Verify(result); err != nil {
+		log.Error("Docker image failed its checks: ", err)
+		return fmt.Errorf("failed checks: %w", err)
+	}
+	return nil
+}
+
+// baselineFile caches the behaviour of the original image in the environment.
+const baselineFile = "baseline.json"
+
+// validateDifferential runs the candidate image described by opts and
+// compares its behaviour with the one of the original image, which is
+// observed on first use.
+func validateDifferential(ctx context.Context, rt engine.Runtime, image types.Image,
+	suite *checks.Suite, opts engine.RunOptions) error {
+	differential, err := checks.NewDifferential(image.Differential)
+	if err != nil {
+		return err
+	}
+	var baseline checks.Observation
+	data, err := os.ReadFile(image.EnvPath + "/" + baselineFile)
+	if err == nil {
+		err = json.Unmarshal(data, &baseline)
+	}
+	if err != nil {
+		log.Info("Observing the original image ", image.Name)
+		original := opts
+		original.Image = image.Name
+		original.Name = strings.ReplaceAll(image.Name, ":", "-") + "-baseline"
+		baseline, _, err = differential.Run(ctx, rt, original, image.EnvPath+"/volumes/baseline")
+		if err != nil {
+			log.Error("Failed to run original image: ", err)
+			return errors.New("failed to run original image")
 		}
-	})
-	defer timer.Stop()
-	output, err = cmd.CombinedOutput()
+		data, _ := json.Marshal(baseline)
+		if err := os.WriteFile(image.EnvPath+"/"+baselineFile, data, 0644); err != nil {
+			return err
+		}
+	}
 
-	log.Info(string(output))
-	if ok && err != nil {
-		log.Error("Failed to run Docker image\n")
+	observation, result, err := differential.Run(ctx, rt, opts, image.EnvPath+"/volumes/candidate")
+	if err != nil {
+		log.Error("Failed to run Docker image: ", err)
 		return errors.New("failed to run Docker image")
 	}
-	CopyFile(envPath+"/"+dockerfile, "Dockerfile.minimal")
+	if err := suite.VerifyChecks(result); err != nil {
+		log.Error("Docker image failed its checks: ", err)
+		return fmt.Errorf("failed checks: %w", err)
+	}
+	if err := differential.Compare(baseline, observation); err != nil {
+		log.Error("Docker image behaves differently from the original: ", err)
+		return fmt.Errorf("behaves differently from the original: %w", err)
+	}
 	return nil
 }
 
-func Cleanup(envPath string, imageName string) {
-	command := fmt.Sprintf("docker rmi -f $(docker images %s --format \"{{.Repository}}:{{.Tag}}\")", imageName)
+// insideRoot reports whether path is dest or below it, without any of the
+// directories in between being a symbolic link.
+func insideRoot(dest string, path string) bool {
+	rel, err := filepath.Rel(dest, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	current := dest
+	for _, part := range strings.Split(filepath.Dir(rel), "/") {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ExtractTar unpacks the archive at tarPath into dest without requiring
+// root. Ownership is not preserved and every entry is made readable, and for
+// directories writable, by the invoking user so that the filesystem can be
+// analysed. Device nodes and FIFOs cannot be created and are replaced by
+// empty files. What is lost is kept in the index of the headers written to
+// dest.index, see LoadIndex.
+func ExtractTar(tarPath string, dest string) (err error) {
+	fd, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	index, err := newIndexWriter(indexPath(dest))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, index.Close())
+	}()
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	dirs := []dirMode{}
+	reader := tar.NewReader(fd)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, filepath.Clean("/"+header.Name))
+		if !insideRoot(dest, target) {
+			log.Info("Skipping entry outside of the rootfs: ", header.Name)
+			continue
+		}
+		if err := index.add(header); err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, mode.Perm() | 0700})
+		case tar.TypeReg:
+			os.MkdirAll(filepath.Dir(target), 0755)
+			os.Remove(target)
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, reader)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			// OpenFile applies the umask and drops the special bits.
+			os.Chmod(target, (mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))|0600)
+		case tar.TypeSymlink:
+			os.MkdirAll(filepath.Dir(target), 0755)
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source := filepath.Join(dest, filepath.Clean("/"+header.Linkname))
+			if !insideRoot(dest, source) {
+				log.Info("Skipping hard link outside of the rootfs: ", header.Name)
+				continue
+			}
+			os.MkdirAll(filepath.Dir(target), 0755)
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			os.MkdirAll(filepath.Dir(target), 0755)
+			os.Remove(target)
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			file.Close()
+		default:
+			log.Info("Skipping special file: ", header.Name)
+		}
+	}
+	// Directory modes are applied last, entries may have been written into them.
+	for _, dir := range slices.Backward(dirs) {
+		os.Chmod(dir.path, dir.mode)
+	}
+	return nil
+}
+
+func Cleanup(rt engine.Runtime, envPath string, imageName string) {
+	if imageName == "" {
+		// An empty reference would match, and remove, every image on the host.
+		os.RemoveAll(envPath)
+		return
+	}
 	log.Info("Cleaning up Docker images...")
-	log.Info("Running command: " + command)
-	exec.Command("sh", "-c", command).CombinedOutput()
-	os.Clearenv()
+	if err := rt.RemoveImages(context.Background(), imageName); err != nil {
+		log.Error("Failed to remove Docker images: ", err)
+	}
 	err := os.RemoveAll(envPath)
 	if err != nil {
 		log.Error("Failed to remove temporary files\n")
@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestValidateDockerfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		checks  []types.Check
+		build   error
+		run     engine.RunResult
+		wantErr bool
+	}{
+		{name: "passes"},
+		{name: "build fails", build: errors.New("COPY failed: file not found"), wantErr: true},
+		{name: "exits with an error", run: engine.RunResult{ExitCode: 127}, wantErr: true},
+		{name: "still running", run: engine.RunResult{ExitCode: 137, TimedOut: true}},
+		{
+			name:   "expected exit code",
+			checks: []types.Check{{Type: "exit_code", ExitCode: 3}},
+			run:    engine.RunResult{ExitCode: 3},
+		},
+		{
+			name:    "output check fails",
+			checks:  []types.Check{{Type: "stdout", Pattern: "listening"}},
+			run:     engine.RunResult{Stdout: []byte("error: no such file")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envPath := filepath.Join(t.TempDir(), "env")
+			os.Mkdir(envPath, 0755)
+			os.WriteFile(filepath.Join(envPath, "Dockerfile.minimal.ldd"), []byte("FROM scratch\n"), 0644)
+			os.WriteFile(filepath.Join(envPath, "app.tar"), nil, 0644)
+			var built engine.BuildOptions
+			var ran engine.RunOptions
+			fake := &engine.Fake{
+				BuildFunc: func(opts engine.BuildOptions) error {
+					built = opts
+					return tt.build
+				},
+				RunFunc: func(opts engine.RunOptions) (engine.RunResult, error) {
+					ran = opts
+					return tt.run, nil
+				},
+			}
+			image := types.Image{EnvPath: envPath, Context: "/context", Checks: tt.checks,
+				Env: []string{"MODE=test"}, RunArgs: []string{"--serve"}}
+
+			err := ValidateDockerfile(context.Background(), fake, image, "Dockerfile.minimal.ldd", 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateDockerfile error = %v, want error %t", err, tt.wantErr)
+			}
+			if built.Tag != "dockerminimize-env:ldd" || built.ContextDir != "/context" {
+				t.Errorf("built %s from %s", built.Tag, built.ContextDir)
+			}
+			if built.ExtraFiles["app.tar"] != envPath+"/app.tar" || len(built.ExtraFiles) != 1 {
+				t.Errorf("extra files = %v, want app.tar only", built.ExtraFiles)
+			}
+			if tt.build != nil {
+				if ran.Image != "" {
+					t.Errorf("ran %s although the build failed", ran.Image)
+				}
+				return
+			}
+			if ran.Image != built.Tag || !slices.Equal(ran.Env, image.Env) || !slices.Equal(ran.Cmd, image.RunArgs) {
+				t.Errorf("ran %s with env %v and command %v", ran.Image, ran.Env, ran.Cmd)
+			}
+		})
+	}
+}
+
+// writeRootfs fills rootfs with files, with their modes, and symbolic links
+// and returns it.
+func writeRootfs(t *testing.T, rootfs string, files map[string]os.FileMode, links map[string]string) string {
+	t.Helper()
+	for path, mode := range files {
+		if err := os.MkdirAll(filepath.Dir(rootfs+path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(rootfs+path, []byte(path), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, target := range links {
+		if err := os.MkdirAll(filepath.Dir(rootfs+path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, rootfs+path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rootfs
+}
+
+func TestLookPath(t *testing.T) {
+	rootfs := writeRootfs(t, t.TempDir(), map[string]os.FileMode{
+		"/usr/bin/python3.12":  0755,
+		"/usr/local/bin/node":  0755,
+		"/opt/app/bin/app":     0755,
+		"/usr/bin/README":      0644,
+		"/usr/local/bin/shell": 0644,
+	}, map[string]string{
+		"/usr/bin/python3": "/usr/bin/python3.12",
+		"/usr/bin/nodejs":  "../local/bin/node",
+		// Present on the host, absent from the rootfs.
+		"/usr/bin/sh":   "/bin/sh",
+		"/usr/bin/loop": "/usr/bin/loop",
+	})
+	tests := []struct {
+		command string
+		env     []string
+		want    string
+	}{
+		{"python3", nil, "/usr/bin/python3"},
+		{"nodejs", nil, "/usr/bin/nodejs"},
+		{"node", nil, "/usr/local/bin/node"},
+		{"sh", nil, ""},
+		{"loop", nil, ""},
+		{"README", nil, ""},
+		{"app", nil, ""},
+		{"app", []string{"HOME=/root", "PATH=relative:/opt/app/bin"}, "/opt/app/bin/app"},
+		{"python3", []string{"PATH=/opt/app/bin"}, ""},
+	}
+	for _, tt := range tests {
+		got, err := LookPath(tt.command, rootfs, tt.env)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("LookPath(%q, %v) = %q, %v, want %q", tt.command, tt.env, got, err, tt.want)
+		}
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{[]string{"/etc/passwd"}, "/etc/passwd", true},
+		{[]string{"/etc/passwd"}, "/etc/passwd-", false},
+		{[]string{"/usr/share/doc"}, "/usr/share/doc", true},
+		{[]string{"/usr/share/doc"}, "/usr/share/doc/bash/README", true},
+		{[]string{"/usr/share/doc/"}, "/usr/share/doc/bash/README", true},
+		{[]string{"/usr/share/doc"}, "/usr/share/docs/README", false},
+		{[]string{"/usr/share/**/*.mo"}, "/usr/share/locale/de/LC_MESSAGES/bash.mo", true},
+		{[]string{"/etc/*.conf"}, "/etc/nsswitch.conf", true},
+		{[]string{"/etc/*.conf"}, "/etc/ld.so.conf.d/libc.conf", false},
+		{[]string{"/etc/ssl/certs/**"}, "/etc/ssl/certs", true},
+		{[]string{"/lib/*/libc.so.6"}, "/lib/x86_64-linux-gnu/libc.so.6", true},
+		{[]string{"/opt/**", "/etc/hosts"}, "/etc/hosts", true},
+		{nil, "/etc/hosts", false},
+	}
+	for _, tt := range tests {
+		if got := MatchesAny(tt.patterns, tt.path); got != tt.want {
+			t.Errorf("MatchesAny(%v, %s) = %t, want %t", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestKeepAndDrop(t *testing.T) {
+	envPath := t.TempDir()
+	rootfs := writeRootfs(t, filepath.Join(envPath, "rootfs"), map[string]os.FileMode{
+		"/app/server":                   0755,
+		"/etc/passwd":                   0644,
+		"/etc/ssl/certs/ca.pem":         0644,
+		"/etc/ssl/certs/legacy.pem":     0644,
+		"/usr/share/doc/bash/README":    0644,
+		"/usr/share/zoneinfo/UTC":       0644,
+		"/usr/share/zoneinfo/right/UTC": 0644,
+	}, map[string]string{
+		"/etc/localtime": "../usr/share/zoneinfo/UTC",
+	})
+	tests := []struct {
+		name   string
+		keep   []string
+		drop   []string
+		want   []string
+		absent []string
+	}{
+		{
+			name:   "nothing",
+			want:   []string{"/app/server", "/usr/share/doc/bash/README"},
+			absent: []string{"/etc/passwd"},
+		},
+		{
+			name:   "keep directory subtree",
+			keep:   []string{"/etc/ssl"},
+			want:   []string{"/etc/ssl/certs/ca.pem", "/etc/ssl/certs/legacy.pem"},
+			absent: []string{"/etc/passwd"},
+		},
+		{
+			name: "keep glob",
+			keep: []string{"/etc/pass*", "/usr/share/zoneinfo/**"},
+			want: []string{"/etc/passwd", "/usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/right/UTC"},
+		},
+		{
+			name: "keep link with its target",
+			keep: []string{"/etc/localtime"},
+			want: []string{"/etc/localtime", "/usr/share/zoneinfo/UTC"},
+		},
+		{
+			name:   "keep missing path",
+			keep:   []string{"/opt/**"},
+			want:   []string{"/app/server"},
+			absent: []string{"/opt"},
+		},
+		{
+			name:   "drop directory subtree",
+			drop:   []string{"/usr/share/doc"},
+			want:   []string{"/app/server"},
+			absent: []string{"/usr/share/doc/bash/README", "/usr/share/doc/bash", "/usr/share/doc"},
+		},
+		{
+			name:   "drop wins over keep",
+			keep:   []string{"/usr/share/zoneinfo"},
+			drop:   []string{"/usr/share/zoneinfo/right"},
+			want:   []string{"/usr/share/zoneinfo/UTC"},
+			absent: []string{"/usr/share/zoneinfo/right/UTC"},
+		},
+		{
+			name:   "drop wins over keep of the same path",
+			keep:   []string{"/etc/ssl/certs/*.pem"},
+			drop:   []string{"/etc/ssl/certs/legacy.pem"},
+			want:   []string{"/etc/ssl/certs/ca.pem"},
+			absent: []string{"/etc/ssl/certs/legacy.pem"},
+		},
+		{
+			name:   "drop target of kept link",
+			keep:   []string{"/etc/localtime"},
+			drop:   []string{"/usr/share/zoneinfo/**"},
+			want:   []string{"/etc/localtime"},
+			absent: []string{"/usr/share/zoneinfo/UTC"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The analysis found the server and the documentation.
+			files := types.NewFileSet()
+			AddFile("/app/server", &files, rootfs, types.Source{Analyzer: "test"})
+			AddFile("/usr/share/doc/bash/README", &files, rootfs, types.Source{Analyzer: "test"})
+			KeepAndDrop(types.Image{EnvPath: envPath, Keep: tt.keep, Drop: tt.drop}, &files)
+			for _, path := range tt.want {
+				if !files.Has(path) {
+					t.Errorf("%s missing from %v", path, files.Paths())
+				}
+			}
+			for _, path := range tt.absent {
+				if files.Has(path) {
+					t.Errorf("%s kept", path)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveChain(t *testing.T) {
+	links := map[string]string{
+		// Merged /usr.
+		"/lib":                                "usr/lib",
+		"/lib64":                              "usr/lib64",
+		"/usr/lib/x86_64-linux-gnu/libc.so.6": "libc-2.36.so",
+		"/usr/lib64/ld-linux-x86-64.so.2":     "../lib/x86_64-linux-gnu/ld-2.36.so",
+		"/etc/localtime":                      "/usr/share/zoneinfo/UTC",
+		"/etc/alternatives/java":              "/opt/jdk/bin/java",
+		"/usr/bin/java":                       "/etc/alternatives/java",
+		// Absolute links and .. stay inside the root.
+		"/opt/escape": "/../../../etc/passwd",
+		"/opt/up":     "../../../../usr",
+		"/loop/a":     "b",
+		"/loop/b":     "a",
+		"/loop/self":  "self/file",
+	}
+	// The 40 links from /hops/2 resolve, one more does not.
+	for i := 1; i < 41; i++ {
+		links[fmt.Sprintf("/hops/%d", i)] = fmt.Sprintf("%d", i+1)
+	}
+	links["/hops/41"] = "/etc/passwd"
+	rootfs := writeRootfs(t, t.TempDir(), map[string]os.FileMode{
+		"/usr/lib/x86_64-linux-gnu/libc-2.36.so": 0755,
+		"/usr/lib/x86_64-linux-gnu/ld-2.36.so":   0755,
+		"/usr/share/zoneinfo/UTC":                0644,
+		"/opt/jdk/bin/java":                      0755,
+		"/etc/passwd":                            0644,
+	}, links)
+	tests := []struct {
+		path  string
+		want  string
+		links []string
+		// wantErr is a substring of the error expected.
+		wantErr string
+	}{
+		{path: "/etc/passwd", want: "/etc/passwd"},
+		{path: "/usr/lib", want: "/usr/lib"},
+		{
+			path:  "/lib/x86_64-linux-gnu/libc.so.6",
+			want:  "/usr/lib/x86_64-linux-gnu/libc-2.36.so",
+			links: []string{"/lib", "/usr/lib/x86_64-linux-gnu/libc.so.6"},
+		},
+		{
+			path:  "/lib64/ld-linux-x86-64.so.2",
+			want:  "/usr/lib/x86_64-linux-gnu/ld-2.36.so",
+			links: []string{"/lib64", "/usr/lib64/ld-linux-x86-64.so.2"},
+		},
+		{
+			path:  "/usr/bin/java",
+			want:  "/opt/jdk/bin/java",
+			links: []string{"/usr/bin/java", "/etc/alternatives/java"},
+		},
+		{path: "/usr/lib/../../etc/./passwd", want: "/etc/passwd"},
+		{path: "/../../etc/passwd", want: "/etc/passwd"},
+		{path: "/opt/escape", want: "/etc/passwd", links: []string{"/opt/escape"}},
+		{path: "/opt/up/lib", want: "/usr/lib", links: []string{"/opt/up"}},
+		{path: "/lib/missing.so", links: []string{"/lib"}, wantErr: "no such file"},
+		{path: "/loop/a", links: []string{"/loop/a", "/loop/b"}, wantErr: "symbolic link loop at /loop/a"},
+		// A link into itself grows the path instead of looping.
+		{path: "/loop/self", wantErr: "too many levels of symbolic links"},
+		{path: "/hops/2", want: "/etc/passwd"},
+		{path: "/hops/1", wantErr: "too many levels of symbolic links"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resolved, followed, err := ResolveChain(rootfs, tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ResolveChain error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if resolved != tt.want {
+				t.Errorf("ResolveChain = %s, want %s", resolved, tt.want)
+			}
+			if tt.links != nil && !slices.Equal(followed, tt.links) {
+				t.Errorf("links followed = %v, want %v", followed, tt.links)
+			}
+		})
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	rootfs := writeRootfs(t, t.TempDir(), map[string]os.FileMode{
+		"/usr/lib/x86_64-linux-gnu/libssl.so.3": 0644,
+		"/usr/share/zoneinfo/UTC":               0644,
+	}, map[string]string{
+		"/lib":                                "usr/lib",
+		"/usr/lib/x86_64-linux-gnu/libssl.so": "libssl.so.3",
+		"/etc/localtime":                      "/usr/share/zoneinfo/UTC",
+		"/etc/zoneinfo":                       "/usr/share/zoneinfo",
+		"/etc/loop":                           "loop",
+	})
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{
+			// The intermediate directory link is added with the file.
+			path: "/lib/x86_64-linux-gnu/libssl.so",
+			want: []string{"/lib", "/usr/lib/x86_64-linux-gnu/libssl.so", "/usr/lib/x86_64-linux-gnu/libssl.so.3"},
+		},
+		{path: "/etc/localtime", want: []string{"/etc/localtime", "/usr/share/zoneinfo/UTC"}},
+		// A link to a directory is added without the directory.
+		{path: "/etc/zoneinfo", want: []string{"/etc/zoneinfo"}},
+		{path: "/etc/zoneinfo/UTC", want: []string{"/etc/zoneinfo", "/usr/share/zoneinfo/UTC"}},
+		{path: "/etc/missing"},
+		{path: "/etc/loop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			files := types.NewFileSet()
+			AddFile(tt.path, &files, rootfs, types.Source{Analyzer: "test"})
+			if got := files.Paths(); !slices.Equal(got, tt.want) {
+				t.Errorf("AddFile added %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Package workload runs user supplied workloads against a running container,
+// both while it is traced and while candidate images are validated.
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/logger"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+var log = logger.Log
+
+// Empty reports whether config declares no workload.
+func Empty(config types.Workload) bool {
+	return len(config.Exec) == 0 && config.Sidecar.Image == ""
+}
+
+// Validate reports configuration errors of config.
+func Validate(config types.Workload) error {
+	for i, command := range config.Exec {
+		if len(command) == 0 {
+			return fmt.Errorf("workload command %d is empty", i+1)
+		}
+	}
+	if config.Sidecar.Image == "" && (len(config.Sidecar.Cmd) > 0 || len(config.Sidecar.Env) > 0) {
+		return errors.New("workload sidecar needs an image")
+	}
+	return nil
+}
+
+// Hook returns a hook running the workload of image against a container, or
+// nil when there is nothing to run.
+func Hook(rt engine.Runtime, image types.Image) func(ctx context.Context, c engine.Container) error {
+	if Empty(image.Workload) {
+		return nil
+	}
+	return func(ctx context.Context, c engine.Container) error {
+		return Run(ctx, rt, c, image)
+	}
+}
+
+// Run executes the commands of the workload of image inside c in order and
+// then runs the sidecar, for the platform of the host, stopping at the first
+// failure. The commands are traced along with the container when it is, so
+// the files they use are kept in the minimized image they run in later.
+func Run(ctx context.Context, rt engine.Runtime, c engine.Container, image types.Image) error {
+	config := image.Workload
+	for _, command := range config.Exec {
+		log.Info("Running workload command: ", strings.Join(command, " "))
+		result, err := c.Exec(ctx, command)
+		if err != nil {
+			return fmt.Errorf("workload %q: %w", strings.Join(command, " "), err)
+		}
+		if result.ExitCode != 0 {
+			return fmt.Errorf("workload %q exited with code %d: %s", strings.Join(command, " "),
+				result.ExitCode, strings.TrimSpace(string(result.Stderr)))
+		}
+	}
+	sidecar := config.Sidecar
+	if sidecar.Image == "" {
+		return nil
+	}
+	if err := rt.Pull(ctx, sidecar.Image, ""); err != nil {
+		return fmt.Errorf("workload sidecar: %w", err)
+	}
+	log.Info("Running workload sidecar ", sidecar.Image)
+	result, err := rt.Run(ctx, engine.RunOptions{
+		Image:       sidecar.Image,
+		Cmd:         sidecar.Cmd,
+		Env:         sidecar.Env,
+		NetworkMode: "container:" + c.ID(),
+	})
+	if err != nil {
+		return fmt.Errorf("workload sidecar: %w", err)
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("workload sidecar exited with code %d: %s", result.ExitCode,
+			strings.TrimSpace(string(result.Stderr)))
+	}
+	return nil
+}
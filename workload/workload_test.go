@@ -0,0 +1,102 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/regelepuma/dockerminimizer/engine"
+	"github.com/regelepuma/dockerminimizer/types"
+)
+
+func TestHookEmpty(t *testing.T) {
+	if Hook(&engine.Fake{}, types.Image{Name: "app"}) != nil {
+		t.Error("Hook returned a hook for an empty workload")
+	}
+}
+
+func TestRun(t *testing.T) {
+	image := types.Image{
+		Name: "dockerminimize-app",
+		Workload: types.Workload{
+			Exec:    [][]string{{"curl", "-sf", "localhost:8080/"}, {"wget", "-q", "localhost:8080/health"}},
+			Sidecar: types.Sidecar{Image: "loadtest", Cmd: []string{"run"}},
+		},
+	}
+	tests := []struct {
+		name    string
+		failing string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "passes",
+			want: []string{
+				"exec app-strace curl -sf localhost:8080/",
+				"exec app-strace wget -q localhost:8080/health",
+				"pull loadtest ",
+				"run loadtest run",
+			},
+		},
+		{
+			name:    "command fails",
+			failing: "curl",
+			want:    []string{"exec app-strace curl -sf localhost:8080/"},
+			wantErr: `workload "curl -sf localhost:8080/" exited with code 7: connection refused`,
+		},
+		{
+			name:    "sidecar fails",
+			failing: "loadtest",
+			want: []string{
+				"exec app-strace curl -sf localhost:8080/",
+				"exec app-strace wget -q localhost:8080/health",
+				"pull loadtest ",
+				"run loadtest run",
+			},
+			wantErr: "workload sidecar exited with code 7: connection refused",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &engine.Fake{}
+			failed := engine.RunResult{ExitCode: 7, Stderr: []byte("connection refused\n")}
+			fake.ExecFunc = func(cmd []string) (engine.ExecResult, error) {
+				if cmd[0] == tt.failing {
+					return engine.ExecResult{ExitCode: failed.ExitCode, Stderr: failed.Stderr}, nil
+				}
+				return engine.ExecResult{}, nil
+			}
+			fake.RunFunc = func(opts engine.RunOptions) (engine.RunResult, error) {
+				if opts.While != nil {
+					// The container under test.
+					return engine.RunResult{}, nil
+				}
+				if opts.NetworkMode != "container:app-strace" {
+					t.Errorf("%s runs in network %q", opts.Image, opts.NetworkMode)
+				}
+				if opts.Image == tt.failing {
+					return failed, nil
+				}
+				return engine.RunResult{}, nil
+			}
+			hook := Hook(fake, image)
+			result, err := fake.Run(context.Background(), engine.RunOptions{
+				Name: "app-strace",
+				While: func(ctx context.Context, c engine.Container) error {
+					fake.Calls = nil
+					return hook(ctx, c)
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(result.WhileErr); (tt.wantErr != "" || result.WhileErr != nil) && got != tt.wantErr {
+				t.Errorf("workload error = %s, want %q", got, tt.wantErr)
+			}
+			if !slices.Equal(fake.Calls, tt.want) {
+				t.Errorf("calls = %q, want %q", fake.Calls, tt.want)
+			}
+		})
+	}
+}